@@ -14,7 +14,26 @@
         fs = pkgs.lib.fileset;
         gleamLib = import ./nix/gleam { inherit pkgs; };
 
-        relayPkg = relay.packages.${system}.default;
+        relayDashboard = gleamLib.buildGleamPackage {
+          name = "sunset-relay-dashboard";
+          src = fs.toSource {
+            root = ./relay/dashboard;
+            fileset = fs.gitTracked ./relay/dashboard;
+          };
+          manifest = ./relay/dashboard/manifest.toml;
+          target = "javascript";
+          lustre = true;
+          buildPhase = ''
+            runHook preBuild
+            gleam run -m lustre/dev build dashboard --minify
+            runHook postBuild
+          '';
+          installPhase = "cp -r dist $out";
+        };
+
+        relayPkg = relay.packages.${system}.default.overrideAttrs {
+          SUTRO_DASHBOARD = "${relayDashboard}/dashboard.js";
+        };
 
         gleamHexDeps = gleamLib.fetchHexDeps { manifest = ./manifest.toml; };
 
@@ -0,0 +1,4 @@
+fn main() -> Result<(), Box<dyn std::error::Error>> {
+    tonic_build::configure().compile_protos(&["proto/admin.proto"], &["proto"])?;
+    Ok(())
+}
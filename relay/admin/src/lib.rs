@@ -0,0 +1,7 @@
+//! Generated bindings for the relay's gRPC admin service. Controllers use
+//! [`v1::relay_admin_client::RelayAdminClient`]; every call needs an
+//! `authorization: Bearer <token>` metadata entry matching `--admin-token`.
+
+pub mod v1 {
+    tonic::include_proto!("sunset.relay.admin.v1");
+}
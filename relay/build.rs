@@ -0,0 +1,74 @@
+//! Embed the commit and date the relay is built from, and the admin
+//! dashboard. Builds outside a git checkout, such as from Nix, pass the
+//! commit in as SUTRO_GIT_COMMIT, and SOURCE_DATE_EPOCH pins the date for
+//! reproducible builds. The dashboard is a Lustre app in `dashboard/`; Nix
+//! builds it separately and passes it in as SUTRO_DASHBOARD, and other
+//! builds run gleam if it is installed.
+
+use std::{
+    env, fs,
+    path::PathBuf,
+    process::Command,
+    time::{Duration, SystemTime},
+};
+
+/// Served in place of the dashboard when it could not be built.
+const NO_DASHBOARD: &str = "document.getElementById(\"app\").textContent = \
+    \"This relay was built without its dashboard; install gleam and rebuild.\";\n";
+
+fn main() {
+    println!("cargo:rerun-if-env-changed=SUTRO_GIT_COMMIT");
+    println!("cargo:rerun-if-env-changed=SOURCE_DATE_EPOCH");
+    println!("cargo:rerun-if-changed=../.git/HEAD");
+    println!("cargo:rerun-if-changed=../.git/refs/heads");
+    let commit = env::var("SUTRO_GIT_COMMIT")
+        .ok()
+        .or_else(git_commit)
+        .unwrap_or_else(|| "unknown".to_string());
+    let built = env::var("SOURCE_DATE_EPOCH")
+        .ok()
+        .and_then(|secs| secs.parse().ok())
+        .map_or_else(SystemTime::now, |secs| {
+            SystemTime::UNIX_EPOCH + Duration::from_secs(secs)
+        });
+    let date = humantime::format_rfc3339_seconds(built).to_string();
+    println!("cargo:rustc-env=SUTRO_GIT_COMMIT={commit}");
+    println!("cargo:rustc-env=SUTRO_BUILD_DATE={}", &date[..10]);
+    dashboard();
+}
+
+fn dashboard() {
+    println!("cargo:rerun-if-env-changed=SUTRO_DASHBOARD");
+    println!("cargo:rerun-if-changed=dashboard/src");
+    println!("cargo:rerun-if-changed=dashboard/gleam.toml");
+    let out = PathBuf::from(env::var("OUT_DIR").unwrap()).join("dashboard.js");
+    if let Ok(built) = env::var("SUTRO_DASHBOARD") {
+        fs::copy(&built, &out).unwrap_or_else(|e| panic!("Failed to copy {built}: {e}"));
+        return;
+    }
+    if build_dashboard() {
+        fs::copy("dashboard/dist/dashboard.js", &out).expect("Failed to copy the dashboard");
+        return;
+    }
+    println!("cargo:warning=Could not build the dashboard with gleam, so it is left out");
+    fs::write(&out, NO_DASHBOARD).expect("Failed to write the dashboard");
+}
+
+fn build_dashboard() -> bool {
+    Command::new("gleam")
+        .args(["run", "-m", "lustre/dev", "build", "dashboard", "--minify"])
+        .current_dir("dashboard")
+        .output()
+        .is_ok_and(|output| output.status.success())
+}
+
+fn git_commit() -> Option<String> {
+    let output = Command::new("git")
+        .args(["rev-parse", "--short=12", "HEAD"])
+        .output()
+        .ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    Some(String::from_utf8(output.stdout).ok()?.trim().to_string())
+}
@@ -0,0 +1,43 @@
+const TOKEN_KEY = "sunset-relay:adminToken";
+
+export function saved_token() {
+  try {
+    return sessionStorage.getItem(TOKEN_KEY) || "";
+  } catch {
+    return "";
+  }
+}
+
+export function save_token(token) {
+  try {
+    sessionStorage.setItem(TOKEN_KEY, token);
+  } catch {
+    // sessionStorage may be unavailable, so the token lasts until reload
+  }
+}
+
+export function forget_token() {
+  try {
+    sessionStorage.removeItem(TOKEN_KEY);
+  } catch {
+    // Nothing was saved
+  }
+}
+
+export function fetch_status(token, callback) {
+  fetch("status", { headers: { Authorization: `Bearer ${token}` } })
+    .then(async (response) => callback(response.status, await response.text()))
+    .catch(() => callback(0, ""));
+}
+
+export function copy(text, callback) {
+  navigator.clipboard.writeText(text).then(() => callback(), () => {});
+}
+
+export function set_timeout(callback, ms) {
+  setTimeout(callback, ms);
+}
+
+export function now_ms() {
+  return Date.now();
+}
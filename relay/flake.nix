@@ -23,13 +23,20 @@
 
         craneLib = (crane.mkLib pkgs).overrideToolchain rustToolchain;
 
-        src = craneLib.cleanCargoSource ./.;
+        src = pkgs.lib.cleanSourceWith {
+          src = ./.;
+          filter = path: type:
+            (pkgs.lib.hasSuffix ".proto" path)
+            || (pkgs.lib.hasSuffix ".html" path)
+            || (craneLib.filterCargoSources path type);
+        };
 
         commonArgs = {
           inherit src;
           strictDeps = true;
           nativeBuildInputs = with pkgs; [
             pkg-config
+            protobuf
           ];
           buildInputs = with pkgs; [
             openssl
@@ -43,6 +50,8 @@
 
         relay = craneLib.buildPackage (commonArgs // {
           inherit cargoArtifacts;
+          SUTRO_GIT_COMMIT = self.shortRev or self.dirtyShortRev or "unknown";
+          SOURCE_DATE_EPOCH = toString self.lastModified;
           meta = {
             description = "Minimal libp2p circuit relay server with gossipsub";
             mainProgram = "relay";
@@ -67,7 +76,7 @@
               };
               WorkingDir = "/data";
               Cmd = [
-                "--identity" "/data/identity.key"
+                "serve" "--identity" "/data/identity.key"
               ];
             };
           };
@@ -78,6 +87,7 @@
             rustToolchain
             rust-analyzer
             pkg-config
+            protobuf
             openssl
           ] ++ pkgs.lib.optionals pkgs.stdenv.isDarwin [
             pkgs.darwin.apple_sdk.frameworks.Security
@@ -0,0 +1,339 @@
+//! Temporary bans for peers whose behaviour looks abusive: reconnecting
+//! rapidly, having circuit after circuit denied or fail, or repeatedly
+//! running circuits into --max-circuit-bytes. Each further ban lasts twice
+//! as long as the last, up to --ban-max-duration, until the peer stays
+//! clean for that long. Banned peers are disconnected, refused new
+//! connections, reservations and circuits, and can be pardoned through the
+//! admin API.
+
+use std::{
+    collections::HashMap,
+    convert::Infallible,
+    fmt, io,
+    sync::{Arc, Mutex},
+    task::{Context, Poll},
+    time::{Duration, Instant},
+};
+
+use libp2p::{
+    Multiaddr, PeerId,
+    core::{Endpoint, transport::PortUse},
+    relay,
+    swarm::{
+        ConnectionDenied, ConnectionId, FromSwarm, NetworkBehaviour, THandler, THandlerInEvent,
+        THandlerOutEvent, ToSwarm, dummy,
+    },
+};
+use tracing::debug;
+
+use crate::config::Config;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash)]
+pub enum Offence {
+    Reconnects,
+    FailedCircuits,
+    DataLimitHits,
+}
+
+impl Offence {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Reconnects => "reconnects",
+            Self::FailedCircuits => "failed_circuits",
+            Self::DataLimitHits => "data_limit_hits",
+        }
+    }
+}
+
+/// The offence that counts against a peer for a relay event, if any.
+pub fn offence(event: &relay::Event) -> Option<(PeerId, Offence)> {
+    match event {
+        relay::Event::CircuitReqDenied { src_peer_id, .. }
+        | relay::Event::CircuitReqOutboundConnectFailed { src_peer_id, .. } => {
+            Some((*src_peer_id, Offence::FailedCircuits))
+        }
+        relay::Event::CircuitClosed {
+            src_peer_id,
+            error: Some(error),
+            ..
+        } if hit_data_limit(error) => Some((*src_peer_id, Offence::DataLimitHits)),
+        _ => None,
+    }
+}
+
+/// The relay only tells a circuit cut off by --max-circuit-bytes apart by
+/// the text of the error it closes with.
+pub fn hit_data_limit(error: &io::Error) -> bool {
+    error.to_string().contains("Max circuit bytes")
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Policy {
+    reconnects: u32,
+    failed_circuits: u32,
+    data_limit_hits: u32,
+    window: Duration,
+    ban: Duration,
+    max_ban: Duration,
+}
+
+impl Policy {
+    /// The thresholds --abuse-bans enforces, if it is on.
+    pub fn from_config(config: &Config) -> Option<Self> {
+        config.abuse_bans.then_some(Self {
+            reconnects: config.ban_reconnects,
+            failed_circuits: config.ban_failed_circuits,
+            data_limit_hits: config.ban_data_limit_hits,
+            window: config.ban_window,
+            ban: config.ban_duration,
+            max_ban: config.ban_max_duration,
+        })
+    }
+
+    fn threshold(&self, offence: Offence) -> u32 {
+        match offence {
+            Offence::Reconnects => self.reconnects,
+            Offence::FailedCircuits => self.failed_circuits,
+            Offence::DataLimitHits => self.data_limit_hits,
+        }
+    }
+
+    /// How long the `bans`th ban lasts.
+    fn duration(&self, bans: u32) -> Duration {
+        let factor = 2u32.saturating_pow(bans.saturating_sub(1));
+        self.ban
+            .checked_mul(factor)
+            .map_or(self.max_ban, |ban| ban.min(self.max_ban))
+    }
+}
+
+/// A peer's offences in the current window and its ban history.
+struct Record {
+    counted_since: Instant,
+    counts: HashMap<Offence, u32>,
+    bans: u32,
+    banned: Option<(Instant, Offence)>,
+}
+
+impl Record {
+    fn new(now: Instant) -> Self {
+        Self {
+            counted_since: now,
+            counts: HashMap::new(),
+            bans: 0,
+            banned: None,
+        }
+    }
+
+    fn is_banned(&self, now: Instant) -> bool {
+        self.banned.is_some_and(|(until, _)| until > now)
+    }
+
+    /// Whether there is nothing left worth remembering: the counts have
+    /// lapsed, and the last ban ended long enough ago to forgive.
+    fn is_stale(&self, policy: &Policy, now: Instant) -> bool {
+        let counted = now.duration_since(self.counted_since) < policy.window;
+        let forgiven = self
+            .banned
+            .is_none_or(|(until, _)| now.saturating_duration_since(until) >= policy.max_ban);
+        !counted && forgiven
+    }
+}
+
+/// A ban in force, as listed by the admin API.
+pub struct Ban {
+    pub peer: PeerId,
+    pub offence: Offence,
+    pub remaining: Duration,
+    pub bans: u32,
+}
+
+#[derive(Default)]
+struct State {
+    policy: Option<Policy>,
+    peers: HashMap<PeerId, Record>,
+}
+
+/// Plugged into the relay as a reservation and circuit rate limiter, and
+/// into the swarm through [`Behaviour`]. Clones share the bans, so the
+/// admin API lifts them for all.
+#[derive(Clone, Default)]
+pub struct Bans {
+    state: Arc<Mutex<State>>,
+}
+
+impl Bans {
+    pub fn new(policy: Option<Policy>) -> Self {
+        let bans = Self::default();
+        bans.set_policy(policy);
+        bans
+    }
+
+    /// Apply changed thresholds. Bans in force are kept, and turning the
+    /// heuristics off lifts them.
+    pub fn set_policy(&self, policy: Option<Policy>) {
+        let mut state = self.state.lock().unwrap();
+        if policy.is_none() {
+            state.peers.clear();
+        }
+        state.policy = policy;
+    }
+
+    /// Count `offence` against `peer`, returning how long it is banned for
+    /// if that crossed the threshold.
+    pub fn strike(&self, peer: PeerId, offence: Offence) -> Option<Duration> {
+        let mut state = self.state.lock().unwrap();
+        let policy = state.policy?;
+        let now = Instant::now();
+        let record = state.peers.entry(peer).or_insert_with(|| Record::new(now));
+        if record.is_banned(now) {
+            return None;
+        }
+        if now.duration_since(record.counted_since) >= policy.window {
+            record.counted_since = now;
+            record.counts.clear();
+        }
+        let count = record.counts.entry(offence).or_default();
+        *count += 1;
+        if *count < policy.threshold(offence) {
+            return None;
+        }
+        record.counts.clear();
+        record.bans += 1;
+        let duration = policy.duration(record.bans);
+        record.banned = Some((now + duration, offence));
+        Some(duration)
+    }
+
+    pub fn is_banned(&self, peer: &PeerId) -> bool {
+        let state = self.state.lock().unwrap();
+        let now = Instant::now();
+        state
+            .peers
+            .get(peer)
+            .is_some_and(|record| record.is_banned(now))
+    }
+
+    /// Lift `peer`'s ban and forget its history. Returns false if it was
+    /// not banned.
+    pub fn lift(&self, peer: &PeerId) -> bool {
+        let removed = self.state.lock().unwrap().peers.remove(peer);
+        removed.is_some_and(|record| record.is_banned(Instant::now()))
+    }
+
+    /// The bans in force, longest remaining first.
+    pub fn active(&self) -> Vec<Ban> {
+        let state = self.state.lock().unwrap();
+        let now = Instant::now();
+        let mut bans: Vec<Ban> = state
+            .peers
+            .iter()
+            .filter_map(|(peer, record)| {
+                let (until, offence) = record.banned.filter(|(until, _)| *until > now)?;
+                Some(Ban {
+                    peer: *peer,
+                    offence,
+                    remaining: until - now,
+                    bans: record.bans,
+                })
+            })
+            .collect();
+        bans.sort_by_key(|ban| std::cmp::Reverse(ban.remaining));
+        bans
+    }
+
+    /// Forget peers with nothing left counting against them.
+    pub fn prune(&self) {
+        let mut state = self.state.lock().unwrap();
+        let Some(policy) = state.policy else {
+            return;
+        };
+        let now = Instant::now();
+        state
+            .peers
+            .retain(|_, record| !record.is_stale(&policy, now));
+    }
+}
+
+impl relay::RateLimiter for Bans {
+    fn try_next(&mut self, peer: PeerId, _addr: &Multiaddr, _now: Instant) -> bool {
+        if self.is_banned(&peer) {
+            debug!(%peer, "Refused: peer is banned");
+            return false;
+        }
+        true
+    }
+}
+
+#[derive(Debug)]
+struct Banned(PeerId);
+
+impl fmt::Display for Banned {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{} is banned", self.0)
+    }
+}
+
+impl std::error::Error for Banned {}
+
+/// Refuses connections from banned peers once they have authenticated.
+pub struct Behaviour {
+    bans: Bans,
+}
+
+impl Behaviour {
+    pub fn new(bans: Bans) -> Self {
+        Self { bans }
+    }
+
+    fn admits(&self, peer: PeerId) -> Result<dummy::ConnectionHandler, ConnectionDenied> {
+        if self.bans.is_banned(&peer) {
+            return Err(ConnectionDenied::new(Banned(peer)));
+        }
+        Ok(dummy::ConnectionHandler)
+    }
+}
+
+impl NetworkBehaviour for Behaviour {
+    type ConnectionHandler = dummy::ConnectionHandler;
+    type ToSwarm = Infallible;
+
+    fn handle_established_inbound_connection(
+        &mut self,
+        _connection_id: ConnectionId,
+        peer: PeerId,
+        _local_addr: &Multiaddr,
+        _remote_addr: &Multiaddr,
+    ) -> Result<THandler<Self>, ConnectionDenied> {
+        self.admits(peer)
+    }
+
+    fn handle_established_outbound_connection(
+        &mut self,
+        _connection_id: ConnectionId,
+        peer: PeerId,
+        _addr: &Multiaddr,
+        _role_override: Endpoint,
+        _port_use: PortUse,
+    ) -> Result<THandler<Self>, ConnectionDenied> {
+        self.admits(peer)
+    }
+
+    fn on_swarm_event(&mut self, _event: FromSwarm) {}
+
+    fn on_connection_handler_event(
+        &mut self,
+        _peer: PeerId,
+        _connection_id: ConnectionId,
+        event: THandlerOutEvent<Self>,
+    ) {
+        match event {}
+    }
+
+    fn poll(
+        &mut self,
+        _cx: &mut Context<'_>,
+    ) -> Poll<ToSwarm<Self::ToSwarm, THandlerInEvent<Self>>> {
+        Poll::Pending
+    }
+}
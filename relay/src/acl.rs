@@ -0,0 +1,94 @@
+use std::{
+    collections::HashSet,
+    path::Path,
+    sync::{Arc, RwLock},
+    time::Instant,
+};
+
+use libp2p::{Multiaddr, PeerId, relay};
+use tokio::fs;
+use tracing::{debug, info};
+
+use crate::startup::StartupError;
+
+/// Which peers may hold reservations. Plugged into the relay as a rate
+/// limiter, so refused requests surface as ordinary reservation denials.
+/// Clones share the lists, so a reload reaches the copy the relay holds.
+#[derive(Clone, Default)]
+pub struct Acl {
+    lists: Arc<RwLock<Lists>>,
+}
+
+#[derive(Default)]
+struct Lists {
+    allow: Option<HashSet<PeerId>>,
+    deny: HashSet<PeerId>,
+}
+
+impl Acl {
+    /// Replace the lists with the contents of `allow` and `deny`. On error
+    /// the current lists are kept.
+    pub async fn load(
+        &self,
+        allow: Option<&Path>,
+        deny: Option<&Path>,
+    ) -> Result<(), StartupError> {
+        let allow = match allow {
+            Some(path) => {
+                let peers = read_peers(path).await?;
+                info!("Restricting reservations to {} allowlisted peers", peers.len());
+                Some(peers)
+            }
+            None => None,
+        };
+        let deny = match deny {
+            Some(path) => {
+                let peers = read_peers(path).await?;
+                info!("Refusing reservations from {} denylisted peers", peers.len());
+                peers
+            }
+            None => HashSet::new(),
+        };
+        *self.lists.write().unwrap() = Lists { allow, deny };
+        Ok(())
+    }
+
+    /// The denylisted peers, shared with a --cluster.
+    pub fn denied(&self) -> Vec<PeerId> {
+        self.lists.read().unwrap().deny.iter().copied().collect()
+    }
+
+    pub fn permits(&self, peer: &PeerId) -> bool {
+        let lists = self.lists.read().unwrap();
+        !lists.deny.contains(peer) && lists.allow.as_ref().is_none_or(|allow| allow.contains(peer))
+    }
+}
+
+impl relay::RateLimiter for Acl {
+    fn try_next(&mut self, peer: PeerId, _addr: &Multiaddr, _now: Instant) -> bool {
+        let permitted = self.permits(&peer);
+        if !permitted {
+            debug!(peer = %peer, "Reservation refused by access list");
+        }
+        permitted
+    }
+}
+
+/// Read one PeerID per line, ignoring blank lines and `#` comments.
+pub async fn read_peers(path: &Path) -> Result<HashSet<PeerId>, StartupError> {
+    let text = fs::read_to_string(path)
+        .await
+        .map_err(|e| StartupError::peer_list(path, e))?;
+    let mut peers = HashSet::new();
+    for (i, line) in text.lines().enumerate() {
+        let line = line.split('#').next().unwrap_or_default().trim();
+        if line.is_empty() {
+            continue;
+        }
+        let peer = line
+            .parse()
+            .map_err(|e| StartupError::peer_list(path, format!("line {}: {e}", i + 1)))?;
+        peers.insert(peer);
+    }
+    Ok(peers)
+}
@@ -0,0 +1,434 @@
+//! Certificates for `--domain` from an ACME CA, Let's Encrypt unless
+//! another directory is configured, proven with DNS-01 challenges so
+//! nothing has to answer on port 80. They are written to the cache
+//! directory, where the certificate watcher picks them up, and can be
+//! shared with other replicas through Consul, holding a Consul lock while
+//! issuing so only one replica asks the CA at a time.
+
+use std::{
+    error::Error,
+    path::{Path, PathBuf},
+    time::{Duration, Instant, SystemTime},
+};
+
+use instant_acme::{
+    Account, AccountCredentials, AuthorizationStatus, ChallengeType, Identifier, NewAccount,
+    NewOrder, Order, OrderStatus,
+};
+use rcgen::{CertificateParams, KeyPair};
+use reqwest::Url;
+use tokio::{fs, time};
+use tracing::{Instrument, info, info_span, instrument, warn};
+
+use crate::{
+    alert::Alerts,
+    cloudflare::{Cloudflare, Record},
+    consul::Consul,
+    metrics::CertMetrics,
+    tls::{self, CertFiles},
+};
+
+/// Renew once the certificate has less than this left, as certbot does.
+const RENEW_BEFORE: Duration = Duration::from_secs(30 * 24 * 60 * 60);
+const CHECK_INTERVAL: Duration = Duration::from_secs(12 * 60 * 60);
+/// How long a new TXT record is given to reach the CA's resolvers.
+const PROPAGATION: Duration = Duration::from_secs(30);
+const POLL_ATTEMPTS: u32 = 10;
+/// How long a replica may hold the lock on issuing, which is longer than
+/// issuing takes, before it lapses for the next one.
+const LOCK_TTL: Duration = Duration::from_secs(10 * 60);
+const LOCK_RETRY: Duration = Duration::from_secs(5);
+
+/// Where the account with the CA at `directory` is kept under `cache`,
+/// apart from other CAs since accounts and certificates are per CA.
+fn ca_dir(cache: &Path, directory: &str) -> PathBuf {
+    let host = Url::parse(directory)
+        .ok()
+        .and_then(|url| url.host_str().map(str::to_owned))
+        .unwrap_or_default();
+    cache.join(host)
+}
+
+/// Where the certificate for `domain` from the CA at `directory` is kept
+/// under `cache`.
+pub fn cert_files(cache: &Path, directory: &str, domain: &str) -> CertFiles {
+    let dir = ca_dir(cache, directory).join(domain);
+    CertFiles {
+        cert: dir.join("cert.pem"),
+        key: dir.join("key.pem"),
+    }
+}
+
+pub struct Acme {
+    domain: String,
+    directory: String,
+    email: Option<String>,
+    dns: Cloudflare,
+    cache: PathBuf,
+    shared: Option<Consul>,
+}
+
+impl Acme {
+    pub fn new(
+        domain: String,
+        directory: String,
+        email: Option<String>,
+        dns: Cloudflare,
+        cache: PathBuf,
+        shared: Option<Consul>,
+    ) -> Self {
+        Self {
+            domain,
+            directory,
+            email,
+            dns,
+            cache,
+            shared,
+        }
+    }
+
+    fn files(&self) -> CertFiles {
+        cert_files(&self.cache, &self.directory, &self.domain)
+    }
+
+    fn account_path(&self) -> PathBuf {
+        ca_dir(&self.cache, &self.directory).join("account.json")
+    }
+
+    /// Obtain a certificate unless the cached one, or a newer one another
+    /// replica shared, is good for a while yet.
+    pub async fn ensure(&self) -> Result<(), Box<dyn Error + Send + Sync>> {
+        if let Some(shared) = &self.shared {
+            return self.ensure_shared(shared).await;
+        }
+        if self.fresh().await {
+            return Ok(());
+        }
+        self.issue().await
+    }
+
+    /// As [`Acme::ensure`], with replicas taking turns to issue so that
+    /// ones starting together ask the CA for the certificate only once.
+    /// Consul being unreachable is only warned about, leaving this replica
+    /// to go it alone with its own cache.
+    async fn ensure_shared(&self, shared: &Consul) -> Result<(), Box<dyn Error + Send + Sync>> {
+        self.pull(shared).await;
+        if self.fresh().await {
+            return Ok(());
+        }
+        let session = self.lock(shared).await;
+        self.pull(shared).await;
+        let issued = self.issue_shared(shared).await;
+        if let Some(session) = session
+            && let Err(e) = shared.destroy_session(&session).await
+        {
+            warn!("Could not release the Consul lock for {}: {e}", self.domain);
+        }
+        issued
+    }
+
+    /// Issue and share a certificate, unless another replica did while this
+    /// one waited for the lock.
+    async fn issue_shared(&self, shared: &Consul) -> Result<(), Box<dyn Error + Send + Sync>> {
+        if self.fresh().await {
+            return Ok(());
+        }
+        self.issue().await?;
+        if let Err(e) = self.push(shared).await {
+            warn!(
+                "Could not share the certificate for {} through Consul: {e}",
+                self.domain
+            );
+        }
+        Ok(())
+    }
+
+    /// Wait for the lock on issuing this certificate, returning the session
+    /// holding it. Without the lock, after an error or once the holder has
+    /// had long enough, this replica issues regardless.
+    async fn lock(&self, shared: &Consul) -> Option<String> {
+        let key = self.key(&self.files().cert.with_file_name("lock"));
+        let name = format!("sunset-relay ACME {}", self.domain);
+        let session = match shared.create_session(&name, LOCK_TTL).await {
+            Ok(session) => session,
+            Err(e) => {
+                warn!("Could not lock issuing {} in Consul: {e}", self.domain);
+                return None;
+            }
+        };
+        let deadline = Instant::now() + LOCK_TTL;
+        loop {
+            match shared.acquire(&key, &session).await {
+                Ok(true) => return Some(session),
+                Ok(false) if Instant::now() < deadline => time::sleep(LOCK_RETRY).await,
+                Ok(false) => {
+                    warn!(
+                        "Another replica has been issuing {} for too long",
+                        self.domain
+                    );
+                    break;
+                }
+                Err(e) => {
+                    warn!("Could not lock issuing {} in Consul: {e}", self.domain);
+                    break;
+                }
+            }
+        }
+        let _ = shared.destroy_session(&session).await;
+        None
+    }
+
+    /// Renew the certificate as it nears expiry. A failed attempt raises
+    /// an alert and is retried at the next check while the current
+    /// certificate stays in use.
+    pub async fn renew(self, metrics: CertMetrics, alerts: Alerts) {
+        let mut ticks = time::interval(CHECK_INTERVAL);
+        ticks.tick().await;
+        loop {
+            ticks.tick().await;
+            let span = info_span!(
+                "certificate_renewal",
+                domain = %self.domain,
+                directory = %self.directory
+            );
+            if let Err(e) = self.ensure().instrument(span).await {
+                metrics.renewal_failed();
+                let text = format!("Could not renew the certificate for {}: {e}", self.domain);
+                alerts.send("certificate_renewal_failed", text);
+            }
+        }
+    }
+
+    /// Whether there is a cached certificate that has not expired yet.
+    pub async fn cached(&self) -> bool {
+        self.remaining().await.is_some()
+    }
+
+    /// Whether the cached certificate is good for a while yet.
+    async fn fresh(&self) -> bool {
+        self.remaining()
+            .await
+            .is_some_and(|left| left > RENEW_BEFORE)
+    }
+
+    /// How long the cached certificate is still valid, if there is one.
+    async fn remaining(&self) -> Option<Duration> {
+        remaining(&fs::read(self.files().cert).await.ok()?)
+    }
+
+    /// Take the account if there is none locally, and the certificate if
+    /// it outlasts the local one.
+    async fn pull(&self, shared: &Consul) {
+        if let Err(e) = self.try_pull(shared).await {
+            warn!(
+                "Could not check Consul for a shared certificate for {}: {e}",
+                self.domain
+            );
+        }
+    }
+
+    async fn try_pull(&self, shared: &Consul) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let account = self.account_path();
+        if fs::metadata(&account).await.is_err() {
+            if let Some(json) = shared.get(&self.key(&account)).await? {
+                write(&account, &json).await?;
+            }
+        }
+        let files = self.files();
+        let cert = shared.get(&self.key(&files.cert)).await?;
+        let key = shared.get(&self.key(&files.key)).await?;
+        let (Some(cert), Some(key)) = (cert, key) else {
+            return Ok(());
+        };
+        if remaining(&cert) <= self.remaining().await {
+            return Ok(());
+        }
+        write(&files.key, &key).await?;
+        write(&files.cert, &cert).await?;
+        info!("Took the certificate for {} from Consul", self.domain);
+        Ok(())
+    }
+
+    async fn push(&self, shared: &Consul) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let files = self.files();
+        for path in [self.account_path(), files.key, files.cert] {
+            shared.put(&self.key(&path), fs::read(&path).await?).await?;
+        }
+        Ok(())
+    }
+
+    /// The shared key for a file in the cache, which mirrors its layout.
+    fn key(&self, path: &Path) -> String {
+        let relative = path.strip_prefix(&self.cache).unwrap_or(path);
+        relative.to_string_lossy().into_owned()
+    }
+
+    #[instrument(
+        name = "certificate_issue",
+        skip_all,
+        fields(domain = %self.domain, directory = %self.directory)
+    )]
+    async fn issue(&self) -> Result<(), Box<dyn Error + Send + Sync>> {
+        info!(
+            "Requesting a certificate for {} from {}",
+            self.domain, self.directory
+        );
+        let account = self.account().await?;
+        let identifiers = [Identifier::Dns(self.domain.clone())];
+        let mut order = account
+            .new_order(&NewOrder {
+                identifiers: &identifiers,
+            })
+            .await?;
+
+        let mut records = Vec::new();
+        let authorized = self
+            .authorize(&mut order, &mut records)
+            .await
+            .map_err(|e| e.to_string());
+        for record in records {
+            if let Err(e) = self.dns.remove(record).await {
+                warn!(
+                    "Could not remove the ACME challenge record for {}: {e}",
+                    self.domain
+                );
+            }
+        }
+        authorized?;
+
+        let key = KeyPair::generate()?;
+        let csr = CertificateParams::new(vec![self.domain.clone()])?.serialize_request(&key)?;
+        order.finalize(csr.der()).await?;
+        let mut backoff = Backoff::new();
+        let chain = loop {
+            backoff.wait().await?;
+            if let Some(chain) = order.certificate().await? {
+                break chain;
+            }
+        };
+
+        let files = self.files();
+        write(&files.key, key.serialize_pem().as_bytes()).await?;
+        write(&files.cert, chain.as_bytes()).await?;
+        info!("Obtained a certificate for {}", self.domain);
+        Ok(())
+    }
+
+    /// Answer every pending authorization with a DNS-01 record, collecting
+    /// the records so they can be cleaned up whatever the outcome.
+    #[instrument(
+        name = "certificate_authorization",
+        skip_all,
+        fields(domain = %self.domain, directory = %self.directory)
+    )]
+    async fn authorize(
+        &self,
+        order: &mut Order,
+        records: &mut Vec<Record>,
+    ) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let mut ready = Vec::new();
+        for authorization in order.authorizations().await? {
+            if authorization.status == AuthorizationStatus::Valid {
+                continue;
+            }
+            let challenge = authorization
+                .challenges
+                .iter()
+                .find(|challenge| challenge.r#type == ChallengeType::Dns01)
+                .ok_or("the CA offered no DNS-01 challenge")?;
+            let value = order.key_authorization(challenge).dns_value();
+            let name = format!("_acme-challenge.{}", self.domain);
+            records.push(self.dns.add(&name, &value).await?);
+            ready.push(challenge.url.clone());
+        }
+        if !ready.is_empty() {
+            time::sleep(PROPAGATION).await;
+        }
+        for url in &ready {
+            order.set_challenge_ready(url).await?;
+        }
+        let mut backoff = Backoff::new();
+        let status = loop {
+            backoff.wait().await?;
+            let status = order.refresh().await?.status;
+            if !matches!(status, OrderStatus::Pending | OrderStatus::Processing) {
+                break status;
+            }
+        };
+        match status {
+            OrderStatus::Ready | OrderStatus::Valid => Ok(()),
+            status => Err(format!(
+                "the CA did not validate {}: order is {status:?}",
+                self.domain
+            )
+            .into()),
+        }
+    }
+
+    /// The account registered earlier, or a new one.
+    async fn account(&self) -> Result<Account, Box<dyn Error + Send + Sync>> {
+        let path = ca_dir(&self.cache, &self.directory).join("account.json");
+        if let Ok(json) = fs::read(&path).await {
+            let credentials: AccountCredentials = serde_json::from_slice(&json)?;
+            return Ok(Account::from_credentials(credentials).await?);
+        }
+        let contact: Vec<String> = self
+            .email
+            .iter()
+            .map(|email| format!("mailto:{email}"))
+            .collect();
+        let contact: Vec<&str> = contact.iter().map(String::as_str).collect();
+        let new = NewAccount {
+            contact: &contact,
+            terms_of_service_agreed: true,
+            only_return_existing: false,
+        };
+        let (account, credentials) = Account::create(&new, &self.directory, None).await?;
+        write(&path, &serde_json::to_vec(&credentials)?).await?;
+        Ok(account)
+    }
+}
+
+/// How long a PEM certificate is still valid.
+fn remaining(pem: &[u8]) -> Option<Duration> {
+    let not_after = tls::not_after(pem)?;
+    let now = SystemTime::UNIX_EPOCH.elapsed().ok()?.as_secs();
+    let left = u64::try_from(not_after).ok()?.checked_sub(now)?;
+    Some(Duration::from_secs(left))
+}
+
+/// Growing delays between polls of the CA, giving up after a while.
+struct Backoff {
+    delay: Duration,
+    attempts: u32,
+}
+
+impl Backoff {
+    fn new() -> Self {
+        Self {
+            delay: Duration::from_millis(500),
+            attempts: 0,
+        }
+    }
+
+    async fn wait(&mut self) -> Result<(), Box<dyn Error + Send + Sync>> {
+        if self.attempts == POLL_ATTEMPTS {
+            return Err("timed out waiting for the CA".into());
+        }
+        self.attempts += 1;
+        time::sleep(self.delay).await;
+        self.delay = (self.delay * 2).min(Duration::from_secs(10));
+        Ok(())
+    }
+}
+
+/// Replace `path` in one step, so the watcher never reads half a file.
+async fn write(path: &Path, contents: &[u8]) -> Result<(), Box<dyn Error + Send + Sync>> {
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir).await?;
+    }
+    let partial = path.with_extension("tmp");
+    fs::write(&partial, contents).await?;
+    fs::rename(&partial, path).await?;
+    Ok(())
+}
@@ -0,0 +1,23 @@
+use libp2p::{Multiaddr, core::multiaddr::Protocol};
+
+/// Name the transport a connection address was reached over.
+pub fn transport_name(addr: &Multiaddr) -> &'static str {
+    if addr.iter().any(|p| matches!(p, Protocol::P2pCircuit)) {
+        return "relayed";
+    }
+    let mut name = "unknown";
+    for protocol in addr.iter() {
+        name = match protocol {
+            Protocol::QuicV1 => return "quic",
+            Protocol::Unix(_) => return "unix",
+            Protocol::Wss(_) => return "wss",
+            Protocol::Ws(_) if name == "tls" => return "wss",
+            Protocol::Ws(_) => return "websocket",
+            Protocol::Tls => "tls",
+            Protocol::Tcp(_) => "tcp",
+            Protocol::Udp(_) => "udp",
+            _ => name,
+        };
+    }
+    name
+}
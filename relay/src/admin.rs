@@ -0,0 +1,485 @@
+use std::{
+    collections::HashMap,
+    convert::Infallible,
+    sync::{Arc, RwLock},
+    time::Instant,
+};
+
+use axum::{
+    Json, Router,
+    extract::{Path, Request, State},
+    http::{StatusCode, header},
+    middleware::{self, Next},
+    response::{
+        Html, Response,
+        sse::{Event, KeepAlive, Sse},
+    },
+    routing::{delete, get, post},
+};
+use futures::{Stream, StreamExt};
+use libp2p::{Multiaddr, PeerId, Swarm, relay, swarm::NetworkBehaviour};
+use prometheus_client::registry::Registry;
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use sunset_relay_admin::v1::{EventKind, RelayEvent};
+use tokio::{
+    net::TcpListener,
+    sync::{broadcast, mpsc, oneshot},
+};
+use tokio_stream::wrappers::BroadcastStream;
+use tracing::warn;
+
+use crate::{
+    abuse::Bans,
+    addrs::transport_name,
+    buildinfo::BuildInfo,
+    capacity::Reservations,
+    drain::Drain,
+    metrics::{self, CertMetrics},
+    quota::Quotas,
+    traffic::PeerTraffic,
+};
+
+/// The dashboard served at `/`, which loads [`DASHBOARD_JS`]. It holds no
+/// data of its own and asks for the admin token to read the API with.
+const DASHBOARD: &str = include_str!("dashboard.html");
+/// The dashboard's Lustre app, built from `dashboard/` by the build script.
+const DASHBOARD_JS: &str = include_str!(concat!(env!("OUT_DIR"), "/dashboard.js"));
+
+/// Snapshot of the relay's state, assembled by the event loop on request.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct Status {
+    pub peer_id: String,
+    pub uptime_secs: u64,
+    pub draining: bool,
+    pub listen_addrs: Vec<String>,
+    pub external_addrs: Vec<String>,
+    pub connected_peers: Vec<String>,
+    pub reservations: Vec<ReservationInfo>,
+    pub circuits: Vec<CircuitInfo>,
+    pub traffic: Vec<TrafficInfo>,
+    pub transports: Vec<TransportInfo>,
+    /// Set while a WebSocket TLS certificate is loaded
+    pub certificate: Option<CertificateInfo>,
+    pub bandwidth: BandwidthInfo,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct ReservationInfo {
+    pub peer_id: String,
+    pub count: usize,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct CircuitInfo {
+    pub src: String,
+    pub dst: String,
+    pub age_secs: u64,
+}
+
+/// Bytes received from and sent to a peer over its connections.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct TrafficInfo {
+    pub peer_id: String,
+    pub bytes_in: u64,
+    pub bytes_out: u64,
+}
+
+/// Bytes over every transport since the relay started, including peers
+/// that have since gone.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct BandwidthInfo {
+    pub bytes_in: u64,
+    pub bytes_out: u64,
+}
+
+/// The WebSocket TLS certificate in use.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct CertificateInfo {
+    /// Unix time after which the certificate is no longer valid
+    pub not_after: i64,
+    /// Failed ACME renewals since the relay started
+    pub renewal_failures: u64,
+}
+
+/// Open connections over one transport, such as `tcp` or `quic`.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct TransportInfo {
+    pub transport: String,
+    pub connections: usize,
+}
+
+/// A peer banned by --abuse-bans.
+#[derive(Debug, Serialize)]
+pub struct BanInfo {
+    pub peer_id: String,
+    pub offence: &'static str,
+    pub remaining_secs: u64,
+    /// Bans the peer has had without staying clean long enough to be
+    /// forgiven, this one included
+    pub bans: u32,
+}
+
+/// An --api-keys key's quota and what its peers are using this month.
+/// Unset limits are unlimited.
+#[derive(Debug, Serialize)]
+pub struct KeyInfo {
+    pub name: String,
+    /// The month counted, as `YYYY-MM` in UTC
+    pub month: String,
+    pub bytes: u64,
+    pub gb_per_month: Option<u64>,
+    pub reservations: usize,
+    pub max_reservations: Option<usize>,
+    pub max_bandwidth: Option<String>,
+    pub connected_peers: usize,
+}
+
+/// A relay event as streamed from `/events`, with the fields of the gRPC
+/// `RelayEvent` that are set for its kind.
+#[derive(Debug, Serialize)]
+pub struct EventInfo {
+    /// Such as `circuit_opened` or `peer_connected`
+    pub kind: String,
+    pub timestamp_ms: u64,
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub src: String,
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub dst: String,
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub remote_addr: String,
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub old_ip: String,
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub new_ip: String,
+}
+
+impl From<RelayEvent> for EventInfo {
+    fn from(event: RelayEvent) -> Self {
+        let kind = EventKind::try_from(event.kind).unwrap_or_default().as_str_name();
+        Self {
+            kind: kind.trim_start_matches("EVENT_KIND_").to_lowercase(),
+            timestamp_ms: event.timestamp_ms,
+            src: event.src,
+            dst: event.dst,
+            remote_addr: event.remote_addr,
+            old_ip: event.old_ip,
+            new_ip: event.new_ip,
+        }
+    }
+}
+
+/// A request for a [`Status`], answered by the event loop.
+pub type Query = oneshot::Sender<Status>;
+
+/// Circuits currently being relayed, oldest first.
+#[derive(Default)]
+pub struct Circuits {
+    open: Vec<(PeerId, PeerId, Instant)>,
+}
+
+impl Circuits {
+    pub fn relay_event(&mut self, event: &relay::Event) {
+        match event {
+            relay::Event::CircuitReqAccepted {
+                src_peer_id,
+                dst_peer_id,
+            } => self.open.push((*src_peer_id, *dst_peer_id, Instant::now())),
+            relay::Event::CircuitClosed {
+                src_peer_id,
+                dst_peer_id,
+                ..
+            } => {
+                let position = self
+                    .open
+                    .iter()
+                    .position(|(src, dst, _)| src == src_peer_id && dst == dst_peer_id);
+                if let Some(i) = position {
+                    self.open.remove(i);
+                }
+            }
+            _ => {}
+        }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.open.is_empty()
+    }
+
+    pub fn len(&self) -> usize {
+        self.open.len()
+    }
+
+    /// Whether `peer` is either end of an open circuit.
+    pub fn involves(&self, peer: &PeerId) -> bool {
+        self.open
+            .iter()
+            .any(|(src, dst, _)| src == peer || dst == peer)
+    }
+}
+
+/// Open connections counted by transport.
+#[derive(Default)]
+pub struct Transports(HashMap<&'static str, usize>);
+
+impl Transports {
+    pub fn connected(&mut self, addr: &Multiaddr) {
+        *self.0.entry(transport_name(addr)).or_default() += 1;
+    }
+
+    pub fn disconnected(&mut self, addr: &Multiaddr) {
+        let transport = transport_name(addr);
+        let Some(count) = self.0.get_mut(transport) else {
+            return;
+        };
+        *count -= 1;
+        if *count == 0 {
+            self.0.remove(transport);
+        }
+    }
+}
+
+/// Gather a status snapshot from the swarm and relay bookkeeping.
+pub fn status<B: NetworkBehaviour>(
+    swarm: &Swarm<B>,
+    started: Instant,
+    reservations: &Reservations,
+    circuits: &Circuits,
+    transports: &Transports,
+    traffic: &PeerTraffic,
+    certs: &CertMetrics,
+    registry: &Registry,
+    draining: bool,
+) -> Status {
+    let (bytes_in, bytes_out) = metrics::bandwidth(registry);
+    Status {
+        peer_id: swarm.local_peer_id().to_string(),
+        uptime_secs: started.elapsed().as_secs(),
+        draining,
+        listen_addrs: swarm.listeners().map(ToString::to_string).collect(),
+        external_addrs: swarm.external_addresses().map(ToString::to_string).collect(),
+        connected_peers: swarm.connected_peers().map(ToString::to_string).collect(),
+        reservations: reservations
+            .holders()
+            .map(|(peer, count)| ReservationInfo {
+                peer_id: peer.to_string(),
+                count,
+            })
+            .collect(),
+        circuits: circuits
+            .open
+            .iter()
+            .map(|(src, dst, opened)| CircuitInfo {
+                src: src.to_string(),
+                dst: dst.to_string(),
+                age_secs: opened.elapsed().as_secs(),
+            })
+            .collect(),
+        traffic: traffic
+            .snapshot()
+            .into_iter()
+            .map(|(peer, traffic)| TrafficInfo {
+                peer_id: peer.to_string(),
+                bytes_in: traffic.bytes_in,
+                bytes_out: traffic.bytes_out,
+            })
+            .collect(),
+        transports: transports
+            .0
+            .iter()
+            .map(|(transport, connections)| TransportInfo {
+                transport: transport.to_string(),
+                connections: *connections,
+            })
+            .collect(),
+        certificate: certs.expires().map(|not_after| CertificateInfo {
+            not_after,
+            renewal_failures: certs.renewal_failures(),
+        }),
+        bandwidth: BandwidthInfo {
+            bytes_in,
+            bytes_out,
+        },
+    }
+}
+
+/// The admin bearer token, kept as a digest. Comparing digests keeps the
+/// check's timing independent of where a presented token first differs.
+/// Clones share the token, which a reload can change.
+#[derive(Clone)]
+pub struct Token(Arc<RwLock<[u8; 32]>>);
+
+impl Token {
+    pub fn new(token: &str) -> Self {
+        Self(Arc::new(RwLock::new(digest(token))))
+    }
+
+    pub fn set(&self, token: &str) {
+        *self.0.write().unwrap() = digest(token);
+    }
+
+    /// Check an `Authorization` header value of the form `Bearer <token>`.
+    pub fn authorizes(&self, header: &str) -> bool {
+        header
+            .strip_prefix("Bearer ")
+            .is_some_and(|presented| digest(presented) == *self.0.read().unwrap())
+    }
+}
+
+fn digest(token: &str) -> [u8; 32] {
+    Sha256::digest(token.as_bytes()).into()
+}
+
+#[derive(Clone)]
+struct AppState {
+    token: Token,
+    queries: mpsc::Sender<Query>,
+    drain: Drain,
+    bans: Bans,
+    quotas: Option<Quotas>,
+    events: broadcast::Sender<RelayEvent>,
+}
+
+/// Serve the admin API on an already-bound listener. Every route but the
+/// dashboard requires `Authorization: Bearer <token>`.
+pub async fn serve(
+    listener: TcpListener,
+    token: Token,
+    queries: mpsc::Sender<Query>,
+    drain: Drain,
+    bans: Bans,
+    quotas: Option<Quotas>,
+    events: broadcast::Sender<RelayEvent>,
+) {
+    let state = AppState {
+        token,
+        queries,
+        drain,
+        bans,
+        quotas,
+        events,
+    };
+    let app = Router::new()
+        .route("/status", get(status_handler))
+        .route("/drain", post(drain_handler))
+        .route("/bans", get(bans_handler))
+        .route("/bans/{peer}", delete(lift_handler))
+        .route("/keys", get(keys_handler))
+        .route("/events", get(events_handler))
+        .route("/version", get(version_handler))
+        .route_layer(middleware::from_fn_with_state(state.clone(), authorize))
+        .route("/", get(dashboard_handler))
+        .route("/dashboard.js", get(dashboard_js_handler))
+        .with_state(state);
+    if let Err(e) = axum::serve(listener, app).await {
+        warn!("Admin API stopped: {e}");
+    }
+}
+
+async fn authorize(
+    State(state): State<AppState>,
+    request: Request,
+    next: Next,
+) -> Result<Response, StatusCode> {
+    let authorized = request
+        .headers()
+        .get(header::AUTHORIZATION)
+        .and_then(|value| value.to_str().ok())
+        .is_some_and(|value| state.token.authorizes(value));
+    if !authorized {
+        return Err(StatusCode::UNAUTHORIZED);
+    }
+    Ok(next.run(request).await)
+}
+
+async fn dashboard_handler() -> Html<&'static str> {
+    Html(DASHBOARD)
+}
+
+async fn dashboard_js_handler() -> ([(header::HeaderName, &'static str); 1], &'static str) {
+    ([(header::CONTENT_TYPE, "text/javascript")], DASHBOARD_JS)
+}
+
+async fn version_handler() -> Json<BuildInfo> {
+    Json(BuildInfo::current())
+}
+
+async fn status_handler(State(state): State<AppState>) -> Result<Json<Status>, StatusCode> {
+    let (reply, status) = oneshot::channel();
+    state
+        .queries
+        .send(reply)
+        .await
+        .map_err(|_| StatusCode::SERVICE_UNAVAILABLE)?;
+    status
+        .await
+        .map(Json)
+        .map_err(|_| StatusCode::SERVICE_UNAVAILABLE)
+}
+
+/// Start draining. Answers 202 the first time and 200 if already draining.
+async fn drain_handler(State(state): State<AppState>) -> StatusCode {
+    if state.drain.start() {
+        StatusCode::ACCEPTED
+    } else {
+        StatusCode::OK
+    }
+}
+
+async fn bans_handler(State(state): State<AppState>) -> Json<Vec<BanInfo>> {
+    let bans = state.bans.active().into_iter().map(|ban| BanInfo {
+        peer_id: ban.peer.to_string(),
+        offence: ban.offence.as_str(),
+        remaining_secs: ban.remaining.as_secs(),
+        bans: ban.bans,
+    });
+    Json(bans.collect())
+}
+
+/// Lift a peer's ban. Answers 204 once lifted and 404 if it was not banned.
+async fn lift_handler(State(state): State<AppState>, Path(peer): Path<String>) -> StatusCode {
+    let Ok(peer) = peer.parse::<PeerId>() else {
+        return StatusCode::BAD_REQUEST;
+    };
+    if state.bans.lift(&peer) {
+        StatusCode::NO_CONTENT
+    } else {
+        StatusCode::NOT_FOUND
+    }
+}
+
+/// Usage per API key. Answers 404 without --api-keys.
+async fn keys_handler(State(state): State<AppState>) -> Result<Json<Vec<KeyInfo>>, StatusCode> {
+    let quotas = state.quotas.as_ref().ok_or(StatusCode::NOT_FOUND)?;
+    let keys = quotas.usage().into_iter().map(|key| KeyInfo {
+        name: key.name,
+        month: key.month,
+        bytes: key.bytes,
+        gb_per_month: key.quota.gb_per_month,
+        reservations: key.reservations,
+        max_reservations: key.quota.reservations,
+        max_bandwidth: key.quota.max_bandwidth.map(|limit| limit.to_string()),
+        connected_peers: key.peers,
+    });
+    Ok(Json(keys.collect()))
+}
+
+/// Stream relay events as they happen, as server-sent events named for
+/// their kind with an [`EventInfo`] as data. Events are not buffered for
+/// slow readers; a lagging stream skips ahead.
+async fn events_handler(
+    State(state): State<AppState>,
+) -> Sse<impl Stream<Item = Result<Event, Infallible>>> {
+    let events = BroadcastStream::new(state.events.subscribe()).filter_map(|event| async {
+        let event = match event {
+            Ok(event) => EventInfo::from(event),
+            Err(e) => {
+                warn!("Admin event stream fell behind: {e}");
+                return None;
+            }
+        };
+        let sse = Event::default().event(&event.kind).json_data(&event).ok()?;
+        Some(Ok(sse))
+    });
+    Sse::new(events).keep_alive(KeepAlive::default())
+}
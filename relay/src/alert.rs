@@ -0,0 +1,47 @@
+//! Alerts for problems an operator has to fix before they become an outage,
+//! posted as JSON to a webhook. The `text` field makes the payload work
+//! with Slack-compatible incoming webhooks as is.
+
+use std::sync::{Arc, RwLock};
+
+use reqwest::Client;
+use serde_json::json;
+use tracing::warn;
+
+/// Clones share the webhook, which a reload can change.
+#[derive(Clone)]
+pub struct Alerts {
+    client: Client,
+    webhook: Arc<RwLock<Option<String>>>,
+}
+
+impl Alerts {
+    pub fn new(webhook: Option<String>) -> Self {
+        Self {
+            client: Client::new(),
+            webhook: Arc::new(RwLock::new(webhook)),
+        }
+    }
+
+    pub fn set_webhook(&self, webhook: Option<String>) {
+        *self.webhook.write().unwrap() = webhook;
+    }
+
+    /// Post an alert in the background. Delivery failures are only logged.
+    pub fn send(&self, event: &'static str, text: String) {
+        warn!(event, "{text}");
+        let Some(webhook) = self.webhook.read().unwrap().clone() else {
+            return;
+        };
+        let request = self
+            .client
+            .post(webhook)
+            .json(&json!({ "event": event, "text": text }));
+        tokio::spawn(async move {
+            let sent = request.send().await.and_then(|r| r.error_for_status());
+            if let Err(e) = sent {
+                warn!("Could not deliver {event} alert: {e}");
+            }
+        });
+    }
+}
@@ -0,0 +1,335 @@
+use std::{
+    collections::HashSet,
+    fmt,
+    net::{IpAddr, Ipv4Addr, Ipv6Addr},
+    str::FromStr,
+};
+
+use libp2p::{Multiaddr, Swarm, core::multiaddr::Protocol, swarm::NetworkBehaviour};
+use serde::Deserialize;
+use tracing::info;
+
+use crate::{addrs::transport_name, config::Config, gate::Cidr, geo, ipv6};
+
+/// A `--no-announce` entry: a multiaddr hiding every address that starts
+/// with it, or an IP range written `/ip4/NET/ipcidr/LEN` as in Kubo.
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
+#[serde(try_from = "String")]
+pub enum AddrFilter {
+    Prefix(Multiaddr),
+    Range(Cidr),
+}
+
+impl AddrFilter {
+    pub(crate) fn matches(&self, addr: &Multiaddr) -> bool {
+        match self {
+            Self::Range(cidr) => geo::ip_of(addr).is_some_and(|ip| cidr.contains(ip)),
+            Self::Prefix(prefix) => {
+                let mut protocols = addr.iter();
+                prefix.iter().all(|p| protocols.next() == Some(p))
+            }
+        }
+    }
+}
+
+impl FromStr for AddrFilter {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let s = s.trim();
+        let not_multiaddr = || format!("{s:?} is not a multiaddr");
+        let Some((network, len)) = s.rsplit_once("/ipcidr/") else {
+            return s.parse().map(Self::Prefix).map_err(|_| not_multiaddr());
+        };
+        let network: Multiaddr = network.parse().map_err(|_| not_multiaddr())?;
+        let ip = geo::ip_of(&network)
+            .filter(|_| network.iter().count() == 1)
+            .ok_or_else(|| format!("{s:?} must be /ip4/NET/ipcidr/LEN or /ip6/NET/ipcidr/LEN"))?;
+        Ok(Self::Range(format!("{ip}/{len}").parse()?))
+    }
+}
+
+impl TryFrom<String> for AddrFilter {
+    type Error = String;
+
+    fn try_from(s: String) -> Result<Self, Self::Error> {
+        s.parse()
+    }
+}
+
+impl fmt::Display for AddrFilter {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::Prefix(prefix) => fmt::Display::fmt(prefix, f),
+            Self::Range(cidr) => fmt::Display::fmt(cidr, f),
+        }
+    }
+}
+
+/// Decides which of the relay's addresses are advertised to peers. Identify
+/// hides raw listen addresses, so the swarm's external addresses are exactly
+/// what this announces. Nothing is announced until [`Announcer::set`] has
+/// applied the configuration.
+#[derive(Default)]
+pub struct Announcer {
+    allow_unstable_ipv6: bool,
+    max: Option<usize>,
+    hidden: Vec<AddrFilter>,
+    dns: Option<String>,
+    fixed: bool,
+    /// --domain and the onion service, announced unless --announce is set
+    configured: Vec<Multiaddr>,
+    listening: Vec<Multiaddr>,
+    candidates: Vec<Multiaddr>,
+    trimmed: HashSet<Multiaddr>,
+    logged: HashSet<Multiaddr>,
+}
+
+impl Announcer {
+    /// Announce `addrs` as given by --announce from now on, ignoring the
+    /// listen and observed addresses.
+    fn fix<B: NetworkBehaviour>(&mut self, swarm: &mut Swarm<B>, addrs: Vec<Multiaddr>) {
+        self.fixed = true;
+        self.candidates = addrs.into_iter().filter(|a| !self.is_hidden(a)).collect();
+        self.sync(swarm);
+    }
+
+    pub fn add<B: NetworkBehaviour>(&mut self, swarm: &mut Swarm<B>, addr: Multiaddr) {
+        if self.insert(addr) {
+            self.sync(swarm);
+        }
+    }
+
+    fn insert(&mut self, addr: Multiaddr) -> bool {
+        if self.fixed
+            || self.candidates.contains(&addr)
+            || self.is_hidden(&addr)
+            || !self.is_stable(&addr)
+        {
+            return false;
+        }
+        self.candidates.push(addr);
+        true
+    }
+
+    /// Apply the announce settings, at startup and on every reload.
+    /// Observed addresses hidden before are not remembered and come back as
+    /// peers report them again.
+    pub fn set<B: NetworkBehaviour>(&mut self, swarm: &mut Swarm<B>, config: &Config) {
+        let old_dns = std::mem::replace(&mut self.dns, config.external_dns.clone());
+        let configured = domain_addr(config)
+            .into_iter()
+            .chain(config.onion_multiaddr())
+            .collect();
+        let old_configured = std::mem::replace(&mut self.configured, configured);
+        self.allow_unstable_ipv6 = config.announce_temporary_ipv6;
+        self.max = config.max_announced_addrs;
+        self.hidden = config.no_announce.clone();
+        self.trimmed.clear();
+        self.logged.clear();
+        if !config.announce.is_empty() {
+            self.fix(swarm, config.announce.clone());
+            return;
+        }
+        let candidates = std::mem::take(&mut self.candidates);
+        let was_fixed = std::mem::replace(&mut self.fixed, false);
+        let listening = self.listening.clone();
+        let derived = |addr: &Multiaddr| {
+            old_configured.contains(addr)
+                || listening.iter().any(|listen| {
+                    listen == addr
+                        || old_dns
+                            .as_ref()
+                            .is_some_and(|dns| dns_variant(dns, listen).as_ref() == Some(addr))
+                })
+        };
+        let observed: Vec<Multiaddr> = candidates
+            .into_iter()
+            .filter(|addr| !was_fixed && !derived(addr))
+            .collect();
+        for addr in self.configured.clone().into_iter().chain(observed) {
+            self.insert(addr);
+        }
+        for addr in listening {
+            if let Some(variant) = self.dns_variant(&addr) {
+                self.insert(variant);
+            }
+            self.insert(addr);
+        }
+        self.sync(swarm);
+    }
+
+    /// A new listen address, announced along with its --external-dns variant.
+    /// Unix sockets are only reachable on this host and stay unannounced.
+    pub fn add_listen<B: NetworkBehaviour>(&mut self, swarm: &mut Swarm<B>, addr: Multiaddr) {
+        if let Some(Protocol::Unix(_)) = addr.iter().next() {
+            return;
+        }
+        if let Some(variant) = self.dns_variant(&addr) {
+            self.add(swarm, variant);
+        }
+        self.listening.push(addr.clone());
+        self.add(swarm, addr);
+    }
+
+    /// An expired listen address. Its --external-dns variant is withdrawn
+    /// once no other listen address has the same one.
+    pub fn remove_listen<B: NetworkBehaviour>(&mut self, swarm: &mut Swarm<B>, addr: &Multiaddr) {
+        self.listening.retain(|a| a != addr);
+        let variant = self.dns_variant(addr);
+        let shared = self
+            .listening
+            .iter()
+            .any(|a| self.dns_variant(a) == variant);
+        if let Some(variant) = variant.filter(|_| !shared) {
+            self.remove(swarm, &variant);
+        }
+        self.remove(swarm, addr);
+    }
+
+    fn dns_variant(&self, addr: &Multiaddr) -> Option<Multiaddr> {
+        dns_variant(self.dns.as_ref()?, addr)
+    }
+
+    /// Stop announcing the addresses peers observed on `ip`, once the
+    /// relay's public IP has moved on from it. Listen addresses stay until
+    /// their listener reports them expired.
+    pub fn withdraw_ip<B: NetworkBehaviour>(&mut self, swarm: &mut Swarm<B>, ip: IpAddr) {
+        if self.fixed {
+            return;
+        }
+        let stale = |addr: &Multiaddr| geo::ip_of(addr) == Some(ip);
+        self.candidates
+            .retain(|addr| !stale(addr) || self.listening.contains(addr));
+        self.trimmed.retain(|addr| !stale(addr));
+        self.logged.retain(|addr| !stale(addr));
+        self.sync(swarm);
+    }
+
+    /// Announce the most useful candidates, up to the configured maximum.
+    fn sync<B: NetworkBehaviour>(&mut self, swarm: &mut Swarm<B>) {
+        self.candidates.sort_by_key(rank);
+        let keep = self.max.unwrap_or(usize::MAX).min(self.candidates.len());
+        let (announced, trimmed) = self.candidates.split_at(keep);
+
+        for addr in trimmed {
+            if self.trimmed.insert(addr.clone()) {
+                info!("Not announcing {addr}: over --max-announced-addrs");
+            }
+        }
+        self.trimmed.retain(|addr| trimmed.contains(addr));
+
+        let current: Vec<Multiaddr> = swarm.external_addresses().cloned().collect();
+        for addr in current.iter().filter(|a| !announced.contains(a)) {
+            swarm.remove_external_address(addr);
+        }
+        for addr in announced.iter().filter(|a| !current.contains(a)) {
+            swarm.add_external_address(addr.clone());
+        }
+    }
+
+    fn is_hidden(&mut self, addr: &Multiaddr) -> bool {
+        let Some(filter) = self.hidden.iter().find(|f| f.matches(addr)) else {
+            return false;
+        };
+        if self.logged.insert(addr.clone()) {
+            info!("Not announcing {addr}: matches --no-announce {filter}");
+        }
+        true
+    }
+
+    /// Temporary and deprecated IPv6 addresses are skipped unless explicitly
+    /// allowed, since clients that cache them lose the relay once the address
+    /// rotates.
+    fn is_stable(&mut self, addr: &Multiaddr) -> bool {
+        let Some(Protocol::Ip6(ip)) = addr.iter().next() else {
+            return true;
+        };
+        let stable = !ipv6::unstable_addresses().contains(&ip);
+        let announce = stable || self.allow_unstable_ipv6;
+        if self.logged.insert(addr.clone()) {
+            let reason = match (stable, announce) {
+                (true, _) => "stable IPv6 address",
+                (false, true) => "temporary IPv6 address allowed by --announce-temporary-ipv6",
+                (false, false) => "temporary or deprecated IPv6 address",
+            };
+            let verdict = if announce { "Announcing" } else { "Not announcing" };
+            info!("{verdict} {addr}: {reason}");
+        }
+        announce
+    }
+}
+
+/// The WebSocket over TLS address clients reach --domain on.
+pub(crate) fn domain_addr(config: &Config) -> Option<Multiaddr> {
+    let domain = config.domain.clone()?;
+    let addr = Multiaddr::empty()
+        .with(Protocol::Dns4(domain.into()))
+        .with(Protocol::Tcp(config.wss_port))
+        .with(Protocol::Tls)
+        .with(Protocol::Ws(config.ws_path.clone().into()));
+    Some(addr)
+}
+
+/// `addr` with its IP replaced by `name`, as announced for --external-dns.
+pub(crate) fn dns_variant(name: &str, addr: &Multiaddr) -> Option<Multiaddr> {
+    let mut protocols = addr.iter();
+    let host = match protocols.next()? {
+        Protocol::Ip4(_) => Protocol::Dns4(name.to_owned().into()),
+        Protocol::Ip6(_) => Protocol::Dns6(name.to_owned().into()),
+        _ => return None,
+    };
+    Some(std::iter::once(host).chain(protocols).collect())
+}
+
+/// Whether `ip` is routable on the internet, as opposed to private,
+/// shared or local.
+pub fn is_public(ip: IpAddr) -> bool {
+    let scope = match ip {
+        IpAddr::V4(ip) => ipv4_scope(ip),
+        IpAddr::V6(ip) => ipv6_scope(ip),
+    };
+    scope == 0
+}
+
+/// Order addresses by how likely a remote client can use them: publicly
+/// routable before private before local, then browser-friendly transports.
+fn rank(addr: &Multiaddr) -> (u8, u8) {
+    let scope = match addr.iter().next() {
+        Some(Protocol::Ip4(ip)) => ipv4_scope(ip),
+        Some(Protocol::Ip6(ip)) => ipv6_scope(ip),
+        _ => 0,
+    };
+    let transport = match transport_name(addr) {
+        "wss" => 0,
+        "websocket" => 1,
+        "quic" => 2,
+        "tcp" => 3,
+        _ => 4,
+    };
+    (scope, transport)
+}
+
+fn ipv4_scope(ip: Ipv4Addr) -> u8 {
+    if ip.is_loopback() || ip.is_link_local() || ip.is_unspecified() {
+        return 2;
+    }
+    let shared = ip.octets()[0] == 100 && (ip.octets()[1] & 0xc0) == 64;
+    if ip.is_private() || shared {
+        return 1;
+    }
+    0
+}
+
+fn ipv6_scope(ip: Ipv6Addr) -> u8 {
+    if ip.is_loopback() || ip.is_unicast_link_local() || ip.is_unspecified() {
+        return 2;
+    }
+    if ip.is_unique_local() {
+        return 1;
+    }
+    if let Some(v4) = ip.to_ipv4_mapped() {
+        return ipv4_scope(v4);
+    }
+    0
+}
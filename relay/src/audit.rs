@@ -0,0 +1,450 @@
+use std::{
+    collections::{HashMap, HashSet},
+    io::{self, SeekFrom},
+    path::{Path, PathBuf},
+    time::{Duration, SystemTime},
+};
+
+use libp2p::{Multiaddr, PeerId, relay};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use tokio::{
+    fs::{self, File, OpenOptions},
+    io::{AsyncReadExt, AsyncSeekExt, AsyncWriteExt},
+    sync::mpsc,
+    task::JoinHandle,
+    time,
+};
+use tracing::{info, warn};
+
+use crate::{addrs::transport_name, traffic::PeerTraffic};
+
+/// How much of an existing log is scanned to resume its hash chain.
+const TAIL_BYTES: u64 = 64 * 1024;
+/// How often rotated logs are checked against --audit-log-retention.
+const EXPIRE_INTERVAL: Duration = Duration::from_secs(60 * 60);
+
+#[derive(Debug, Clone, Copy, Serialize)]
+#[serde(rename_all = "snake_case")]
+enum EventKind {
+    ReservationAccepted,
+    ReservationRenewed,
+    ReservationDenied,
+    ReservationTimedOut,
+    CircuitOpened,
+    CircuitDenied,
+    CircuitClosed,
+    Disconnected,
+}
+
+#[derive(Debug, Serialize)]
+struct Entry {
+    timestamp: String,
+    event: EventKind,
+    src: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    dst: Option<String>,
+    transport: &'static str,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    remote_addr: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    bytes_in: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    bytes_out: Option<u64>,
+}
+
+/// One line of the log. `prev` is the SHA-256 of the previous line, so
+/// removed, reordered or replayed entries break the chain.
+#[derive(Serialize)]
+struct Record<'a> {
+    seq: u64,
+    #[serde(flatten)]
+    entry: &'a Entry,
+    prev: &'a str,
+}
+
+/// Append-only record of reservations and circuits for forensics, kept
+/// separate from the operational log. A peer that reserved or relayed
+/// through the relay gets a closing entry with the bytes it moved once its
+/// last connection closes.
+pub struct AuditLog {
+    tx: Option<mpsc::UnboundedSender<Entry>>,
+    writer: Option<JoinHandle<()>>,
+    addrs: HashMap<PeerId, Multiaddr>,
+    involved: HashSet<PeerId>,
+}
+
+impl AuditLog {
+    pub fn disabled() -> Self {
+        Self {
+            tx: None,
+            writer: None,
+            addrs: HashMap::new(),
+            involved: HashSet::new(),
+        }
+    }
+
+    /// Rotated logs are deleted once `keep` newer ones exist, or once their
+    /// newest entry is older than `retention`.
+    pub async fn open(
+        path: &Path,
+        max_bytes: u64,
+        keep: usize,
+        retention: Option<Duration>,
+    ) -> io::Result<Self> {
+        let mut writer = Writer::open(path, max_bytes, keep, retention).await?;
+        let (tx, mut rx) = mpsc::unbounded_channel::<Entry>();
+        let writer = tokio::spawn(async move {
+            let mut expiry = time::interval(EXPIRE_INTERVAL);
+            expiry.set_missed_tick_behavior(time::MissedTickBehavior::Skip);
+            loop {
+                tokio::select! {
+                    entry = rx.recv() => {
+                        let Some(entry) = entry else {
+                            break;
+                        };
+                        if let Err(e) = writer.write(&entry).await {
+                            warn!("Failed to write audit log entry: {e}");
+                        }
+                    }
+                    _ = expiry.tick() => writer.expire().await,
+                }
+            }
+        });
+        Ok(Self {
+            tx: Some(tx),
+            writer: Some(writer),
+            addrs: HashMap::new(),
+            involved: HashSet::new(),
+        })
+    }
+
+    pub fn connected(&mut self, peer: PeerId, addr: &Multiaddr) {
+        if self.tx.is_some() {
+            self.addrs.insert(peer, addr.clone());
+        }
+    }
+
+    pub fn disconnected(&mut self, peer: &PeerId, traffic: &PeerTraffic) {
+        let addr = self.addrs.remove(peer);
+        if !self.involved.remove(peer) {
+            return;
+        }
+        let Some(tx) = &self.tx else {
+            return;
+        };
+        let moved = traffic.get(peer).unwrap_or_default();
+        let _ = tx.send(Entry {
+            timestamp: now(),
+            event: EventKind::Disconnected,
+            src: peer.to_string(),
+            dst: None,
+            transport: addr.as_ref().map_or("unknown", transport_name),
+            remote_addr: addr.as_ref().map(Multiaddr::to_string),
+            bytes_in: Some(moved.bytes_in),
+            bytes_out: Some(moved.bytes_out),
+        });
+    }
+
+    pub fn relay_event(&mut self, event: &relay::Event) {
+        let (event, src, dst) = match event {
+            relay::Event::ReservationReqAccepted {
+                src_peer_id,
+                renewed,
+            } if *renewed => (EventKind::ReservationRenewed, src_peer_id, None),
+            relay::Event::ReservationReqAccepted { src_peer_id, .. } => {
+                (EventKind::ReservationAccepted, src_peer_id, None)
+            }
+            relay::Event::ReservationReqDenied { src_peer_id, .. } => {
+                (EventKind::ReservationDenied, src_peer_id, None)
+            }
+            relay::Event::ReservationTimedOut { src_peer_id } => {
+                (EventKind::ReservationTimedOut, src_peer_id, None)
+            }
+            relay::Event::CircuitReqAccepted {
+                src_peer_id,
+                dst_peer_id,
+            } => (EventKind::CircuitOpened, src_peer_id, Some(dst_peer_id)),
+            relay::Event::CircuitReqDenied {
+                src_peer_id,
+                dst_peer_id,
+                ..
+            } => (EventKind::CircuitDenied, src_peer_id, Some(dst_peer_id)),
+            relay::Event::CircuitClosed {
+                src_peer_id,
+                dst_peer_id,
+                ..
+            } => (EventKind::CircuitClosed, src_peer_id, Some(dst_peer_id)),
+            _ => return,
+        };
+        let Some(tx) = &self.tx else {
+            return;
+        };
+        let addr = self.addrs.get(src);
+        let _ = tx.send(Entry {
+            timestamp: now(),
+            event,
+            src: src.to_string(),
+            dst: dst.map(PeerId::to_string),
+            transport: addr.map_or("unknown", transport_name),
+            remote_addr: addr.map(Multiaddr::to_string),
+            bytes_in: None,
+            bytes_out: None,
+        });
+        self.involved.insert(*src);
+        self.involved.extend(dst);
+    }
+
+    /// Continue in the log `open` resolves to, as after a reload changed its
+    /// settings. The entries queued here are on disk before `open` runs, so
+    /// a log reopened at the same path resumes the chain from its real tail.
+    /// The log stays disabled if `open` fails.
+    pub async fn reopen(&mut self, open: impl Future<Output = io::Result<Self>>) -> io::Result<()> {
+        drop(self.tx.take());
+        if let Some(writer) = self.writer.take() {
+            let _ = writer.await;
+        }
+        let next = open.await?;
+        self.tx = next.tx;
+        self.writer = next.writer;
+        Ok(())
+    }
+
+    /// Flush every queued entry to disk.
+    pub async fn close(self) {
+        drop(self.tx);
+        if let Some(writer) = self.writer {
+            let _ = writer.await;
+        }
+    }
+}
+
+struct Writer {
+    path: PathBuf,
+    file: File,
+    size: u64,
+    max_bytes: u64,
+    keep: usize,
+    retention: Option<Duration>,
+    seq: u64,
+    prev: String,
+}
+
+impl Writer {
+    async fn open(
+        path: &Path,
+        max_bytes: u64,
+        keep: usize,
+        retention: Option<Duration>,
+    ) -> io::Result<Self> {
+        let (seq, prev) = resume_chain(path).await;
+        let file = append(path).await?;
+        let size = file.metadata().await?.len();
+        Ok(Self {
+            path: path.to_path_buf(),
+            file,
+            size,
+            max_bytes,
+            keep,
+            retention,
+            seq,
+            prev,
+        })
+    }
+
+    async fn write(&mut self, entry: &Entry) -> io::Result<()> {
+        let seq = self.seq + 1;
+        let mut line = serde_json::to_string(&Record {
+            seq,
+            entry,
+            prev: &self.prev,
+        })?;
+        let hash = format!("{:x}", Sha256::digest(line.as_bytes()));
+        line.push('\n');
+
+        if self.size > 0 && self.size + line.len() as u64 > self.max_bytes {
+            self.rotate().await?;
+        }
+        self.file.write_all(line.as_bytes()).await?;
+        self.file.sync_data().await?;
+
+        self.size += line.len() as u64;
+        self.seq = seq;
+        self.prev = hash;
+        Ok(())
+    }
+
+    async fn rotate(&mut self) -> io::Result<()> {
+        if self.keep == 0 {
+            fs::remove_file(&self.path).await?;
+        } else {
+            for n in (1..self.keep).rev() {
+                let from = rotated(&self.path, n);
+                if fs::try_exists(&from).await? {
+                    fs::rename(&from, rotated(&self.path, n + 1)).await?;
+                }
+            }
+            fs::rename(&self.path, rotated(&self.path, 1)).await?;
+        }
+        self.file = append(&self.path).await?;
+        self.size = 0;
+        self.expire().await;
+        Ok(())
+    }
+
+    /// Delete rotated logs whose newest entry is past the retention period.
+    async fn expire(&self) {
+        let Some(retention) = self.retention else {
+            return;
+        };
+        for n in 1..=self.keep {
+            let path = rotated(&self.path, n);
+            let expired = fs::metadata(&path)
+                .await
+                .and_then(|meta| meta.modified())
+                .is_ok_and(|modified| modified.elapsed().is_ok_and(|age| age > retention));
+            if !expired {
+                continue;
+            }
+            match fs::remove_file(&path).await {
+                Ok(()) => info!("Deleted expired audit log {}", path.display()),
+                Err(e) => warn!("Could not delete expired audit log {}: {e}", path.display()),
+            }
+        }
+    }
+}
+
+fn now() -> String {
+    humantime::format_rfc3339_millis(SystemTime::now()).to_string()
+}
+
+async fn append(path: &Path) -> io::Result<File> {
+    OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(path)
+        .await
+}
+
+fn rotated(path: &Path, n: usize) -> PathBuf {
+    let mut name = path.as_os_str().to_owned();
+    name.push(format!(".{n}"));
+    PathBuf::from(name)
+}
+
+/// Recover the sequence number and hash of the newest record, looking in the
+/// most recently rotated file if the live one is empty.
+async fn resume_chain(path: &Path) -> (u64, String) {
+    for candidate in [path.to_path_buf(), rotated(path, 1)] {
+        match last_line(&candidate).await {
+            Ok(Some(line)) => return parse_chain(&candidate, &line),
+            Ok(None) => continue,
+            Err(e) if e.kind() == io::ErrorKind::NotFound => continue,
+            Err(e) => {
+                warn!("Could not read audit log {}: {e}", candidate.display());
+                break;
+            }
+        }
+    }
+    (0, String::new())
+}
+
+fn parse_chain(path: &Path, line: &str) -> (u64, String) {
+    #[derive(Deserialize)]
+    struct Last {
+        seq: u64,
+    }
+    match serde_json::from_str::<Last>(line) {
+        Ok(last) => (last.seq, format!("{:x}", Sha256::digest(line.as_bytes()))),
+        Err(e) => {
+            warn!(
+                "Last audit log entry in {} is unreadable ({e}), starting a new chain",
+                path.display()
+            );
+            (0, String::new())
+        }
+    }
+}
+
+async fn last_line(path: &Path) -> io::Result<Option<String>> {
+    let mut file = File::open(path).await?;
+    let len = file.metadata().await?.len();
+    file.seek(SeekFrom::Start(len.saturating_sub(TAIL_BYTES)))
+        .await?;
+    let mut tail = Vec::new();
+    file.read_to_end(&mut tail).await?;
+    Ok(String::from_utf8_lossy(&tail)
+        .lines()
+        .rev()
+        .find(|line| !line.trim().is_empty())
+        .map(str::to_string))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn entry() -> Entry {
+        Entry {
+            timestamp: now(),
+            event: EventKind::ReservationAccepted,
+            src: PeerId::random().to_string(),
+            dst: None,
+            transport: "quic",
+            remote_addr: None,
+            bytes_in: None,
+            bytes_out: None,
+        }
+    }
+
+    fn lines(path: &Path) -> Vec<String> {
+        let contents = std::fs::read_to_string(path).unwrap();
+        contents.lines().map(str::to_string).collect()
+    }
+
+    /// Check that `lines` are numbered from `seq` on, each naming the hash
+    /// of the one before it.
+    fn assert_chained(lines: &[String], mut seq: u64, mut prev: String) {
+        for line in lines {
+            let record: serde_json::Value = serde_json::from_str(line).unwrap();
+            seq += 1;
+            assert_eq!(record["seq"], seq, "{line}");
+            assert_eq!(record["prev"], prev.as_str(), "{line}");
+            prev = format!("{:x}", Sha256::digest(line.as_bytes()));
+        }
+    }
+
+    #[tokio::test]
+    async fn chain_continues_across_rotation() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("audit.log");
+        let mut writer = Writer::open(&path, 1, 2, None).await.unwrap();
+        for _ in 0..3 {
+            writer.write(&entry()).await.unwrap();
+        }
+        let all: Vec<String> = [rotated(&path, 2), rotated(&path, 1), path]
+            .iter()
+            .flat_map(|path| lines(path))
+            .collect();
+        assert_eq!(all.len(), 3);
+        assert_chained(&all, 0, String::new());
+    }
+
+    #[tokio::test]
+    async fn reopening_resumes_from_the_rotated_log() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("audit.log");
+        let mut writer = Writer::open(&path, u64::MAX, 1, None).await.unwrap();
+        writer.write(&entry()).await.unwrap();
+        writer.write(&entry()).await.unwrap();
+        drop(writer);
+        std::fs::rename(&path, rotated(&path, 1)).unwrap();
+
+        let mut writer = Writer::open(&path, u64::MAX, 1, None).await.unwrap();
+        writer.write(&entry()).await.unwrap();
+        let mut all = lines(&rotated(&path, 1));
+        all.extend(lines(&path));
+        assert_eq!(all.len(), 3);
+        assert_chained(&all, 0, String::new());
+    }
+}
@@ -0,0 +1,362 @@
+//! Reservations for token holders only. With --reservation-token-secret
+//! set, a client first sends an HS256 JWT whose `sub` is its own PeerID
+//! over /sunset/auth/1.0.0, and is refused reservations until a token is
+//! accepted and again once it expires. A `tier` claim places the peer in
+//! that reservation tier. The same protocol carries the API keys of
+//! --api-keys.
+
+use std::{
+    collections::HashMap,
+    fmt,
+    sync::{Arc, Mutex, RwLock},
+    time::{Instant, SystemTime, UNIX_EPOCH},
+};
+
+use base64::{Engine, engine::general_purpose::URL_SAFE_NO_PAD as BASE64URL};
+use hmac::{Hmac, Mac};
+use libp2p::{Multiaddr, PeerId, relay};
+use serde::{Deserialize, Serialize, de::DeserializeOwned};
+use sha2::Sha256;
+use tracing::debug;
+
+use crate::tiers::Tier;
+
+/// A reservation token, an API key, or both when the relay asks for both.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct AuthRequest {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub token: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub api_key: Option<String>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct AuthResponse {
+    pub accepted: bool,
+    /// Unix time the token expires, after which reservations are refused
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub expires: Option<u64>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+impl AuthResponse {
+    pub fn accepted(expires: Option<u64>) -> Self {
+        Self {
+            accepted: true,
+            expires,
+            error: None,
+        }
+    }
+
+    pub fn refused(error: impl fmt::Display) -> Self {
+        Self {
+            accepted: false,
+            expires: None,
+            error: Some(error.to_string()),
+        }
+    }
+}
+
+#[derive(Debug, PartialEq, Eq)]
+pub enum TokenError {
+    Missing,
+    Malformed,
+    Algorithm,
+    Signature,
+    Subject,
+    Expired,
+    NotYetValid,
+}
+
+impl fmt::Display for TokenError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Self::Missing => "no token presented",
+            Self::Malformed => "not a JWT with sub and exp claims",
+            Self::Algorithm => "not signed with HS256",
+            Self::Signature => "signature does not match",
+            Self::Subject => "issued to another PeerID",
+            Self::Expired => "expired",
+            Self::NotYetValid => "not valid yet",
+        })
+    }
+}
+
+#[derive(Deserialize)]
+struct Header {
+    alg: String,
+}
+
+#[derive(Deserialize)]
+struct Claims {
+    sub: String,
+    exp: u64,
+    nbf: Option<u64>,
+    tier: Option<Tier>,
+}
+
+/// What an accepted token grants, until it expires.
+#[derive(Clone, Copy)]
+struct Grant {
+    expires: u64,
+    tier: Tier,
+}
+
+/// Plugged into the relay as a reservation rate limiter. Clones share the
+/// authorized peers, which accepted tokens add to, and the secret.
+#[derive(Clone)]
+pub struct Tokens {
+    key: Arc<RwLock<Hmac<Sha256>>>,
+    authorized: Arc<Mutex<HashMap<PeerId, Grant>>>,
+}
+
+impl Tokens {
+    pub fn new(secret: &str) -> Self {
+        Self {
+            key: Arc::new(RwLock::new(key(secret))),
+            authorized: Arc::default(),
+        }
+    }
+
+    /// Verify tokens against a rotated secret from now on. Peers already
+    /// authorized keep their grants until they expire.
+    pub fn set_secret(&self, secret: &str) {
+        *self.key.write().unwrap() = key(secret);
+    }
+
+    /// Check `request`'s token for `peer` and, if it holds, let the peer
+    /// reserve until it expires.
+    pub fn authorize(&self, peer: PeerId, request: &AuthRequest) -> AuthResponse {
+        let verified = request
+            .token
+            .as_deref()
+            .ok_or(TokenError::Missing)
+            .and_then(|token| self.verify(token, &peer));
+        match verified {
+            Ok(claims) => {
+                let grant = Grant {
+                    expires: claims.exp,
+                    tier: claims.tier.unwrap_or(Tier::Default),
+                };
+                debug!(
+                    %peer,
+                    expires = grant.expires,
+                    tier = ?grant.tier,
+                    "Reservation token accepted"
+                );
+                self.authorized.lock().unwrap().insert(peer, grant);
+                AuthResponse::accepted(Some(grant.expires))
+            }
+            Err(e) => {
+                debug!(%peer, "Reservation token refused: {e}");
+                AuthResponse::refused(e)
+            }
+        }
+    }
+
+    /// The token's claims, if it is a valid HS256 JWT issued to `peer`.
+    fn verify(&self, token: &str, peer: &PeerId) -> Result<Claims, TokenError> {
+        let mut parts = token.split('.');
+        let (Some(header), Some(claims), Some(signature), None) =
+            (parts.next(), parts.next(), parts.next(), parts.next())
+        else {
+            return Err(TokenError::Malformed);
+        };
+        let signed = &token.as_bytes()[..header.len() + 1 + claims.len()];
+        let header: Header = decode(header)?;
+        if header.alg != "HS256" {
+            return Err(TokenError::Algorithm);
+        }
+        let signature = BASE64URL
+            .decode(signature)
+            .map_err(|_| TokenError::Malformed)?;
+        let mut mac = self.key.read().unwrap().clone();
+        mac.update(signed);
+        mac.verify_slice(&signature)
+            .map_err(|_| TokenError::Signature)?;
+        let claims: Claims = decode(claims)?;
+        if claims.sub != peer.to_string() {
+            return Err(TokenError::Subject);
+        }
+        let now = unix_now();
+        if claims.exp <= now {
+            return Err(TokenError::Expired);
+        }
+        if claims.nbf.is_some_and(|nbf| nbf > now) {
+            return Err(TokenError::NotYetValid);
+        }
+        Ok(claims)
+    }
+
+    /// The tier `peer`'s token grants, while it holds one.
+    pub fn tier(&self, peer: &PeerId) -> Option<Tier> {
+        let grant = self.authorized.lock().unwrap().get(peer).copied()?;
+        (grant.expires > unix_now()).then_some(grant.tier)
+    }
+
+    /// Forget peers whose tokens have expired.
+    pub fn prune(&self) {
+        let now = unix_now();
+        self.authorized
+            .lock()
+            .unwrap()
+            .retain(|_, grant| grant.expires > now);
+    }
+}
+
+fn key(secret: &str) -> Hmac<Sha256> {
+    Hmac::new_from_slice(secret.as_bytes()).expect("HMAC takes keys of any length")
+}
+
+impl relay::RateLimiter for Tokens {
+    fn try_next(&mut self, peer: PeerId, _addr: &Multiaddr, _now: Instant) -> bool {
+        if self.tier(&peer).is_some() {
+            return true;
+        }
+        debug!(%peer, "Reservation refused: no valid token presented");
+        false
+    }
+}
+
+fn decode<T: DeserializeOwned>(segment: &str) -> Result<T, TokenError> {
+    let json = BASE64URL
+        .decode(segment)
+        .map_err(|_| TokenError::Malformed)?;
+    serde_json::from_slice(&json).map_err(|_| TokenError::Malformed)
+}
+
+fn unix_now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_or(0, |since| since.as_secs())
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_json::{Value, json};
+
+    use super::*;
+
+    const SECRET: &str = "a reservation token secret of 32+ bytes";
+
+    fn sign(secret: &str, header: Value, claims: Value) -> String {
+        let signed = format!(
+            "{}.{}",
+            BASE64URL.encode(header.to_string()),
+            BASE64URL.encode(claims.to_string())
+        );
+        let mut mac = key(secret);
+        mac.update(signed.as_bytes());
+        let signature = BASE64URL.encode(mac.finalize().into_bytes());
+        format!("{signed}.{signature}")
+    }
+
+    fn token(peer: &PeerId, mut claims: Value) -> String {
+        claims["sub"] = json!(peer.to_string());
+        sign(SECRET, json!({"alg": "HS256", "typ": "JWT"}), claims)
+    }
+
+    fn verified(token: &str, peer: &PeerId) -> Result<(), TokenError> {
+        Tokens::new(SECRET).verify(token, peer).map(|_| ())
+    }
+
+    #[test]
+    fn verify_accepts_a_valid_token() {
+        let peer = PeerId::random();
+        let token = token(
+            &peer,
+            json!({"exp": unix_now() + 60, "nbf": unix_now() - 60}),
+        );
+        assert_eq!(verified(&token, &peer), Ok(()));
+    }
+
+    #[test]
+    fn verify_rejects_malformed_tokens() {
+        let peer = PeerId::random();
+        let valid = token(&peer, json!({"exp": unix_now() + 60}));
+        for token in [
+            "",
+            "not.a.jwt",
+            "a.b.c.d",
+            &format!("{valid}!"),
+            &sign(
+                SECRET,
+                json!({"alg": "HS256"}),
+                json!({"sub": peer.to_string()}),
+            ),
+        ] {
+            assert_eq!(
+                verified(token, &peer),
+                Err(TokenError::Malformed),
+                "{token}"
+            );
+        }
+    }
+
+    #[test]
+    fn verify_rejects_other_algorithms() {
+        let peer = PeerId::random();
+        let claims = json!({"sub": peer.to_string(), "exp": unix_now() + 60});
+        let token = sign(SECRET, json!({"alg": "none"}), claims);
+        assert_eq!(verified(&token, &peer), Err(TokenError::Algorithm));
+    }
+
+    #[test]
+    fn verify_rejects_another_secret() {
+        let peer = PeerId::random();
+        let claims = json!({"sub": peer.to_string(), "exp": unix_now() + 60});
+        let token = sign("another secret", json!({"alg": "HS256"}), claims);
+        assert_eq!(verified(&token, &peer), Err(TokenError::Signature));
+
+        let tokens = Tokens::new(SECRET);
+        tokens.set_secret("another secret");
+        assert!(tokens.verify(&token, &peer).is_ok());
+    }
+
+    #[test]
+    fn verify_rejects_tokens_for_another_peer() {
+        let token = token(&PeerId::random(), json!({"exp": unix_now() + 60}));
+        assert_eq!(
+            verified(&token, &PeerId::random()),
+            Err(TokenError::Subject)
+        );
+    }
+
+    #[test]
+    fn verify_rejects_tokens_outside_their_validity() {
+        let peer = PeerId::random();
+        let expired = token(&peer, json!({"exp": unix_now() - 1}));
+        assert_eq!(verified(&expired, &peer), Err(TokenError::Expired));
+        let early = token(
+            &peer,
+            json!({"exp": unix_now() + 120, "nbf": unix_now() + 60}),
+        );
+        assert_eq!(verified(&early, &peer), Err(TokenError::NotYetValid));
+    }
+
+    #[test]
+    fn authorize_grants_the_token_tier() {
+        let tokens = Tokens::new(SECRET);
+        let peer = PeerId::random();
+        let response = tokens.authorize(
+            peer,
+            &AuthRequest {
+                token: None,
+                api_key: None,
+            },
+        );
+        assert_eq!(response.error, Some(TokenError::Missing.to_string()));
+        assert_eq!(tokens.tier(&peer), None);
+
+        let exp = unix_now() + 60;
+        let request = AuthRequest {
+            token: Some(token(&peer, json!({"exp": exp, "tier": "trusted"}))),
+            api_key: None,
+        };
+        let response = tokens.authorize(peer, &request);
+        assert!(response.accepted);
+        assert_eq!(response.expires, Some(exp));
+        assert_eq!(tokens.tier(&peer), Some(Tier::Trusted));
+    }
+}
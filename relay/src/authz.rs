@@ -0,0 +1,235 @@
+//! Reservation policy kept in another service. With --reservation-webhook,
+//! each peer that connects is looked up by POSTing
+//! `{"peer_id": ..., "remote_addr": ...}` to the URL, which answers
+//! `{"decision": "allow" | "deny" | "limit"}`, with `reservations` giving
+//! the most a limited peer may hold and an optional `ttl_secs` for how long
+//! the answer holds. Rate limiters cannot wait on a request, so a peer that
+//! asks to reserve before its first answer is in is refused, and retries.
+//! An expired answer keeps being served for a while as a fresh one is
+//! fetched in the background, so renewals do not stall on the webhook.
+
+use std::{
+    collections::{HashMap, HashSet},
+    sync::{Arc, Mutex},
+    time::{Duration, Instant},
+};
+
+use libp2p::{Multiaddr, PeerId, relay};
+use reqwest::Client;
+use serde::{Deserialize, Serialize};
+use tracing::{debug, warn};
+
+use crate::config::Config;
+
+/// How soon a peer is looked up again after the webhook failed.
+const RETRY_AFTER: Duration = Duration::from_secs(30);
+/// How long past its expiry an answer is still served while it is refreshed.
+const SERVE_STALE: Duration = Duration::from_secs(10 * 60);
+
+#[derive(Serialize)]
+struct Request {
+    peer_id: String,
+    remote_addr: String,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "lowercase")]
+enum Decision {
+    Allow,
+    Deny,
+    Limit,
+}
+
+#[derive(Deserialize)]
+struct Answer {
+    decision: Decision,
+    reservations: Option<usize>,
+    ttl_secs: Option<u64>,
+}
+
+#[derive(Debug, Clone, Copy)]
+enum Verdict {
+    Allow,
+    Deny,
+    /// At most this many reservations at once
+    Limit(usize),
+}
+
+#[derive(Clone)]
+struct Settings {
+    url: String,
+    timeout: Duration,
+    cache: Duration,
+    fail_open: bool,
+}
+
+impl Settings {
+    fn from_config(config: &Config) -> Option<Self> {
+        Some(Self {
+            url: config.reservation_webhook.clone()?.0,
+            timeout: config.reservation_webhook_timeout,
+            cache: config.reservation_webhook_cache,
+            fail_open: config.reservation_webhook_fail_open,
+        })
+    }
+}
+
+#[derive(Default)]
+struct Shared {
+    settings: Option<Settings>,
+    verdicts: HashMap<PeerId, (Verdict, Instant)>,
+    pending: HashSet<PeerId>,
+    held: HashMap<PeerId, usize>,
+}
+
+/// Plugged into the relay as a reservation rate limiter, letting everyone
+/// through while no webhook is set. Clones share the answers, which lookups
+/// started by [`Webhook::check`] fill in, and the settings, which a reload
+/// can change.
+#[derive(Clone)]
+pub struct Webhook {
+    client: Client,
+    shared: Arc<Mutex<Shared>>,
+}
+
+impl Webhook {
+    pub fn from_config(config: &Config) -> Self {
+        let webhook = Self {
+            client: Client::new(),
+            shared: Arc::default(),
+        };
+        webhook.set(config);
+        webhook
+    }
+
+    /// Apply changed settings. Answers from a different URL are forgotten.
+    pub fn set(&self, config: &Config) {
+        let settings = Settings::from_config(config);
+        let mut shared = self.shared.lock().unwrap();
+        let same_url =
+            shared.settings.as_ref().map(|s| &s.url) == settings.as_ref().map(|s| &s.url);
+        if !same_url {
+            shared.verdicts.clear();
+        }
+        shared.settings = settings;
+    }
+
+    /// Look `peer` up in the background, unless its answer is still fresh
+    /// or already on the way.
+    pub fn check(&self, peer: PeerId, remote_addr: &Multiaddr) {
+        let mut shared = self.shared.lock().unwrap();
+        let Some(settings) = shared.settings.clone() else {
+            return;
+        };
+        let fresh = shared
+            .verdicts
+            .get(&peer)
+            .is_some_and(|(_, expires)| *expires > Instant::now());
+        if fresh || !shared.pending.insert(peer) {
+            return;
+        }
+        let webhook = self.clone();
+        let request = Request {
+            peer_id: peer.to_string(),
+            remote_addr: remote_addr.to_string(),
+        };
+        tokio::spawn(async move {
+            let (verdict, ttl) = match webhook.ask(&settings, &request).await {
+                Ok(answer) => answer,
+                Err(e) => {
+                    warn!(%peer, "Reservation webhook failed: {e}");
+                    let verdict = if settings.fail_open {
+                        Verdict::Allow
+                    } else {
+                        Verdict::Deny
+                    };
+                    (verdict, RETRY_AFTER)
+                }
+            };
+            debug!(%peer, ?verdict, "Reservation webhook answered");
+            let mut shared = webhook.shared.lock().unwrap();
+            shared.pending.remove(&peer);
+            shared
+                .verdicts
+                .insert(peer, (verdict, Instant::now() + ttl));
+        });
+    }
+
+    async fn ask(
+        &self,
+        settings: &Settings,
+        request: &Request,
+    ) -> Result<(Verdict, Duration), reqwest::Error> {
+        let answer: Answer = self
+            .client
+            .post(&settings.url)
+            .timeout(settings.timeout)
+            .json(request)
+            .send()
+            .await?
+            .error_for_status()?
+            .json()
+            .await?;
+        let verdict = match answer.decision {
+            Decision::Allow => Verdict::Allow,
+            Decision::Deny => Verdict::Deny,
+            Decision::Limit => Verdict::Limit(answer.reservations.unwrap_or(0)),
+        };
+        let ttl = answer.ttl_secs.map_or(settings.cache, Duration::from_secs);
+        Ok((verdict, ttl))
+    }
+
+    /// Track how many reservations each peer holds, for limited peers.
+    pub fn set_reservations<'a>(&self, holders: impl IntoIterator<Item = (&'a PeerId, usize)>) {
+        let mut shared = self.shared.lock().unwrap();
+        shared.held = holders
+            .into_iter()
+            .map(|(peer, count)| (*peer, count))
+            .collect();
+    }
+
+    /// Forget answers too old to be served even while refreshing.
+    pub fn prune(&self) {
+        let now = Instant::now();
+        self.shared
+            .lock()
+            .unwrap()
+            .verdicts
+            .retain(|_, (_, expires)| *expires + SERVE_STALE > now);
+    }
+}
+
+impl relay::RateLimiter for Webhook {
+    fn try_next(&mut self, peer: PeerId, addr: &Multiaddr, now: Instant) -> bool {
+        let shared = self.shared.lock().unwrap();
+        if shared.settings.is_none() {
+            return true;
+        }
+        let answer = shared
+            .verdicts
+            .get(&peer)
+            .filter(|(_, expires)| *expires + SERVE_STALE > now)
+            .copied();
+        let held = shared.held.get(&peer).copied().unwrap_or(0);
+        drop(shared);
+        if answer.is_some_and(|(_, expires)| expires <= now) {
+            self.check(peer, addr);
+        }
+        let verdict = answer.map(|(verdict, _)| verdict);
+        let allowed = match verdict {
+            Some(Verdict::Allow) => true,
+            Some(Verdict::Deny) => false,
+            // A peer at its limit is let through to renew what it holds.
+            Some(Verdict::Limit(max)) => held < max || (held > 0 && held == max),
+            None => {
+                self.check(peer, addr);
+                debug!(%peer, "Reservation refused: the webhook has not answered yet");
+                return false;
+            }
+        };
+        if !allowed {
+            debug!(%peer, ?verdict, held, "Reservation refused by the webhook");
+        }
+        allowed
+    }
+}
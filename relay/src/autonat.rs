@@ -0,0 +1,163 @@
+//! An AutoNAT v2 server, so NATed peers can ask the relay which of their
+//! addresses are reachable from the internet, with a cap on how many
+//! dial-backs one peer and all peers together get per period.
+
+use std::{
+    collections::VecDeque,
+    task::{Context, Poll, ready},
+    time::{Duration, Instant},
+};
+
+use either::Either;
+use libp2p::{
+    Multiaddr, PeerId,
+    autonat::v2::server,
+    core::{Endpoint, transport::PortUse},
+    swarm::{
+        ConnectionDenied, ConnectionId, FromSwarm, NetworkBehaviour, THandler, THandlerInEvent,
+        THandlerOutEvent, ToSwarm, dummy,
+    },
+};
+use tracing::debug;
+
+/// How many dial-backs are served per `period`.
+#[derive(Debug, Clone, Copy)]
+pub struct Limits {
+    pub per_peer: usize,
+    pub global: usize,
+    pub period: Duration,
+}
+
+/// The libp2p AutoNAT v2 server, which has no limits of its own. Peers over
+/// a limit get new connections without the protocol; requests on a
+/// connection opened before that are still served.
+pub struct Behaviour {
+    inner: server::Behaviour,
+    limits: Limits,
+    served: VecDeque<(Instant, PeerId)>,
+}
+
+impl Behaviour {
+    pub fn new(limits: Limits) -> Self {
+        Self {
+            inner: server::Behaviour::new(rand::rngs::OsRng),
+            limits,
+            served: VecDeque::new(),
+        }
+    }
+
+    pub fn set_limits(&mut self, limits: Limits) {
+        self.limits = limits;
+    }
+
+    /// Whether `peer` is within both limits, once dial-backs older than the
+    /// period are forgotten.
+    fn admits(&mut self, peer: PeerId) -> bool {
+        let now = Instant::now();
+        let period = self.limits.period;
+        while self
+            .served
+            .front()
+            .is_some_and(|(at, _)| now.duration_since(*at) > period)
+        {
+            self.served.pop_front();
+        }
+        let by_peer = self.served.iter().filter(|(_, p)| *p == peer).count();
+        self.served.len() < self.limits.global && by_peer < self.limits.per_peer
+    }
+}
+
+impl NetworkBehaviour for Behaviour {
+    type ConnectionHandler = Either<THandler<server::Behaviour>, dummy::ConnectionHandler>;
+    type ToSwarm = server::Event;
+
+    fn handle_pending_inbound_connection(
+        &mut self,
+        connection_id: ConnectionId,
+        local_addr: &Multiaddr,
+        remote_addr: &Multiaddr,
+    ) -> Result<(), ConnectionDenied> {
+        self.inner
+            .handle_pending_inbound_connection(connection_id, local_addr, remote_addr)
+    }
+
+    fn handle_established_inbound_connection(
+        &mut self,
+        connection_id: ConnectionId,
+        peer: PeerId,
+        local_addr: &Multiaddr,
+        remote_addr: &Multiaddr,
+    ) -> Result<THandler<Self>, ConnectionDenied> {
+        if !self.admits(peer) {
+            debug!(%peer, "Not offering AutoNAT: over the dial-back limit");
+            return Ok(Either::Right(dummy::ConnectionHandler));
+        }
+        self.inner
+            .handle_established_inbound_connection(connection_id, peer, local_addr, remote_addr)
+            .map(Either::Left)
+    }
+
+    fn handle_pending_outbound_connection(
+        &mut self,
+        connection_id: ConnectionId,
+        maybe_peer: Option<PeerId>,
+        addresses: &[Multiaddr],
+        effective_role: Endpoint,
+    ) -> Result<Vec<Multiaddr>, ConnectionDenied> {
+        self.inner.handle_pending_outbound_connection(
+            connection_id,
+            maybe_peer,
+            addresses,
+            effective_role,
+        )
+    }
+
+    fn handle_established_outbound_connection(
+        &mut self,
+        connection_id: ConnectionId,
+        peer: PeerId,
+        addr: &Multiaddr,
+        role_override: Endpoint,
+        port_use: PortUse,
+    ) -> Result<THandler<Self>, ConnectionDenied> {
+        self.inner
+            .handle_established_outbound_connection(
+                connection_id,
+                peer,
+                addr,
+                role_override,
+                port_use,
+            )
+            .map(Either::Left)
+    }
+
+    fn on_swarm_event(&mut self, event: FromSwarm) {
+        self.inner.on_swarm_event(event);
+    }
+
+    fn on_connection_handler_event(
+        &mut self,
+        peer: PeerId,
+        connection_id: ConnectionId,
+        event: THandlerOutEvent<Self>,
+    ) {
+        match event {
+            Either::Left(event) => {
+                self.inner
+                    .on_connection_handler_event(peer, connection_id, event)
+            }
+            Either::Right(never) => match never {},
+        }
+    }
+
+    fn poll(
+        &mut self,
+        cx: &mut Context<'_>,
+    ) -> Poll<ToSwarm<Self::ToSwarm, THandlerInEvent<Self>>> {
+        let event = ready!(self.inner.poll(cx));
+        if let ToSwarm::GenerateEvent(served) = &event {
+            self.served.push_back((Instant::now(), served.client));
+        }
+        Poll::Ready(event.map_in(Either::Left))
+    }
+}
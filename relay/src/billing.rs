@@ -0,0 +1,272 @@
+//! Usage records for billing. Every --usage-export-interval, each peer
+//! that used the relay in the period gets one record of the bytes it
+//! exchanged, the hours of circuits relayed to it and the reservations it
+//! took, along with the --api-keys key it presented. Circuits are billed to
+//! their destination, the peer holding the reservation they run through.
+
+use std::{
+    collections::HashMap,
+    io,
+    path::{Path, PathBuf},
+    time::{Duration, Instant, SystemTime},
+};
+
+use libp2p::{PeerId, relay};
+use reqwest::Client;
+use serde::Serialize;
+use tokio::{fs::OpenOptions, io::AsyncWriteExt};
+use tracing::warn;
+
+use crate::{
+    config::{Config, DumpFormat},
+    quota::Quotas,
+    traffic::{PeerTraffic, Traffic},
+};
+
+#[derive(Default)]
+struct Usage {
+    api_key: Option<String>,
+    bytes_in: u64,
+    bytes_out: u64,
+    circuit_time: Duration,
+    reservations: u64,
+}
+
+#[derive(Serialize)]
+struct Record {
+    period_start: String,
+    period_end: String,
+    peer_id: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    api_key: Option<String>,
+    bytes_in: u64,
+    bytes_out: u64,
+    circuit_hours: f64,
+    reservations: u64,
+}
+
+/// Where a batch of records goes.
+#[derive(Clone)]
+struct Sink {
+    file: Option<PathBuf>,
+    webhook: Option<String>,
+    format: DumpFormat,
+    client: Client,
+}
+
+/// Usage gathered by the event loop over the current period.
+pub struct Billing {
+    sink: Sink,
+    quotas: Option<Quotas>,
+    period_start: SystemTime,
+    peers: HashMap<PeerId, Usage>,
+    /// Traffic totals last credited, to credit only what is new
+    credited: HashMap<PeerId, Traffic>,
+    /// Open circuits by destination, with when they were last billed up to
+    circuits: Vec<(PeerId, PeerId, Instant)>,
+}
+
+impl Billing {
+    pub fn from_config(config: &Config, quotas: Option<Quotas>) -> Option<Self> {
+        Some(Self {
+            sink: Sink::from_config(config)?,
+            quotas,
+            period_start: SystemTime::now(),
+            peers: HashMap::new(),
+            credited: HashMap::new(),
+            circuits: Vec::new(),
+        })
+    }
+
+    fn usage(&mut self, peer: PeerId) -> &mut Usage {
+        let api_key = self
+            .quotas
+            .as_ref()
+            .and_then(|quotas| quotas.key_name(&peer));
+        let usage = self.peers.entry(peer).or_default();
+        if api_key.is_some() {
+            usage.api_key = api_key;
+        }
+        usage
+    }
+
+    pub fn relay_event(&mut self, event: &relay::Event) {
+        match event {
+            relay::Event::ReservationReqAccepted {
+                src_peer_id,
+                renewed: false,
+            } => self.usage(*src_peer_id).reservations += 1,
+            relay::Event::CircuitReqAccepted {
+                src_peer_id,
+                dst_peer_id,
+            } => self
+                .circuits
+                .push((*src_peer_id, *dst_peer_id, Instant::now())),
+            relay::Event::CircuitClosed {
+                src_peer_id,
+                dst_peer_id,
+                ..
+            } => {
+                let position = self
+                    .circuits
+                    .iter()
+                    .position(|(src, dst, _)| src == src_peer_id && dst == dst_peer_id);
+                if let Some(i) = position {
+                    let (_, dst, since) = self.circuits.remove(i);
+                    self.usage(dst).circuit_time += since.elapsed();
+                }
+            }
+            _ => {}
+        }
+    }
+
+    /// Credit the bytes exchanged with each peer since the last call. Runs
+    /// before peers are pruned, so none are lost in between. A total below
+    /// the last one means the peer was pruned and came back with fresh
+    /// counters.
+    pub fn credit(&mut self, traffic: &PeerTraffic) {
+        let mut credited = HashMap::new();
+        for (peer, total) in traffic.snapshot() {
+            let last = self
+                .credited
+                .get(&peer)
+                .copied()
+                .filter(|last| last.bytes_in <= total.bytes_in && last.bytes_out <= total.bytes_out)
+                .unwrap_or_default();
+            credited.insert(peer, total);
+            if total == last {
+                continue;
+            }
+            let usage = self.usage(peer);
+            usage.bytes_in += total.bytes_in - last.bytes_in;
+            usage.bytes_out += total.bytes_out - last.bytes_out;
+        }
+        self.credited = credited;
+    }
+
+    /// Close the period, writing its records out in the background.
+    pub fn export(&mut self, traffic: &PeerTraffic) {
+        let (sink, records) = self.close_period(traffic);
+        tokio::spawn(async move { sink.deliver(records).await });
+    }
+
+    /// Close the last period before the relay stops.
+    pub async fn close(&mut self, traffic: &PeerTraffic) {
+        let (sink, records) = self.close_period(traffic);
+        sink.deliver(records).await;
+    }
+
+    /// Deliver usage where `config` now says, closing the period so far to
+    /// the previous sink. Billing stops once neither --usage-export nor
+    /// --usage-export-webhook is set.
+    pub fn reconfigure(mut self, config: &Config, traffic: &PeerTraffic) -> Option<Self> {
+        self.export(traffic);
+        self.sink = Sink::from_config(config)?;
+        Some(self)
+    }
+
+    fn close_period(&mut self, traffic: &PeerTraffic) -> (Sink, Vec<Record>) {
+        self.credit(traffic);
+        let now = Instant::now();
+        let open: Vec<(PeerId, Duration)> = self
+            .circuits
+            .iter_mut()
+            .map(|(_, dst, since)| (*dst, now.duration_since(std::mem::replace(since, now))))
+            .collect();
+        for (dst, time) in open {
+            self.usage(dst).circuit_time += time;
+        }
+        let period_end = SystemTime::now();
+        let start = humantime::format_rfc3339_seconds(self.period_start).to_string();
+        let end = humantime::format_rfc3339_seconds(period_end).to_string();
+        self.period_start = period_end;
+        let records = self
+            .peers
+            .drain()
+            .map(|(peer, usage)| Record {
+                period_start: start.clone(),
+                period_end: end.clone(),
+                peer_id: peer.to_string(),
+                api_key: usage.api_key,
+                bytes_in: usage.bytes_in,
+                bytes_out: usage.bytes_out,
+                circuit_hours: usage.circuit_time.as_secs_f64() / 3600.0,
+                reservations: usage.reservations,
+            })
+            .collect();
+        (self.sink.clone(), records)
+    }
+}
+
+impl Sink {
+    fn from_config(config: &Config) -> Option<Self> {
+        if config.usage_export.is_none() && config.usage_export_webhook.is_none() {
+            return None;
+        }
+        Some(Self {
+            file: config.usage_export.clone(),
+            webhook: config.usage_export_webhook.clone().map(|url| url.0),
+            format: config.usage_export_format,
+            client: Client::new(),
+        })
+    }
+
+    async fn deliver(&self, records: Vec<Record>) {
+        if records.is_empty() {
+            return;
+        }
+        if let Some(path) = &self.file
+            && let Err(e) = self.append(path, &records).await
+        {
+            warn!("Failed to write usage records to {}: {e}", path.display());
+        }
+        let Some(webhook) = &self.webhook else {
+            return;
+        };
+        let sent = self
+            .client
+            .post(webhook)
+            .json(&records)
+            .send()
+            .await
+            .and_then(|r| r.error_for_status());
+        if let Err(e) = sent {
+            warn!("Could not deliver usage records: {e}");
+        }
+    }
+
+    async fn append(&self, path: &Path, records: &[Record]) -> io::Result<()> {
+        let mut file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(path)
+            .await?;
+        let mut out = String::new();
+        if matches!(self.format, DumpFormat::Csv) && file.metadata().await?.len() == 0 {
+            out.push_str(
+                "period_start,period_end,peer_id,api_key,bytes_in,bytes_out,circuit_hours,reservations\n",
+            );
+        }
+        for record in records {
+            match self.format {
+                DumpFormat::Json => {
+                    out.push_str(&serde_json::to_string(record)?);
+                    out.push('\n');
+                }
+                DumpFormat::Csv => out.push_str(&format!(
+                    "{},{},{},{},{},{},{:.4},{}\n",
+                    record.period_start,
+                    record.period_end,
+                    record.peer_id,
+                    record.api_key.as_deref().unwrap_or_default(),
+                    record.bytes_in,
+                    record.bytes_out,
+                    record.circuit_hours,
+                    record.reservations
+                )),
+            }
+        }
+        file.write_all(out.as_bytes()).await?;
+        file.flush().await
+    }
+}
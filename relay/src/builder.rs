@@ -0,0 +1,64 @@
+//! Starting an embedded relay without filling in a whole [`Config`]: set
+//! what matters to the application and every other setting takes its
+//! default, as it would for the `relay` binary run without flags.
+
+use std::{path::PathBuf, sync::Arc};
+
+use libp2p::Multiaddr;
+
+use crate::{
+    config::{Config, Settings},
+    gate::Gater,
+    server::Relay,
+    startup::StartupError,
+};
+
+/// Options for [`Relay::builder`]. Those set here take precedence over the
+/// same ones in [`RelayBuilder::settings`].
+#[derive(Default)]
+pub struct RelayBuilder {
+    settings: Settings,
+    listen: Option<Vec<Multiaddr>>,
+    identity: Option<PathBuf>,
+    gater: Option<Arc<dyn Gater>>,
+}
+
+impl RelayBuilder {
+    /// Listen on exactly these addresses instead of the default ports.
+    pub fn listen(mut self, addrs: impl IntoIterator<Item = Multiaddr>) -> Self {
+        self.listen = Some(addrs.into_iter().collect());
+        self
+    }
+
+    /// Load the identity from `path`, generating one there if it does not
+    /// exist yet, instead of `identity.key` in the working directory.
+    pub fn identity(mut self, path: impl Into<PathBuf>) -> Self {
+        self.identity = Some(path.into());
+        self
+    }
+
+    /// Admit connections only as `gater` allows, after the built-in IP and
+    /// country checks.
+    pub fn gater(mut self, gater: impl Gater) -> Self {
+        self.gater = Some(Arc::new(gater));
+        self
+    }
+
+    /// Take every other setting from `settings`, with anything left unset
+    /// there at its default.
+    pub fn settings(mut self, settings: Settings) -> Self {
+        self.settings = settings;
+        self
+    }
+
+    /// Apply the defaults and start the relay as [`Relay::start`] does.
+    pub async fn start(self) -> Result<Relay, StartupError> {
+        let settings = Settings {
+            listen: self.listen.or(self.settings.listen),
+            identity: self.identity.or(self.settings.identity),
+            ..self.settings
+        };
+        let config = Config::load(None, settings).map_err(StartupError::Config)?;
+        Relay::spawn(config, self.gater).await
+    }
+}
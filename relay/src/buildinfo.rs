@@ -0,0 +1,45 @@
+//! What this binary was built from, embedded by the build script and
+//! reported by `--version`, the admin API and identify.
+
+use serde::{Deserialize, Serialize};
+
+pub const VERSION: &str = env!("CARGO_PKG_VERSION");
+pub const COMMIT: &str = env!("SUTRO_GIT_COMMIT");
+/// The build date as `YYYY-MM-DD` in UTC
+pub const BUILD_DATE: &str = env!("SUTRO_BUILD_DATE");
+
+/// As `--version` prints it, such as `0.1.0 (3f2a9c1b04de 2026-10-14)`.
+pub const LONG_VERSION: &str = concat!(
+    env!("CARGO_PKG_VERSION"),
+    " (",
+    env!("SUTRO_GIT_COMMIT"),
+    " ",
+    env!("SUTRO_BUILD_DATE"),
+    ")"
+);
+
+/// The agent version peers see through identify.
+pub const AGENT_VERSION: &str = concat!(
+    "sunset-relay/",
+    env!("CARGO_PKG_VERSION"),
+    " (",
+    env!("SUTRO_GIT_COMMIT"),
+    ")"
+);
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct BuildInfo {
+    pub version: String,
+    pub commit: String,
+    pub build_date: String,
+}
+
+impl BuildInfo {
+    pub fn current() -> Self {
+        Self {
+            version: VERSION.to_string(),
+            commit: COMMIT.to_string(),
+            build_date: BUILD_DATE.to_string(),
+        }
+    }
+}
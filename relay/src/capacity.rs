@@ -0,0 +1,134 @@
+use std::collections::HashMap;
+
+use libp2p::{PeerId, relay};
+use serde::{Deserialize, Serialize};
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CapacityRequest {}
+
+/// Reservation capacity advertised to clients choosing between relays.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Capacity {
+    /// Exact free reservation slots, omitted when advertising coarse load only
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub free_reservations: Option<usize>,
+    /// Share of reservation slots in use, rounded up to the advertised granularity
+    pub load_percent: u8,
+}
+
+/// Live reservation accounting, keyed by the peer holding them.
+pub struct Reservations {
+    max: usize,
+    active: usize,
+    by_peer: HashMap<PeerId, usize>,
+    discrepancies: u64,
+}
+
+impl Reservations {
+    pub fn new(max: usize) -> Self {
+        Self {
+            max,
+            active: 0,
+            by_peer: HashMap::new(),
+            discrepancies: 0,
+        }
+    }
+
+    /// Apply a changed --max-reservations.
+    pub fn set_max(&mut self, max: usize) {
+        self.max = max;
+    }
+
+    pub fn relay_event(&mut self, event: &relay::Event) {
+        match event {
+            relay::Event::ReservationReqAccepted {
+                src_peer_id,
+                renewed,
+            } => self.accepted(*src_peer_id, *renewed),
+            relay::Event::ReservationTimedOut { src_peer_id } => self.timed_out(src_peer_id),
+            _ => {}
+        }
+    }
+
+    fn accepted(&mut self, peer: PeerId, renewed: bool) {
+        if renewed {
+            return;
+        }
+        *self.by_peer.entry(peer).or_default() += 1;
+        self.active += 1;
+    }
+
+    fn timed_out(&mut self, peer: &PeerId) {
+        let Some(count) = self.by_peer.get_mut(peer) else {
+            return;
+        };
+        *count -= 1;
+        self.active -= 1;
+        if *count == 0 {
+            self.by_peer.remove(peer);
+        }
+    }
+
+    /// Drop every reservation held by a peer whose last connection closed.
+    pub fn disconnected(&mut self, peer: &PeerId) {
+        if let Some(count) = self.by_peer.remove(peer) {
+            self.active -= count;
+        }
+    }
+
+    /// Reclaim slots held by peers that are no longer connected and repair
+    /// the running total if it drifted, returning how many fixes were made.
+    pub fn reconcile(&mut self, is_connected: impl Fn(&PeerId) -> bool) -> usize {
+        let before = self.by_peer.len();
+        self.by_peer.retain(|peer, _| is_connected(peer));
+        let mut fixed = before - self.by_peer.len();
+
+        let counted: usize = self.by_peer.values().sum();
+        if counted != self.active {
+            self.active = counted;
+            fixed += 1;
+        }
+        self.discrepancies += fixed as u64;
+        fixed
+    }
+
+    /// Reservations currently held.
+    pub fn active(&self) -> usize {
+        self.active
+    }
+
+    /// Peers holding reservations and how many each holds.
+    pub fn holders(&self) -> impl Iterator<Item = (&PeerId, usize)> {
+        self.by_peer.iter().map(|(peer, count)| (peer, *count))
+    }
+
+    /// Whether `peer` holds at least one reservation.
+    pub fn holds(&self, peer: &PeerId) -> bool {
+        self.by_peer.contains_key(peer)
+    }
+
+    /// Total accounting errors repaired by [`Self::reconcile`].
+    pub fn discrepancies(&self) -> u64 {
+        self.discrepancies
+    }
+
+    /// Describe current capacity. A `granularity` of 0 advertises exact
+    /// counts; otherwise load is rounded up to buckets of that many percent.
+    /// A draining relay advertises itself as full, so clients choosing
+    /// between relays move elsewhere.
+    pub fn capacity(&self, granularity: u8, draining: bool) -> Capacity {
+        let active = if draining { self.max } else { self.active };
+        let free = self.max.saturating_sub(active);
+        let load = (active * 100).div_ceil(self.max.max(1)).min(100) as u8;
+        if granularity == 0 {
+            return Capacity {
+                free_reservations: Some(free),
+                load_percent: load,
+            };
+        }
+        Capacity {
+            free_reservations: None,
+            load_percent: load.div_ceil(granularity).saturating_mul(granularity).min(100),
+        }
+    }
+}
@@ -0,0 +1,187 @@
+//! Paces new inbound connections per source subnet with a token bucket, so
+//! one host churning connections cannot tie up file descriptors and
+//! handshake CPU. Attempts over --conn-rate-per-ip are refused before any
+//! handshake work is done.
+
+use std::{
+    collections::HashMap,
+    convert::Infallible,
+    fmt,
+    net::IpAddr,
+    task::{Context, Poll},
+    time::{Duration, Instant},
+};
+
+use libp2p::{
+    Multiaddr, PeerId,
+    core::{Endpoint, transport::PortUse},
+    swarm::{
+        ConnectionDenied, ConnectionId, FromSwarm, NetworkBehaviour, THandler, THandlerInEvent,
+        THandlerOutEvent, ToSwarm, dummy,
+    },
+};
+use tracing::debug;
+
+use crate::{config::Config, gate, geo};
+
+/// How often buckets that have filled back up are forgotten.
+const PRUNE_INTERVAL: Duration = Duration::from_secs(60);
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Limit {
+    per_sec: f64,
+    burst: f64,
+    ipv4_prefix: u8,
+    ipv6_prefix: u8,
+}
+
+impl Limit {
+    /// The limit --conn-rate-per-ip sets, if any.
+    pub fn from_config(config: &Config) -> Option<Self> {
+        let per_minute = config.conn_rate_per_ip?;
+        Some(Self {
+            per_sec: f64::from(per_minute) / 60.0,
+            burst: f64::from(config.conn_burst_per_ip.unwrap_or(per_minute)),
+            ipv4_prefix: config.conn_rate_ipv4_prefix,
+            ipv6_prefix: config.conn_rate_ipv6_prefix,
+        })
+    }
+
+    /// The network `ip` shares a bucket with.
+    fn subnet(&self, ip: IpAddr) -> IpAddr {
+        gate::subnet(ip, self.ipv4_prefix, self.ipv6_prefix)
+    }
+}
+
+struct Bucket {
+    tokens: f64,
+    updated: Instant,
+}
+
+impl Bucket {
+    /// Credit the time since the last call, returning the balance.
+    fn refill(&mut self, limit: &Limit, now: Instant) -> f64 {
+        let elapsed = now.duration_since(self.updated).as_secs_f64();
+        self.tokens = (self.tokens + elapsed * limit.per_sec).min(limit.burst);
+        self.updated = now;
+        self.tokens
+    }
+}
+
+#[derive(Debug)]
+struct Churning(IpAddr);
+
+impl fmt::Display for Churning {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{} is opening connections too fast", self.0)
+    }
+}
+
+impl std::error::Error for Churning {}
+
+/// Without a limit every attempt is let through, and one can be set later.
+pub struct Behaviour {
+    limit: Option<Limit>,
+    buckets: HashMap<IpAddr, Bucket>,
+    pruned: Instant,
+}
+
+impl Behaviour {
+    pub fn new(limit: Option<Limit>) -> Self {
+        Self {
+            limit,
+            buckets: HashMap::new(),
+            pruned: Instant::now(),
+        }
+    }
+
+    /// Apply a changed limit, starting every subnet over with a full bucket.
+    pub fn set_limit(&mut self, limit: Option<Limit>) {
+        if self.limit == limit {
+            return;
+        }
+        self.limit = limit;
+        self.buckets.clear();
+    }
+
+    fn take(&mut self, ip: IpAddr) -> bool {
+        let Some(limit) = self.limit else {
+            return true;
+        };
+        let now = Instant::now();
+        if now.duration_since(self.pruned) >= PRUNE_INTERVAL {
+            self.buckets
+                .retain(|_, bucket| bucket.refill(&limit, now) < limit.burst);
+            self.pruned = now;
+        }
+        let bucket = self.buckets.entry(limit.subnet(ip)).or_insert(Bucket {
+            tokens: limit.burst,
+            updated: now,
+        });
+        if bucket.refill(&limit, now) < 1.0 {
+            return false;
+        }
+        bucket.tokens -= 1.0;
+        true
+    }
+}
+
+impl NetworkBehaviour for Behaviour {
+    type ConnectionHandler = dummy::ConnectionHandler;
+    type ToSwarm = Infallible;
+
+    fn handle_pending_inbound_connection(
+        &mut self,
+        _connection_id: ConnectionId,
+        _local_addr: &Multiaddr,
+        remote_addr: &Multiaddr,
+    ) -> Result<(), ConnectionDenied> {
+        let Some(ip) = geo::ip_of(remote_addr) else {
+            return Ok(());
+        };
+        if self.take(ip) {
+            return Ok(());
+        }
+        debug!(%ip, "Connection refused: too many new connections from this subnet");
+        Err(ConnectionDenied::new(Churning(ip)))
+    }
+
+    fn handle_established_inbound_connection(
+        &mut self,
+        _connection_id: ConnectionId,
+        _peer: PeerId,
+        _local_addr: &Multiaddr,
+        _remote_addr: &Multiaddr,
+    ) -> Result<THandler<Self>, ConnectionDenied> {
+        Ok(dummy::ConnectionHandler)
+    }
+
+    fn handle_established_outbound_connection(
+        &mut self,
+        _connection_id: ConnectionId,
+        _peer: PeerId,
+        _addr: &Multiaddr,
+        _role_override: Endpoint,
+        _port_use: PortUse,
+    ) -> Result<THandler<Self>, ConnectionDenied> {
+        Ok(dummy::ConnectionHandler)
+    }
+
+    fn on_swarm_event(&mut self, _event: FromSwarm) {}
+
+    fn on_connection_handler_event(
+        &mut self,
+        _peer: PeerId,
+        _connection_id: ConnectionId,
+        event: THandlerOutEvent<Self>,
+    ) {
+        match event {}
+    }
+
+    fn poll(
+        &mut self,
+        _cx: &mut Context<'_>,
+    ) -> Poll<ToSwarm<Self::ToSwarm, THandlerInEvent<Self>>> {
+        Poll::Pending
+    }
+}
@@ -0,0 +1,170 @@
+//! Publishing ACME challenge, dynamic DNS and dnsaddr records through the
+//! Cloudflare API, with a token that has DNS edit permission on the zone.
+
+use std::error::Error;
+
+use reqwest::{Client, Method, RequestBuilder};
+use serde::{Deserialize, de::DeserializeOwned};
+use serde_json::json;
+
+const API: &str = "https://api.cloudflare.com/client/v4";
+
+/// A TXT record to remove once the challenge is over.
+pub struct Record {
+    zone: String,
+    id: String,
+}
+
+#[derive(Deserialize)]
+struct Response<T> {
+    success: bool,
+    #[serde(default)]
+    errors: Vec<ApiError>,
+    result: Option<T>,
+}
+
+#[derive(Deserialize)]
+struct ApiError {
+    message: String,
+}
+
+#[derive(Deserialize)]
+struct Id {
+    id: String,
+}
+
+#[derive(Deserialize)]
+struct Existing {
+    id: String,
+    content: String,
+}
+
+pub struct Cloudflare {
+    client: Client,
+    token: String,
+}
+
+impl Cloudflare {
+    pub fn new(token: String) -> Self {
+        Self {
+            client: Client::new(),
+            token,
+        }
+    }
+
+    /// Publish a TXT record with a short TTL.
+    pub async fn add(
+        &self,
+        name: &str,
+        content: &str,
+    ) -> Result<Record, Box<dyn Error + Send + Sync>> {
+        let zone = self.zone(name).await?;
+        let record = json!({ "type": "TXT", "name": name, "content": content, "ttl": 60 });
+        let created: Id = self
+            .send(
+                self.request(Method::POST, &format!("zones/{zone}/dns_records"))
+                    .json(&record),
+            )
+            .await?;
+        Ok(Record {
+            zone,
+            id: created.id,
+        })
+    }
+
+    /// Point the `kind` record for `name` at `content`, replacing whatever
+    /// it held.
+    pub async fn upsert(
+        &self,
+        name: &str,
+        kind: &str,
+        content: &str,
+    ) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let zone = self.zone(name).await?;
+        let path = format!("zones/{zone}/dns_records");
+        let existing: Vec<Id> = self
+            .send(
+                self.request(Method::GET, &path)
+                    .query(&[("type", kind), ("name", name)]),
+            )
+            .await?;
+        let record = json!({ "type": kind, "name": name, "content": content, "ttl": 60 });
+        let request = match existing.first() {
+            Some(Id { id }) => self.request(Method::PUT, &format!("{path}/{id}")),
+            None => self.request(Method::POST, &path),
+        };
+        let _: Id = self.send(request.json(&record)).await?;
+        Ok(())
+    }
+
+    /// Make `values` the TXT records of `name`, removing any others and
+    /// adding the missing ones.
+    pub async fn replace_txt(
+        &self,
+        name: &str,
+        values: &[String],
+    ) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let zone = self.zone(name).await?;
+        let path = format!("zones/{zone}/dns_records");
+        let existing: Vec<Existing> = self
+            .send(
+                self.request(Method::GET, &path)
+                    .query(&[("type", "TXT"), ("name", name)]),
+            )
+            .await?;
+        // Newer zones return TXT content quoted.
+        let content = |record: &Existing| record.content.trim_matches('"').to_owned();
+        for record in existing.iter().filter(|r| !values.contains(&content(r))) {
+            let delete = self.request(Method::DELETE, &format!("{path}/{}", record.id));
+            let _: Id = self.send(delete).await?;
+        }
+        let present: Vec<String> = existing.iter().map(content).collect();
+        for value in values.iter().filter(|v| !present.contains(v)) {
+            let record = json!({ "type": "TXT", "name": name, "content": value, "ttl": 300 });
+            let _: Id = self
+                .send(self.request(Method::POST, &path).json(&record))
+                .await?;
+        }
+        Ok(())
+    }
+
+    pub async fn remove(&self, record: Record) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let path = format!("zones/{}/dns_records/{}", record.zone, record.id);
+        let _: Id = self.send(self.request(Method::DELETE, &path)).await?;
+        Ok(())
+    }
+
+    /// The zone holding `name`, found by trying each parent domain in turn.
+    async fn zone(&self, name: &str) -> Result<String, Box<dyn Error + Send + Sync>> {
+        let mut candidate = name;
+        while let Some((_, parent)) = candidate.split_once('.') {
+            let request = self
+                .request(Method::GET, "zones")
+                .query(&[("name", parent)]);
+            let zones: Vec<Id> = self.send(request).await?;
+            if let Some(zone) = zones.into_iter().next() {
+                return Ok(zone.id);
+            }
+            candidate = parent;
+        }
+        Err(format!("no Cloudflare zone holds {name}").into())
+    }
+
+    fn request(&self, method: Method, path: &str) -> RequestBuilder {
+        self.client
+            .request(method, format!("{API}/{path}"))
+            .bearer_auth(&self.token)
+    }
+
+    async fn send<T: DeserializeOwned>(
+        &self,
+        request: RequestBuilder,
+    ) -> Result<T, Box<dyn Error + Send + Sync>> {
+        let response: Response<T> = request.send().await?.json().await?;
+        if !response.success {
+            let errors: Vec<String> = response.errors.into_iter().map(|e| e.message).collect();
+            return Err(format!("Cloudflare API error: {}", errors.join("; ")).into());
+        }
+        Ok(response.result.ok_or("Cloudflare API returned no result")?)
+    }
+}
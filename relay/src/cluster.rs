@@ -0,0 +1,203 @@
+//! Relays sharing a --cluster prefix in Consul act as one: each publishes
+//! which peers hold its reservations, whom its denylist refuses and whom it
+//! has banned for abuse, and refuses reservations to peers denylisted or
+//! banned anywhere or already holding --max-reservations-per-peer
+//! elsewhere, so a refused client cannot just move on to the next relay.
+
+use std::{
+    collections::{HashMap, HashSet},
+    error::Error,
+    sync::{Arc, RwLock},
+    time::{Duration, Instant, SystemTime, UNIX_EPOCH},
+};
+
+use libp2p::{Multiaddr, PeerId, relay};
+use serde::{Deserialize, Serialize};
+use tokio::sync::watch;
+use tracing::{debug, warn};
+
+use crate::consul::Consul;
+
+/// How many sync intervals a relay may miss before its entry is ignored,
+/// so the counts of a relay that died do not linger.
+const STALE_AFTER: u32 = 3;
+
+/// What one relay publishes. PeerIDs are strings, as libp2p's are not
+/// serializable.
+#[derive(Clone, Default, Serialize, Deserialize)]
+struct Node {
+    /// Unix time of the update
+    updated: u64,
+    reservations: HashMap<String, usize>,
+    denied: Vec<String>,
+    /// Missing from relays that predate sharing bans
+    #[serde(default)]
+    banned: Vec<String>,
+}
+
+#[derive(Default)]
+struct Shared {
+    max_per_peer: usize,
+    /// Peers holding reservations here, whose renewals are always let through
+    held: HashSet<PeerId>,
+    elsewhere: HashMap<PeerId, usize>,
+    denied: HashSet<PeerId>,
+    banned: HashSet<PeerId>,
+}
+
+/// Plugged into the relay as a reservation rate limiter. Clones share the
+/// cluster view kept current by the background sync.
+#[derive(Clone)]
+pub struct Cluster {
+    shared: Arc<RwLock<Shared>>,
+    local: Arc<watch::Sender<Node>>,
+}
+
+impl Cluster {
+    /// Start syncing with the other relays under `prefix` every `interval`,
+    /// as driven by [`Cluster::publish`].
+    pub fn spawn(
+        prefix: &str,
+        local_peer_id: PeerId,
+        max_per_peer: usize,
+        interval: Duration,
+    ) -> Self {
+        let shared = Arc::new(RwLock::new(Shared {
+            max_per_peer,
+            ..Default::default()
+        }));
+        let (local, updates) = watch::channel(Node::default());
+        let consul = Consul::from_env(prefix);
+        tokio::spawn(run(
+            consul,
+            local_peer_id,
+            updates,
+            shared.clone(),
+            interval,
+        ));
+        Self {
+            shared,
+            local: Arc::new(local),
+        }
+    }
+
+    /// Apply a changed --max-reservations-per-peer.
+    pub fn set_max_per_peer(&self, max_per_peer: usize) {
+        self.shared.write().unwrap().max_per_peer = max_per_peer;
+    }
+
+    /// Share this relay's reservation holders, denylist and active bans
+    /// with the cluster.
+    pub fn publish<'a>(
+        &self,
+        holders: impl IntoIterator<Item = (&'a PeerId, usize)>,
+        denied: impl IntoIterator<Item = PeerId>,
+        banned: impl IntoIterator<Item = PeerId>,
+    ) {
+        let reservations: HashMap<PeerId, usize> = holders
+            .into_iter()
+            .map(|(peer, count)| (*peer, count))
+            .collect();
+        self.shared.write().unwrap().held = reservations.keys().copied().collect();
+        self.local.send_replace(Node {
+            updated: unix_now(),
+            reservations: reservations
+                .into_iter()
+                .map(|(peer, count)| (peer.to_string(), count))
+                .collect(),
+            denied: denied.into_iter().map(|peer| peer.to_string()).collect(),
+            banned: banned.into_iter().map(|peer| peer.to_string()).collect(),
+        });
+    }
+}
+
+impl relay::RateLimiter for Cluster {
+    fn try_next(&mut self, peer: PeerId, _addr: &Multiaddr, _now: Instant) -> bool {
+        let shared = self.shared.read().unwrap();
+        if shared.denied.contains(&peer) {
+            debug!(%peer, "Reservation refused: denylisted by another relay in the cluster");
+            return false;
+        }
+        if shared.banned.contains(&peer) {
+            debug!(%peer, "Reservation refused: banned by another relay in the cluster");
+            return false;
+        }
+        if shared.held.contains(&peer) {
+            return true;
+        }
+        let elsewhere = shared.elsewhere.get(&peer).copied().unwrap_or(0);
+        if elsewhere >= shared.max_per_peer {
+            debug!(%peer, elsewhere, "Reservation refused: holds the most allowed elsewhere in the cluster");
+            return false;
+        }
+        true
+    }
+}
+
+/// Push each update and pull the other relays' entries, until the relay
+/// stops and takes its entry down.
+async fn run(
+    consul: Consul,
+    local_peer_id: PeerId,
+    mut updates: watch::Receiver<Node>,
+    shared: Arc<RwLock<Shared>>,
+    interval: Duration,
+) {
+    let key = format!("nodes/{local_peer_id}");
+    while updates.changed().await.is_ok() {
+        let node = updates.borrow_and_update().clone();
+        let result = sync(&consul, &key, &node, &shared, interval)
+            .await
+            .map_err(|e| e.to_string());
+        if let Err(e) = result {
+            warn!("Could not sync with the cluster: {e}");
+        }
+    }
+    if let Err(e) = consul.delete(&key).await.map_err(|e| e.to_string()) {
+        warn!("Could not leave the cluster: {e}");
+    }
+}
+
+async fn sync(
+    consul: &Consul,
+    key: &str,
+    node: &Node,
+    shared: &RwLock<Shared>,
+    interval: Duration,
+) -> Result<(), Box<dyn Error + Send + Sync>> {
+    consul.put(key, serde_json::to_vec(node)?).await?;
+    let oldest = unix_now().saturating_sub((interval * STALE_AFTER).as_secs());
+    let mut elsewhere = HashMap::new();
+    let mut denied = HashSet::new();
+    let mut banned = HashSet::new();
+    for (entry, value) in consul.list("nodes").await? {
+        if entry.ends_with(key) {
+            continue;
+        }
+        let Ok(other) = serde_json::from_slice::<Node>(&value) else {
+            warn!("Ignoring unreadable cluster entry {entry}");
+            continue;
+        };
+        if other.updated < oldest {
+            continue;
+        }
+        for (peer, count) in other.reservations {
+            if let Ok(peer) = peer.parse() {
+                *elsewhere.entry(peer).or_default() += count;
+            }
+        }
+        denied.extend(other.denied.iter().filter_map(|peer| peer.parse().ok()));
+        banned.extend(other.banned.iter().filter_map(|peer| peer.parse().ok()));
+    }
+    let mut shared = shared.write().unwrap();
+    shared.elsewhere = elsewhere;
+    shared.denied = denied;
+    shared.banned = banned;
+    Ok(())
+}
+
+fn unix_now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_or(0, |since| since.as_secs())
+}
@@ -0,0 +1,226 @@
+//! One-shot subcommands that inspect or prepare a relay without starting it.
+
+use std::{error::Error, io, path::PathBuf, thread};
+
+use clap::Args;
+use libp2p::{PeerId, core::multiaddr::Protocol, identity::Keypair};
+use sunset_relay::{
+    config::{Config, ConfigError, KeyType},
+    dnsaddr,
+    identity::{self, load_identity},
+    keyformat::{self, KeyFormat},
+    listen,
+    startup::StartupError,
+    vanity,
+};
+use tokio::{fs, io::AsyncReadExt, task};
+use tracing::info;
+
+/// Print the PeerID of the configured identity and the addresses the relay
+/// would listen on.
+pub async fn id(config: &Config) -> Result<(), StartupError> {
+    let peer_id = peer_id(config).await?;
+    println!("{peer_id}");
+    for addr in listen::plan(config) {
+        println!("{}", addr.with(Protocol::P2p(peer_id)));
+    }
+    Ok(())
+}
+
+/// Print the `_dnsaddr` TXT records for the addresses known from the
+/// configuration in zone file syntax, or replace the published ones with
+/// them through --ddns-provider.
+pub async fn dnsaddr(
+    config: &Config,
+    name: Option<String>,
+    publish: bool,
+) -> Result<(), StartupError> {
+    let name = name
+        .or_else(|| config.dnsaddr.clone())
+        .or_else(|| config.external_dns.clone())
+        .or_else(|| config.domain.clone())
+        .ok_or(StartupError::Config(ConfigError::Invalid {
+            setting: "dnsaddr",
+            reason: "needs a NAME, or --dnsaddr, --external-dns or --domain to take it from",
+        }))?;
+    let records = dnsaddr::records(peer_id(config).await?, &dnsaddr::configured(config));
+    if records.is_empty() {
+        return Err(StartupError::Config(ConfigError::Invalid {
+            setting: "announce",
+            reason: "or --external-dns or --domain must say which addresses clients can dial",
+        }));
+    }
+    let host = dnsaddr::host(&name);
+    if !publish {
+        for record in &records {
+            println!("{host}. 300 IN TXT \"{record}\"");
+        }
+        return Ok(());
+    }
+    dnsaddr::publish(config, &name, &records)
+        .await
+        .map_err(|e| StartupError::dns(&host, e))?;
+    info!("Published {} dnsaddr records at {host}", records.len());
+    Ok(())
+}
+
+/// The PeerID of the configured identity.
+async fn peer_id(config: &Config) -> Result<PeerId, StartupError> {
+    let passphrase = config.identity_passphrase.as_ref().map(|p| p.0.as_str());
+    let source = config.identity_source();
+    let keypair = load_identity(&source, passphrase)
+        .await
+        .map_err(|e| StartupError::identity(&source, e))?;
+    Ok(keypair.public().to_peer_id())
+}
+
+/// Where and how a new identity file is written.
+#[derive(Debug, Args)]
+pub struct KeyFileArgs {
+    /// Where to write the key
+    #[arg(long, default_value = "identity.key")]
+    out: PathBuf,
+
+    /// Replace an existing identity file
+    #[arg(long)]
+    force: bool,
+
+    /// Encrypt the key with this passphrase
+    #[arg(long = "identity-passphrase", env = "SUTRO_IDENTITY_PASSPHRASE", hide_env_values = true)]
+    passphrase: Option<String>,
+
+    /// Encrypt the key, prompting for a passphrase unless one is given
+    #[arg(long)]
+    encrypt: bool,
+}
+
+#[derive(Debug, Args)]
+pub struct KeygenArgs {
+    #[command(flatten)]
+    file: KeyFileArgs,
+
+    /// Type of key to generate
+    #[arg(long, env = "SUTRO_KEY_TYPE", default_value = "ed25519")]
+    key_type: KeyType,
+
+    /// Modulus size in bits for RSA keys
+    #[arg(long, env = "SUTRO_KEY_BITS", default_value_t = 2048)]
+    key_bits: usize,
+
+    /// Keep generating keys until the PeerID starts with this, such as 12D3KooWSutro
+    #[arg(long)]
+    vanity_prefix: Option<String>,
+
+    /// Threads searching for --vanity-prefix [default: one per CPU]
+    #[arg(long)]
+    workers: Option<usize>,
+}
+
+/// Write a fresh identity to `--out` and print its PeerID.
+pub async fn keygen(args: KeygenArgs) -> Result<(), StartupError> {
+    let key = async move {
+        let Some(prefix) = args.vanity_prefix else {
+            return identity::generate(args.key_type, args.key_bits);
+        };
+        vanity::check_prefix(args.key_type, &prefix)?;
+        let workers = args
+            .workers
+            .unwrap_or_else(|| thread::available_parallelism().map_or(1, |n| n.get()));
+        info!("Searching for a PeerID starting with {prefix} on {workers} threads");
+        let (key_type, key_bits) = (args.key_type, args.key_bits);
+        let found =
+            task::spawn_blocking(move || vanity::search(key_type, key_bits, &prefix, workers))
+                .await
+                .expect("vanity search panicked")?;
+        Ok(found)
+    };
+    write_key(args.file, key).await
+}
+
+#[derive(Debug, Args)]
+pub struct KeyImportArgs {
+    /// PKCS#8 PEM or JWK private key to import, or - for stdin
+    input: PathBuf,
+
+    #[command(flatten)]
+    file: KeyFileArgs,
+}
+
+/// Convert a PEM or JWK private key into an identity file at `--out` and
+/// print its PeerID.
+pub async fn import_key(args: KeyImportArgs) -> Result<(), StartupError> {
+    let input = args.input;
+    let key = async move {
+        let text = if input.as_os_str() == "-" {
+            let mut text = String::new();
+            tokio::io::stdin().read_to_string(&mut text).await?;
+            text
+        } else {
+            fs::read_to_string(&input).await?
+        };
+        keyformat::import(&text)
+    };
+    write_key(args.file, key).await
+}
+
+/// Print the configured identity as PEM or JWK, decrypting it if needed.
+pub async fn export_key(config: &Config, format: KeyFormat) -> Result<(), StartupError> {
+    let passphrase = config.identity_passphrase.as_ref().map(|p| p.0.as_str());
+    let source = config.identity_source();
+    let fail = |e: Box<dyn Error + Send + Sync>| StartupError::identity(&source, e);
+    let (keypair, stored) = identity::load_stored(&source, passphrase)
+        .await
+        .map_err(fail)?;
+    let exported = keyformat::export(&keypair, &stored, format).map_err(fail)?;
+    println!("{}", exported.trim_end());
+    Ok(())
+}
+
+/// Write the key `make` resolves to and print its PeerID. `--out` and the
+/// passphrase are settled first, so a slow vanity search is not wasted on
+/// a file that cannot be written.
+async fn write_key<F>(args: KeyFileArgs, make: F) -> Result<(), StartupError>
+where
+    F: Future<Output = Result<(Keypair, Vec<u8>), Box<dyn Error + Send + Sync>>>,
+{
+    let out = args.out.as_path();
+    let fail = |e: Box<dyn Error + Send + Sync>| StartupError::identity(out.display(), e);
+    if !args.force && out.exists() {
+        let exists = io::Error::new(
+            io::ErrorKind::AlreadyExists,
+            "file already exists; pass --force to replace it",
+        );
+        return Err(fail(exists.into()));
+    }
+    let passphrase = match args.passphrase {
+        None if args.encrypt => Some(new_passphrase().map_err(|e| fail(e.into()))?),
+        passphrase => passphrase,
+    };
+    let (keypair, encoded) = make.await.map_err(fail)?;
+    identity::save(out, encoded, passphrase.as_deref())
+        .await
+        .map_err(fail)?;
+    println!("{}", keypair.public().to_peer_id());
+    Ok(())
+}
+
+/// Ask for a new passphrase twice on the terminal.
+fn new_passphrase() -> io::Result<String> {
+    let passphrase = rpassword::prompt_password("New passphrase: ")?;
+    if passphrase.is_empty() {
+        return Err(io::Error::new(io::ErrorKind::InvalidInput, "passphrase is empty"));
+    }
+    if rpassword::prompt_password("Repeat passphrase: ")? != passphrase {
+        return Err(io::Error::new(io::ErrorKind::InvalidInput, "passphrases do not match"));
+    }
+    Ok(passphrase)
+}
+
+/// Report whether the configuration would start, without binding anything.
+/// Settings were already validated while loading.
+pub fn check(config: &Config) -> Result<(), StartupError> {
+    listen::check_conflicts(&listen::plan(config))?;
+    println!("{config:#?}");
+    println!("Configuration OK");
+    Ok(())
+}
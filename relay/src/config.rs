@@ -0,0 +1,2685 @@
+use std::{
+    fmt, fs, io,
+    net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr},
+    num::NonZeroU32,
+    path::{Path, PathBuf},
+    time::{Duration, SystemTime},
+};
+
+use clap::{Args, ValueEnum};
+use libp2p::{Multiaddr, core::multiaddr::Protocol};
+use reqwest::Url;
+use serde::{Deserialize, Serialize};
+use tracing_subscriber::EnvFilter;
+
+use crate::{
+    acme,
+    announce::AddrFilter,
+    gate::Cidr,
+    geo::CountryPolicy,
+    identity::{IdentitySource, RSA_BITS},
+    listen,
+    rfc2136::TsigKey,
+    throttle::Bandwidth,
+    tls::CertFiles,
+};
+
+/// Where --dht joins the public DHT unless --bootstrap says otherwise.
+const IPFS_BOOTSTRAP: [&str; 5] = [
+    "/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+    "/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
+    "/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
+    "/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
+    "/ip4/104.131.131.82/tcp/4001/p2p/QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ",
+];
+
+/// Relay settings as given by flags, `SUTRO_*` environment variables or a
+/// config file. Everything is optional so that flags and the environment only
+/// override the values they actually set.
+#[derive(Debug, Default, Clone, Args, Deserialize)]
+#[serde(deny_unknown_fields, rename_all = "kebab-case")]
+pub struct Settings {
+    /// Port to listen on [default: 4001]
+    #[arg(long, env = "SUTRO_PORT")]
+    pub port: Option<u16>,
+
+    /// TCP port for WebSocket, such as one a reverse proxy forwards to [default: --port]
+    #[arg(long, env = "SUTRO_WS_PORT")]
+    pub ws_port: Option<u16>,
+
+    /// UDP port for QUIC [default: --port]
+    #[arg(long, env = "SUTRO_QUIC_PORT")]
+    pub quic_port: Option<u16>,
+
+    /// Neither listen on nor dial plain WebSocket; WebSocket over TLS is still served with a certificate
+    #[arg(
+        long,
+        env = "SUTRO_NO_WS",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub no_ws: Option<bool>,
+
+    /// Neither listen on nor dial QUIC, as where UDP is blocked
+    #[arg(
+        long,
+        env = "SUTRO_NO_QUIC",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub no_quic: Option<bool>,
+
+    /// Send TCP keepalive probes on TCP and WebSocket connections idle this long, dropping peers that miss three in a row where the platform allows (system default if unset)
+    #[arg(long, env = "SUTRO_TCP_KEEPALIVE", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub tcp_keepalive: Option<Duration>,
+
+    /// Send small TCP and WebSocket writes straight away rather than batching them (TCP_NODELAY) [default: true]
+    #[arg(
+        long,
+        env = "SUTRO_TCP_NODELAY",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub tcp_nodelay: Option<bool>,
+
+    /// Security handshakes to offer on TCP, WebSocket and Unix socket connections, in order of preference; QUIC always uses TLS 1.3 [default: noise]
+    #[arg(long, env = "SUTRO_SECURITY", value_delimiter = ',')]
+    pub security: Option<Vec<SecurityProtocol>>,
+
+    /// Close a QUIC connection after this long without traffic [default: 10s]
+    #[arg(long, env = "SUTRO_QUIC_IDLE_TIMEOUT", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub quic_idle_timeout: Option<Duration>,
+
+    /// Ping idle QUIC connections this often to keep them and their NAT mappings open [default: 5s]
+    #[arg(long, env = "SUTRO_QUIC_KEEP_ALIVE", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub quic_keep_alive: Option<Duration>,
+
+    /// Max concurrent incoming streams on one QUIC connection [default: --max-streams-per-connection]
+    #[arg(long, env = "SUTRO_QUIC_MAX_STREAMS")]
+    pub quic_max_streams: Option<usize>,
+
+    /// UDP receive buffer in bytes QUIC needs at relay-scale traffic; the relay warns at startup when net.core.rmem_max caps buffers lower [default: 7500000]
+    #[arg(long, env = "SUTRO_QUIC_RECEIVE_BUFFER")]
+    pub quic_receive_buffer: Option<u64>,
+
+    /// Comma-separated local IPs to listen on, such as a multi-homed host's public one, leaving its internal interfaces alone [default: 0.0.0.0,::]
+    #[arg(long, env = "SUTRO_LISTEN_IP", value_delimiter = ',')]
+    pub listen_ip: Option<Vec<IpAddr>>,
+
+    /// Listen on exactly these comma-separated multiaddrs instead of the ones the port settings, --onion-address and --unix-socket make up
+    #[arg(long, env = "SUTRO_LISTEN", value_delimiter = ',')]
+    pub listen: Option<Vec<Multiaddr>>,
+
+    /// TCP port for WebSocket over TLS, served when --tls-cert is set [default: 443]
+    #[arg(long, env = "SUTRO_WSS_PORT")]
+    pub wss_port: Option<u16>,
+
+    /// URL path WebSocket connections are expected on, announced with the addresses so clients dial it, for a reverse proxy that routes by path [default: /]
+    #[arg(long, env = "SUTRO_WS_PATH")]
+    pub ws_path: Option<String>,
+
+    /// swarm.key of a private network, as written by ipfs-swarm-key-gen; the relay then only speaks to peers holding it, over TCP and WebSocket as QUIC cannot carry the key (public network if unset)
+    #[arg(long, env = "SUTRO_PSK")]
+    pub psk: Option<PathBuf>,
+
+    /// Onion service Tor serves the relay under, as written to its HiddenServiceDir/hostname; announced as /onion3 so peers that can only reach the network over Tor can use the relay (disabled if unset)
+    #[arg(long, env = "SUTRO_ONION_ADDRESS")]
+    pub onion_address: Option<String>,
+
+    /// TCP port on 127.0.0.1 for the onion service, which Tor must forward the same port to with `HiddenServicePort PORT 127.0.0.1:PORT` [default: 4005]
+    #[arg(long, env = "SUTRO_ONION_PORT")]
+    pub onion_port: Option<u16>,
+
+    /// Also listen on this Unix socket, as /unix/PATH, so co-located services such as a sidecar gateway reach the relay without the network stack; never announced (disabled if unset)
+    #[arg(long, env = "SUTRO_UNIX_SOCKET")]
+    pub unix_socket: Option<PathBuf>,
+
+    /// Take the client address of WebSocket connections from the X-Forwarded-For header set by an HTTP reverse proxy, and log X-Forwarded-Host and X-Forwarded-Proto
+    #[arg(
+        long,
+        env = "SUTRO_FORWARDED_HEADERS",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub forwarded_headers: Option<bool>,
+
+    /// Expect a PROXY protocol v1 or v2 header, as sent by HAProxy or an AWS NLB, on TCP and WebSocket connections and take the client address from it
+    #[arg(
+        long,
+        env = "SUTRO_PROXY_PROTOCOL",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub proxy_protocol: Option<bool>,
+
+    /// Only honour PROXY and X-Forwarded-For headers from these comma-separated load balancer IPs or CIDR ranges, taking other connections as direct. Required with --forwarded-headers and --proxy-protocol
+    #[arg(long, env = "SUTRO_TRUSTED_PROXIES", value_delimiter = ',')]
+    pub trusted_proxies: Option<Vec<Cidr>>,
+
+    /// PEM certificate chain for WebSocket over TLS, reloaded when the file changes
+    #[arg(long, env = "SUTRO_TLS_CERT")]
+    pub tls_cert: Option<PathBuf>,
+
+    /// PEM private key for --tls-cert
+    #[arg(long, env = "SUTRO_TLS_KEY")]
+    pub tls_key: Option<PathBuf>,
+
+    /// Get a certificate for this domain from Let's Encrypt with a DNS-01 challenge instead of --tls-cert, and announce it as /dns4/DOMAIN/tcp/WSS_PORT/tls/ws
+    #[arg(long, env = "SUTRO_DOMAIN")]
+    pub domain: Option<String>,
+
+    /// Cloudflare API token with DNS edit permission, for publishing --domain's challenge records and --ddns-provider cloudflare updates
+    #[arg(long, env = "SUTRO_CLOUDFLARE_API_TOKEN", hide_env_values = true)]
+    pub cloudflare_api_token: Option<String>,
+
+    /// ACME directory to get --domain's certificate from, such as Let's Encrypt staging or an internal CA trusted by the system [default: Let's Encrypt]
+    #[arg(long, env = "SUTRO_ACME_DIRECTORY")]
+    pub acme_directory: Option<String>,
+
+    /// Contact address for the ACME account, told about expiring certificates
+    #[arg(long, env = "SUTRO_ACME_EMAIL")]
+    pub acme_email: Option<String>,
+
+    /// Directory to keep the ACME account and certificates in [default: acme]
+    #[arg(long, env = "SUTRO_ACME_CACHE")]
+    pub acme_cache: Option<PathBuf>,
+
+    /// URL to POST JSON alerts to, such as a certificate nearing expiry or a failed renewal
+    #[arg(long, env = "SUTRO_ALERT_WEBHOOK")]
+    pub alert_webhook: Option<String>,
+
+    /// URL to POST JSON notifications of relay events to, such as reservations, bans and certificate renewals (disabled if unset)
+    #[arg(long, env = "SUTRO_EVENT_WEBHOOK")]
+    pub event_webhook: Option<String>,
+
+    /// Comma-separated events to notify --event-webhook of [default: all]
+    #[arg(long, env = "SUTRO_EVENT_WEBHOOK_EVENTS", value_delimiter = ',')]
+    pub event_webhook_events: Option<Vec<NotifyEvent>>,
+
+    /// Where replicas share the ACME account and certificates beyond --acme-cache [default: file]
+    #[arg(long, env = "SUTRO_ACME_STORAGE")]
+    pub acme_storage: Option<AcmeStorage>,
+
+    /// Consul KV prefix for --acme-storage consul, on the agent at CONSUL_HTTP_ADDR with CONSUL_HTTP_TOKEN [default: sutro/acme]
+    #[arg(long, env = "SUTRO_ACME_CONSUL_PREFIX")]
+    pub acme_consul_prefix: Option<String>,
+
+    /// Path to persistent identity key [default: identity.key]
+    #[arg(long, env = "SUTRO_IDENTITY")]
+    pub identity: Option<PathBuf>,
+
+    /// Passphrase the identity key is encrypted with; prompted for if unset and the key is encrypted
+    #[arg(long, env = "SUTRO_IDENTITY_PASSPHRASE", hide_env_values = true)]
+    pub identity_passphrase: Option<String>,
+
+    /// Read the identity key, base64-encoded, from this environment variable instead of --identity
+    #[arg(long, env = "SUTRO_IDENTITY_ENV")]
+    pub identity_env: Option<String>,
+
+    /// Read the identity key from standard input instead of --identity
+    #[arg(
+        long,
+        env = "SUTRO_IDENTITY_STDIN",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub identity_stdin: Option<bool>,
+
+    /// Read the identity key, base64-encoded in its `key` field, from this Vault KV v2 secret (MOUNT/PATH) using VAULT_ADDR and VAULT_TOKEN
+    #[arg(long, env = "SUTRO_IDENTITY_VAULT")]
+    pub identity_vault: Option<String>,
+
+    /// Key type for newly generated identities [default: ed25519]
+    #[arg(long, env = "SUTRO_KEY_TYPE")]
+    pub key_type: Option<KeyType>,
+
+    /// Modulus size in bits for newly generated RSA identities [default: 2048]
+    #[arg(long, env = "SUTRO_KEY_BITS")]
+    pub key_bits: Option<usize>,
+
+    /// Identity being retired, served alongside --identity on --previous-identity-port until --previous-identity-until
+    #[arg(long, env = "SUTRO_PREVIOUS_IDENTITY")]
+    pub previous_identity: Option<PathBuf>,
+
+    /// Port to serve --previous-identity on
+    #[arg(long, env = "SUTRO_PREVIOUS_IDENTITY_PORT")]
+    pub previous_identity_port: Option<u16>,
+
+    /// When to retire --previous-identity, as an RFC 3339 time such as 2026-12-01T00:00:00Z
+    #[arg(long, env = "SUTRO_PREVIOUS_IDENTITY_UNTIL", value_parser = humantime::parse_rfc3339_weak)]
+    #[serde(default, with = "humantime_serde")]
+    pub previous_identity_until: Option<SystemTime>,
+
+    /// Write the relay's process ID to this file while it runs (disabled if unset)
+    #[arg(long, env = "SUTRO_PID_FILE")]
+    pub pid_file: Option<PathBuf>,
+
+    /// Detach from the terminal and keep running in the background once started, on Unix; log lines are discarded unless --log-file is set
+    #[arg(
+        long,
+        env = "SUTRO_DAEMON",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub daemon: Option<bool>,
+
+    /// Max circuit relay reservations [default: 256]
+    #[arg(long, env = "SUTRO_MAX_RESERVATIONS")]
+    pub max_reservations: Option<usize>,
+
+    /// Max reservations a single PeerID may hold [default: 4]
+    #[arg(long, env = "SUTRO_MAX_RESERVATIONS_PER_PEER")]
+    pub max_reservations_per_peer: Option<usize>,
+
+    /// Max circuits relayed at once [default: 16]
+    #[arg(long, env = "SUTRO_MAX_CIRCUITS")]
+    pub max_circuits: Option<usize>,
+
+    /// Max concurrent circuits a peer may take part in, as source or destination [default: 4]
+    #[arg(long, env = "SUTRO_MAX_CIRCUITS_PER_PEER")]
+    pub max_circuits_per_peer: Option<usize>,
+
+    /// Max concurrent circuits opened from a single source IP (unlimited if unset)
+    #[arg(long, env = "SUTRO_MAX_CIRCUITS_PER_IP")]
+    pub max_circuits_per_ip: Option<usize>,
+
+    /// Close relayed circuits after this long; 0 means unlimited [default: 2m]
+    #[arg(long, env = "SUTRO_MAX_CIRCUIT_DURATION", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub max_circuit_duration: Option<Duration>,
+
+    /// Close relayed circuits after relaying this many bytes; 0 means unlimited [default: 131072]
+    #[arg(long, env = "SUTRO_MAX_CIRCUIT_BYTES")]
+    pub max_circuit_bytes: Option<u64>,
+
+    /// RESERVE requests, renewals included, a single PeerID may make per --reservation-rate-peer-window; 0 means unlimited [default: 30]
+    #[arg(long, env = "SUTRO_RESERVATION_RATE_PER_PEER")]
+    pub reservation_rate_per_peer: Option<u32>,
+
+    /// Window --reservation-rate-per-peer counts over [default: 2m]
+    #[arg(long, env = "SUTRO_RESERVATION_RATE_PEER_WINDOW", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub reservation_rate_peer_window: Option<Duration>,
+
+    /// RESERVE requests peers connecting from a single IP may make per --reservation-rate-ip-window; 0 means unlimited [default: 60]
+    #[arg(long, env = "SUTRO_RESERVATION_RATE_PER_IP")]
+    pub reservation_rate_per_ip: Option<u32>,
+
+    /// Window --reservation-rate-per-ip counts over [default: 1m]
+    #[arg(long, env = "SUTRO_RESERVATION_RATE_IP_WINDOW", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub reservation_rate_ip_window: Option<Duration>,
+
+    /// Temporarily ban peers that reconnect rapidly, keep having circuits denied or fail, or keep hitting --max-circuit-bytes [default: false]
+    #[arg(
+        long,
+        env = "SUTRO_ABUSE_BANS",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub abuse_bans: Option<bool>,
+
+    /// Inbound connections a peer may open within --ban-window before it is banned [default: 30]
+    #[arg(long, env = "SUTRO_BAN_RECONNECTS")]
+    pub ban_reconnects: Option<u32>,
+
+    /// Circuit requests of a peer's that may be denied or fail within --ban-window before it is banned [default: 20]
+    #[arg(long, env = "SUTRO_BAN_FAILED_CIRCUITS")]
+    pub ban_failed_circuits: Option<u32>,
+
+    /// Circuits of a peer's that may be cut off by --max-circuit-bytes within --ban-window before it is banned [default: 10]
+    #[arg(long, env = "SUTRO_BAN_DATA_LIMIT_HITS")]
+    pub ban_data_limit_hits: Option<u32>,
+
+    /// Window the --abuse-bans thresholds count over [default: 1m]
+    #[arg(long, env = "SUTRO_BAN_WINDOW", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub ban_window: Option<Duration>,
+
+    /// How long a peer's first ban lasts; each further one lasts twice as long [default: 5m]
+    #[arg(long, env = "SUTRO_BAN_DURATION", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub ban_duration: Option<Duration>,
+
+    /// Longest a ban can grow to, and how long a peer must stay clean for its bans to be forgotten [default: 24h]
+    #[arg(long, env = "SUTRO_BAN_MAX_DURATION", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub ban_max_duration: Option<Duration>,
+
+    /// Score peers by the circuits and bytes they relay, their failed circuits and their bans, keeping the scores in this file across restarts (disabled if unset)
+    #[arg(long, env = "SUTRO_REPUTATION_FILE")]
+    pub reputation_file: Option<PathBuf>,
+
+    /// Reservation slots, out of --max-reservations, that only peers with a positive --reputation-file score may take [default: a tenth of --max-reservations]
+    #[arg(long, env = "SUTRO_REPUTATION_RESERVED")]
+    pub reputation_reserved: Option<usize>,
+
+    /// Only grant reservations to peers that have presented an HS256 JWT signed with this secret, whose `sub` is their PeerID, over /sunset/auth/1.0.0 (open to all if unset)
+    #[arg(long, env = "SUTRO_RESERVATION_TOKEN_SECRET", hide_env_values = true)]
+    pub reservation_token_secret: Option<String>,
+
+    /// TOML file of API keys and the quota each carries; peers must present one over /sunset/auth/1.0.0 before reserving, and are held to its quota (open to all if unset)
+    #[arg(long, env = "SUTRO_API_KEYS")]
+    pub api_keys: Option<PathBuf>,
+
+    /// Keep each --api-keys key's usage for the month in this file across restarts (kept in memory only if unset)
+    #[arg(long, env = "SUTRO_API_KEY_USAGE")]
+    pub api_key_usage: Option<PathBuf>,
+
+    /// Ask this URL whether to grant a peer reservations, POSTing its PeerID and address as JSON as it connects and honouring the allow, deny or limit answer (disabled if unset)
+    #[arg(long, env = "SUTRO_RESERVATION_WEBHOOK")]
+    pub reservation_webhook: Option<String>,
+
+    /// How long to wait for --reservation-webhook to answer [default: 2s]
+    #[arg(long, env = "SUTRO_RESERVATION_WEBHOOK_TIMEOUT", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub reservation_webhook_timeout: Option<Duration>,
+
+    /// How long to keep a --reservation-webhook answer that sets no ttl_secs of its own before refreshing it; the old answer is served until the new one is in [default: 5m]
+    #[arg(long, env = "SUTRO_RESERVATION_WEBHOOK_CACHE", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub reservation_webhook_cache: Option<Duration>,
+
+    /// Grant reservations while --reservation-webhook cannot be reached or answers with an error, instead of refusing them [default: false]
+    #[arg(
+        long,
+        env = "SUTRO_RESERVATION_WEBHOOK_FAIL_OPEN",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub reservation_webhook_fail_open: Option<bool>,
+
+    /// File of PeerIDs, one per line, that may hold reservations; everyone else is refused
+    #[arg(long, env = "SUTRO_RESERVATION_ALLOWLIST")]
+    pub reservation_allowlist: Option<PathBuf>,
+
+    /// File of PeerIDs, one per line, that are refused reservations
+    #[arg(long, env = "SUTRO_RESERVATION_DENYLIST")]
+    pub reservation_denylist: Option<PathBuf>,
+
+    /// File of PeerIDs, one per line, in the trusted reservation tier, along with peers whose token or API key names that tier
+    #[arg(long, env = "SUTRO_TRUSTED_PEERS")]
+    pub trusted_peers: Option<PathBuf>,
+
+    /// Reservation slots, out of --max-reservations, kept free for trusted peers until they take them [default: 0]
+    #[arg(long, env = "SUTRO_TIER_RESERVED_TRUSTED")]
+    pub tier_reserved_trusted: Option<usize>,
+
+    /// Reservation slots, out of --max-reservations, kept free for peers with a token or API key until they take them [default: 0]
+    #[arg(long, env = "SUTRO_TIER_RESERVED_DEFAULT")]
+    pub tier_reserved_default: Option<usize>,
+
+    /// Cap on the combined throughput of peers in the default tier, leaving the rest of --max-bandwidth to trusted peers (unlimited if unset)
+    #[arg(long, env = "SUTRO_TIER_BANDWIDTH_DEFAULT")]
+    pub tier_bandwidth_default: Option<Bandwidth>,
+
+    /// Cap on the combined throughput of anonymous peers, those without a token or API key (unlimited if unset)
+    #[arg(long, env = "SUTRO_TIER_BANDWIDTH_ANONYMOUS")]
+    pub tier_bandwidth_anonymous: Option<Bandwidth>,
+
+    /// Only accept inbound connections from these comma-separated IPs or CIDR ranges
+    #[arg(long, env = "SUTRO_ALLOW_CIDRS", value_delimiter = ',')]
+    pub allow_cidrs: Option<Vec<Cidr>>,
+
+    /// Drop inbound connections from these comma-separated IPs or CIDR ranges
+    #[arg(long, env = "SUTRO_DENY_CIDRS", value_delimiter = ',')]
+    pub deny_cidrs: Option<Vec<Cidr>>,
+
+    /// MaxMind GeoIP2/GeoLite2 country database used by the country policies and metrics
+    #[arg(long, env = "SUTRO_GEOIP_DB")]
+    pub geoip_db: Option<PathBuf>,
+
+    /// Only accept inbound connections from these comma-separated ISO country codes
+    #[arg(long, env = "SUTRO_ALLOW_COUNTRIES", value_delimiter = ',')]
+    pub allow_countries: Option<Vec<String>>,
+
+    /// Drop inbound connections from these comma-separated ISO country codes
+    #[arg(long, env = "SUTRO_DENY_COUNTRIES", value_delimiter = ',')]
+    pub deny_countries: Option<Vec<String>>,
+
+    /// Only grant reservations to peers connecting from these comma-separated ISO country codes
+    #[arg(long, env = "SUTRO_RESERVATION_ALLOW_COUNTRIES", value_delimiter = ',')]
+    pub reservation_allow_countries: Option<Vec<String>>,
+
+    /// Refuse reservations to peers connecting from these comma-separated ISO country codes
+    #[arg(long, env = "SUTRO_RESERVATION_DENY_COUNTRIES", value_delimiter = ',')]
+    pub reservation_deny_countries: Option<Vec<String>>,
+
+    /// Address to serve the `/healthz` and `/readyz` health checks on (disabled if unset)
+    #[arg(long, env = "SUTRO_HEALTH_ADDR")]
+    pub health_addr: Option<SocketAddr>,
+
+    /// Address to serve Prometheus `/metrics` on (disabled if unset)
+    #[arg(long, env = "SUTRO_METRICS_ADDR")]
+    pub metrics_addr: Option<SocketAddr>,
+
+    /// Address to serve unauthenticated `/debug/vars` and CPU profiles under `/debug/pprof` on; keep it on localhost (disabled if unset)
+    #[arg(long, env = "SUTRO_DEBUG_ADDR")]
+    pub debug_addr: Option<SocketAddr>,
+
+    /// Write the state snapshot taken on SIGUSR1 to this file as JSON instead of logging it
+    #[arg(long, env = "SUTRO_DIAGNOSTICS_FILE")]
+    pub diagnostics_file: Option<PathBuf>,
+
+    /// Address to serve the admin status API on [default: 127.0.0.1:4002]
+    #[arg(long, env = "SUTRO_ADMIN_ADDR")]
+    pub admin_addr: Option<SocketAddr>,
+
+    /// Address to serve the gRPC admin API on [default: 127.0.0.1:4003]
+    #[arg(long, env = "SUTRO_ADMIN_GRPC_ADDR")]
+    pub admin_grpc_addr: Option<SocketAddr>,
+
+    /// Bearer token required by the HTTP and gRPC admin APIs, which are disabled if unset
+    #[arg(long, env = "SUTRO_ADMIN_TOKEN", hide_env_values = true)]
+    pub admin_token: Option<String>,
+
+    /// How long to fail readiness after a shutdown signal before stopping listeners [default: 0s]
+    #[arg(long, env = "SUTRO_PRE_STOP_DELAY", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub pre_stop_delay: Option<Duration>,
+
+    /// When draining (SIGUSR2 or the admin API), stop anyway after this long even if circuits are still open [default: 5m]
+    #[arg(long, env = "SUTRO_DRAIN_TIMEOUT", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub drain_timeout: Option<Duration>,
+
+    /// After a shutdown signal and --pre-stop-delay, drain for up to this long: refuse new reservations and circuits, advertise no free capacity, and let open circuits finish [default: 0s]
+    #[arg(long, env = "SUTRO_SHUTDOWN_GRACE", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub shutdown_grace: Option<Duration>,
+
+    /// Round advertised reservation load up to buckets of this many percent (0 advertises exact free slots) [default: 0]
+    #[arg(long, env = "SUTRO_CAPACITY_GRANULARITY")]
+    pub capacity_granularity: Option<u8>,
+
+    /// Gossipsub topic to publish signed reservation load and bandwidth headroom on, for clients picking a relay in a fleet (disabled if unset)
+    #[arg(long, env = "SUTRO_CAPACITY_TOPIC")]
+    pub capacity_topic: Option<String>,
+
+    /// How often to publish on --capacity-topic [default: 30s]
+    #[arg(long, env = "SUTRO_CAPACITY_INTERVAL", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub capacity_interval: Option<Duration>,
+
+    /// Append-only audit log of reservations and circuits (disabled if unset)
+    #[arg(long, env = "SUTRO_AUDIT_LOG")]
+    pub audit_log: Option<PathBuf>,
+
+    /// Rotate the audit log once it reaches this many bytes [default: 104857600]
+    #[arg(long, env = "SUTRO_AUDIT_LOG_MAX_BYTES")]
+    pub audit_log_max_bytes: Option<u64>,
+
+    /// Number of rotated audit logs to keep [default: 10]
+    #[arg(long, env = "SUTRO_AUDIT_LOG_KEEP")]
+    pub audit_log_keep: Option<usize>,
+
+    /// Delete rotated audit logs once their newest entry is older than this (kept whatever their age if unset)
+    #[arg(long, env = "SUTRO_AUDIT_LOG_RETENTION", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub audit_log_retention: Option<Duration>,
+
+    /// Periodically append bytes exchanged with each peer to this file (disabled if unset)
+    #[arg(long, env = "SUTRO_TRAFFIC_DUMP")]
+    pub traffic_dump: Option<PathBuf>,
+
+    /// How often to append to --traffic-dump [default: 1m]
+    #[arg(long, env = "SUTRO_TRAFFIC_DUMP_INTERVAL", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub traffic_dump_interval: Option<Duration>,
+
+    /// Format of --traffic-dump rows [default: json]
+    #[arg(long, env = "SUTRO_TRAFFIC_DUMP_FORMAT")]
+    pub traffic_dump_format: Option<DumpFormat>,
+
+    /// Periodically append a usage record per peer, with its bytes, circuit-hours and reservations, to this file for billing (disabled if unset)
+    #[arg(long, env = "SUTRO_USAGE_EXPORT")]
+    pub usage_export: Option<PathBuf>,
+
+    /// Also POST each batch of usage records to this URL as a JSON array (disabled if unset)
+    #[arg(long, env = "SUTRO_USAGE_EXPORT_WEBHOOK")]
+    pub usage_export_webhook: Option<String>,
+
+    /// The period each usage record covers [default: 1h]
+    #[arg(long, env = "SUTRO_USAGE_EXPORT_INTERVAL", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub usage_export_interval: Option<Duration>,
+
+    /// Format of --usage-export records [default: json]
+    #[arg(long, env = "SUTRO_USAGE_EXPORT_FORMAT")]
+    pub usage_export_format: Option<DumpFormat>,
+
+    /// Also announce temporary (privacy extension) and deprecated IPv6 addresses
+    #[arg(
+        long,
+        env = "SUTRO_ANNOUNCE_TEMPORARY_IPV6",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub announce_temporary_ipv6: Option<bool>,
+
+    /// Announce only these comma-separated multiaddrs instead of the listen, observed and --domain addresses
+    #[arg(long, env = "SUTRO_ANNOUNCE", value_delimiter = ',')]
+    pub announce: Option<Vec<Multiaddr>>,
+
+    /// Also announce /dns4/NAME and /dns6/NAME variants of every listen address, so clients need not know IPs that may change
+    #[arg(long, env = "SUTRO_EXTERNAL_DNS")]
+    pub external_dns: Option<String>,
+
+    /// DNS provider to keep --external-dns pointed at the relay's public IPs through, and to publish --dnsaddr records with (off if unset)
+    #[arg(long, env = "SUTRO_DDNS_PROVIDER")]
+    pub ddns_provider: Option<DdnsProvider>,
+
+    /// Publish the announced addresses as _dnsaddr.NAME TXT records through --ddns-provider, so clients can bootstrap from /dnsaddr/NAME
+    #[arg(long, env = "SUTRO_DNSADDR")]
+    pub dnsaddr: Option<String>,
+
+    /// Route 53 hosted zone ID holding --external-dns, with credentials from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+    #[arg(long, env = "SUTRO_ROUTE53_ZONE_ID")]
+    pub route53_zone_id: Option<String>,
+
+    /// Authoritative server to send RFC 2136 updates to, as HOST[:PORT]
+    #[arg(long, env = "SUTRO_DDNS_SERVER")]
+    pub ddns_server: Option<String>,
+
+    /// Zone to send RFC 2136 updates for [default: the parent of --external-dns or --dnsaddr]
+    #[arg(long, env = "SUTRO_DDNS_ZONE")]
+    pub ddns_zone: Option<String>,
+
+    /// HMAC-SHA256 TSIG key to sign RFC 2136 updates with, as NAME:BASE64SECRET
+    #[arg(long, env = "SUTRO_DDNS_TSIG_KEY", hide_env_values = true)]
+    pub ddns_tsig_key: Option<String>,
+
+    /// Never announce addresses starting with these comma-separated multiaddrs or in these /ip4/NET/ipcidr/LEN ranges
+    #[arg(long, env = "SUTRO_NO_ANNOUNCE", value_delimiter = ',')]
+    pub no_announce: Option<Vec<AddrFilter>>,
+
+    /// Run an AutoNAT v2 server, so NATed peers can learn which of their addresses are reachable
+    #[arg(
+        long,
+        env = "SUTRO_AUTONAT",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub autonat: Option<bool>,
+
+    /// Max AutoNAT dial-backs a single peer gets per --autonat-limit-period [default: 3]
+    #[arg(long, env = "SUTRO_AUTONAT_PEER_LIMIT")]
+    pub autonat_peer_limit: Option<usize>,
+
+    /// Max AutoNAT dial-backs for all peers together per --autonat-limit-period [default: 30]
+    #[arg(long, env = "SUTRO_AUTONAT_GLOBAL_LIMIT")]
+    pub autonat_global_limit: Option<usize>,
+
+    /// Window the AutoNAT dial-back limits count over [default: 1m]
+    #[arg(long, env = "SUTRO_AUTONAT_LIMIT_PERIOD", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub autonat_limit_period: Option<Duration>,
+
+    /// Have AutoNAT servers among the connected peers and --reachability-servers dial the relay back periodically, alerting when it stays unreachable
+    #[arg(
+        long,
+        env = "SUTRO_CHECK_REACHABILITY",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub check_reachability: Option<bool>,
+
+    /// Comma-separated AutoNAT v1 servers to ask, as multiaddrs ending in /p2p/PEERID, such as other relays with --check-reachability
+    #[arg(long, env = "SUTRO_REACHABILITY_SERVERS", value_delimiter = ',')]
+    pub reachability_servers: Option<Vec<Multiaddr>>,
+
+    /// How often to ask for a dial-back once reachability is known [default: 15m]
+    #[arg(long, env = "SUTRO_REACHABILITY_INTERVAL", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub reachability_interval: Option<Duration>,
+
+    /// Alert once AutoNAT servers have found the relay unreachable for this long [default: 30m]
+    #[arg(long, env = "SUTRO_UNREACHABLE_AFTER", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub unreachable_after: Option<Duration>,
+
+    /// Also stop with a non-zero exit status after --unreachable-after, so an orchestrator reschedules the relay
+    #[arg(
+        long,
+        env = "SUTRO_EXIT_WHEN_UNREACHABLE",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub exit_when_unreachable: Option<bool>,
+
+    /// Join the public libp2p DHT and advertise the relay there, so AutoRelay clients find it without its address; --dht alone means server [default: off]
+    #[arg(
+        long,
+        env = "SUTRO_DHT",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "server"
+    )]
+    pub dht: Option<DhtMode>,
+
+    /// Address to serve the delegated routing API (/routing/v1) on, answered from --dht, so browsers can find peers and providers without joining it (disabled if unset)
+    #[arg(long, env = "SUTRO_ROUTING_ADDR")]
+    pub routing_addr: Option<SocketAddr>,
+
+    /// Comma-separated peers to connect to at startup, retrying until reached, and to join the DHT through, as multiaddrs ending in /p2p/PEERID [default: the IPFS bootstrap nodes with --dht outside a --psk network, else none]
+    #[arg(long, env = "SUTRO_BOOTSTRAP", value_delimiter = ',')]
+    pub bootstrap: Option<Vec<Multiaddr>>,
+
+    /// Comma-separated relays to stay connected to, as multiaddrs ending in /p2p/PEERID; their connections are never trimmed and are redialed whenever they drop
+    #[arg(long, env = "SUTRO_PEERING", value_delimiter = ',')]
+    pub peering: Option<Vec<Multiaddr>>,
+
+    /// Consul KV prefix shared with other relays, which then enforce --max-reservations-per-peer and each other's denylists and abuse bans together, on the agent at CONSUL_HTTP_ADDR with CONSUL_HTTP_TOKEN (disabled if unset)
+    #[arg(long, env = "SUTRO_CLUSTER")]
+    pub cluster: Option<String>,
+
+    /// How often to share reservations with the --cluster and learn theirs [default: 10s]
+    #[arg(long, env = "SUTRO_CLUSTER_SYNC_INTERVAL", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub cluster_sync_interval: Option<Duration>,
+
+    /// Serve the rendezvous protocol, so peers can register under namespaces and discover each other
+    #[arg(
+        long,
+        env = "SUTRO_RENDEZVOUS",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub rendezvous: Option<bool>,
+
+    /// Longest a rendezvous registration may last before it must be renewed [default: 72h]
+    #[arg(long, env = "SUTRO_RENDEZVOUS_MAX_TTL", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub rendezvous_max_ttl: Option<Duration>,
+
+    /// Find and be found by peers on the local network over mDNS, for labs, demos and deployments without public infrastructure
+    #[arg(
+        long,
+        env = "SUTRO_MDNS",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub mdns: Option<bool>,
+
+    /// Max inbound connections allowed to be mid-handshake, TLS included, at once; more are rejected [default: 1024]
+    #[arg(long, env = "SUTRO_MAX_PENDING_HANDSHAKES")]
+    pub max_pending_handshakes: Option<u32>,
+
+    /// Max established connections in total (unlimited if unset)
+    #[arg(long, env = "SUTRO_MAX_CONNECTIONS")]
+    pub max_connections: Option<u32>,
+
+    /// Max established inbound connections (unlimited if unset)
+    #[arg(long, env = "SUTRO_MAX_INCOMING_CONNECTIONS")]
+    pub max_incoming_connections: Option<u32>,
+
+    /// Max established connections to a single peer (unlimited if unset)
+    #[arg(long, env = "SUTRO_MAX_CONNECTIONS_PER_PEER")]
+    pub max_connections_per_peer: Option<u32>,
+
+    /// Once more than --conns-high connections are open, close idle ones down to this many [default: --conns-high]
+    #[arg(long, env = "SUTRO_CONNS_LOW")]
+    pub conns_low: Option<usize>,
+
+    /// Start trimming idle connections above this many (disabled if unset)
+    #[arg(long, env = "SUTRO_CONNS_HIGH")]
+    pub conns_high: Option<usize>,
+
+    /// Never trim connections younger than this [default: 1m]
+    #[arg(long, env = "SUTRO_CONN_GRACE", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub conn_grace: Option<Duration>,
+
+    /// New inbound connections a single source IP or subnet may open per minute once its burst is used up; attempts over it are refused before any handshake (unlimited if unset)
+    #[arg(long, env = "SUTRO_CONN_RATE_PER_IP")]
+    pub conn_rate_per_ip: Option<u32>,
+
+    /// New inbound connections a source IP or subnet may open in a burst before --conn-rate-per-ip paces it [default: --conn-rate-per-ip]
+    #[arg(long, env = "SUTRO_CONN_BURST_PER_IP")]
+    pub conn_burst_per_ip: Option<u32>,
+
+    /// IPv4 prefix length whose addresses share one --conn-rate-per-ip budget [default: 32]
+    #[arg(long, env = "SUTRO_CONN_RATE_IPV4_PREFIX")]
+    pub conn_rate_ipv4_prefix: Option<u8>,
+
+    /// IPv6 prefix length whose addresses share one --conn-rate-per-ip budget, as hosts are usually handed a whole /64 [default: 64]
+    #[arg(long, env = "SUTRO_CONN_RATE_IPV6_PREFIX")]
+    pub conn_rate_ipv6_prefix: Option<u8>,
+
+    /// Cap on total throughput across every transport in each direction, e.g. `50Mbps`; traffic over it is slowed down, not dropped (unlimited if unset)
+    #[arg(long, env = "SUTRO_MAX_BANDWIDTH")]
+    pub max_bandwidth: Option<Bandwidth>,
+
+    /// Max concurrent streams on one connection [default: 512]
+    #[arg(long, env = "SUTRO_MAX_STREAMS_PER_CONNECTION")]
+    pub max_streams_per_connection: Option<usize>,
+
+    /// Refuse new connections while the process uses more than this many bytes of memory (unlimited if unset)
+    #[arg(long, env = "SUTRO_MAX_MEMORY_BYTES")]
+    pub max_memory_bytes: Option<usize>,
+
+    /// Advertise at most this many addresses, preferring public addresses and browser transports
+    #[arg(long, env = "SUTRO_MAX_ANNOUNCED_ADDRS")]
+    pub max_announced_addrs: Option<usize>,
+
+    /// How often to cross-check reservation accounting against live connections [default: 5m]
+    #[arg(long, env = "SUTRO_RECONCILE_INTERVAL", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub reconcile_interval: Option<Duration>,
+
+    /// Log filter such as `debug` or `info,libp2p_relay=debug` [default: $RUST_LOG, else info]
+    #[arg(long, env = "SUTRO_LOG_LEVEL")]
+    pub log_level: Option<String>,
+
+    /// Log line format [default: text]
+    #[arg(long, env = "SUTRO_LOG_FORMAT")]
+    pub log_format: Option<LogFormat>,
+
+    /// Where log lines go when there is no --log-file [default: stdout]
+    #[arg(long, env = "SUTRO_LOG_TARGET")]
+    pub log_target: Option<LogTarget>,
+
+    /// Write log lines to this file instead of stdout, rotating it as it grows (disabled if unset)
+    #[arg(long, env = "SUTRO_LOG_FILE")]
+    pub log_file: Option<PathBuf>,
+
+    /// Rotate the log file once it reaches this many bytes [default: 104857600]
+    #[arg(long, env = "SUTRO_LOG_FILE_MAX_BYTES")]
+    pub log_file_max_bytes: Option<u64>,
+
+    /// Also rotate the log file once it has been written to for this long (rotated by size only if unset)
+    #[arg(long, env = "SUTRO_LOG_FILE_MAX_AGE", value_parser = humantime::parse_duration)]
+    #[serde(default, with = "humantime_serde")]
+    pub log_file_max_age: Option<Duration>,
+
+    /// Number of rotated log files to keep [default: 10]
+    #[arg(long, env = "SUTRO_LOG_FILE_KEEP")]
+    pub log_file_keep: Option<usize>,
+
+    /// Gzip rotated log files [default: true]
+    #[arg(
+        long,
+        env = "SUTRO_LOG_FILE_COMPRESS",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub log_file_compress: Option<bool>,
+
+    /// What to print on stdout once listening [default: text]
+    #[arg(long, env = "SUTRO_OUTPUT")]
+    pub output: Option<Output>,
+
+    /// Print a terminal QR code of the relay's primary address on stderr once listening
+    #[arg(
+        long,
+        env = "SUTRO_QR",
+        num_args = 0..=1,
+        require_equals = true,
+        default_missing_value = "true"
+    )]
+    pub qr: Option<bool>,
+
+    /// OTLP/gRPC collector to export trace spans to (disabled if unset)
+    #[arg(long, env = "SUTRO_OTEL_ENDPOINT")]
+    pub otel_endpoint: Option<String>,
+
+    /// Extra trace resource attributes as `key=value,...`, e.g. `service.instance.id=relay-1,cloud.region=eu-west-1`
+    #[arg(long, env = "SUTRO_OTEL_RESOURCE_ATTRIBUTES")]
+    pub otel_resource_attributes: Option<String>,
+}
+
+impl Settings {
+    /// Fill in anything unset here from `fallback`.
+    fn or(self, fallback: Settings) -> Settings {
+        Settings {
+            port: self.port.or(fallback.port),
+            ws_port: self.ws_port.or(fallback.ws_port),
+            quic_port: self.quic_port.or(fallback.quic_port),
+            no_ws: self.no_ws.or(fallback.no_ws),
+            no_quic: self.no_quic.or(fallback.no_quic),
+            tcp_keepalive: self.tcp_keepalive.or(fallback.tcp_keepalive),
+            tcp_nodelay: self.tcp_nodelay.or(fallback.tcp_nodelay),
+            security: self.security.or(fallback.security),
+            quic_idle_timeout: self.quic_idle_timeout.or(fallback.quic_idle_timeout),
+            quic_keep_alive: self.quic_keep_alive.or(fallback.quic_keep_alive),
+            quic_max_streams: self.quic_max_streams.or(fallback.quic_max_streams),
+            quic_receive_buffer: self.quic_receive_buffer.or(fallback.quic_receive_buffer),
+            listen_ip: self.listen_ip.or(fallback.listen_ip),
+            listen: self.listen.or(fallback.listen),
+            wss_port: self.wss_port.or(fallback.wss_port),
+            ws_path: self.ws_path.or(fallback.ws_path),
+            psk: self.psk.or(fallback.psk),
+            onion_address: self.onion_address.or(fallback.onion_address),
+            onion_port: self.onion_port.or(fallback.onion_port),
+            unix_socket: self.unix_socket.or(fallback.unix_socket),
+            forwarded_headers: self.forwarded_headers.or(fallback.forwarded_headers),
+            proxy_protocol: self.proxy_protocol.or(fallback.proxy_protocol),
+            trusted_proxies: self.trusted_proxies.or(fallback.trusted_proxies),
+            tls_cert: self.tls_cert.or(fallback.tls_cert),
+            tls_key: self.tls_key.or(fallback.tls_key),
+            domain: self.domain.or(fallback.domain),
+            cloudflare_api_token: self.cloudflare_api_token.or(fallback.cloudflare_api_token),
+            acme_directory: self.acme_directory.or(fallback.acme_directory),
+            acme_email: self.acme_email.or(fallback.acme_email),
+            acme_cache: self.acme_cache.or(fallback.acme_cache),
+            acme_storage: self.acme_storage.or(fallback.acme_storage),
+            alert_webhook: self.alert_webhook.or(fallback.alert_webhook),
+            event_webhook: self.event_webhook.or(fallback.event_webhook),
+            event_webhook_events: self.event_webhook_events.or(fallback.event_webhook_events),
+            acme_consul_prefix: self.acme_consul_prefix.or(fallback.acme_consul_prefix),
+            identity: self.identity.or(fallback.identity),
+            identity_passphrase: self.identity_passphrase.or(fallback.identity_passphrase),
+            identity_env: self.identity_env.or(fallback.identity_env),
+            identity_stdin: self.identity_stdin.or(fallback.identity_stdin),
+            identity_vault: self.identity_vault.or(fallback.identity_vault),
+            key_type: self.key_type.or(fallback.key_type),
+            key_bits: self.key_bits.or(fallback.key_bits),
+            previous_identity: self.previous_identity.or(fallback.previous_identity),
+            previous_identity_port: self.previous_identity_port.or(fallback.previous_identity_port),
+            previous_identity_until: self
+                .previous_identity_until
+                .or(fallback.previous_identity_until),
+            pid_file: self.pid_file.or(fallback.pid_file),
+            daemon: self.daemon.or(fallback.daemon),
+            max_reservations: self.max_reservations.or(fallback.max_reservations),
+            max_reservations_per_peer: self
+                .max_reservations_per_peer
+                .or(fallback.max_reservations_per_peer),
+            max_circuits: self.max_circuits.or(fallback.max_circuits),
+            max_circuits_per_peer: self.max_circuits_per_peer.or(fallback.max_circuits_per_peer),
+            max_circuits_per_ip: self.max_circuits_per_ip.or(fallback.max_circuits_per_ip),
+            max_circuit_duration: self.max_circuit_duration.or(fallback.max_circuit_duration),
+            max_circuit_bytes: self.max_circuit_bytes.or(fallback.max_circuit_bytes),
+            reservation_rate_per_peer: self
+                .reservation_rate_per_peer
+                .or(fallback.reservation_rate_per_peer),
+            reservation_rate_peer_window: self
+                .reservation_rate_peer_window
+                .or(fallback.reservation_rate_peer_window),
+            reservation_rate_per_ip: self
+                .reservation_rate_per_ip
+                .or(fallback.reservation_rate_per_ip),
+            reservation_rate_ip_window: self
+                .reservation_rate_ip_window
+                .or(fallback.reservation_rate_ip_window),
+            abuse_bans: self.abuse_bans.or(fallback.abuse_bans),
+            ban_reconnects: self.ban_reconnects.or(fallback.ban_reconnects),
+            ban_failed_circuits: self.ban_failed_circuits.or(fallback.ban_failed_circuits),
+            ban_data_limit_hits: self.ban_data_limit_hits.or(fallback.ban_data_limit_hits),
+            ban_window: self.ban_window.or(fallback.ban_window),
+            ban_duration: self.ban_duration.or(fallback.ban_duration),
+            ban_max_duration: self.ban_max_duration.or(fallback.ban_max_duration),
+            reputation_file: self.reputation_file.or(fallback.reputation_file),
+            reputation_reserved: self.reputation_reserved.or(fallback.reputation_reserved),
+            reservation_token_secret: self
+                .reservation_token_secret
+                .or(fallback.reservation_token_secret),
+            api_keys: self.api_keys.or(fallback.api_keys),
+            api_key_usage: self.api_key_usage.or(fallback.api_key_usage),
+            reservation_webhook: self.reservation_webhook.or(fallback.reservation_webhook),
+            reservation_webhook_timeout: self
+                .reservation_webhook_timeout
+                .or(fallback.reservation_webhook_timeout),
+            reservation_webhook_cache: self
+                .reservation_webhook_cache
+                .or(fallback.reservation_webhook_cache),
+            reservation_webhook_fail_open: self
+                .reservation_webhook_fail_open
+                .or(fallback.reservation_webhook_fail_open),
+            reservation_allowlist: self.reservation_allowlist.or(fallback.reservation_allowlist),
+            reservation_denylist: self.reservation_denylist.or(fallback.reservation_denylist),
+            trusted_peers: self.trusted_peers.or(fallback.trusted_peers),
+            tier_reserved_trusted: self.tier_reserved_trusted.or(fallback.tier_reserved_trusted),
+            tier_reserved_default: self.tier_reserved_default.or(fallback.tier_reserved_default),
+            tier_bandwidth_default: self
+                .tier_bandwidth_default
+                .or(fallback.tier_bandwidth_default),
+            tier_bandwidth_anonymous: self
+                .tier_bandwidth_anonymous
+                .or(fallback.tier_bandwidth_anonymous),
+            allow_cidrs: self.allow_cidrs.or(fallback.allow_cidrs),
+            deny_cidrs: self.deny_cidrs.or(fallback.deny_cidrs),
+            geoip_db: self.geoip_db.or(fallback.geoip_db),
+            allow_countries: self.allow_countries.or(fallback.allow_countries),
+            deny_countries: self.deny_countries.or(fallback.deny_countries),
+            reservation_allow_countries: self
+                .reservation_allow_countries
+                .or(fallback.reservation_allow_countries),
+            reservation_deny_countries: self
+                .reservation_deny_countries
+                .or(fallback.reservation_deny_countries),
+            health_addr: self.health_addr.or(fallback.health_addr),
+            metrics_addr: self.metrics_addr.or(fallback.metrics_addr),
+            debug_addr: self.debug_addr.or(fallback.debug_addr),
+            diagnostics_file: self.diagnostics_file.or(fallback.diagnostics_file),
+            admin_addr: self.admin_addr.or(fallback.admin_addr),
+            admin_grpc_addr: self.admin_grpc_addr.or(fallback.admin_grpc_addr),
+            admin_token: self.admin_token.or(fallback.admin_token),
+            pre_stop_delay: self.pre_stop_delay.or(fallback.pre_stop_delay),
+            drain_timeout: self.drain_timeout.or(fallback.drain_timeout),
+            shutdown_grace: self.shutdown_grace.or(fallback.shutdown_grace),
+            capacity_granularity: self.capacity_granularity.or(fallback.capacity_granularity),
+            capacity_topic: self.capacity_topic.or(fallback.capacity_topic),
+            capacity_interval: self.capacity_interval.or(fallback.capacity_interval),
+            audit_log: self.audit_log.or(fallback.audit_log),
+            audit_log_max_bytes: self.audit_log_max_bytes.or(fallback.audit_log_max_bytes),
+            audit_log_keep: self.audit_log_keep.or(fallback.audit_log_keep),
+            audit_log_retention: self.audit_log_retention.or(fallback.audit_log_retention),
+            traffic_dump: self.traffic_dump.or(fallback.traffic_dump),
+            traffic_dump_interval: self
+                .traffic_dump_interval
+                .or(fallback.traffic_dump_interval),
+            traffic_dump_format: self.traffic_dump_format.or(fallback.traffic_dump_format),
+            usage_export: self.usage_export.or(fallback.usage_export),
+            usage_export_webhook: self.usage_export_webhook.or(fallback.usage_export_webhook),
+            usage_export_interval: self
+                .usage_export_interval
+                .or(fallback.usage_export_interval),
+            usage_export_format: self.usage_export_format.or(fallback.usage_export_format),
+            announce_temporary_ipv6: self
+                .announce_temporary_ipv6
+                .or(fallback.announce_temporary_ipv6),
+            announce: self.announce.or(fallback.announce),
+            no_announce: self.no_announce.or(fallback.no_announce),
+            autonat: self.autonat.or(fallback.autonat),
+            autonat_peer_limit: self.autonat_peer_limit.or(fallback.autonat_peer_limit),
+            autonat_global_limit: self.autonat_global_limit.or(fallback.autonat_global_limit),
+            autonat_limit_period: self.autonat_limit_period.or(fallback.autonat_limit_period),
+            check_reachability: self.check_reachability.or(fallback.check_reachability),
+            reachability_servers: self.reachability_servers.or(fallback.reachability_servers),
+            reachability_interval: self.reachability_interval.or(fallback.reachability_interval),
+            unreachable_after: self.unreachable_after.or(fallback.unreachable_after),
+            exit_when_unreachable: self.exit_when_unreachable.or(fallback.exit_when_unreachable),
+            dht: self.dht.or(fallback.dht),
+            routing_addr: self.routing_addr.or(fallback.routing_addr),
+            bootstrap: self.bootstrap.or(fallback.bootstrap),
+            peering: self.peering.or(fallback.peering),
+            cluster: self.cluster.or(fallback.cluster),
+            cluster_sync_interval: self.cluster_sync_interval.or(fallback.cluster_sync_interval),
+            rendezvous: self.rendezvous.or(fallback.rendezvous),
+            rendezvous_max_ttl: self.rendezvous_max_ttl.or(fallback.rendezvous_max_ttl),
+            mdns: self.mdns.or(fallback.mdns),
+            external_dns: self.external_dns.or(fallback.external_dns),
+            ddns_provider: self.ddns_provider.or(fallback.ddns_provider),
+            dnsaddr: self.dnsaddr.or(fallback.dnsaddr),
+            route53_zone_id: self.route53_zone_id.or(fallback.route53_zone_id),
+            ddns_server: self.ddns_server.or(fallback.ddns_server),
+            ddns_zone: self.ddns_zone.or(fallback.ddns_zone),
+            ddns_tsig_key: self.ddns_tsig_key.or(fallback.ddns_tsig_key),
+            max_pending_handshakes: self
+                .max_pending_handshakes
+                .or(fallback.max_pending_handshakes),
+            max_connections: self.max_connections.or(fallback.max_connections),
+            max_incoming_connections: self
+                .max_incoming_connections
+                .or(fallback.max_incoming_connections),
+            max_connections_per_peer: self
+                .max_connections_per_peer
+                .or(fallback.max_connections_per_peer),
+            conns_low: self.conns_low.or(fallback.conns_low),
+            conns_high: self.conns_high.or(fallback.conns_high),
+            conn_grace: self.conn_grace.or(fallback.conn_grace),
+            conn_rate_per_ip: self.conn_rate_per_ip.or(fallback.conn_rate_per_ip),
+            conn_burst_per_ip: self.conn_burst_per_ip.or(fallback.conn_burst_per_ip),
+            conn_rate_ipv4_prefix: self.conn_rate_ipv4_prefix.or(fallback.conn_rate_ipv4_prefix),
+            conn_rate_ipv6_prefix: self.conn_rate_ipv6_prefix.or(fallback.conn_rate_ipv6_prefix),
+            max_bandwidth: self.max_bandwidth.or(fallback.max_bandwidth),
+            max_streams_per_connection: self
+                .max_streams_per_connection
+                .or(fallback.max_streams_per_connection),
+            max_memory_bytes: self.max_memory_bytes.or(fallback.max_memory_bytes),
+            max_announced_addrs: self.max_announced_addrs.or(fallback.max_announced_addrs),
+            reconcile_interval: self.reconcile_interval.or(fallback.reconcile_interval),
+            log_level: self.log_level.or(fallback.log_level),
+            log_format: self.log_format.or(fallback.log_format),
+            log_target: self.log_target.or(fallback.log_target),
+            log_file: self.log_file.or(fallback.log_file),
+            log_file_max_bytes: self.log_file_max_bytes.or(fallback.log_file_max_bytes),
+            log_file_max_age: self.log_file_max_age.or(fallback.log_file_max_age),
+            log_file_keep: self.log_file_keep.or(fallback.log_file_keep),
+            log_file_compress: self.log_file_compress.or(fallback.log_file_compress),
+            output: self.output.or(fallback.output),
+            qr: self.qr.or(fallback.qr),
+            otel_endpoint: self.otel_endpoint.or(fallback.otel_endpoint),
+            otel_resource_attributes: self
+                .otel_resource_attributes
+                .or(fallback.otel_resource_attributes),
+        }
+    }
+}
+
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq, ValueEnum, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum LogFormat {
+    /// Human-readable lines
+    #[default]
+    Text,
+    /// One JSON object per line, with fields such as `peer` and `remote_addr`
+    Json,
+}
+
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq, ValueEnum, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum LogTarget {
+    /// Standard output, or standard error under `--output json`
+    #[default]
+    Stdout,
+    /// The local syslog daemon, under the daemon facility, with ERROR, WARN,
+    /// INFO and DEBUG as the err, warning, info and debug severities
+    Syslog,
+    /// The systemd journal, with the same priorities as syslog and each
+    /// event's fields as journal fields
+    Journald,
+}
+
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq, ValueEnum, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Output {
+    /// Nothing beyond the log lines
+    #[default]
+    Text,
+    /// A JSON document with the PeerID and addresses, printed again whenever
+    /// they or the TLS certificate change, with log lines moved to stderr
+    Json,
+}
+
+/// Relay events --event-webhook can be notified of.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+#[value(rename_all = "snake_case")]
+pub enum NotifyEvent {
+    /// A peer took a new reservation
+    ReservationCreated,
+    /// A reservation ran out without being renewed
+    ReservationExpired,
+    /// A circuit was cut off by --max-circuit-bytes
+    CircuitLimitExceeded,
+    /// A peer was banned for abuse
+    PeerBanned,
+    /// A renewed TLS certificate was loaded
+    CertificateRenewed,
+    /// Peers started seeing the relay at a new public IP
+    AddressChanged,
+}
+
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq, ValueEnum, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DumpFormat {
+    /// One JSON object per line
+    #[default]
+    Json,
+    /// Comma-separated values with a header row
+    Csv,
+}
+
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq, ValueEnum, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum KeyType {
+    #[default]
+    Ed25519,
+    /// ECDSA on the P-256 curve
+    Ecdsa,
+    Secp256k1,
+    /// RSA of --key-bits, stored as PKCS#8 since libp2p cannot encode it otherwise
+    Rsa,
+}
+
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq, ValueEnum, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum AcmeStorage {
+    /// Only the local --acme-cache
+    #[default]
+    File,
+    /// Consul's KV store, mirrored into --acme-cache
+    Consul,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DhtMode {
+    Off,
+    /// Look up and advertise, but leave answering queries to others
+    Client,
+    /// Also store records and answer queries for the rest of the DHT
+    Server,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DdnsProvider {
+    /// The zone's records through --cloudflare-api-token
+    Cloudflare,
+    /// A Route 53 hosted zone
+    Route53,
+    /// An authoritative server accepting RFC 2136 updates, such as BIND
+    Rfc2136,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum SecurityProtocol {
+    /// The Noise XX handshake every libp2p implementation supports
+    Noise,
+    /// TLS 1.3 with the libp2p certificate extension
+    Tls,
+}
+
+/// A credential that is kept out of logs.
+#[derive(Clone, PartialEq, Eq)]
+pub struct Secret(pub String);
+
+impl fmt::Debug for Secret {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str("<redacted>")
+    }
+}
+
+/// Fully resolved relay configuration.
+#[derive(Debug, Clone)]
+pub struct Config {
+    pub port: u16,
+    pub ws_port: u16,
+    pub quic_port: u16,
+    pub no_ws: bool,
+    pub no_quic: bool,
+    pub tcp_keepalive: Option<Duration>,
+    pub tcp_nodelay: bool,
+    pub security: Vec<SecurityProtocol>,
+    pub quic_idle_timeout: Duration,
+    pub quic_keep_alive: Duration,
+    pub quic_max_streams: usize,
+    pub quic_receive_buffer: u64,
+    pub listen_ips: Vec<IpAddr>,
+    pub listen: Vec<Multiaddr>,
+    pub wss_port: u16,
+    pub ws_path: String,
+    pub psk: Option<PathBuf>,
+    pub onion_address: Option<String>,
+    pub onion_port: u16,
+    pub unix_socket: Option<PathBuf>,
+    pub forwarded_headers: bool,
+    pub proxy_protocol: bool,
+    pub trusted_proxies: Vec<Cidr>,
+    pub tls_cert: Option<PathBuf>,
+    pub tls_key: Option<PathBuf>,
+    pub domain: Option<String>,
+    pub cloudflare_api_token: Option<Secret>,
+    pub acme_directory: String,
+    pub acme_email: Option<String>,
+    pub acme_cache: PathBuf,
+    pub acme_storage: AcmeStorage,
+    pub alert_webhook: Option<Secret>,
+    pub event_webhook: Option<Secret>,
+    pub event_webhook_events: Vec<NotifyEvent>,
+    pub acme_consul_prefix: String,
+    pub identity: PathBuf,
+    pub identity_passphrase: Option<Secret>,
+    pub identity_env: Option<String>,
+    pub identity_stdin: bool,
+    pub identity_vault: Option<String>,
+    pub key_type: KeyType,
+    pub key_bits: usize,
+    pub previous_identity: Option<PathBuf>,
+    pub previous_identity_port: Option<u16>,
+    pub previous_identity_until: Option<SystemTime>,
+    pub pid_file: Option<PathBuf>,
+    pub daemon: bool,
+    pub max_reservations: usize,
+    pub max_reservations_per_peer: usize,
+    pub max_circuits: usize,
+    pub max_circuits_per_peer: usize,
+    pub max_circuits_per_ip: Option<usize>,
+    pub max_circuit_duration: Duration,
+    pub max_circuit_bytes: u64,
+    pub reservation_rate_per_peer: u32,
+    pub reservation_rate_peer_window: Duration,
+    pub reservation_rate_per_ip: u32,
+    pub reservation_rate_ip_window: Duration,
+    pub abuse_bans: bool,
+    pub ban_reconnects: u32,
+    pub ban_failed_circuits: u32,
+    pub ban_data_limit_hits: u32,
+    pub ban_window: Duration,
+    pub ban_duration: Duration,
+    pub ban_max_duration: Duration,
+    pub reputation_file: Option<PathBuf>,
+    pub reputation_reserved: Option<usize>,
+    pub reservation_token_secret: Option<Secret>,
+    pub api_keys: Option<PathBuf>,
+    pub api_key_usage: Option<PathBuf>,
+    pub reservation_webhook: Option<Secret>,
+    pub reservation_webhook_timeout: Duration,
+    pub reservation_webhook_cache: Duration,
+    pub reservation_webhook_fail_open: bool,
+    pub reservation_allowlist: Option<PathBuf>,
+    pub reservation_denylist: Option<PathBuf>,
+    pub trusted_peers: Option<PathBuf>,
+    pub tier_reserved_trusted: usize,
+    pub tier_reserved_default: usize,
+    pub tier_bandwidth_default: Option<Bandwidth>,
+    pub tier_bandwidth_anonymous: Option<Bandwidth>,
+    pub allow_cidrs: Vec<Cidr>,
+    pub deny_cidrs: Vec<Cidr>,
+    pub geoip_db: Option<PathBuf>,
+    pub connection_countries: CountryPolicy,
+    pub reservation_countries: CountryPolicy,
+    pub health_addr: Option<SocketAddr>,
+    pub metrics_addr: Option<SocketAddr>,
+    pub debug_addr: Option<SocketAddr>,
+    pub diagnostics_file: Option<PathBuf>,
+    pub admin_addr: SocketAddr,
+    pub admin_grpc_addr: SocketAddr,
+    pub admin_token: Option<Secret>,
+    pub pre_stop_delay: Duration,
+    pub drain_timeout: Duration,
+    pub shutdown_grace: Duration,
+    pub capacity_granularity: u8,
+    pub capacity_topic: Option<String>,
+    pub capacity_interval: Duration,
+    pub audit_log: Option<PathBuf>,
+    pub audit_log_max_bytes: u64,
+    pub audit_log_keep: usize,
+    pub audit_log_retention: Option<Duration>,
+    pub traffic_dump: Option<PathBuf>,
+    pub traffic_dump_interval: Duration,
+    pub traffic_dump_format: DumpFormat,
+    pub usage_export: Option<PathBuf>,
+    pub usage_export_webhook: Option<Secret>,
+    pub usage_export_interval: Duration,
+    pub usage_export_format: DumpFormat,
+    pub announce_temporary_ipv6: bool,
+    pub announce: Vec<Multiaddr>,
+    pub no_announce: Vec<AddrFilter>,
+    pub autonat: bool,
+    pub autonat_peer_limit: usize,
+    pub autonat_global_limit: usize,
+    pub autonat_limit_period: Duration,
+    pub check_reachability: bool,
+    pub reachability_servers: Vec<Multiaddr>,
+    pub reachability_interval: Duration,
+    pub unreachable_after: Duration,
+    pub exit_when_unreachable: bool,
+    pub dht: DhtMode,
+    pub routing_addr: Option<SocketAddr>,
+    pub bootstrap: Vec<Multiaddr>,
+    pub peering: Vec<Multiaddr>,
+    pub cluster: Option<String>,
+    pub cluster_sync_interval: Duration,
+    pub rendezvous: bool,
+    pub rendezvous_max_ttl: Duration,
+    pub mdns: bool,
+    pub external_dns: Option<String>,
+    pub ddns_provider: Option<DdnsProvider>,
+    pub dnsaddr: Option<String>,
+    pub route53_zone_id: Option<String>,
+    pub ddns_server: Option<String>,
+    pub ddns_zone: Option<String>,
+    pub ddns_tsig_key: Option<Secret>,
+    pub max_pending_handshakes: u32,
+    pub max_connections: Option<u32>,
+    pub max_incoming_connections: Option<u32>,
+    pub max_connections_per_peer: Option<u32>,
+    pub conns_low: Option<usize>,
+    pub conns_high: Option<usize>,
+    pub conn_grace: Duration,
+    pub conn_rate_per_ip: Option<u32>,
+    pub conn_burst_per_ip: Option<u32>,
+    pub conn_rate_ipv4_prefix: u8,
+    pub conn_rate_ipv6_prefix: u8,
+    pub max_bandwidth: Option<Bandwidth>,
+    pub max_streams_per_connection: usize,
+    pub max_memory_bytes: Option<usize>,
+    pub max_announced_addrs: Option<usize>,
+    pub reconcile_interval: Duration,
+    pub log_level: Option<String>,
+    pub log_format: LogFormat,
+    pub log_target: LogTarget,
+    pub log_file: Option<PathBuf>,
+    pub log_file_max_bytes: u64,
+    pub log_file_max_age: Option<Duration>,
+    pub log_file_keep: usize,
+    pub log_file_compress: bool,
+    pub output: Output,
+    pub qr: bool,
+    pub otel_endpoint: Option<String>,
+    pub otel_resource_attributes: Vec<(String, String)>,
+}
+
+impl Config {
+    /// Combine flags and environment variables (already merged by clap, flags
+    /// first) with an optional config file, which has the lowest precedence.
+    pub fn load(file: Option<&Path>, flags: Settings) -> Result<Self, ConfigError> {
+        let settings = match file {
+            Some(path) => flags.or(read(path)?),
+            None => flags,
+        };
+        Self::resolve(settings)
+    }
+
+    fn resolve(s: Settings) -> Result<Self, ConfigError> {
+        let port = s.port.unwrap_or(4001);
+        let config = Config {
+            port,
+            ws_port: s.ws_port.unwrap_or(port),
+            quic_port: s.quic_port.unwrap_or(port),
+            no_ws: s.no_ws.unwrap_or(false),
+            no_quic: s.no_quic.unwrap_or(false),
+            tcp_keepalive: s.tcp_keepalive,
+            tcp_nodelay: s.tcp_nodelay.unwrap_or(true),
+            security: s.security.unwrap_or_else(|| vec![SecurityProtocol::Noise]),
+            quic_idle_timeout: s.quic_idle_timeout.unwrap_or(Duration::from_secs(10)),
+            quic_keep_alive: s.quic_keep_alive.unwrap_or(Duration::from_secs(5)),
+            quic_max_streams: s
+                .quic_max_streams
+                .or(s.max_streams_per_connection)
+                .unwrap_or(512),
+            quic_receive_buffer: s.quic_receive_buffer.unwrap_or(7_500_000),
+            listen_ips: s.listen_ip.unwrap_or_else(|| {
+                vec![
+                    IpAddr::V4(Ipv4Addr::UNSPECIFIED),
+                    IpAddr::V6(Ipv6Addr::UNSPECIFIED),
+                ]
+            }),
+            listen: s.listen.unwrap_or_default(),
+            wss_port: s.wss_port.unwrap_or(443),
+            ws_path: s.ws_path.unwrap_or_else(|| "/".into()),
+            psk: s.psk.clone(),
+            onion_address: s.onion_address,
+            onion_port: s.onion_port.unwrap_or(4005),
+            unix_socket: s.unix_socket,
+            forwarded_headers: s.forwarded_headers.unwrap_or(false),
+            proxy_protocol: s.proxy_protocol.unwrap_or(false),
+            trusted_proxies: s.trusted_proxies.unwrap_or_default(),
+            tls_cert: s.tls_cert,
+            tls_key: s.tls_key,
+            domain: s.domain,
+            cloudflare_api_token: s.cloudflare_api_token.map(Secret),
+            acme_directory: s
+                .acme_directory
+                .unwrap_or_else(|| "https://acme-v02.api.letsencrypt.org/directory".into()),
+            acme_email: s.acme_email,
+            acme_cache: s.acme_cache.unwrap_or_else(|| PathBuf::from("acme")),
+            acme_storage: s.acme_storage.unwrap_or_default(),
+            alert_webhook: s.alert_webhook.map(Secret),
+            event_webhook: s.event_webhook.map(Secret),
+            event_webhook_events: s
+                .event_webhook_events
+                .unwrap_or_else(|| NotifyEvent::value_variants().to_vec()),
+            acme_consul_prefix: s.acme_consul_prefix.unwrap_or_else(|| "sutro/acme".into()),
+            identity: s.identity.unwrap_or_else(|| PathBuf::from("identity.key")),
+            identity_passphrase: s.identity_passphrase.map(Secret),
+            identity_env: s.identity_env,
+            identity_stdin: s.identity_stdin.unwrap_or(false),
+            identity_vault: s.identity_vault,
+            key_type: s.key_type.unwrap_or_default(),
+            key_bits: s.key_bits.unwrap_or(2048),
+            previous_identity: s.previous_identity,
+            previous_identity_port: s.previous_identity_port,
+            previous_identity_until: s.previous_identity_until,
+            pid_file: s.pid_file,
+            daemon: s.daemon.unwrap_or(false),
+            max_reservations: s.max_reservations.unwrap_or(256),
+            max_reservations_per_peer: s.max_reservations_per_peer.unwrap_or(4),
+            max_circuits: s.max_circuits.unwrap_or(16),
+            max_circuits_per_peer: s.max_circuits_per_peer.unwrap_or(4),
+            max_circuits_per_ip: s.max_circuits_per_ip,
+            max_circuit_duration: s
+                .max_circuit_duration
+                .unwrap_or(Duration::from_secs(2 * 60)),
+            max_circuit_bytes: s.max_circuit_bytes.unwrap_or(1 << 17),
+            reservation_rate_per_peer: s.reservation_rate_per_peer.unwrap_or(30),
+            reservation_rate_peer_window: s
+                .reservation_rate_peer_window
+                .unwrap_or(Duration::from_secs(2 * 60)),
+            reservation_rate_per_ip: s.reservation_rate_per_ip.unwrap_or(60),
+            reservation_rate_ip_window: s
+                .reservation_rate_ip_window
+                .unwrap_or(Duration::from_secs(60)),
+            abuse_bans: s.abuse_bans.unwrap_or(false),
+            ban_reconnects: s.ban_reconnects.unwrap_or(30),
+            ban_failed_circuits: s.ban_failed_circuits.unwrap_or(20),
+            ban_data_limit_hits: s.ban_data_limit_hits.unwrap_or(10),
+            ban_window: s.ban_window.unwrap_or(Duration::from_secs(60)),
+            ban_duration: s.ban_duration.unwrap_or(Duration::from_secs(5 * 60)),
+            ban_max_duration: s.ban_max_duration.unwrap_or(Duration::from_secs(24 * 60 * 60)),
+            reputation_file: s.reputation_file,
+            reputation_reserved: s.reputation_reserved,
+            reservation_token_secret: s.reservation_token_secret.map(Secret),
+            api_keys: s.api_keys,
+            api_key_usage: s.api_key_usage,
+            reservation_webhook: s.reservation_webhook.map(Secret),
+            reservation_webhook_timeout: s
+                .reservation_webhook_timeout
+                .unwrap_or(Duration::from_secs(2)),
+            reservation_webhook_cache: s
+                .reservation_webhook_cache
+                .unwrap_or(Duration::from_secs(5 * 60)),
+            reservation_webhook_fail_open: s.reservation_webhook_fail_open.unwrap_or(false),
+            reservation_allowlist: s.reservation_allowlist,
+            reservation_denylist: s.reservation_denylist,
+            trusted_peers: s.trusted_peers,
+            tier_reserved_trusted: s.tier_reserved_trusted.unwrap_or(0),
+            tier_reserved_default: s.tier_reserved_default.unwrap_or(0),
+            tier_bandwidth_default: s.tier_bandwidth_default,
+            tier_bandwidth_anonymous: s.tier_bandwidth_anonymous,
+            allow_cidrs: s.allow_cidrs.unwrap_or_default(),
+            deny_cidrs: s.deny_cidrs.unwrap_or_default(),
+            geoip_db: s.geoip_db,
+            connection_countries: CountryPolicy {
+                allow: countries(s.allow_countries)?,
+                deny: countries(s.deny_countries)?,
+            },
+            reservation_countries: CountryPolicy {
+                allow: countries(s.reservation_allow_countries)?,
+                deny: countries(s.reservation_deny_countries)?,
+            },
+            health_addr: s.health_addr,
+            metrics_addr: s.metrics_addr,
+            debug_addr: s.debug_addr,
+            diagnostics_file: s.diagnostics_file,
+            admin_addr: s
+                .admin_addr
+                .unwrap_or_else(|| SocketAddr::from(([127, 0, 0, 1], 4002))),
+            admin_grpc_addr: s
+                .admin_grpc_addr
+                .unwrap_or_else(|| SocketAddr::from(([127, 0, 0, 1], 4003))),
+            admin_token: s.admin_token.map(Secret),
+            pre_stop_delay: s.pre_stop_delay.unwrap_or_default(),
+            drain_timeout: s.drain_timeout.unwrap_or(Duration::from_secs(300)),
+            shutdown_grace: s.shutdown_grace.unwrap_or_default(),
+            capacity_granularity: s.capacity_granularity.unwrap_or(0),
+            capacity_topic: s.capacity_topic,
+            capacity_interval: s.capacity_interval.unwrap_or(Duration::from_secs(30)),
+            audit_log: s.audit_log,
+            audit_log_max_bytes: s.audit_log_max_bytes.unwrap_or(100 * 1024 * 1024),
+            audit_log_keep: s.audit_log_keep.unwrap_or(10),
+            audit_log_retention: s.audit_log_retention,
+            traffic_dump: s.traffic_dump,
+            traffic_dump_interval: s.traffic_dump_interval.unwrap_or(Duration::from_secs(60)),
+            traffic_dump_format: s.traffic_dump_format.unwrap_or_default(),
+            usage_export: s.usage_export,
+            usage_export_webhook: s.usage_export_webhook.map(Secret),
+            usage_export_interval: s
+                .usage_export_interval
+                .unwrap_or(Duration::from_secs(60 * 60)),
+            usage_export_format: s.usage_export_format.unwrap_or_default(),
+            announce_temporary_ipv6: s.announce_temporary_ipv6.unwrap_or(false),
+            announce: s.announce.unwrap_or_default(),
+            no_announce: s.no_announce.unwrap_or_default(),
+            autonat: s.autonat.unwrap_or(false),
+            autonat_peer_limit: s.autonat_peer_limit.unwrap_or(3),
+            autonat_global_limit: s.autonat_global_limit.unwrap_or(30),
+            autonat_limit_period: s.autonat_limit_period.unwrap_or(Duration::from_secs(60)),
+            check_reachability: s.check_reachability.unwrap_or(false),
+            reachability_servers: s.reachability_servers.unwrap_or_default(),
+            reachability_interval: s.reachability_interval.unwrap_or(Duration::from_secs(15 * 60)),
+            unreachable_after: s.unreachable_after.unwrap_or(Duration::from_secs(30 * 60)),
+            exit_when_unreachable: s.exit_when_unreachable.unwrap_or(false),
+            dht: s.dht.unwrap_or(DhtMode::Off),
+            routing_addr: s.routing_addr,
+            bootstrap: s.bootstrap.unwrap_or_else(|| {
+                if s.psk.is_some() || s.dht.is_none_or(|dht| dht == DhtMode::Off) {
+                    return Vec::new();
+                }
+                IPFS_BOOTSTRAP
+                    .iter()
+                    .map(|addr| addr.parse().expect("IPFS bootstrap addresses are valid"))
+                    .collect()
+            }),
+            peering: s.peering.unwrap_or_default(),
+            cluster: s.cluster,
+            cluster_sync_interval: s.cluster_sync_interval.unwrap_or(Duration::from_secs(10)),
+            rendezvous: s.rendezvous.unwrap_or(false),
+            rendezvous_max_ttl: s.rendezvous_max_ttl.unwrap_or(Duration::from_secs(72 * 60 * 60)),
+            mdns: s.mdns.unwrap_or(false),
+            ddns_zone: s
+                .ddns_zone
+                .or_else(|| parent(s.external_dns.as_deref().or(s.dnsaddr.as_deref())?)),
+            external_dns: s.external_dns,
+            ddns_provider: s.ddns_provider,
+            dnsaddr: s.dnsaddr,
+            route53_zone_id: s.route53_zone_id,
+            ddns_server: s.ddns_server,
+            ddns_tsig_key: s.ddns_tsig_key.map(Secret),
+            max_pending_handshakes: s.max_pending_handshakes.unwrap_or(1024),
+            max_connections: s.max_connections,
+            max_incoming_connections: s.max_incoming_connections,
+            max_connections_per_peer: s.max_connections_per_peer,
+            conns_low: s.conns_low.or(s.conns_high),
+            conns_high: s.conns_high,
+            conn_grace: s.conn_grace.unwrap_or(Duration::from_secs(60)),
+            conn_rate_per_ip: s.conn_rate_per_ip,
+            conn_burst_per_ip: s.conn_burst_per_ip,
+            conn_rate_ipv4_prefix: s.conn_rate_ipv4_prefix.unwrap_or(32),
+            conn_rate_ipv6_prefix: s.conn_rate_ipv6_prefix.unwrap_or(64),
+            max_bandwidth: s.max_bandwidth,
+            max_streams_per_connection: s.max_streams_per_connection.unwrap_or(512),
+            max_memory_bytes: s.max_memory_bytes,
+            max_announced_addrs: s.max_announced_addrs,
+            reconcile_interval: s.reconcile_interval.unwrap_or(Duration::from_secs(300)),
+            log_level: s.log_level,
+            log_format: s.log_format.unwrap_or_default(),
+            log_target: s.log_target.unwrap_or_default(),
+            log_file: s.log_file,
+            log_file_max_bytes: s.log_file_max_bytes.unwrap_or(100 * 1024 * 1024),
+            log_file_max_age: s.log_file_max_age,
+            log_file_keep: s.log_file_keep.unwrap_or(10),
+            log_file_compress: s.log_file_compress.unwrap_or(true),
+            output: s.output.unwrap_or_default(),
+            qr: s.qr.unwrap_or(false),
+            otel_endpoint: s.otel_endpoint,
+            otel_resource_attributes: match s.otel_resource_attributes {
+                Some(attrs) => parse_attributes(&attrs).ok_or(ConfigError::Invalid {
+                    setting: "otel-resource-attributes",
+                    reason: "must be a comma-separated list of key=value pairs",
+                })?,
+                None => Vec::new(),
+            },
+        };
+        config.validate()?;
+        Ok(config)
+    }
+
+    /// The circuit duration limit to give the relay, which has no notion of
+    /// unlimited; u32::MAX seconds is the most a reservation can advertise.
+    pub fn circuit_duration_limit(&self) -> Duration {
+        if self.max_circuit_duration.is_zero() {
+            return Duration::from_secs(u32::MAX.into());
+        }
+        self.max_circuit_duration
+    }
+
+    /// The circuit byte limit to give the relay.
+    pub fn circuit_bytes_limit(&self) -> u64 {
+        if self.max_circuit_bytes == 0 {
+            return u64::MAX;
+        }
+        self.max_circuit_bytes
+    }
+
+    /// The RESERVE rate limit per PeerID to give the relay, unless unlimited.
+    pub fn reservation_peer_rate(&self) -> Option<(NonZeroU32, Duration)> {
+        let limit = NonZeroU32::new(self.reservation_rate_per_peer)?;
+        Some((limit, self.reservation_rate_peer_window))
+    }
+
+    /// The RESERVE rate limit per source IP to give the relay, unless
+    /// unlimited.
+    pub fn reservation_ip_rate(&self) -> Option<(NonZeroU32, Duration)> {
+        let limit = NonZeroU32::new(self.reservation_rate_per_ip)?;
+        Some((limit, self.reservation_rate_ip_window))
+    }
+
+    /// Reservation slots held back for peers with a positive reputation.
+    pub fn reserved_slots(&self) -> usize {
+        self.reputation_reserved.unwrap_or(self.max_reservations / 10)
+    }
+
+    /// The same relay for the previous identity and when to retire it, if
+    /// one is being rotated out. It listens on its own port, so announces
+    /// what it discovers rather than --announce, and leaves the HTTP
+    /// endpoints, onion service, Unix socket, DNS records, reachability
+    /// checks, the DHT, rendezvous, mDNS, capacity gossip, peering, the
+    /// cluster, PID file, audit log, traffic dump, usage export, reputation
+    /// scores and API key usage file to the current identity.
+    pub fn retiring(&self) -> Option<(Config, SystemTime)> {
+        let port = self.previous_identity_port?;
+        let config = Config {
+            port,
+            ws_port: port,
+            quic_port: port,
+            listen: Vec::new(),
+            identity: self.previous_identity.clone()?,
+            tls_cert: None,
+            tls_key: None,
+            domain: None,
+            onion_address: None,
+            unix_socket: None,
+            announce: Vec::new(),
+            ddns_provider: None,
+            dnsaddr: None,
+            check_reachability: false,
+            exit_when_unreachable: false,
+            dht: DhtMode::Off,
+            routing_addr: None,
+            bootstrap: Vec::new(),
+            peering: Vec::new(),
+            cluster: None,
+            rendezvous: false,
+            mdns: false,
+            capacity_topic: None,
+            identity_env: None,
+            identity_stdin: false,
+            identity_vault: None,
+            previous_identity: None,
+            previous_identity_port: None,
+            previous_identity_until: None,
+            pid_file: None,
+            health_addr: None,
+            metrics_addr: None,
+            debug_addr: None,
+            admin_token: None,
+            audit_log: None,
+            traffic_dump: None,
+            usage_export: None,
+            usage_export_webhook: None,
+            reputation_file: None,
+            api_key_usage: None,
+            ..self.clone()
+        };
+        Some((config, self.previous_identity_until?))
+    }
+
+    pub fn identity_source(&self) -> IdentitySource {
+        if let Some(var) = &self.identity_env {
+            return IdentitySource::Env(var.clone());
+        }
+        if let Some(secret) = &self.identity_vault {
+            return IdentitySource::Vault(secret.clone());
+        }
+        match self.identity_stdin {
+            true => IdentitySource::Stdin,
+            false => IdentitySource::File(self.identity.clone()),
+        }
+    }
+
+    /// The certificate to serve WebSocket over TLS with, if configured.
+    pub(crate) fn cert_files(&self) -> Option<CertFiles> {
+        if let Some(domain) = &self.domain {
+            return Some(acme::cert_files(&self.acme_cache, &self.acme_directory, domain));
+        }
+        Some(CertFiles {
+            cert: self.tls_cert.clone()?,
+            key: self.tls_key.clone()?,
+        })
+    }
+
+    /// The load balancers to read PROXY headers from, none unless
+    /// --proxy-protocol is on.
+    pub(crate) fn proxy_sources(&self) -> Vec<Cidr> {
+        self.proxy_protocol
+            .then(|| self.trusted_proxies.clone())
+            .unwrap_or_default()
+    }
+
+    /// The reverse proxies to take `X-Forwarded-For` from, none unless
+    /// --forwarded-headers is on.
+    pub(crate) fn forwarding_proxies(&self) -> Vec<Cidr> {
+        self.forwarded_headers
+            .then(|| self.trusted_proxies.clone())
+            .unwrap_or_default()
+    }
+
+    /// Whether the WebSocket transport is needed, plain or over TLS.
+    pub(crate) fn serves_websocket(&self) -> bool {
+        !self.no_ws || self.cert_files().is_some()
+    }
+
+    /// Whether the QUIC transport is on. A --psk network cannot use it.
+    pub(crate) fn serves_quic(&self) -> bool {
+        !self.no_quic && self.psk.is_none()
+    }
+
+    /// The /onion3 address peers reach --onion-address on, if it is valid.
+    pub(crate) fn onion_multiaddr(&self) -> Option<Multiaddr> {
+        let name = self.onion_address.as_deref()?.strip_suffix(".onion")?;
+        format!("/onion3/{name}:{}", self.onion_port).parse().ok()
+    }
+
+    /// Idle-connection watermarks as `(low, high)`, if trimming is enabled.
+    pub fn conn_watermarks(&self) -> Option<(usize, usize)> {
+        Some((self.conns_low?, self.conns_high?))
+    }
+
+    /// Take over the settings from `new` that a running relay can apply, and
+    /// name the ones that differ but only take effect after a restart: the
+    /// identity, the listeners and the transports behind them, turning
+    /// protocols and services on or off, the circuit, AutoNAT and rendezvous
+    /// limits libp2p fixes when it builds them, and the process's own
+    /// settings such as logging.
+    pub fn reload(&mut self, new: Config) -> Vec<&'static str> {
+        let mut restart = Vec::new();
+        let mut check = |setting, changed: bool| {
+            if changed {
+                restart.push(setting);
+            }
+        };
+        check("identity", self.identity != new.identity);
+        check("identity-passphrase", self.identity_passphrase != new.identity_passphrase);
+        check("identity-env", self.identity_env != new.identity_env);
+        check("identity-stdin", self.identity_stdin != new.identity_stdin);
+        check("identity-vault", self.identity_vault != new.identity_vault);
+        check("key-type", self.key_type != new.key_type);
+        check("key-bits", self.key_bits != new.key_bits);
+        check("previous-identity", self.previous_identity != new.previous_identity);
+        check(
+            "previous-identity-port",
+            self.previous_identity_port != new.previous_identity_port,
+        );
+        check(
+            "previous-identity-until",
+            self.previous_identity_until != new.previous_identity_until,
+        );
+        check("port", self.port != new.port);
+        check("ws-port", self.ws_port != new.ws_port);
+        check("quic-port", self.quic_port != new.quic_port);
+        check("wss-port", self.wss_port != new.wss_port);
+        check("listen-ip", self.listen_ips != new.listen_ips);
+        check("listen", self.listen != new.listen);
+        check("no-ws", self.no_ws != new.no_ws);
+        check("no-quic", self.no_quic != new.no_quic);
+        check("security", self.security != new.security);
+        check("psk", self.psk != new.psk);
+        check("quic-idle-timeout", self.quic_idle_timeout != new.quic_idle_timeout);
+        check("quic-keep-alive", self.quic_keep_alive != new.quic_keep_alive);
+        check("quic-max-streams", self.quic_max_streams != new.quic_max_streams);
+        check("quic-receive-buffer", self.quic_receive_buffer != new.quic_receive_buffer);
+        check(
+            "max-streams-per-connection",
+            self.max_streams_per_connection != new.max_streams_per_connection,
+        );
+        check("onion-address", self.onion_address != new.onion_address);
+        check("onion-port", self.onion_port != new.onion_port);
+        check("unix-socket", self.unix_socket != new.unix_socket);
+        check("tls-cert", self.tls_cert != new.tls_cert);
+        check("tls-key", self.tls_key != new.tls_key);
+        check("domain", self.domain != new.domain);
+        check(
+            "cloudflare-api-token",
+            self.domain.is_some() && self.cloudflare_api_token != new.cloudflare_api_token,
+        );
+        check("acme-directory", self.acme_directory != new.acme_directory);
+        check("acme-email", self.acme_email != new.acme_email);
+        check("acme-cache", self.acme_cache != new.acme_cache);
+        check("acme-storage", self.acme_storage != new.acme_storage);
+        check("acme-consul-prefix", self.acme_consul_prefix != new.acme_consul_prefix);
+        check("health-addr", self.health_addr != new.health_addr);
+        check("metrics-addr", self.metrics_addr != new.metrics_addr);
+        check("debug-addr", self.debug_addr != new.debug_addr);
+        check("admin-addr", self.admin_addr != new.admin_addr);
+        check("admin-grpc-addr", self.admin_grpc_addr != new.admin_grpc_addr);
+        check("routing-addr", self.routing_addr != new.routing_addr);
+        check("autonat", self.autonat != new.autonat);
+        check("check-reachability", self.check_reachability != new.check_reachability);
+        check("dht", self.dht != new.dht);
+        check("mdns", self.mdns != new.mdns);
+        check("rendezvous", self.rendezvous != new.rendezvous);
+        check("capacity-topic", self.capacity_topic != new.capacity_topic);
+        check("cluster", self.cluster != new.cluster);
+        check(
+            "reservation-token-secret",
+            self.reservation_token_secret.is_some() != new.reservation_token_secret.is_some(),
+        );
+        check("api-keys", self.api_keys.is_some() != new.api_keys.is_some());
+        check("admin-token", self.admin_token.is_some() != new.admin_token.is_some());
+        check("max-circuit-duration", self.max_circuit_duration != new.max_circuit_duration);
+        check("max-circuit-bytes", self.max_circuit_bytes != new.max_circuit_bytes);
+        check("reachability-interval", self.reachability_interval != new.reachability_interval);
+        check("rendezvous-max-ttl", self.rendezvous_max_ttl != new.rendezvous_max_ttl);
+        check("pid-file", self.pid_file != new.pid_file);
+        check("daemon", self.daemon != new.daemon);
+        check("log-format", self.log_format != new.log_format);
+        check("log-target", self.log_target != new.log_target);
+        check("log-file", self.log_file != new.log_file);
+        check("log-file-max-bytes", self.log_file_max_bytes != new.log_file_max_bytes);
+        check("log-file-max-age", self.log_file_max_age != new.log_file_max_age);
+        check("log-file-keep", self.log_file_keep != new.log_file_keep);
+        check("log-file-compress", self.log_file_compress != new.log_file_compress);
+        check("output", self.output != new.output);
+        check("qr", self.qr != new.qr);
+        check("otel-endpoint", self.otel_endpoint != new.otel_endpoint);
+        check(
+            "otel-resource-attributes",
+            self.otel_resource_attributes != new.otel_resource_attributes,
+        );
+
+        self.reservation_allowlist = new.reservation_allowlist;
+        self.reservation_denylist = new.reservation_denylist;
+        self.trusted_peers = new.trusted_peers;
+        self.tier_reserved_trusted = new.tier_reserved_trusted;
+        self.tier_reserved_default = new.tier_reserved_default;
+        self.tier_bandwidth_default = new.tier_bandwidth_default;
+        self.tier_bandwidth_anonymous = new.tier_bandwidth_anonymous;
+        self.allow_cidrs = new.allow_cidrs;
+        self.deny_cidrs = new.deny_cidrs;
+        self.connection_countries = new.connection_countries;
+        self.reservation_countries = new.reservation_countries;
+        self.capacity_granularity = new.capacity_granularity;
+        self.capacity_interval = new.capacity_interval;
+        self.drain_timeout = new.drain_timeout;
+        self.shutdown_grace = new.shutdown_grace;
+        self.conns_low = new.conns_low;
+        self.conns_high = new.conns_high;
+        self.conn_grace = new.conn_grace;
+        self.abuse_bans = new.abuse_bans;
+        self.ban_reconnects = new.ban_reconnects;
+        self.ban_failed_circuits = new.ban_failed_circuits;
+        self.ban_data_limit_hits = new.ban_data_limit_hits;
+        self.ban_window = new.ban_window;
+        self.ban_duration = new.ban_duration;
+        self.ban_max_duration = new.ban_max_duration;
+        self.conn_rate_per_ip = new.conn_rate_per_ip;
+        self.conn_burst_per_ip = new.conn_burst_per_ip;
+        self.conn_rate_ipv4_prefix = new.conn_rate_ipv4_prefix;
+        self.conn_rate_ipv6_prefix = new.conn_rate_ipv6_prefix;
+        self.max_bandwidth = new.max_bandwidth;
+        self.autonat_peer_limit = new.autonat_peer_limit;
+        self.autonat_global_limit = new.autonat_global_limit;
+        self.autonat_limit_period = new.autonat_limit_period;
+        self.unreachable_after = new.unreachable_after;
+        self.exit_when_unreachable = new.exit_when_unreachable;
+        self.reconcile_interval = new.reconcile_interval;
+        self.tcp_keepalive = new.tcp_keepalive;
+        self.tcp_nodelay = new.tcp_nodelay;
+        self.forwarded_headers = new.forwarded_headers;
+        self.proxy_protocol = new.proxy_protocol;
+        self.trusted_proxies = new.trusted_proxies;
+        self.max_reservations = new.max_reservations;
+        self.max_reservations_per_peer = new.max_reservations_per_peer;
+        self.max_circuits = new.max_circuits;
+        self.max_circuits_per_peer = new.max_circuits_per_peer;
+        self.max_circuits_per_ip = new.max_circuits_per_ip;
+        self.reputation_reserved = new.reputation_reserved;
+        self.reservation_rate_per_peer = new.reservation_rate_per_peer;
+        self.reservation_rate_peer_window = new.reservation_rate_peer_window;
+        self.reservation_rate_per_ip = new.reservation_rate_per_ip;
+        self.reservation_rate_ip_window = new.reservation_rate_ip_window;
+        self.max_pending_handshakes = new.max_pending_handshakes;
+        self.max_connections = new.max_connections;
+        self.max_incoming_connections = new.max_incoming_connections;
+        self.max_connections_per_peer = new.max_connections_per_peer;
+        self.max_memory_bytes = new.max_memory_bytes;
+        self.alert_webhook = new.alert_webhook;
+        self.event_webhook = new.event_webhook;
+        self.event_webhook_events = new.event_webhook_events;
+        self.reservation_webhook = new.reservation_webhook;
+        self.reservation_webhook_timeout = new.reservation_webhook_timeout;
+        self.reservation_webhook_cache = new.reservation_webhook_cache;
+        self.reservation_webhook_fail_open = new.reservation_webhook_fail_open;
+        self.pre_stop_delay = new.pre_stop_delay;
+        self.diagnostics_file = new.diagnostics_file;
+        self.bootstrap = new.bootstrap;
+        self.peering = new.peering;
+        self.cluster_sync_interval = new.cluster_sync_interval;
+        self.usage_export_interval = new.usage_export_interval;
+        self.reservation_token_secret = new.reservation_token_secret;
+        self.admin_token = new.admin_token;
+        self.announce = new.announce;
+        self.no_announce = new.no_announce;
+        self.announce_temporary_ipv6 = new.announce_temporary_ipv6;
+        self.max_announced_addrs = new.max_announced_addrs;
+        self.external_dns = new.external_dns;
+        self.ddns_provider = new.ddns_provider;
+        self.dnsaddr = new.dnsaddr;
+        self.route53_zone_id = new.route53_zone_id;
+        self.ddns_server = new.ddns_server;
+        self.ddns_zone = new.ddns_zone;
+        self.ddns_tsig_key = new.ddns_tsig_key;
+        self.cloudflare_api_token = new.cloudflare_api_token;
+        self.ws_path = new.ws_path;
+        self.audit_log = new.audit_log;
+        self.audit_log_max_bytes = new.audit_log_max_bytes;
+        self.audit_log_keep = new.audit_log_keep;
+        self.audit_log_retention = new.audit_log_retention;
+        self.traffic_dump = new.traffic_dump;
+        self.traffic_dump_interval = new.traffic_dump_interval;
+        self.traffic_dump_format = new.traffic_dump_format;
+        self.usage_export = new.usage_export;
+        self.usage_export_webhook = new.usage_export_webhook;
+        self.usage_export_format = new.usage_export_format;
+        self.geoip_db = new.geoip_db;
+        self.reachability_servers = new.reachability_servers;
+        self.api_keys = new.api_keys;
+        self.api_key_usage = new.api_key_usage;
+        self.reputation_file = new.reputation_file;
+        self.log_level = new.log_level;
+
+        restart
+    }
+
+    fn validate_previous_identity(&self, path: &Path) -> Result<(), ConfigError> {
+        let invalid = |setting, reason| Err(ConfigError::Invalid { setting, reason });
+        match self.previous_identity_port {
+            None => return invalid("previous-identity-port", "is required with --previous-identity"),
+            Some(port) if port == self.ws_port || port == self.quic_port => {
+                return invalid(
+                    "previous-identity-port",
+                    "must differ from --ws-port and --quic-port",
+                );
+            }
+            Some(_) => {}
+        }
+        if self.previous_identity_until.is_none() {
+            return invalid("previous-identity-until", "is required with --previous-identity");
+        }
+        if !path.exists() {
+            return invalid("previous-identity", "must be an existing key file");
+        }
+        Ok(())
+    }
+
+    fn validate_domain(&self, domain: &str) -> Result<(), ConfigError> {
+        let invalid = |setting, reason| Err(ConfigError::Invalid { setting, reason });
+        if !is_fqdn(domain) {
+            return invalid("domain", "must be a fully qualified name such as relay.example.com");
+        }
+        if self.tls_cert.is_some() {
+            return invalid("domain", "conflicts with --tls-cert");
+        }
+        if self.cloudflare_api_token.as_ref().is_none_or(|t| t.0.is_empty()) {
+            return invalid("cloudflare-api-token", "is required with --domain");
+        }
+        if !is_http_url(&self.acme_directory) {
+            return invalid("acme-directory", "must be an http or https URL");
+        }
+        let consul = self.acme_storage == AcmeStorage::Consul;
+        if consul && self.acme_consul_prefix.trim_matches('/').is_empty() {
+            return invalid("acme-consul-prefix", "must not be empty");
+        }
+        Ok(())
+    }
+
+    fn validate_ddns(&self, provider: DdnsProvider) -> Result<(), ConfigError> {
+        let invalid = |setting, reason| Err(ConfigError::Invalid { setting, reason });
+        let unset = |value: Option<&str>| value.is_none_or(str::is_empty);
+        let names: Vec<&String> = self.external_dns.iter().chain(&self.dnsaddr).collect();
+        if names.is_empty() {
+            return invalid("external-dns", "or --dnsaddr is required with --ddns-provider");
+        }
+        let token = self.cloudflare_api_token.as_ref().map(|t| t.0.as_str());
+        if provider == DdnsProvider::Cloudflare && unset(token) {
+            return invalid("cloudflare-api-token", "is required with --ddns-provider cloudflare");
+        }
+        if provider == DdnsProvider::Route53 && unset(self.route53_zone_id.as_deref()) {
+            return invalid("route53-zone-id", "is required with --ddns-provider route53");
+        }
+        if provider != DdnsProvider::Rfc2136 {
+            return Ok(());
+        }
+        if unset(self.ddns_server.as_deref()) {
+            return invalid("ddns-server", "is required with --ddns-provider rfc2136");
+        }
+        let zone = self.ddns_zone.as_deref().unwrap_or_default();
+        let outside = |name: &&String| !format!(".{name}").ends_with(&format!(".{zone}"));
+        if !is_fqdn(zone) || names.iter().any(outside) {
+            return invalid("ddns-zone", "must be a zone containing --external-dns and --dnsaddr");
+        }
+        if self.ddns_tsig_key.as_ref().is_some_and(|key| TsigKey::parse(&key.0).is_none()) {
+            return invalid("ddns-tsig-key", "must be NAME:BASE64SECRET");
+        }
+        Ok(())
+    }
+
+    fn validate(&self) -> Result<(), ConfigError> {
+        if self.cluster_sync_interval.is_zero() {
+            return Err(ConfigError::Invalid {
+                setting: "cluster-sync-interval",
+                reason: "must be longer than zero",
+            });
+        }
+        if self.capacity_interval.is_zero() {
+            return Err(ConfigError::Invalid {
+                setting: "capacity-interval",
+                reason: "must be longer than zero",
+            });
+        }
+        if self.capacity_granularity > 100 {
+            return Err(ConfigError::Invalid {
+                setting: "capacity-granularity",
+                reason: "must be a percentage between 0 and 100",
+            });
+        }
+        let sources = [
+            ("identity-env", self.identity_env.is_some()),
+            ("identity-stdin", self.identity_stdin),
+            ("identity-vault", self.identity_vault.is_some()),
+        ];
+        let mut set = sources.into_iter().filter(|(_, set)| *set).map(|(name, _)| name);
+        if let (Some(_), Some(setting)) = (set.next(), set.next()) {
+            return Err(ConfigError::Invalid {
+                setting,
+                reason: "conflicts with another of --identity-env, --identity-stdin and --identity-vault",
+            });
+        }
+        if let Some(path) = &self.previous_identity {
+            self.validate_previous_identity(path)?;
+        }
+        let required = |setting, reason| Err(ConfigError::Invalid { setting, reason });
+        match (&self.tls_cert, &self.tls_key) {
+            (Some(_), None) => return required("tls-key", "is required with --tls-cert"),
+            (None, Some(_)) => return required("tls-cert", "is required with --tls-key"),
+            _ => {}
+        }
+        if self.forwarded_headers && self.trusted_proxies.is_empty() {
+            return required("trusted-proxies", "is required with --forwarded-headers");
+        }
+        if self.proxy_protocol && self.trusted_proxies.is_empty() {
+            return required("trusted-proxies", "is required with --proxy-protocol");
+        }
+        if !self.ws_path.starts_with('/') {
+            return Err(ConfigError::Invalid {
+                setting: "ws-path",
+                reason: "must start with /",
+            });
+        }
+        if self.no_ws && listen::plan(self).is_empty() {
+            return Err(ConfigError::Invalid {
+                setting: "no-ws",
+                reason: "leaves no transport to listen on",
+            });
+        }
+        if let Some(domain) = &self.domain {
+            self.validate_domain(domain)?;
+        }
+        if self.onion_address.is_some() && self.onion_multiaddr().is_none() {
+            return Err(ConfigError::Invalid {
+                setting: "onion-address",
+                reason: "must be a v3 onion hostname: 56 base32 characters and .onion",
+            });
+        }
+        if self.unix_socket.is_some() && !cfg!(unix) {
+            return Err(ConfigError::Invalid {
+                setting: "unix-socket",
+                reason: "is only supported on Unix",
+            });
+        }
+        if self.unix_socket.as_ref().is_some_and(|path| !path.is_absolute()) {
+            return Err(ConfigError::Invalid {
+                setting: "unix-socket",
+                reason: "must be an absolute path",
+            });
+        }
+        if self.external_dns.as_deref().is_some_and(|name| !is_fqdn(name)) {
+            return Err(ConfigError::Invalid {
+                setting: "external-dns",
+                reason: "must be a fully qualified name such as relay.example.com",
+            });
+        }
+        if self.dnsaddr.as_deref().is_some_and(|name| !is_fqdn(name)) {
+            return Err(ConfigError::Invalid {
+                setting: "dnsaddr",
+                reason: "must be a fully qualified name such as relay.example.com",
+            });
+        }
+        if self.dnsaddr.is_some() && self.ddns_provider.is_none() {
+            return Err(ConfigError::Invalid {
+                setting: "dnsaddr",
+                reason: "needs --ddns-provider to publish its records",
+            });
+        }
+        if let Some(provider) = self.ddns_provider {
+            self.validate_ddns(provider)?;
+        }
+        if self.alert_webhook.as_ref().is_some_and(|url| !is_http_url(&url.0)) {
+            return Err(ConfigError::Invalid {
+                setting: "alert-webhook",
+                reason: "must be an http or https URL",
+            });
+        }
+        if self.event_webhook.as_ref().is_some_and(|url| !is_http_url(&url.0)) {
+            return Err(ConfigError::Invalid {
+                setting: "event-webhook",
+                reason: "must be an http or https URL",
+            });
+        }
+        if self.reservation_webhook.as_ref().is_some_and(|url| !is_http_url(&url.0)) {
+            return Err(ConfigError::Invalid {
+                setting: "reservation-webhook",
+                reason: "must be an http or https URL",
+            });
+        }
+        if self.reservation_webhook_timeout.is_zero() {
+            return Err(ConfigError::Invalid {
+                setting: "reservation-webhook-timeout",
+                reason: "must be longer than zero",
+            });
+        }
+        if self.reservation_webhook_cache.is_zero() {
+            return Err(ConfigError::Invalid {
+                setting: "reservation-webhook-cache",
+                reason: "must be longer than zero",
+            });
+        }
+        if !RSA_BITS.contains(&self.key_bits) {
+            return Err(ConfigError::Invalid {
+                setting: "key-bits",
+                reason: "must be between 2048 and 8192",
+            });
+        }
+        if self.identity_vault.as_ref().is_some_and(|secret| !secret.contains('/')) {
+            return Err(ConfigError::Invalid {
+                setting: "identity-vault",
+                reason: "must be MOUNT/PATH, such as secret/sutro/relay",
+            });
+        }
+        if self.identity_env.as_ref().is_some_and(|var| var.is_empty()) {
+            return Err(ConfigError::Invalid {
+                setting: "identity-env",
+                reason: "must name an environment variable",
+            });
+        }
+        if self.identity_passphrase.as_ref().is_some_and(|p| p.0.is_empty()) {
+            return Err(ConfigError::Invalid {
+                setting: "identity-passphrase",
+                reason: "must not be empty; unset it to store the key unencrypted",
+            });
+        }
+        if self.reservation_token_secret.as_ref().is_some_and(|t| t.0.len() < 32) {
+            return Err(ConfigError::Invalid {
+                setting: "reservation-token-secret",
+                reason: "must be at least 32 bytes, as HS256 keys should be",
+            });
+        }
+        if self.admin_token.as_ref().is_some_and(|t| t.0.is_empty()) {
+            return Err(ConfigError::Invalid {
+                setting: "admin-token",
+                reason: "must not be empty; unset it to disable the admin API",
+            });
+        }
+        let country_policy = !self.connection_countries.is_empty()
+            || !self.reservation_countries.is_empty();
+        if country_policy && self.geoip_db.is_none() {
+            return Err(ConfigError::Invalid {
+                setting: "geoip-db",
+                reason: "must be set to filter by country",
+            });
+        }
+        if self.traffic_dump_interval.is_zero() {
+            return Err(ConfigError::Invalid {
+                setting: "traffic-dump-interval",
+                reason: "must be longer than zero",
+            });
+        }
+        if self.log_target != LogTarget::Stdout && self.log_file.is_some() {
+            return Err(ConfigError::Invalid {
+                setting: "log-target",
+                reason: "cannot be combined with --log-file, which already says where logs go",
+            });
+        }
+        if self.log_target != LogTarget::Stdout && !cfg!(unix) {
+            return Err(ConfigError::Invalid {
+                setting: "log-target",
+                reason: "can only be syslog or journald on Unix",
+            });
+        }
+        if self.log_file_max_bytes == 0 {
+            return Err(ConfigError::Invalid {
+                setting: "log-file-max-bytes",
+                reason: "must be at least one byte",
+            });
+        }
+        if self.log_file_max_age.is_some_and(|d| d.is_zero()) {
+            return Err(ConfigError::Invalid {
+                setting: "log-file-max-age",
+                reason: "must be longer than zero",
+            });
+        }
+        if self.audit_log_retention.is_some_and(|d| d.is_zero()) {
+            return Err(ConfigError::Invalid {
+                setting: "audit-log-retention",
+                reason: "must be longer than zero",
+            });
+        }
+        if self.usage_export_interval.is_zero() {
+            return Err(ConfigError::Invalid {
+                setting: "usage-export-interval",
+                reason: "must be longer than zero",
+            });
+        }
+        if self.usage_export_webhook.as_ref().is_some_and(|url| !is_http_url(&url.0)) {
+            return Err(ConfigError::Invalid {
+                setting: "usage-export-webhook",
+                reason: "must be an http or https URL",
+            });
+        }
+        if self.reconcile_interval.is_zero() {
+            return Err(ConfigError::Invalid {
+                setting: "reconcile-interval",
+                reason: "must be longer than zero",
+            });
+        }
+        if let Some(level) = &self.log_level {
+            if EnvFilter::builder().parse(level).is_err() {
+                return Err(ConfigError::Invalid {
+                    setting: "log-level",
+                    reason: "must be a level or tracing filter directive such as info,libp2p=debug",
+                });
+            }
+        }
+        match (self.conns_low, self.conns_high) {
+            (Some(_), None) => {
+                return Err(ConfigError::Invalid {
+                    setting: "conns-low",
+                    reason: "needs --conns-high to be set as well",
+                });
+            }
+            (Some(low), Some(high)) if low > high => {
+                return Err(ConfigError::Invalid {
+                    setting: "conns-low",
+                    reason: "must not be above --conns-high",
+                });
+            }
+            _ => {}
+        }
+        if self.max_streams_per_connection == 0 {
+            return Err(ConfigError::Invalid {
+                setting: "max-streams-per-connection",
+                reason: "must allow at least one stream",
+            });
+        }
+        if self.tcp_keepalive.is_some_and(|idle| idle < Duration::from_secs(1)) {
+            return Err(ConfigError::Invalid {
+                setting: "tcp-keepalive",
+                reason: "must be at least 1s, the finest the kernel counts in",
+            });
+        }
+        if self.security.is_empty() {
+            return Err(ConfigError::Invalid {
+                setting: "security",
+                reason: "must offer at least one handshake",
+            });
+        }
+        let repeated = |(i, protocol)| self.security[..i].contains(protocol);
+        if self.security.iter().enumerate().any(repeated) {
+            return Err(ConfigError::Invalid {
+                setting: "security",
+                reason: "must not list a handshake twice",
+            });
+        }
+        if self.quic_max_streams == 0 {
+            return Err(ConfigError::Invalid {
+                setting: "quic-max-streams",
+                reason: "must allow at least one stream",
+            });
+        }
+        if self.quic_keep_alive >= self.quic_idle_timeout {
+            return Err(ConfigError::Invalid {
+                setting: "quic-keep-alive",
+                reason: "must be shorter than --quic-idle-timeout, or idle connections time out",
+            });
+        }
+        if self.reservation_rate_peer_window.is_zero() {
+            return Err(ConfigError::Invalid {
+                setting: "reservation-rate-peer-window",
+                reason: "must be longer than zero",
+            });
+        }
+        if self.reservation_rate_ip_window.is_zero() {
+            return Err(ConfigError::Invalid {
+                setting: "reservation-rate-ip-window",
+                reason: "must be longer than zero",
+            });
+        }
+        let thresholds = [
+            ("ban-reconnects", self.ban_reconnects),
+            ("ban-failed-circuits", self.ban_failed_circuits),
+            ("ban-data-limit-hits", self.ban_data_limit_hits),
+        ];
+        if let Some(&(setting, _)) = thresholds.iter().find(|(_, threshold)| *threshold == 0) {
+            return Err(ConfigError::Invalid {
+                setting,
+                reason: "must be at least 1",
+            });
+        }
+        if self.ban_window.is_zero() {
+            return Err(ConfigError::Invalid {
+                setting: "ban-window",
+                reason: "must be longer than zero",
+            });
+        }
+        if self.ban_duration.is_zero() {
+            return Err(ConfigError::Invalid {
+                setting: "ban-duration",
+                reason: "must be longer than zero",
+            });
+        }
+        if self.ban_max_duration < self.ban_duration {
+            return Err(ConfigError::Invalid {
+                setting: "ban-max-duration",
+                reason: "must not be shorter than --ban-duration",
+            });
+        }
+        if self.api_key_usage.is_some() && self.api_keys.is_none() {
+            return Err(ConfigError::Invalid {
+                setting: "api-key-usage",
+                reason: "needs --api-keys to track",
+            });
+        }
+        let tier_reserved = self.tier_reserved_trusted.saturating_add(self.tier_reserved_default);
+        if tier_reserved > self.max_reservations {
+            return Err(ConfigError::Invalid {
+                setting: "tier-reserved-default",
+                reason: "must not exceed --max-reservations together with --tier-reserved-trusted",
+            });
+        }
+        if self.reputation_reserved.is_some_and(|reserved| reserved > self.max_reservations) {
+            return Err(ConfigError::Invalid {
+                setting: "reputation-reserved",
+                reason: "must not exceed --max-reservations",
+            });
+        }
+        if self.conn_rate_per_ip == Some(0) {
+            return Err(ConfigError::Invalid {
+                setting: "conn-rate-per-ip",
+                reason: "must allow at least one connection; unset it to remove the limit",
+            });
+        }
+        if self.conn_burst_per_ip == Some(0) {
+            return Err(ConfigError::Invalid {
+                setting: "conn-burst-per-ip",
+                reason: "must allow at least one connection",
+            });
+        }
+        if self.conn_rate_ipv4_prefix > 32 {
+            return Err(ConfigError::Invalid {
+                setting: "conn-rate-ipv4-prefix",
+                reason: "must be at most 32",
+            });
+        }
+        if self.conn_rate_ipv6_prefix > 128 {
+            return Err(ConfigError::Invalid {
+                setting: "conn-rate-ipv6-prefix",
+                reason: "must be at most 128",
+            });
+        }
+        if self.max_circuits_per_ip == Some(0) {
+            return Err(ConfigError::Invalid {
+                setting: "max-circuits-per-ip",
+                reason: "must allow at least one circuit; unset it to remove the limit",
+            });
+        }
+        if self.autonat_peer_limit == 0 || self.autonat_global_limit == 0 {
+            return Err(ConfigError::Invalid {
+                setting: "autonat-peer-limit",
+                reason: "and --autonat-global-limit must allow at least one dial-back",
+            });
+        }
+        if self.autonat_limit_period.is_zero() {
+            return Err(ConfigError::Invalid {
+                setting: "autonat-limit-period",
+                reason: "must be longer than zero",
+            });
+        }
+        if self.exit_when_unreachable && !self.check_reachability {
+            return Err(ConfigError::Invalid {
+                setting: "exit-when-unreachable",
+                reason: "needs --check-reachability to find out",
+            });
+        }
+        if self.routing_addr.is_some() && self.dht == DhtMode::Off {
+            return Err(ConfigError::Invalid {
+                setting: "routing-addr",
+                reason: "needs --dht to answer from",
+            });
+        }
+        let anonymous = |addrs: &[Multiaddr]| {
+            addrs
+                .iter()
+                .any(|addr| !matches!(addr.iter().last(), Some(Protocol::P2p(_))))
+        };
+        if anonymous(&self.reachability_servers) {
+            return Err(ConfigError::Invalid {
+                setting: "reachability-servers",
+                reason: "must end in /p2p/PEERID",
+            });
+        }
+        if anonymous(&self.bootstrap) {
+            return Err(ConfigError::Invalid {
+                setting: "bootstrap",
+                reason: "must end in /p2p/PEERID",
+            });
+        }
+        if anonymous(&self.peering) {
+            return Err(ConfigError::Invalid {
+                setting: "peering",
+                reason: "must end in /p2p/PEERID",
+            });
+        }
+        if self.reachability_interval.is_zero() || self.unreachable_after.is_zero() {
+            return Err(ConfigError::Invalid {
+                setting: "reachability-interval",
+                reason: "and --unreachable-after must be longer than zero",
+            });
+        }
+        if self.rendezvous_max_ttl < Duration::from_secs(2 * 60 * 60) {
+            return Err(ConfigError::Invalid {
+                setting: "rendezvous-max-ttl",
+                reason: "must be at least 2h, the shortest registration clients may ask for",
+            });
+        }
+        if self.max_announced_addrs == Some(0) {
+            return Err(ConfigError::Invalid {
+                setting: "max-announced-addrs",
+                reason: "must allow at least one address; unset it to announce everything",
+            });
+        }
+        if self.daemon && !cfg!(unix) {
+            return Err(ConfigError::Invalid {
+                setting: "daemon",
+                reason: "is only supported on Unix; on Windows use `service install` instead",
+            });
+        }
+        Ok(())
+    }
+}
+
+fn is_fqdn(name: &str) -> bool {
+    name.contains('.') && !name.starts_with('.') && !name.ends_with('.')
+}
+
+/// The zone a name is most likely in, such as example.com for
+/// relay.example.com.
+fn parent(name: &str) -> Option<String> {
+    let (_, parent) = name.split_once('.')?;
+    is_fqdn(parent).then(|| parent.to_owned())
+}
+
+fn is_http_url(url: &str) -> bool {
+    Url::parse(url).is_ok_and(|url| matches!(url.scheme(), "https" | "http") && url.has_host())
+}
+
+/// Normalise ISO 3166-1 alpha-2 codes to upper case.
+fn countries(codes: Option<Vec<String>>) -> Result<Vec<String>, ConfigError> {
+    codes
+        .unwrap_or_default()
+        .into_iter()
+        .map(|code| {
+            let code = code.trim().to_ascii_uppercase();
+            if code.len() == 2 && code.bytes().all(|b| b.is_ascii_uppercase()) {
+                Ok(code)
+            } else {
+                Err(ConfigError::Invalid {
+                    setting: "countries",
+                    reason: "must be two-letter ISO 3166-1 country codes such as DE",
+                })
+            }
+        })
+        .collect()
+}
+
+fn parse_attributes(attrs: &str) -> Option<Vec<(String, String)>> {
+    attrs
+        .split(',')
+        .map(str::trim)
+        .filter(|pair| !pair.is_empty())
+        .map(|pair| {
+            let (key, value) = pair.split_once('=')?;
+            let key = key.trim();
+            (!key.is_empty()).then(|| (key.to_string(), value.trim().to_string()))
+        })
+        .collect()
+}
+
+fn read(path: &Path) -> Result<Settings, ConfigError> {
+    let text = fs::read_to_string(path).map_err(|source| ConfigError::Read {
+        path: path.to_path_buf(),
+        source,
+    })?;
+    toml::from_str(&text).map_err(|source| ConfigError::Parse {
+        path: path.to_path_buf(),
+        source,
+    })
+}
+
+#[derive(Debug)]
+pub enum ConfigError {
+    Read {
+        path: PathBuf,
+        source: io::Error,
+    },
+    Parse {
+        path: PathBuf,
+        source: toml::de::Error,
+    },
+    Invalid {
+        setting: &'static str,
+        reason: &'static str,
+    },
+}
+
+impl fmt::Display for ConfigError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::Read { path, source } => write!(f, "could not read {}: {source}", path.display()),
+            Self::Parse { path, source } => write!(f, "invalid config {}: {source}", path.display()),
+            Self::Invalid { setting, reason } => write!(f, "{setting} {reason}"),
+        }
+    }
+}
+
+impl std::error::Error for ConfigError {}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// The setting `settings` are rejected for.
+    fn rejected(settings: Settings) -> &'static str {
+        match Config::resolve(settings) {
+            Err(ConfigError::Invalid { setting, .. }) => setting,
+            other => panic!("not rejected: {other:?}"),
+        }
+    }
+
+    #[test]
+    fn flags_take_precedence_over_the_file() {
+        let flags = Settings {
+            port: Some(4101),
+            ..Settings::default()
+        };
+        let file = Settings {
+            port: Some(4201),
+            ws_port: Some(4202),
+            ..Settings::default()
+        };
+        let settings = flags.or(file);
+        assert_eq!(settings.port, Some(4101));
+        assert_eq!(settings.ws_port, Some(4202));
+        assert_eq!(settings.quic_port, None);
+    }
+
+    #[test]
+    fn load_reads_the_file_under_the_flags() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("relay.toml");
+        fs::write(&path, "port = 4201\nws-port = 4202\n").unwrap();
+        let flags = Settings {
+            port: Some(4101),
+            ..Settings::default()
+        };
+        let config = Config::load(Some(&path), flags).unwrap();
+        assert_eq!(config.port, 4101);
+        assert_eq!(config.ws_port, 4202);
+        assert_eq!(config.quic_port, 4101);
+    }
+
+    #[test]
+    fn load_rejects_unknown_file_settings() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("relay.toml");
+        fs::write(&path, "prot = 4201\n").unwrap();
+        let err = Config::load(Some(&path), Settings::default()).unwrap_err();
+        assert!(matches!(err, ConfigError::Parse { .. }), "{err:?}");
+    }
+
+    #[test]
+    fn defaults_are_valid() {
+        Config::resolve(Settings::default()).unwrap();
+    }
+
+    #[test]
+    fn validate_rejects_a_cert_without_its_key() {
+        let settings = Settings {
+            tls_cert: Some("cert.pem".into()),
+            ..Settings::default()
+        };
+        assert_eq!(rejected(settings), "tls-key");
+    }
+
+    #[test]
+    fn validate_rejects_forwarded_headers_from_anyone() {
+        let settings = Settings {
+            forwarded_headers: Some(true),
+            ..Settings::default()
+        };
+        assert_eq!(rejected(settings), "trusted-proxies");
+        let settings = Settings {
+            proxy_protocol: Some(true),
+            ..Settings::default()
+        };
+        assert_eq!(rejected(settings), "trusted-proxies");
+    }
+
+    #[test]
+    fn validate_rejects_conflicting_identity_sources() {
+        let settings = Settings {
+            identity_env: Some("SUTRO_KEY".into()),
+            identity_stdin: Some(true),
+            ..Settings::default()
+        };
+        assert_eq!(rejected(settings), "identity-stdin");
+    }
+
+    #[test]
+    fn validate_rejects_out_of_range_values() {
+        let settings = Settings {
+            ws_path: Some("ws".into()),
+            ..Settings::default()
+        };
+        assert_eq!(rejected(settings), "ws-path");
+        let settings = Settings {
+            capacity_granularity: Some(101),
+            ..Settings::default()
+        };
+        assert_eq!(rejected(settings), "capacity-granularity");
+        let settings = Settings {
+            reservation_token_secret: Some("too short".into()),
+            ..Settings::default()
+        };
+        assert_eq!(rejected(settings), "reservation-token-secret");
+        let settings = Settings {
+            cluster_sync_interval: Some(Duration::ZERO),
+            ..Settings::default()
+        };
+        assert_eq!(rejected(settings), "cluster-sync-interval");
+    }
+}
@@ -0,0 +1,177 @@
+//! Caps established connections at --max-connections, of which at most
+//! --max-incoming-connections inbound, and --max-connections-per-peer per
+//! peer. Unlike libp2p's connection limits these can be changed while
+//! running; connections already over a lowered limit are left open.
+
+use std::{
+    collections::{HashMap, HashSet},
+    convert::Infallible,
+    fmt,
+    task::{Context, Poll},
+};
+
+use libp2p::{
+    Multiaddr, PeerId,
+    core::{Endpoint, transport::PortUse},
+    swarm::{
+        ConnectionClosed, ConnectionDenied, ConnectionId, FromSwarm, NetworkBehaviour, THandler,
+        THandlerInEvent, THandlerOutEvent, ToSwarm, dummy,
+    },
+};
+use tracing::debug;
+
+use crate::config::Config;
+
+#[derive(Debug, Default, Clone, Copy, PartialEq)]
+pub struct Limits {
+    max: Option<u32>,
+    max_incoming: Option<u32>,
+    max_per_peer: Option<u32>,
+}
+
+impl Limits {
+    pub fn from_config(config: &Config) -> Self {
+        Self {
+            max: config.max_connections,
+            max_incoming: config.max_incoming_connections,
+            max_per_peer: config.max_connections_per_peer,
+        }
+    }
+}
+
+#[derive(Debug)]
+struct LimitReached(&'static str, u32);
+
+impl fmt::Display for LimitReached {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "already {} {}", self.1, self.0)
+    }
+}
+
+impl std::error::Error for LimitReached {}
+
+fn check(kind: &'static str, count: usize, max: Option<u32>) -> Result<(), ConnectionDenied> {
+    let Some(max) = max else {
+        return Ok(());
+    };
+    if count < max as usize {
+        return Ok(());
+    }
+    Err(ConnectionDenied::new(LimitReached(kind, max)))
+}
+
+pub struct Behaviour {
+    limits: Limits,
+    incoming: HashSet<ConnectionId>,
+    outgoing: HashSet<ConnectionId>,
+    by_peer: HashMap<PeerId, HashSet<ConnectionId>>,
+}
+
+impl Behaviour {
+    pub fn new(limits: Limits) -> Self {
+        Self {
+            limits,
+            incoming: HashSet::new(),
+            outgoing: HashSet::new(),
+            by_peer: HashMap::new(),
+        }
+    }
+
+    pub fn set_limits(&mut self, limits: Limits) {
+        self.limits = limits;
+    }
+
+    fn check_established(&self, peer: &PeerId) -> Result<(), ConnectionDenied> {
+        let total = self.incoming.len() + self.outgoing.len();
+        check("connections", total, self.limits.max)?;
+        let of_peer = self.by_peer.get(peer).map_or(0, HashSet::len);
+        check(
+            "connections to this peer",
+            of_peer,
+            self.limits.max_per_peer,
+        )
+    }
+}
+
+impl NetworkBehaviour for Behaviour {
+    type ConnectionHandler = dummy::ConnectionHandler;
+    type ToSwarm = Infallible;
+
+    fn handle_established_inbound_connection(
+        &mut self,
+        _connection_id: ConnectionId,
+        peer: PeerId,
+        _local_addr: &Multiaddr,
+        remote_addr: &Multiaddr,
+    ) -> Result<THandler<Self>, ConnectionDenied> {
+        check(
+            "incoming connections",
+            self.incoming.len(),
+            self.limits.max_incoming,
+        )
+        .and_then(|()| self.check_established(&peer))
+        .inspect_err(|e| debug!(%peer, %remote_addr, "Connection refused: {e}"))?;
+        Ok(dummy::ConnectionHandler)
+    }
+
+    fn handle_established_outbound_connection(
+        &mut self,
+        _connection_id: ConnectionId,
+        peer: PeerId,
+        addr: &Multiaddr,
+        _role_override: Endpoint,
+        _port_use: PortUse,
+    ) -> Result<THandler<Self>, ConnectionDenied> {
+        self.check_established(&peer)
+            .inspect_err(|e| debug!(%peer, %addr, "Dial dropped: {e}"))?;
+        Ok(dummy::ConnectionHandler)
+    }
+
+    fn on_swarm_event(&mut self, event: FromSwarm) {
+        match event {
+            FromSwarm::ConnectionEstablished(established) => {
+                let connection_id = established.connection_id;
+                if established.endpoint.is_listener() {
+                    self.incoming.insert(connection_id);
+                } else {
+                    self.outgoing.insert(connection_id);
+                }
+                self.by_peer
+                    .entry(established.peer_id)
+                    .or_default()
+                    .insert(connection_id);
+            }
+            FromSwarm::ConnectionClosed(ConnectionClosed {
+                peer_id,
+                connection_id,
+                ..
+            }) => {
+                self.incoming.remove(&connection_id);
+                self.outgoing.remove(&connection_id);
+                if let Some(connections) = self.by_peer.get_mut(&peer_id) {
+                    connections.remove(&connection_id);
+                    if connections.is_empty() {
+                        self.by_peer.remove(&peer_id);
+                    }
+                }
+            }
+            _ => {}
+        }
+    }
+
+    fn on_connection_handler_event(
+        &mut self,
+        _peer: PeerId,
+        _connection_id: ConnectionId,
+        event: THandlerOutEvent<Self>,
+    ) {
+        match event {}
+    }
+
+    fn poll(
+        &mut self,
+        _cx: &mut Context<'_>,
+    ) -> Poll<ToSwarm<Self::ToSwarm, THandlerInEvent<Self>>> {
+        Poll::Pending
+    }
+}
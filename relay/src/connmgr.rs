@@ -0,0 +1,57 @@
+use std::time::{Duration, Instant};
+
+use libp2p::{PeerId, swarm::ConnectionId};
+
+/// Keeps the number of open connections between two watermarks. Once more
+/// than `high` are open, connections past their grace period whose peer
+/// holds no reservation, takes part in no circuit and is not a --peering
+/// relay are closed, newest first, until `low` remain. Connections are
+/// tracked even while trimming is off so it can be turned on by a reload.
+pub struct ConnManager {
+    watermarks: Option<(usize, usize)>,
+    grace: Duration,
+    open: Vec<(ConnectionId, PeerId, Instant)>,
+}
+
+impl ConnManager {
+    /// `watermarks` are `(low, high)`; `None` never trims.
+    pub fn new(watermarks: Option<(usize, usize)>, grace: Duration) -> Self {
+        Self {
+            watermarks,
+            grace,
+            open: Vec::new(),
+        }
+    }
+
+    pub fn set_limits(&mut self, watermarks: Option<(usize, usize)>, grace: Duration) {
+        self.watermarks = watermarks;
+        self.grace = grace;
+    }
+
+    pub fn connected(&mut self, connection: ConnectionId, peer: PeerId) {
+        self.open.push((connection, peer, Instant::now()));
+    }
+
+    pub fn disconnected(&mut self, connection: ConnectionId) {
+        self.open.retain(|(id, _, _)| *id != connection);
+    }
+
+    /// Connections to close to get back under the low watermark. `busy`
+    /// tells whether a peer is doing relay work and must be kept.
+    pub fn trim(&self, busy: impl Fn(&PeerId) -> bool) -> Vec<ConnectionId> {
+        let Some((low, high)) = self.watermarks else {
+            return Vec::new();
+        };
+        if self.open.len() <= high {
+            return Vec::new();
+        }
+        let now = Instant::now();
+        self.open
+            .iter()
+            .rev()
+            .filter(|(_, peer, since)| now.duration_since(*since) >= self.grace && !busy(peer))
+            .take(self.open.len() - low)
+            .map(|(id, _, _)| *id)
+            .collect()
+    }
+}
@@ -0,0 +1,139 @@
+//! Sharing state between replicas, such as ACME certificates and cluster
+//! reservations, through Consul's KV store, with the agent address and token
+//! taken from the environment as the `consul` CLI does.
+
+use std::{env, error::Error, time::Duration};
+
+use base64::{Engine, engine::general_purpose::STANDARD as BASE64};
+use reqwest::{Client, RequestBuilder, StatusCode};
+use serde::Deserialize;
+use serde_json::json;
+
+#[derive(Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct Entry {
+    key: String,
+    value: Option<String>,
+}
+
+#[derive(Deserialize)]
+struct Session {
+    #[serde(rename = "ID")]
+    id: String,
+}
+
+pub struct Consul {
+    client: Client,
+    addr: String,
+    token: Option<String>,
+    prefix: String,
+}
+
+impl Consul {
+    /// Keys under `prefix` on the agent at `CONSUL_HTTP_ADDR`, or the local
+    /// agent if that is unset.
+    pub fn from_env(prefix: &str) -> Self {
+        let addr = env::var("CONSUL_HTTP_ADDR").unwrap_or_else(|_| "127.0.0.1:8500".into());
+        let addr = if addr.contains("://") {
+            addr.trim_end_matches('/').to_owned()
+        } else {
+            format!("http://{addr}")
+        };
+        Self {
+            client: Client::new(),
+            addr,
+            token: env::var("CONSUL_HTTP_TOKEN").ok(),
+            prefix: prefix.trim_matches('/').to_owned(),
+        }
+    }
+
+    pub async fn get(&self, key: &str) -> Result<Option<Vec<u8>>, Box<dyn Error + Send + Sync>> {
+        let response = self.request(self.client.get(self.url(key)).query(&[("raw", "")]));
+        let response = response.send().await?;
+        if response.status() == StatusCode::NOT_FOUND {
+            return Ok(None);
+        }
+        Ok(Some(response.error_for_status()?.bytes().await?.to_vec()))
+    }
+
+    pub async fn put(&self, key: &str, value: Vec<u8>) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let request = self.request(self.client.put(self.url(key)).body(value));
+        request.send().await?.error_for_status()?;
+        Ok(())
+    }
+
+    /// Every key under `dir` with its value.
+    pub async fn list(
+        &self,
+        dir: &str,
+    ) -> Result<Vec<(String, Vec<u8>)>, Box<dyn Error + Send + Sync>> {
+        let response = self.request(self.client.get(self.url(dir)).query(&[("recurse", "")]));
+        let response = response.send().await?;
+        if response.status() == StatusCode::NOT_FOUND {
+            return Ok(Vec::new());
+        }
+        let entries: Vec<Entry> = response.error_for_status()?.json().await?;
+        entries
+            .into_iter()
+            .map(|entry| {
+                let value = BASE64.decode(entry.value.unwrap_or_default())?;
+                Ok((entry.key, value))
+            })
+            .collect()
+    }
+
+    pub async fn delete(&self, key: &str) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let request = self.request(self.client.delete(self.url(key)));
+        request.send().await?.error_for_status()?;
+        Ok(())
+    }
+
+    /// Open a session that lapses after `ttl` unless destroyed first,
+    /// releasing the locks it holds either way.
+    pub async fn create_session(
+        &self,
+        name: &str,
+        ttl: Duration,
+    ) -> Result<String, Box<dyn Error + Send + Sync>> {
+        let body = json!({ "Name": name, "TTL": format!("{}s", ttl.as_secs()) });
+        let url = format!("{}/v1/session/create", self.addr);
+        let request = self.request(self.client.put(url).json(&body));
+        let session: Session = request.send().await?.error_for_status()?.json().await?;
+        Ok(session.id)
+    }
+
+    /// Take the lock on `key` for `session`, which fails while another
+    /// session holds it.
+    pub async fn acquire(
+        &self,
+        key: &str,
+        session: &str,
+    ) -> Result<bool, Box<dyn Error + Send + Sync>> {
+        let request = self.request(
+            self.client
+                .put(self.url(key))
+                .query(&[("acquire", session)]),
+        );
+        Ok(request.send().await?.error_for_status()?.json().await?)
+    }
+
+    pub async fn destroy_session(&self, session: &str) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let url = format!("{}/v1/session/destroy/{session}", self.addr);
+        self.request(self.client.put(url))
+            .send()
+            .await?
+            .error_for_status()?;
+        Ok(())
+    }
+
+    fn url(&self, key: &str) -> String {
+        format!("{}/v1/kv/{}/{key}", self.addr, self.prefix)
+    }
+
+    fn request(&self, request: RequestBuilder) -> RequestBuilder {
+        match &self.token {
+            Some(token) => request.header("X-Consul-Token", token),
+            None => request,
+        }
+    }
+}
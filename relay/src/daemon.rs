@@ -0,0 +1,33 @@
+//! `--daemon`: detaching from the terminal on Unix. This forks, so it has to
+//! happen before the Tokio runtime starts any threads.
+
+use sunset_relay::startup::StartupError;
+
+use crate::ConfigArgs;
+
+/// Move into the background if the configuration asks to, leaving the
+/// parent to exit. The working directory is kept so relative paths still
+/// resolve, and standard streams go to /dev/null. A configuration that does
+/// not load is left for [`crate::setup`] to report once logging is up.
+#[cfg(unix)]
+pub fn detach(args: &ConfigArgs) -> Result<(), StartupError> {
+    use sunset_relay::config::Config;
+
+    let Ok(config) = Config::load(args.config.as_deref(), args.settings.clone()) else {
+        return Ok(());
+    };
+    if !config.daemon {
+        return Ok(());
+    }
+    let dir = std::env::current_dir()
+        .map_err(|e| StartupError::service("detach from the terminal", e))?;
+    daemonize::Daemonize::new()
+        .working_directory(dir)
+        .start()
+        .map_err(|e| StartupError::service("detach from the terminal", e))
+}
+
+#[cfg(not(unix))]
+pub fn detach(_args: &ConfigArgs) -> Result<(), StartupError> {
+    Ok(())
+}
@@ -0,0 +1,183 @@
+//! Keeping a DNS name pointed at the relay's public IPs once peers agree on
+//! them and, with --check-reachability, AutoNAT has dialed the relay back on
+//! them, so `/dns4` and `/dns6` announcements stay valid on hosts whose IP
+//! changes without a script outside the relay.
+
+use std::{error::Error, net::IpAddr, time::Duration};
+
+use libp2p::Multiaddr;
+use tokio::{
+    sync::mpsc::{self, UnboundedReceiver},
+    time,
+};
+use tracing::info;
+
+use crate::{
+    alert::Alerts,
+    cloudflare::Cloudflare,
+    config::{Config, DdnsProvider},
+    geo,
+    rfc2136::{Rfc2136, TsigKey},
+    route53::Route53,
+};
+
+/// How long to wait before retrying a failed update.
+const RETRY: Duration = Duration::from_secs(5 * 60);
+
+pub enum Provider {
+    Cloudflare(Cloudflare),
+    Route53(Route53),
+    Rfc2136(Rfc2136),
+}
+
+impl Provider {
+    /// The --ddns-provider with its credentials, if one is configured.
+    pub fn from_config(config: &Config) -> Option<Self> {
+        let provider = match config.ddns_provider? {
+            DdnsProvider::Cloudflare => {
+                let token = config
+                    .cloudflare_api_token
+                    .clone()
+                    .map(|t| t.0)
+                    .unwrap_or_default();
+                Self::Cloudflare(Cloudflare::new(token))
+            }
+            DdnsProvider::Route53 => {
+                let zone = config.route53_zone_id.as_deref().unwrap_or_default();
+                Self::Route53(Route53::from_env(zone))
+            }
+            DdnsProvider::Rfc2136 => Self::Rfc2136(Rfc2136::new(
+                config.ddns_server.clone().unwrap_or_default(),
+                config.ddns_zone.clone().unwrap_or_default(),
+                config
+                    .ddns_tsig_key
+                    .as_ref()
+                    .and_then(|key| TsigKey::parse(&key.0)),
+            )),
+        };
+        Some(provider)
+    }
+
+    /// Replace the A or AAAA record of `name` with `ip`.
+    async fn point(&self, name: &str, ip: IpAddr) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let kind = if ip.is_ipv4() { "A" } else { "AAAA" };
+        match self {
+            Self::Cloudflare(api) => api.upsert(name, kind, &ip.to_string()).await,
+            Self::Route53(api) => api.upsert(name, kind, &ip.to_string()).await,
+            Self::Rfc2136(server) => server.replace(name, ip).await,
+        }
+    }
+
+    /// Make `values` the TXT records of `name`.
+    pub async fn replace_txt(
+        &self,
+        name: &str,
+        values: &[String],
+    ) -> Result<(), Box<dyn Error + Send + Sync>> {
+        match self {
+            Self::Cloudflare(api) => api.replace_txt(name, values).await,
+            Self::Route53(api) => api.replace_txt(name, values).await,
+            Self::Rfc2136(server) => server.replace_txt(name, values).await,
+        }
+    }
+}
+
+/// Handle to the background task updating the records.
+pub struct Ddns {
+    ips: mpsc::UnboundedSender<IpAddr>,
+    /// Whether an IP also needs a successful dial-back to be published
+    dial_back: bool,
+    /// The newest IP of each family peers agree on
+    confirmed: Vec<IpAddr>,
+    /// The newest IP of each family AutoNAT reached the relay on
+    reachable: Vec<IpAddr>,
+}
+
+impl Ddns {
+    pub fn spawn(provider: Provider, name: String, alerts: Alerts, dial_back: bool) -> Self {
+        let (ips, updates) = mpsc::unbounded_channel();
+        tokio::spawn(run(provider, name, updates, alerts));
+        Self {
+            ips,
+            dial_back,
+            confirmed: Vec::new(),
+            reachable: Vec::new(),
+        }
+    }
+
+    /// Pass the IPs learned so far on to `next`, which publishes them under
+    /// its own settings.
+    pub fn hand_over(self, next: &mut Self) {
+        next.reachable = self.reachable;
+        for ip in self.confirmed {
+            next.update(ip);
+        }
+    }
+
+    /// Point the name at a new public IP of the same family that peers
+    /// agree on, once AutoNAT has reached it too if dial-backs are checked.
+    pub fn update(&mut self, ip: IpAddr) {
+        queue(&mut self.confirmed, ip);
+        self.publish(ip);
+    }
+
+    /// Record that an AutoNAT dial-back reached the relay at `addr`.
+    pub fn reachable(&mut self, addr: &Multiaddr) {
+        let Some(ip) = geo::ip_of(addr) else {
+            return;
+        };
+        if self.reachable.contains(&ip) {
+            return;
+        }
+        queue(&mut self.reachable, ip);
+        self.publish(ip);
+    }
+
+    fn publish(&self, ip: IpAddr) {
+        if !self.confirmed.contains(&ip) || self.dial_back && !self.reachable.contains(&ip) {
+            return;
+        }
+        let _ = self.ips.send(ip);
+    }
+}
+
+/// Apply the newest IP of each family, retrying failed updates until they
+/// succeed or a newer IP replaces them.
+async fn run(provider: Provider, name: String, mut ips: UnboundedReceiver<IpAddr>, alerts: Alerts) {
+    let mut pending = Vec::new();
+    loop {
+        let next = if pending.is_empty() {
+            Ok(ips.recv().await)
+        } else {
+            time::timeout(RETRY, ips.recv()).await
+        };
+        match next {
+            Ok(Some(ip)) => queue(&mut pending, ip),
+            Ok(None) => return,
+            // Time to retry what is pending.
+            Err(_) => {}
+        }
+        while let Ok(ip) = ips.try_recv() {
+            queue(&mut pending, ip);
+        }
+        for ip in std::mem::take(&mut pending) {
+            let result = provider.point(&name, ip).await.map_err(|e| e.to_string());
+            match result {
+                Ok(()) => info!("Pointed {name} at {ip}"),
+                Err(e) => {
+                    alerts.send(
+                        "ddns_update_failed",
+                        format!("Could not point {name} at {ip}: {e}"),
+                    );
+                    pending.push(ip);
+                }
+            }
+        }
+    }
+}
+
+/// Add `ip`, dropping an older one of the same family.
+fn queue(pending: &mut Vec<IpAddr>, ip: IpAddr) {
+    pending.retain(|old| old.is_ipv4() != ip.is_ipv4());
+    pending.push(ip);
+}
@@ -0,0 +1,140 @@
+//! Opt-in profiling and runtime introspection for operators. Nothing here
+//! is authenticated, so keep the listener on localhost.
+
+use std::{fs, time::Instant};
+
+use axum::{
+    Json, Router,
+    extract::State,
+    response::IntoResponse,
+    routing::get,
+};
+use serde::Serialize;
+use tokio::{net::TcpListener, runtime::Handle};
+use tracing::warn;
+
+#[derive(Serialize)]
+struct Vars {
+    version: &'static str,
+    uptime_secs: u64,
+    runtime: RuntimeVars,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    rss_bytes: Option<u64>,
+}
+
+#[derive(Serialize)]
+struct RuntimeVars {
+    workers: usize,
+    alive_tasks: usize,
+    global_queue_depth: usize,
+}
+
+/// Serve `/debug/vars` and, on Unix, CPU profiles under `/debug/pprof` on
+/// an already-bound listener.
+pub async fn serve(listener: TcpListener, started: Instant) {
+    let app = Router::new().route("/debug/vars", get(vars));
+    #[cfg(unix)]
+    let app = app
+        .route("/debug/pprof/profile", get(profiling::profile))
+        .route("/debug/pprof/flamegraph", get(profiling::flamegraph));
+    let app = app.with_state(started);
+    if let Err(e) = axum::serve(listener, app).await {
+        warn!("Debug server stopped: {e}");
+    }
+}
+
+async fn vars(State(started): State<Instant>) -> impl IntoResponse {
+    let metrics = Handle::current().metrics();
+    Json(Vars {
+        version: env!("CARGO_PKG_VERSION"),
+        uptime_secs: started.elapsed().as_secs(),
+        runtime: RuntimeVars {
+            workers: metrics.num_workers(),
+            alive_tasks: metrics.num_alive_tasks(),
+            global_queue_depth: metrics.global_queue_depth(),
+        },
+        rss_bytes: rss_bytes(),
+    })
+}
+
+/// Resident set size from `/proc`, where available.
+fn rss_bytes() -> Option<u64> {
+    let status = fs::read_to_string("/proc/self/status").ok()?;
+    let line = status.lines().find(|line| line.starts_with("VmRSS:"))?;
+    let kb: u64 = line.split_whitespace().nth(1)?.parse().ok()?;
+    Some(kb * 1024)
+}
+
+#[cfg(unix)]
+mod profiling {
+    use std::{thread, time::Duration};
+
+    use axum::{
+        extract::Query,
+        http::{StatusCode, header},
+        response::{IntoResponse, Response},
+    };
+    use pprof::{ProfilerGuardBuilder, Report, protos::Message};
+    use serde::Deserialize;
+    use tokio::task;
+
+    const DEFAULT_SECONDS: u64 = 30;
+    const MAX_SECONDS: u64 = 300;
+
+    #[derive(Deserialize)]
+    pub struct Params {
+        seconds: Option<u64>,
+    }
+
+    /// A CPU profile in the pprof protobuf format, for `go tool pprof`.
+    pub async fn profile(Query(params): Query<Params>) -> Response {
+        match sample(params).await {
+            Ok(report) => match report.pprof() {
+                Ok(profile) => (
+                    [(header::CONTENT_TYPE, "application/octet-stream")],
+                    profile.encode_to_vec(),
+                )
+                    .into_response(),
+                Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+            },
+            Err(response) => response,
+        }
+    }
+
+    /// A CPU profile rendered as an SVG flame graph.
+    pub async fn flamegraph(Query(params): Query<Params>) -> Response {
+        match sample(params).await {
+            Ok(report) => {
+                let mut svg = Vec::new();
+                match report.flamegraph(&mut svg) {
+                    Ok(()) => ([(header::CONTENT_TYPE, "image/svg+xml")], svg).into_response(),
+                    Err(e) => (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response(),
+                }
+            }
+            Err(response) => response,
+        }
+    }
+
+    /// Sample the whole process for the requested number of seconds. Only
+    /// one profile can run at a time.
+    async fn sample(params: Params) -> Result<Report, Response> {
+        let seconds = params
+            .seconds
+            .unwrap_or(DEFAULT_SECONDS)
+            .clamp(1, MAX_SECONDS);
+        let report = task::spawn_blocking(move || {
+            let guard = ProfilerGuardBuilder::default()
+                .frequency(99)
+                .blocklist(&["libc", "libgcc", "pthread", "vdso"])
+                .build()?;
+            thread::sleep(Duration::from_secs(seconds));
+            guard.report().build()
+        })
+        .await;
+        match report {
+            Ok(Ok(report)) => Ok(report),
+            Ok(Err(e)) => Err((StatusCode::CONFLICT, e.to_string()).into_response()),
+            Err(_) => Err(StatusCode::INTERNAL_SERVER_ERROR.into_response()),
+        }
+    }
+}
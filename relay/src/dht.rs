@@ -0,0 +1,88 @@
+//! Taking part in the public libp2p DHT and advertising the relay there
+//! under the namespace AutoRelay clients look relays up by, so they can find
+//! it without being given its address.
+
+use libp2p::{
+    PeerId,
+    core::multiaddr::Protocol,
+    identify,
+    kad::{self, QueryResult, RecordKey, store::MemoryStore, store::RecordStore},
+};
+use sha2::{Digest, Sha256};
+use tracing::{info, warn};
+
+use crate::config::{Config, DhtMode};
+
+/// The rendezvous go-libp2p advertises and discovers circuit relays under.
+const RELAY_NAMESPACE: &str = "/libp2p/relay";
+
+pub type Behaviour = kad::Behaviour<MemoryStore>;
+
+/// A DHT node in the --dht mode, if any, that starts joining through
+/// --bootstrap as soon as the swarm runs. A client still advertises the
+/// relay; it just does not answer other peers' queries.
+pub fn behaviour(local_peer_id: PeerId, config: &Config) -> Option<Behaviour> {
+    let mode = match config.dht {
+        DhtMode::Off => return None,
+        DhtMode::Client => kad::Mode::Client,
+        DhtMode::Server => kad::Mode::Server,
+    };
+    let mut dht = kad::Behaviour::with_config(
+        local_peer_id,
+        MemoryStore::new(local_peer_id),
+        kad::Config::new(kad::PROTOCOL_NAME),
+    );
+    dht.set_mode(Some(mode));
+    for addr in &config.bootstrap {
+        if let Some(Protocol::P2p(peer)) = addr.iter().last() {
+            dht.add_address(&peer, addr.clone());
+        }
+    }
+    if let Err(e) = dht.bootstrap() {
+        warn!("Not joining the DHT: {e}");
+    }
+    Some(dht)
+}
+
+/// The provider key for the relay namespace: the multihash in the CID
+/// go-libp2p derives from it.
+fn relay_key() -> RecordKey {
+    let mut multihash = vec![0x12, 0x20];
+    multihash.extend_from_slice(&Sha256::digest(RELAY_NAMESPACE));
+    RecordKey::new(&multihash)
+}
+
+/// Add the addresses of an identified peer that serves the DHT.
+pub fn learn(dht: &mut Behaviour, peer: PeerId, info: &identify::Info) {
+    if !info.protocols.contains(&kad::PROTOCOL_NAME) {
+        return;
+    }
+    for addr in &info.listen_addrs {
+        dht.add_address(&peer, addr.clone());
+    }
+}
+
+/// Follow the relay's own queries, starting to advertise it once the first
+/// bootstrap has found peers to hold the record. The DHT republishes it
+/// from then on.
+pub fn on_event(dht: &mut Behaviour, event: &kad::Event) {
+    let kad::Event::OutboundQueryProgressed { result, step, .. } = event else {
+        return;
+    };
+    match result {
+        QueryResult::Bootstrap(Ok(_)) if step.last => {
+            if dht.store_mut().provided().next().is_some() {
+                return;
+            }
+            if let Err(e) = dht.start_providing(relay_key()) {
+                warn!("Could not advertise the relay on the DHT: {e}");
+            }
+        }
+        QueryResult::Bootstrap(Err(e)) => warn!("DHT bootstrap failed: {e}"),
+        QueryResult::StartProviding(Ok(_)) => info!("Advertising the relay on the DHT"),
+        QueryResult::StartProviding(Err(e)) => {
+            warn!("Could not advertise the relay on the DHT: {e}")
+        }
+        _ => {}
+    }
+}
@@ -0,0 +1,109 @@
+//! A snapshot of the relay's internals for debugging one that is hung or
+//! overloaded: everything in [`Status`], how close each limit is to being
+//! hit, the active bans, and how busy the Tokio runtime is.
+
+use libp2p::{Swarm, swarm::NetworkBehaviour};
+use serde::Serialize;
+use tokio::{runtime::Handle, sync::oneshot};
+
+use crate::{abuse::Bans, admin::Status, config::Config, limits::RelayLimits};
+
+pub type Query = oneshot::Sender<Diagnostics>;
+
+#[derive(Debug, Serialize)]
+pub struct Diagnostics {
+    pub status: Status,
+    pub limits: Vec<LimitInfo>,
+    pub banned_peers: usize,
+    pub runtime: RuntimeInfo,
+}
+
+/// How much of a limit is in use. For per-peer and per-IP limits, `used`
+/// is the busiest peer or IP.
+#[derive(Debug, Serialize)]
+pub struct LimitInfo {
+    pub limit: &'static str,
+    pub used: usize,
+    /// Unset if the limit is disabled
+    pub max: Option<usize>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct RuntimeInfo {
+    pub workers: usize,
+    pub alive_tasks: usize,
+    pub global_queue_depth: usize,
+}
+
+impl RuntimeInfo {
+    /// The runtime this is called on. Answers even when the relay's event
+    /// loop is stuck.
+    pub fn current() -> Self {
+        let metrics = Handle::current().metrics();
+        Self {
+            workers: metrics.num_workers(),
+            alive_tasks: metrics.num_alive_tasks(),
+            global_queue_depth: metrics.global_queue_depth(),
+        }
+    }
+}
+
+pub fn snapshot<B: NetworkBehaviour>(
+    status: Status,
+    swarm: &Swarm<B>,
+    config: &Config,
+    bans: &Bans,
+    relay_limits: &RelayLimits,
+) -> Diagnostics {
+    let info = swarm.network_info();
+    let counters = info.connection_counters();
+    let limit = |limit: &'static str, used: u32, max: Option<u32>| LimitInfo {
+        limit,
+        used: used as usize,
+        max: max.map(|max| max as usize),
+    };
+    let reservations = status.reservations.iter().map(|r| r.count);
+    let limits = vec![
+        LimitInfo {
+            limit: "reservations",
+            used: reservations.clone().sum(),
+            max: Some(config.max_reservations),
+        },
+        LimitInfo {
+            limit: "reservations_per_peer",
+            used: reservations.max().unwrap_or(0),
+            max: Some(config.max_reservations_per_peer),
+        },
+        LimitInfo {
+            limit: "circuits",
+            used: status.circuits.len(),
+            max: Some(config.max_circuits),
+        },
+        LimitInfo {
+            limit: "circuits_per_ip",
+            used: relay_limits.busiest_ip(),
+            max: config.max_circuits_per_ip,
+        },
+        limit(
+            "connections",
+            counters.num_established(),
+            config.max_connections,
+        ),
+        limit(
+            "incoming_connections",
+            counters.num_established_incoming(),
+            config.max_incoming_connections,
+        ),
+        limit(
+            "pending_handshakes",
+            counters.num_pending_incoming(),
+            Some(config.max_pending_handshakes),
+        ),
+    ];
+    Diagnostics {
+        status,
+        limits,
+        banned_peers: bans.active().len(),
+        runtime: RuntimeInfo::current(),
+    }
+}
@@ -0,0 +1,146 @@
+//! Dialing the peers the relay is configured to connect to, retrying with
+//! backoff: --bootstrap peers until each has been reached once, so a relay
+//! that starts before its network is reachable still joins it, and
+//! --peering relays whenever their last connection drops, so a fleet stays
+//! meshed.
+
+use std::{
+    collections::HashMap,
+    time::{Duration, Instant},
+};
+
+use libp2p::{Multiaddr, PeerId, core::multiaddr::Protocol};
+
+const FIRST_RETRY: Duration = Duration::from_secs(5);
+const MAX_RETRY: Duration = Duration::from_secs(10 * 60);
+
+enum State {
+    Due(Instant),
+    Dialing,
+    Connected,
+}
+
+struct Peer {
+    addr: Multiaddr,
+    /// Redial after every disconnect rather than forgetting the peer once
+    /// it has been reached.
+    keep: bool,
+    backoff: Duration,
+    state: State,
+}
+
+pub struct Dialer {
+    peers: HashMap<PeerId, Peer>,
+}
+
+impl Dialer {
+    /// Every peer is due straight away. Addresses without a /p2p suffix
+    /// are rejected by validation and skipped here.
+    pub fn new(bootstrap: &[Multiaddr], peering: &[Multiaddr]) -> Self {
+        Self {
+            peers: listed(bootstrap, peering).collect(),
+        }
+    }
+
+    /// Follow changed peer lists. Peers still listed keep their state,
+    /// dropped ones are no longer dialed and new ones are due straight away,
+    /// bootstrap peers already reached included.
+    pub fn set(&mut self, bootstrap: &[Multiaddr], peering: &[Multiaddr]) {
+        let mut old = std::mem::take(&mut self.peers);
+        self.peers = listed(bootstrap, peering)
+            .map(|(id, mut peer)| {
+                if let Some(old) = old.remove(&id) {
+                    peer.backoff = old.backoff;
+                    peer.state = old.state;
+                }
+                (id, peer)
+            })
+            .collect();
+    }
+
+    /// Whether connections to `peer` must be kept open.
+    pub fn is_peering(&self, peer: &PeerId) -> bool {
+        self.peers.get(peer).is_some_and(|peer| peer.keep)
+    }
+
+    /// When the next dial is due, if one is waiting.
+    pub fn next(&self) -> Option<Instant> {
+        self.peers
+            .values()
+            .filter_map(|peer| match peer.state {
+                State::Due(at) => Some(at),
+                _ => None,
+            })
+            .min()
+    }
+
+    /// The peers due for a dial by `now`, which are then considered dialing.
+    pub fn due(&mut self, now: Instant) -> Vec<(PeerId, Multiaddr)> {
+        self.peers
+            .iter_mut()
+            .filter(|(_, peer)| matches!(peer.state, State::Due(at) if at <= now))
+            .map(|(id, peer)| {
+                peer.state = State::Dialing;
+                (*id, peer.addr.clone())
+            })
+            .collect()
+    }
+
+    pub fn connected(&mut self, id: &PeerId) {
+        let Some(peer) = self.peers.get_mut(id) else {
+            return;
+        };
+        if !peer.keep {
+            self.peers.remove(id);
+            return;
+        }
+        peer.state = State::Connected;
+        peer.backoff = FIRST_RETRY;
+    }
+
+    /// Redial a peering relay shortly after its last connection closed,
+    /// returning whether it is one.
+    pub fn disconnected(&mut self, id: &PeerId) -> bool {
+        let Some(peer) = self.peers.get_mut(id).filter(|peer| peer.keep) else {
+            return false;
+        };
+        peer.state = State::Due(Instant::now() + FIRST_RETRY);
+        true
+    }
+
+    /// Schedule another dial after a failed one, returning the wait, or
+    /// `None` if `id` is not a peer being dialed.
+    pub fn failed(&mut self, id: &PeerId) -> Option<Duration> {
+        let peer = self.peers.get_mut(id)?;
+        let State::Dialing = peer.state else {
+            return None;
+        };
+        let wait = peer.backoff;
+        peer.state = State::Due(Instant::now() + wait);
+        peer.backoff = (wait * 2).min(MAX_RETRY);
+        Some(wait)
+    }
+}
+
+fn listed<'a>(
+    bootstrap: &'a [Multiaddr],
+    peering: &'a [Multiaddr],
+) -> impl Iterator<Item = (PeerId, Peer)> + 'a {
+    let now = Instant::now();
+    let bootstrap = bootstrap.iter().map(|addr| (addr, false));
+    let peering = peering.iter().map(|addr| (addr, true));
+    bootstrap
+        .chain(peering)
+        .filter_map(move |(addr, keep)| match addr.iter().last() {
+            Some(Protocol::P2p(id)) => {
+                let peer = Peer {
+                    addr: addr.clone(),
+                    keep,
+                    backoff: FIRST_RETRY,
+                    state: State::Due(now),
+                };
+                Some((id, peer))
+            }
+            _ => None,
+        })
+}
@@ -0,0 +1,90 @@
+//! Room-based peer discovery: peers announce their addresses under a room
+//! name and learn about the other peers in it.
+
+use std::{
+    collections::HashMap,
+    sync::Arc,
+    time::{Duration, Instant},
+};
+
+use libp2p::PeerId;
+use serde::{Deserialize, Serialize};
+use tokio::sync::Mutex;
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct DiscoveryRequest {
+    pub room: String,
+    pub peer_id: String,
+    pub addrs: Vec<String>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct PeerInfo {
+    pub peer_id: String,
+    pub addrs: Vec<String>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct DiscoveryResponse {
+    pub peers: Vec<PeerInfo>,
+}
+
+pub struct PeerEntry {
+    addrs: Vec<String>,
+    last_seen: Instant,
+}
+
+pub type RoomRegistry = Arc<Mutex<HashMap<String, HashMap<String, PeerEntry>>>>;
+
+const PEER_TTL: Duration = Duration::from_secs(30);
+
+pub async fn handle_discovery(
+    registry: &RoomRegistry,
+    req: DiscoveryRequest,
+) -> DiscoveryResponse {
+    let mut rooms = registry.lock().await;
+
+    // Expire stale entries in this room
+    let now = Instant::now();
+    if let Some(room) = rooms.get_mut(&req.room) {
+        room.retain(|_, entry| now.duration_since(entry.last_seen) < PEER_TTL);
+    }
+
+    // Insert/update the requesting peer
+    let room = rooms.entry(req.room.clone()).or_default();
+    room.insert(
+        req.peer_id.clone(),
+        PeerEntry {
+            addrs: req.addrs,
+            last_seen: now,
+        },
+    );
+
+    // Collect all other peers in the room
+    let peers: Vec<PeerInfo> = room
+        .iter()
+        .filter(|(pid, _)| *pid != &req.peer_id)
+        .map(|(pid, entry)| PeerInfo {
+            peer_id: pid.clone(),
+            addrs: entry.addrs.clone(),
+        })
+        .collect();
+
+    DiscoveryResponse { peers }
+}
+
+/// Clean up a peer from all rooms when they disconnect.
+pub async fn remove_peer(registry: &RoomRegistry, peer_id: &PeerId) {
+    let peer_str = peer_id.to_string();
+    let mut rooms = registry.lock().await;
+    let mut empty_rooms = Vec::new();
+    for (room_name, peers) in rooms.iter_mut() {
+        peers.remove(&peer_str);
+        if peers.is_empty() {
+            empty_rooms.push(room_name.clone());
+        }
+    }
+    for room_name in empty_rooms {
+        rooms.remove(&room_name);
+    }
+}
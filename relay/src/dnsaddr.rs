@@ -0,0 +1,138 @@
+//! `_dnsaddr` TXT records, which let clients bootstrap from `/dnsaddr/NAME`
+//! instead of a list of addresses, printed by the `dnsaddr` subcommand and
+//! kept current for --dnsaddr by the running relay.
+
+use std::{error::Error, time::Duration};
+
+use libp2p::{Multiaddr, PeerId};
+use tokio::{sync::watch, time};
+use tracing::info;
+
+use crate::{alert::Alerts, announce, config::Config, ddns::Provider, geo, listen};
+
+/// How long announced addresses must hold still before they are published,
+/// since they change in bursts at startup and on IP changes.
+const SETTLE: Duration = Duration::from_secs(10);
+/// How long to wait before retrying a failed update.
+const RETRY: Duration = Duration::from_secs(5 * 60);
+
+/// The name holding the records for `/dnsaddr/NAME`.
+pub fn host(name: &str) -> String {
+    format!("_dnsaddr.{name}")
+}
+
+/// The TXT values advertising `addrs` for `peer_id`, sorted so unchanged
+/// sets compare equal. Unspecified IPs cannot be dialed and are left out.
+pub fn records<'a>(
+    peer_id: PeerId,
+    addrs: impl IntoIterator<Item = &'a Multiaddr>,
+) -> Vec<String> {
+    let mut records: Vec<String> = addrs
+        .into_iter()
+        .filter(|addr| geo::ip_of(addr).is_none_or(|ip| !ip.is_unspecified()))
+        .filter_map(|addr| addr.clone().with_p2p(peer_id).ok())
+        .map(|addr| format!("dnsaddr={addr}"))
+        .collect();
+    records.sort();
+    records.dedup();
+    records
+}
+
+/// The addresses the relay announces that are known without running it:
+/// --announce, or else --domain, the onion service and the --external-dns
+/// variants of the listen addresses. Observed IPs are only learned from peers.
+pub fn configured(config: &Config) -> Vec<Multiaddr> {
+    let addrs = if !config.announce.is_empty() {
+        config.announce.clone()
+    } else {
+        let dns = config.external_dns.as_deref();
+        let listen = listen::plan(config).into_iter();
+        let variants = listen.filter_map(|addr| announce::dns_variant(dns?, &addr));
+        announce::domain_addr(config)
+            .into_iter()
+            .chain(config.onion_multiaddr())
+            .chain(variants)
+            .collect()
+    };
+    addrs
+        .into_iter()
+        .filter(|addr| !config.no_announce.iter().any(|f| f.matches(addr)))
+        .collect()
+}
+
+/// Make `records` the TXT records for `/dnsaddr/NAME` through
+/// --ddns-provider.
+pub async fn publish(
+    config: &Config,
+    name: &str,
+    records: &[String],
+) -> Result<(), Box<dyn Error + Send + Sync>> {
+    let provider = Provider::from_config(config).ok_or("--ddns-provider is not set")?;
+    provider.replace_txt(&host(name), records).await
+}
+
+/// Handle to the background task keeping --dnsaddr's records current.
+pub(crate) struct Publisher {
+    records: watch::Sender<Vec<String>>,
+}
+
+impl Publisher {
+    pub(crate) fn spawn(provider: Provider, name: String, alerts: Alerts) -> Self {
+        let (records, updates) = watch::channel(Vec::new());
+        tokio::spawn(run(provider, name, updates, alerts));
+        Self { records }
+    }
+
+    /// Publish `records` once the announced addresses settle.
+    pub(crate) fn update(&self, records: Vec<String>) {
+        self.records.send_if_modified(|current| {
+            let changed = *current != records;
+            *current = records;
+            changed
+        });
+    }
+}
+
+/// Publish the latest records whenever they change, retrying failures until
+/// they succeed. An empty set is never published, so a relay that briefly
+/// announces nothing leaves the last good records in place.
+async fn run(
+    provider: Provider,
+    name: String,
+    mut updates: watch::Receiver<Vec<String>>,
+    alerts: Alerts,
+) {
+    let host = host(&name);
+    let mut published = Vec::new();
+    loop {
+        if updates.changed().await.is_err() {
+            return;
+        }
+        time::sleep(SETTLE).await;
+        let records = updates.borrow_and_update().clone();
+        if records.is_empty() || records == published {
+            continue;
+        }
+        let result = provider
+            .replace_txt(&host, &records)
+            .await
+            .map_err(|e| e.to_string());
+        match result {
+            Ok(()) => {
+                info!(
+                    records = records.len(),
+                    "Published dnsaddr records at {host}"
+                );
+                published = records;
+            }
+            Err(e) => {
+                alerts.send(
+                    "dnsaddr_update_failed",
+                    format!("Could not publish {host}: {e}"),
+                );
+                time::sleep(RETRY).await;
+                updates.mark_changed();
+            }
+        }
+    }
+}
@@ -0,0 +1,41 @@
+use std::{sync::Arc, time::Instant};
+
+use libp2p::{Multiaddr, PeerId, relay};
+use tokio::sync::watch;
+use tracing::debug;
+
+/// Maintenance mode: once started, new reservations and circuits are refused
+/// while open circuits run to completion, after which the relay exits.
+/// Plugged into the relay as a rate limiter for both.
+#[derive(Clone)]
+pub struct Drain(Arc<watch::Sender<bool>>);
+
+impl Drain {
+    pub fn new() -> Self {
+        Self(Arc::new(watch::Sender::new(false)))
+    }
+
+    /// Start draining. Returns false if the relay was already draining.
+    pub fn start(&self) -> bool {
+        !self.0.send_replace(true)
+    }
+
+    pub fn is_draining(&self) -> bool {
+        *self.0.borrow()
+    }
+
+    /// Resolve once draining has started.
+    pub async fn started(&self) {
+        let _ = self.0.subscribe().wait_for(|draining| *draining).await;
+    }
+}
+
+impl relay::RateLimiter for Drain {
+    fn try_next(&mut self, peer: PeerId, _addr: &Multiaddr, _now: Instant) -> bool {
+        let draining = self.is_draining();
+        if draining {
+            debug!(peer = %peer, "Refused while draining");
+        }
+        !draining
+    }
+}
@@ -0,0 +1,58 @@
+//! State dumps on SIGUSR1, for looking inside a hung or overloaded relay
+//! without restarting it.
+
+use std::{
+    path::{Path, PathBuf},
+    time::Duration,
+};
+
+use serde::Serialize;
+use sunset_relay::{Relay, RuntimeInfo};
+use tokio::{
+    fs,
+    signal::unix::{SignalKind, signal},
+    sync::watch,
+    time,
+};
+use tracing::{info, warn};
+
+/// How long to wait for the event loop to answer before dumping only what
+/// the runtime can say about itself.
+const ANSWER_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// Dump the relay's diagnostics to the log, or to the latest `file`,
+/// whenever the process receives SIGUSR1.
+pub async fn dump_on_signal(relay: Relay, file: watch::Receiver<Option<PathBuf>>) {
+    let mut usr1 = signal(SignalKind::user_defined1()).expect("failed to install SIGUSR1 handler");
+    while usr1.recv().await.is_some() {
+        let file = file.borrow().clone();
+        match time::timeout(ANSWER_TIMEOUT, relay.diagnostics()).await {
+            Ok(Some(diagnostics)) => dump(&diagnostics, file.as_deref()).await,
+            Ok(None) => return,
+            Err(_) => {
+                warn!(
+                    "Event loop did not answer within {ANSWER_TIMEOUT:?}; dumping the runtime only"
+                );
+                dump(&RuntimeInfo::current(), file.as_deref()).await;
+            }
+        }
+    }
+}
+
+async fn dump(state: &impl Serialize, file: Option<&Path>) {
+    let Some(path) = file else {
+        match serde_json::to_string(state) {
+            Ok(json) => info!("State dump: {json}"),
+            Err(e) => warn!("Could not serialize state dump: {e}"),
+        }
+        return;
+    };
+    let written = match serde_json::to_vec_pretty(state) {
+        Ok(json) => fs::write(path, json).await,
+        Err(e) => Err(e.into()),
+    };
+    match written {
+        Ok(()) => info!("Wrote state dump to {}", path.display()),
+        Err(e) => warn!("Could not write state dump to {}: {e}", path.display()),
+    }
+}
@@ -0,0 +1,332 @@
+//! Deterministic failure points for resilience tests. They are no-ops unless
+//! the relay is built with the `fault-injection` feature, in which case they
+//! are driven by `SUTRO_FAULTS`, a comma-separated list such as
+//! `listen:quic,cert,slow-dial:2s`, and by [`inject`] and [`clear`] for tests
+//! that embed the relay.
+
+#[cfg(not(feature = "fault-injection"))]
+pub use disabled::{Faulty, check_cert, check_identity, check_listen, muxer, relay_event};
+#[cfg(feature = "fault-injection")]
+pub use injected::{Fault, clear, inject};
+#[cfg(feature = "fault-injection")]
+pub(crate) use injected::{Faulty, check_cert, check_identity, check_listen, muxer, relay_event};
+
+#[cfg(not(feature = "fault-injection"))]
+mod disabled {
+    use std::io;
+
+    use libp2p::{Multiaddr, PeerId, relay};
+
+    pub type Faulty<M> = M;
+
+    pub fn check_listen(_addr: &Multiaddr) -> io::Result<()> {
+        Ok(())
+    }
+
+    pub fn check_identity() -> io::Result<()> {
+        Ok(())
+    }
+
+    pub fn check_cert() -> io::Result<()> {
+        Ok(())
+    }
+
+    pub fn muxer<M>(_peer: PeerId, muxer: M) -> M {
+        muxer
+    }
+
+    pub fn relay_event(_event: &relay::Event) {}
+}
+
+#[cfg(feature = "fault-injection")]
+mod injected {
+    use std::{
+        collections::HashSet,
+        io,
+        pin::Pin,
+        str::FromStr,
+        sync::{LazyLock, RwLock},
+        task::{Context, Poll, ready},
+        time::Duration,
+    };
+
+    use futures::{AsyncRead, AsyncWrite};
+    use libp2p::{
+        Multiaddr, PeerId,
+        core::muxing::{StreamMuxer, StreamMuxerEvent},
+        relay,
+    };
+    use tokio::time::{self, Sleep};
+    use tracing::warn;
+
+    use crate::addrs::transport_name;
+
+    /// How often a stalled stream checks whether it has been released.
+    const RECHECK: Duration = Duration::from_millis(50);
+
+    /// A failure to inject, as named in `SUTRO_FAULTS`.
+    #[derive(Debug, Clone, PartialEq, Eq)]
+    pub enum Fault {
+        /// `listen:<transport>`: fail listening on addresses over the
+        /// transport, such as `quic` or `websocket`.
+        Listen(String),
+        /// `identity`: fail loading the identity.
+        Identity,
+        /// `cert`: fail loading the WebSocket TLS certificate, at startup
+        /// and on reload.
+        Cert,
+        /// `stuck-circuit`: circuits opened from now on stop moving data
+        /// without closing, until the fault is cleared.
+        StuckCircuit,
+        /// `slow-dial:<duration>`: hold each stream the relay opens for
+        /// this long, which includes the stream that connects a circuit to
+        /// its destination.
+        SlowDial(Duration),
+    }
+
+    impl FromStr for Fault {
+        type Err = String;
+
+        fn from_str(s: &str) -> Result<Self, Self::Err> {
+            match s.split_once(':') {
+                Some(("listen", transport)) => Ok(Fault::Listen(transport.to_string())),
+                Some(("slow-dial", delay)) => humantime::parse_duration(delay)
+                    .map(Fault::SlowDial)
+                    .map_err(|e| format!("{s:?}: {e}")),
+                None if s == "identity" => Ok(Fault::Identity),
+                None if s == "cert" => Ok(Fault::Cert),
+                None if s == "stuck-circuit" => Ok(Fault::StuckCircuit),
+                _ => Err(format!("unknown fault {s:?}")),
+            }
+        }
+    }
+
+    #[derive(Default)]
+    struct Faults {
+        injected: Vec<Fault>,
+        /// Peers on either end of a stuck circuit
+        stuck: HashSet<PeerId>,
+    }
+
+    impl Faults {
+        fn has(&self, fault: &Fault) -> bool {
+            self.injected.contains(fault)
+        }
+
+        fn dial_delay(&self) -> Option<Duration> {
+            self.injected.iter().find_map(|fault| match fault {
+                Fault::SlowDial(delay) => Some(*delay),
+                _ => None,
+            })
+        }
+    }
+
+    static FAULTS: LazyLock<RwLock<Faults>> =
+        LazyLock::new(|| RwLock::new(parse(&std::env::var("SUTRO_FAULTS").unwrap_or_default())));
+
+    /// Start injecting `fault`, on top of any already injected.
+    pub fn inject(fault: Fault) {
+        warn!("Injecting fault {fault:?}");
+        FAULTS.write().unwrap().injected.push(fault);
+    }
+
+    /// Stop injecting every fault, releasing stuck circuits.
+    pub fn clear() {
+        *FAULTS.write().unwrap() = Faults::default();
+    }
+
+    fn injected(fault: &Fault) -> bool {
+        FAULTS.read().unwrap().has(fault)
+    }
+
+    fn stuck(peer: &PeerId) -> bool {
+        FAULTS.read().unwrap().stuck.contains(peer)
+    }
+
+    pub fn check_listen(addr: &Multiaddr) -> io::Result<()> {
+        if !injected(&Fault::Listen(transport_name(addr).to_string())) {
+            return Ok(());
+        }
+        Err(io::Error::new(
+            io::ErrorKind::AddrInUse,
+            format!("injected listen fault for {addr}"),
+        ))
+    }
+
+    pub fn check_identity() -> io::Result<()> {
+        if !injected(&Fault::Identity) {
+            return Ok(());
+        }
+        Err(io::Error::other("injected identity fault"))
+    }
+
+    pub fn check_cert() -> io::Result<()> {
+        if !injected(&Fault::Cert) {
+            return Ok(());
+        }
+        Err(io::Error::other("injected certificate fault"))
+    }
+
+    /// Mark both ends of circuits opened under `stuck-circuit`, and forget
+    /// them once the circuit closes.
+    pub fn relay_event(event: &relay::Event) {
+        match event {
+            relay::Event::CircuitReqAccepted {
+                src_peer_id,
+                dst_peer_id,
+            } => {
+                let mut faults = FAULTS.write().unwrap();
+                if faults.has(&Fault::StuckCircuit) {
+                    faults.stuck.extend([*src_peer_id, *dst_peer_id]);
+                }
+            }
+            relay::Event::CircuitClosed {
+                src_peer_id,
+                dst_peer_id,
+                ..
+            } => {
+                let mut faults = FAULTS.write().unwrap();
+                faults.stuck.remove(src_peer_id);
+                faults.stuck.remove(dst_peer_id);
+            }
+            _ => {}
+        }
+    }
+
+    /// Wrap the muxer of a connection to `peer` so its streams are subject
+    /// to `slow-dial` and `stuck-circuit`.
+    pub fn muxer<M>(peer: PeerId, muxer: M) -> Faulty<M> {
+        Faulty {
+            inner: muxer,
+            peer,
+            dial_delay: None,
+        }
+    }
+
+    pub struct Faulty<M> {
+        inner: M,
+        peer: PeerId,
+        dial_delay: Option<Pin<Box<Sleep>>>,
+    }
+
+    impl<M: StreamMuxer + Unpin> StreamMuxer for Faulty<M>
+    where
+        M::Substream: Unpin,
+    {
+        type Substream = FaultyStream<M::Substream>;
+        type Error = M::Error;
+
+        fn poll_inbound(
+            mut self: Pin<&mut Self>,
+            cx: &mut Context<'_>,
+        ) -> Poll<Result<Self::Substream, Self::Error>> {
+            let stream = ready!(Pin::new(&mut self.inner).poll_inbound(cx))?;
+            Poll::Ready(Ok(FaultyStream::new(stream, self.peer)))
+        }
+
+        fn poll_outbound(
+            mut self: Pin<&mut Self>,
+            cx: &mut Context<'_>,
+        ) -> Poll<Result<Self::Substream, Self::Error>> {
+            let this = &mut *self;
+            if this.dial_delay.is_none() {
+                let delay = FAULTS.read().unwrap().dial_delay();
+                this.dial_delay = delay.map(|delay| Box::pin(time::sleep(delay)));
+            }
+            if let Some(delay) = &mut this.dial_delay {
+                ready!(delay.as_mut().poll(cx));
+            }
+            let stream = ready!(Pin::new(&mut this.inner).poll_outbound(cx))?;
+            this.dial_delay = None;
+            Poll::Ready(Ok(FaultyStream::new(stream, this.peer)))
+        }
+
+        fn poll_close(
+            mut self: Pin<&mut Self>,
+            cx: &mut Context<'_>,
+        ) -> Poll<Result<(), Self::Error>> {
+            Pin::new(&mut self.inner).poll_close(cx)
+        }
+
+        fn poll(
+            mut self: Pin<&mut Self>,
+            cx: &mut Context<'_>,
+        ) -> Poll<Result<StreamMuxerEvent, Self::Error>> {
+            Pin::new(&mut self.inner).poll(cx)
+        }
+    }
+
+    /// A stream that stops moving data while its peer is on a stuck circuit.
+    pub struct FaultyStream<S> {
+        inner: S,
+        peer: PeerId,
+        recheck: Option<Pin<Box<Sleep>>>,
+    }
+
+    impl<S> FaultyStream<S> {
+        fn new(inner: S, peer: PeerId) -> Self {
+            Self {
+                inner,
+                peer,
+                recheck: None,
+            }
+        }
+
+        fn poll_released(&mut self, cx: &mut Context<'_>) -> Poll<()> {
+            loop {
+                if let Some(recheck) = &mut self.recheck {
+                    ready!(recheck.as_mut().poll(cx));
+                    self.recheck = None;
+                }
+                if !stuck(&self.peer) {
+                    return Poll::Ready(());
+                }
+                self.recheck = Some(Box::pin(time::sleep(RECHECK)));
+            }
+        }
+    }
+
+    impl<S: AsyncRead + Unpin> AsyncRead for FaultyStream<S> {
+        fn poll_read(
+            mut self: Pin<&mut Self>,
+            cx: &mut Context<'_>,
+            buf: &mut [u8],
+        ) -> Poll<io::Result<usize>> {
+            ready!(self.poll_released(cx));
+            Pin::new(&mut self.inner).poll_read(cx, buf)
+        }
+    }
+
+    impl<S: AsyncWrite + Unpin> AsyncWrite for FaultyStream<S> {
+        fn poll_write(
+            mut self: Pin<&mut Self>,
+            cx: &mut Context<'_>,
+            buf: &[u8],
+        ) -> Poll<io::Result<usize>> {
+            ready!(self.poll_released(cx));
+            Pin::new(&mut self.inner).poll_write(cx, buf)
+        }
+
+        fn poll_flush(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+            Pin::new(&mut self.inner).poll_flush(cx)
+        }
+
+        fn poll_close(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+            Pin::new(&mut self.inner).poll_close(cx)
+        }
+    }
+
+    fn parse(spec: &str) -> Faults {
+        let mut faults = Faults::default();
+        for fault in spec.split(',').map(str::trim).filter(|f| !f.is_empty()) {
+            match fault.parse() {
+                Ok(fault) => {
+                    warn!("Injecting fault {fault:?}");
+                    faults.injected.push(fault);
+                }
+                Err(e) => warn!("Ignoring injected fault: {e}"),
+            }
+        }
+        faults
+    }
+}
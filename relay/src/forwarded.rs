@@ -0,0 +1,266 @@
+//! `X-Forwarded-*` headers for relays behind an HTTP reverse proxy that
+//! shares a domain with other services. The WebSocket upgrade request is
+//! read before the connection is reported to the swarm and replayed for the
+//! WebSocket handshake, so the client named by the proxy shows up in logs,
+//! gating and metrics in place of the proxy.
+
+use std::{
+    io,
+    net::{IpAddr, SocketAddr},
+    pin::Pin,
+    task::{Context, Poll},
+    time::Duration,
+};
+
+use futures::{
+    AsyncRead, AsyncReadExt, AsyncWrite, StreamExt, TryFutureExt,
+    future::{self, BoxFuture, MapOk},
+    stream::FuturesUnordered,
+};
+use libp2p::{
+    Multiaddr,
+    core::{
+        multiaddr::Protocol,
+        transport::{DialOpts, ListenerId, Transport, TransportError, TransportEvent},
+    },
+};
+use tokio::time;
+use tracing::debug;
+
+use crate::ingress::Ingress;
+
+/// How long a proxy gets to send the upgrade request after connecting.
+const REQUEST_TIMEOUT: Duration = Duration::from_secs(10);
+/// Requests with a longer head are passed on without being looked at.
+const MAX_HEAD: usize = 8 * 1024;
+
+type Upgrade<T> =
+    BoxFuture<'static, Result<Rewind<<T as Transport>::Output>, <T as Transport>::Error>>;
+type Event<T> = TransportEvent<Upgrade<T>, <T as Transport>::Error>;
+
+/// A transport that takes the client address from the `X-Forwarded-For`
+/// header of upgrade requests from the proxies `ingress` trusts. Since the
+/// header carries no port, the client is reported on TCP port 0.
+/// Connections arriving while too many requests are already awaited are
+/// dropped. Dialing is left alone.
+pub struct Forwarded<T: Transport> {
+    inner: T,
+    ingress: Ingress,
+    pending: FuturesUnordered<BoxFuture<'static, Option<Event<T>>>>,
+}
+
+impl<T: Transport> Forwarded<T> {
+    pub fn new(inner: T, ingress: Ingress) -> Self {
+        Self {
+            inner,
+            ingress,
+            pending: FuturesUnordered::new(),
+        }
+    }
+}
+
+impl<T> Transport for Forwarded<T>
+where
+    T: Transport + Unpin,
+    T::Output: AsyncRead + Unpin + Send + 'static,
+    T::Error: Send + 'static,
+    T::ListenerUpgrade: Send + 'static,
+{
+    type Output = Rewind<T::Output>;
+    type Error = T::Error;
+    type ListenerUpgrade = Upgrade<T>;
+    type Dial = MapOk<T::Dial, fn(T::Output) -> Rewind<T::Output>>;
+
+    fn listen_on(
+        &mut self,
+        id: ListenerId,
+        addr: Multiaddr,
+    ) -> Result<(), TransportError<Self::Error>> {
+        self.inner.listen_on(id, addr)
+    }
+
+    fn remove_listener(&mut self, id: ListenerId) -> bool {
+        self.inner.remove_listener(id)
+    }
+
+    fn dial(
+        &mut self,
+        addr: Multiaddr,
+        opts: DialOpts,
+    ) -> Result<Self::Dial, TransportError<Self::Error>> {
+        let dial = self.inner.dial(addr, opts)?;
+        Ok(dial.map_ok(Rewind::new as fn(_) -> _))
+    }
+
+    fn poll(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<Event<T>> {
+        let this = &mut *self;
+        loop {
+            if let Poll::Ready(Some(accepted)) = this.pending.poll_next_unpin(cx) {
+                match accepted {
+                    Some(event) => return Poll::Ready(event),
+                    None => continue,
+                }
+            }
+            let event = match Pin::new(&mut this.inner).poll(cx) {
+                Poll::Ready(event) => event,
+                Poll::Pending => return Poll::Pending,
+            };
+            match event {
+                TransportEvent::Incoming {
+                    listener_id,
+                    upgrade,
+                    local_addr,
+                    send_back_addr,
+                } if this.ingress.trusts_forwarded(&send_back_addr) => {
+                    if this.pending.len() >= this.ingress.max_pending() {
+                        debug!(%send_back_addr, "Dropped connection: too many requests awaited");
+                        continue;
+                    }
+                    this.pending.push(Box::pin(accept::<T>(
+                        listener_id,
+                        upgrade,
+                        local_addr,
+                        send_back_addr,
+                    )));
+                }
+                event => {
+                    return Poll::Ready(event.map_upgrade(|upgrade| -> Upgrade<T> {
+                        Box::pin(upgrade.map_ok(Rewind::new))
+                    }));
+                }
+            }
+        }
+    }
+}
+
+/// Report the connection once its upgrade request has been read, or drop
+/// it if none arrives.
+async fn accept<T>(
+    listener_id: ListenerId,
+    upgrade: T::ListenerUpgrade,
+    local_addr: Multiaddr,
+    send_back_addr: Multiaddr,
+) -> Option<Event<T>>
+where
+    T: Transport,
+    T::Output: AsyncRead + Unpin + Send + 'static,
+    T::Error: Send + 'static,
+{
+    let stream = upgrade.await.ok()?;
+    let (stream, head) = time::timeout(REQUEST_TIMEOUT, read_head(stream))
+        .await
+        .unwrap_or_else(|_| Err(io::ErrorKind::TimedOut.into()))
+        .inspect_err(|e| debug!(%send_back_addr, "Dropped connection: {e}"))
+        .ok()?;
+    let send_back_addr = match client(&head) {
+        Some(ip) => {
+            debug!(
+                proxy = %send_back_addr,
+                client = %ip,
+                host = header(&head, "x-forwarded-host").unwrap_or("-"),
+                proto = header(&head, "x-forwarded-proto").unwrap_or("-"),
+                "Forwarded WebSocket connection"
+            );
+            Multiaddr::from(ip).with(Protocol::Tcp(0))
+        }
+        None => send_back_addr,
+    };
+    Some(TransportEvent::Incoming {
+        listener_id,
+        upgrade: Box::pin(future::ready(Ok(stream))),
+        local_addr,
+        send_back_addr,
+    })
+}
+
+/// Read until the end of the request head, returning the stream with
+/// everything read put back and the head if it fit in [`MAX_HEAD`].
+async fn read_head<S: AsyncRead + Unpin>(mut stream: S) -> io::Result<(Rewind<S>, String)> {
+    let mut buf = Vec::new();
+    let mut chunk = [0; 1024];
+    let end = loop {
+        if let Some(end) = buf.windows(4).position(|w| w == b"\r\n\r\n") {
+            break end;
+        }
+        if buf.len() >= MAX_HEAD {
+            return Ok((Rewind::replaying(buf, stream), String::new()));
+        }
+        let read = stream.read(&mut chunk).await?;
+        if read == 0 {
+            return Err(io::ErrorKind::UnexpectedEof.into());
+        }
+        buf.extend_from_slice(&chunk[..read]);
+    };
+    let head = String::from_utf8_lossy(&buf[..end]).into_owned();
+    Ok((Rewind::replaying(buf, stream), head))
+}
+
+/// The value of the first `name` header, matched case-insensitively.
+fn header<'a>(head: &'a str, name: &str) -> Option<&'a str> {
+    head.lines().skip(1).find_map(|line| {
+        let (key, value) = line.split_once(':')?;
+        key.trim().eq_ignore_ascii_case(name).then(|| value.trim())
+    })
+}
+
+/// The address the proxy itself saw, which is the last one it appended to
+/// `X-Forwarded-For`; earlier entries are whatever the client claimed.
+fn client(head: &str) -> Option<IpAddr> {
+    let last = header(head, "x-forwarded-for")?.rsplit(',').next()?.trim();
+    last.parse()
+        .ok()
+        .or_else(|| last.parse::<SocketAddr>().ok().map(|addr| addr.ip()))
+}
+
+/// A stream that first yields bytes already read from it.
+pub struct Rewind<S> {
+    read: Vec<u8>,
+    at: usize,
+    inner: S,
+}
+
+impl<S> Rewind<S> {
+    fn new(inner: S) -> Self {
+        Self::replaying(Vec::new(), inner)
+    }
+
+    fn replaying(read: Vec<u8>, inner: S) -> Self {
+        Self { read, at: 0, inner }
+    }
+}
+
+impl<S: AsyncRead + Unpin> AsyncRead for Rewind<S> {
+    fn poll_read(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut [u8],
+    ) -> Poll<io::Result<usize>> {
+        let this = &mut *self;
+        let replay = &this.read[this.at..];
+        if replay.is_empty() {
+            return Pin::new(&mut this.inner).poll_read(cx, buf);
+        }
+        let n = replay.len().min(buf.len());
+        buf[..n].copy_from_slice(&replay[..n]);
+        this.at += n;
+        Poll::Ready(Ok(n))
+    }
+}
+
+impl<S: AsyncWrite + Unpin> AsyncWrite for Rewind<S> {
+    fn poll_write(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        Pin::new(&mut self.inner).poll_write(cx, buf)
+    }
+
+    fn poll_flush(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.inner).poll_flush(cx)
+    }
+
+    fn poll_close(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.inner).poll_close(cx)
+    }
+}
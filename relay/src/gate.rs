@@ -0,0 +1,321 @@
+use std::{
+    convert::Infallible,
+    fmt,
+    net::IpAddr,
+    str::FromStr,
+    sync::Arc,
+    task::{Context, Poll},
+};
+
+use libp2p::{
+    Multiaddr, PeerId,
+    core::{Endpoint, transport::PortUse},
+    swarm::{
+        ConnectionDenied, ConnectionId, FromSwarm, NetworkBehaviour, THandler, THandlerInEvent,
+        THandlerOutEvent, ToSwarm, dummy,
+    },
+};
+use serde::Deserialize;
+
+use crate::geo::{self, CountryPolicy, GeoIp};
+
+/// An IP network such as `203.0.113.0/24`. A bare address is a single host.
+#[derive(Clone, Copy, PartialEq, Eq, Deserialize)]
+#[serde(try_from = "String")]
+pub struct Cidr {
+    network: IpAddr,
+    prefix: u8,
+}
+
+impl Cidr {
+    pub fn contains(&self, ip: IpAddr) -> bool {
+        match (self.network, canonical(ip)) {
+            (IpAddr::V4(net), IpAddr::V4(ip)) => {
+                let mask = u32::MAX.checked_shl(32 - u32::from(self.prefix)).unwrap_or(0);
+                u32::from(net) & mask == u32::from(ip) & mask
+            }
+            (IpAddr::V6(net), IpAddr::V6(ip)) => {
+                let mask = u128::MAX.checked_shl(128 - u32::from(self.prefix)).unwrap_or(0);
+                u128::from(net) & mask == u128::from(ip) & mask
+            }
+            _ => false,
+        }
+    }
+}
+
+impl FromStr for Cidr {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let (addr, prefix) = match s.split_once('/') {
+            Some((addr, prefix)) => (addr, Some(prefix)),
+            None => (s, None),
+        };
+        let network: IpAddr = addr
+            .trim()
+            .parse()
+            .map_err(|_| format!("{s:?} is not an IP address or CIDR range"))?;
+        let max = if network.is_ipv4() { 32 } else { 128 };
+        let prefix = match prefix {
+            Some(prefix) => prefix
+                .trim()
+                .parse()
+                .ok()
+                .filter(|p| *p <= max)
+                .ok_or_else(|| format!("{s:?} has an invalid prefix length"))?,
+            None => max,
+        };
+        // Store IPv4-mapped ranges as plain IPv4 so they match either form.
+        let (network, prefix) = match network {
+            IpAddr::V6(v6) if prefix >= 96 => match v6.to_ipv4_mapped() {
+                Some(v4) => (IpAddr::V4(v4), prefix - 96),
+                None => (network, prefix),
+            },
+            _ => (network, prefix),
+        };
+        Ok(Self { network, prefix })
+    }
+}
+
+impl TryFrom<String> for Cidr {
+    type Error = String;
+
+    fn try_from(s: String) -> Result<Self, Self::Error> {
+        s.parse()
+    }
+}
+
+impl fmt::Display for Cidr {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}/{}", self.network, self.prefix)
+    }
+}
+
+impl fmt::Debug for Cidr {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        fmt::Display::fmt(self, f)
+    }
+}
+
+/// Treat IPv4-mapped IPv6 addresses as the IPv4 addresses they carry.
+pub fn canonical(ip: IpAddr) -> IpAddr {
+    match ip {
+        IpAddr::V6(v6) => v6.to_ipv4_mapped().map_or(ip, IpAddr::V4),
+        v4 => v4,
+    }
+}
+
+/// The network `ip` belongs to, cut to `ipv4_prefix` or `ipv6_prefix` bits.
+pub fn subnet(ip: IpAddr, ipv4_prefix: u8, ipv6_prefix: u8) -> IpAddr {
+    match canonical(ip) {
+        IpAddr::V4(v4) => {
+            let mask = u32::MAX
+                .checked_shl(32 - u32::from(ipv4_prefix))
+                .unwrap_or(0);
+            IpAddr::V4((u32::from(v4) & mask).into())
+        }
+        IpAddr::V6(v6) => {
+            let mask = u128::MAX
+                .checked_shl(128 - u32::from(ipv6_prefix))
+                .unwrap_or(0);
+            IpAddr::V6((u128::from(v6) & mask).into())
+        }
+    }
+}
+
+#[derive(Debug)]
+struct Blocked(IpAddr);
+
+impl fmt::Display for Blocked {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{} is not allowed to connect", self.0)
+    }
+}
+
+impl std::error::Error for Blocked {}
+
+#[derive(Debug)]
+struct Refused(String);
+
+impl fmt::Display for Refused {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{} was refused by the connection gater", self.0)
+    }
+}
+
+impl std::error::Error for Refused {}
+
+/// Admission logic of an embedder's own, consulted for the connections the
+/// built-in IP and country checks let through.
+pub trait Gater: Send + Sync + 'static {
+    /// Whether to accept an inbound connection from `remote_addr`, before any
+    /// handshake work is done.
+    fn allow_inbound(&self, _local_addr: &Multiaddr, _remote_addr: &Multiaddr) -> bool {
+        true
+    }
+
+    /// Whether to keep a connection, inbound or outbound, once the remote
+    /// end has authenticated as `peer`.
+    fn allow_peer(&self, _peer: PeerId, _remote_addr: &Multiaddr) -> bool {
+        true
+    }
+}
+
+/// Refuses inbound connections by source IP, and optionally by the IP's
+/// country, before any handshake work is done. Deny ranges win over allow
+/// ranges; an empty allow list allows all.
+pub struct Behaviour {
+    allow: Vec<Cidr>,
+    deny: Vec<Cidr>,
+    countries: Option<(Arc<GeoIp>, CountryPolicy)>,
+    gater: Option<Arc<dyn Gater>>,
+}
+
+impl Behaviour {
+    pub fn new(allow: Vec<Cidr>, deny: Vec<Cidr>) -> Self {
+        Self {
+            allow,
+            deny,
+            countries: None,
+            gater: None,
+        }
+    }
+
+    pub fn with_countries(mut self, geoip: Arc<GeoIp>, policy: CountryPolicy) -> Self {
+        self.countries = Some((geoip, policy));
+        self
+    }
+
+    pub fn with_gater(mut self, gater: Arc<dyn Gater>) -> Self {
+        self.gater = Some(gater);
+        self
+    }
+
+    fn admits(&self, peer: PeerId, remote_addr: &Multiaddr) -> Result<(), ConnectionDenied> {
+        if self.gater.as_ref().is_none_or(|g| g.allow_peer(peer, remote_addr)) {
+            return Ok(());
+        }
+        Err(ConnectionDenied::new(Refused(peer.to_string())))
+    }
+
+    fn permits(&self, ip: IpAddr) -> bool {
+        let in_range = !self.deny.iter().any(|c| c.contains(ip))
+            && (self.allow.is_empty() || self.allow.iter().any(|c| c.contains(ip)));
+        in_range
+            && self
+                .countries
+                .as_ref()
+                .is_none_or(|(geoip, policy)| policy.permits(geoip.country(ip).as_deref()))
+    }
+}
+
+impl NetworkBehaviour for Behaviour {
+    type ConnectionHandler = dummy::ConnectionHandler;
+    type ToSwarm = Infallible;
+
+    fn handle_pending_inbound_connection(
+        &mut self,
+        _connection_id: ConnectionId,
+        local_addr: &Multiaddr,
+        remote_addr: &Multiaddr,
+    ) -> Result<(), ConnectionDenied> {
+        if let Some(ip) = geo::ip_of(remote_addr).filter(|ip| !self.permits(*ip)) {
+            return Err(ConnectionDenied::new(Blocked(ip)));
+        }
+        if self.gater.as_ref().is_none_or(|g| g.allow_inbound(local_addr, remote_addr)) {
+            return Ok(());
+        }
+        Err(ConnectionDenied::new(Refused(remote_addr.to_string())))
+    }
+
+    fn handle_established_inbound_connection(
+        &mut self,
+        _connection_id: ConnectionId,
+        peer: PeerId,
+        _local_addr: &Multiaddr,
+        remote_addr: &Multiaddr,
+    ) -> Result<THandler<Self>, ConnectionDenied> {
+        self.admits(peer, remote_addr)?;
+        Ok(dummy::ConnectionHandler)
+    }
+
+    fn handle_established_outbound_connection(
+        &mut self,
+        _connection_id: ConnectionId,
+        peer: PeerId,
+        addr: &Multiaddr,
+        _role_override: Endpoint,
+        _port_use: PortUse,
+    ) -> Result<THandler<Self>, ConnectionDenied> {
+        self.admits(peer, addr)?;
+        Ok(dummy::ConnectionHandler)
+    }
+
+    fn on_swarm_event(&mut self, _event: FromSwarm) {}
+
+    fn on_connection_handler_event(
+        &mut self,
+        _peer: PeerId,
+        _connection_id: ConnectionId,
+        event: THandlerOutEvent<Self>,
+    ) {
+        match event {}
+    }
+
+    fn poll(
+        &mut self,
+        _cx: &mut Context<'_>,
+    ) -> Poll<ToSwarm<Self::ToSwarm, THandlerInEvent<Self>>> {
+        Poll::Pending
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn cidr(s: &str) -> Cidr {
+        s.parse().unwrap()
+    }
+
+    fn ip(s: &str) -> IpAddr {
+        s.parse().unwrap()
+    }
+
+    #[test]
+    fn parse_reads_ranges_and_bare_addresses() {
+        assert_eq!(cidr("203.0.113.0/24").to_string(), "203.0.113.0/24");
+        assert_eq!(cidr("203.0.113.7").to_string(), "203.0.113.7/32");
+        assert_eq!(cidr("2001:db8::/32").to_string(), "2001:db8::/32");
+        assert_eq!(cidr(" 2001:db8::1 ").to_string(), "2001:db8::1/128");
+    }
+
+    #[test]
+    fn parse_rejects_bad_addresses_and_prefixes() {
+        assert!("relay.example.com".parse::<Cidr>().is_err());
+        assert!("203.0.113.0/33".parse::<Cidr>().is_err());
+        assert!("2001:db8::/129".parse::<Cidr>().is_err());
+        assert!("203.0.113.0/".parse::<Cidr>().is_err());
+    }
+
+    #[test]
+    fn contains_matches_on_the_prefix() {
+        let range = cidr("203.0.113.0/24");
+        assert!(range.contains(ip("203.0.113.255")));
+        assert!(!range.contains(ip("203.0.114.0")));
+        assert!(!range.contains(ip("2001:db8::1")));
+        assert!(cidr("0.0.0.0/0").contains(ip("198.51.100.1")));
+        assert!(cidr("2001:db8::/32").contains(ip("2001:db8:ffff::1")));
+        assert!(!cidr("2001:db8::/32").contains(ip("2001:db9::1")));
+    }
+
+    #[test]
+    fn ipv4_mapped_addresses_match_ipv4_ranges() {
+        assert!(cidr("203.0.113.0/24").contains(ip("::ffff:203.0.113.9")));
+        let mapped = cidr("::ffff:203.0.113.0/120");
+        assert_eq!(mapped.to_string(), "203.0.113.0/24");
+        assert!(mapped.contains(ip("203.0.113.9")));
+        assert!(mapped.contains(ip("::ffff:203.0.113.9")));
+        assert!(!mapped.contains(ip("::ffff:203.0.114.9")));
+    }
+}
@@ -0,0 +1,120 @@
+use std::{
+    net::IpAddr,
+    path::Path,
+    sync::{Arc, RwLock},
+    time::Instant,
+};
+
+use libp2p::{Multiaddr, PeerId, core::multiaddr::Protocol, relay};
+use maxminddb::{Reader, geoip2};
+use tracing::debug;
+
+use crate::startup::StartupError;
+
+/// Country lookups from a MaxMind GeoIP2 or GeoLite2 country database. With
+/// no database loaded every lookup comes back empty.
+pub struct GeoIp {
+    reader: RwLock<Option<Reader<Vec<u8>>>>,
+}
+
+impl GeoIp {
+    pub fn open(path: Option<&Path>) -> Result<Arc<Self>, StartupError> {
+        let reader = RwLock::new(read(path)?);
+        Ok(Arc::new(Self { reader }))
+    }
+
+    /// Switch to the database at `path`, keeping the current one if it can't
+    /// be read.
+    pub fn reload(&self, path: Option<&Path>) -> Result<(), StartupError> {
+        *self.reader.write().unwrap() = read(path)?;
+        Ok(())
+    }
+
+    /// ISO 3166-1 alpha-2 code of the country `ip` is registered in.
+    pub fn country(&self, ip: IpAddr) -> Option<String> {
+        let reader = self.reader.read().unwrap();
+        let record: geoip2::Country = reader.as_ref()?.lookup(ip).ok()?;
+        Some(record.country?.iso_code?.to_string())
+    }
+
+    /// Country of the IP an address starts with, if any.
+    pub fn country_of(&self, addr: &Multiaddr) -> Option<String> {
+        self.country(ip_of(addr)?)
+    }
+}
+
+fn read(path: Option<&Path>) -> Result<Option<Reader<Vec<u8>>>, StartupError> {
+    let Some(path) = path else {
+        return Ok(None);
+    };
+    let reader = Reader::open_readfile(path).map_err(|e| StartupError::database(path, e))?;
+    Ok(Some(reader))
+}
+
+pub fn ip_of(addr: &Multiaddr) -> Option<IpAddr> {
+    match addr.iter().next()? {
+        Protocol::Ip4(ip) => Some(IpAddr::V4(ip)),
+        Protocol::Ip6(ip) => Some(IpAddr::V6(ip)),
+        _ => None,
+    }
+}
+
+/// Allowed and denied country codes. Denials win, and when an allowlist is
+/// set, addresses with no known country are refused.
+#[derive(Debug, Clone, Default)]
+pub struct CountryPolicy {
+    pub allow: Vec<String>,
+    pub deny: Vec<String>,
+}
+
+impl CountryPolicy {
+    pub fn is_empty(&self) -> bool {
+        self.allow.is_empty() && self.deny.is_empty()
+    }
+
+    pub fn permits(&self, country: Option<&str>) -> bool {
+        match country {
+            Some(country) => {
+                !self.deny.iter().any(|c| c == country)
+                    && (self.allow.is_empty() || self.allow.iter().any(|c| c == country))
+            }
+            None => self.allow.is_empty(),
+        }
+    }
+}
+
+/// Refuses reservations from countries outside the reservation policy.
+/// Clones share the policy so it can be replaced while the relay runs.
+#[derive(Clone)]
+pub struct ReservationPolicy {
+    geoip: Arc<GeoIp>,
+    policy: Arc<RwLock<CountryPolicy>>,
+}
+
+impl ReservationPolicy {
+    pub fn new(geoip: Arc<GeoIp>, policy: CountryPolicy) -> Self {
+        Self {
+            geoip,
+            policy: Arc::new(RwLock::new(policy)),
+        }
+    }
+
+    pub fn set(&self, policy: CountryPolicy) {
+        *self.policy.write().unwrap() = policy;
+    }
+}
+
+impl relay::RateLimiter for ReservationPolicy {
+    fn try_next(&mut self, peer: PeerId, addr: &Multiaddr, _now: Instant) -> bool {
+        let policy = self.policy.read().unwrap();
+        if policy.is_empty() {
+            return true;
+        }
+        let country = self.geoip.country_of(addr);
+        let permitted = policy.permits(country.as_deref());
+        if !permitted {
+            debug!(peer = %peer, country = ?country, "Reservation refused by country policy");
+        }
+        permitted
+    }
+}
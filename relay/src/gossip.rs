@@ -0,0 +1,110 @@
+//! Announcing the relay's free capacity on a gossipsub topic, so clients
+//! following a fleet can pick the least loaded relay without asking each
+//! one. Messages are signed with the relay's identity.
+
+use std::{
+    collections::HashMap,
+    time::{Instant, SystemTime, UNIX_EPOCH},
+};
+
+use libp2p::{
+    Multiaddr, PeerId,
+    gossipsub::{self, IdentTopic, MessageAuthenticity, ValidationMode},
+    identity::Keypair,
+};
+use serde::Serialize;
+use tracing::{debug, warn};
+
+use crate::{
+    capacity::Capacity,
+    throttle::Bandwidth,
+    traffic::{PeerTraffic, Traffic},
+};
+
+#[derive(Debug, Serialize)]
+pub struct Announcement {
+    pub peer_id: String,
+    pub addrs: Vec<String>,
+    #[serde(flatten)]
+    pub capacity: Capacity,
+    /// Bytes per second left under --max-bandwidth in the busier direction
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub bandwidth_headroom: Option<u64>,
+    /// Unix time of the announcement, so clients can drop stale ones
+    pub timestamp: u64,
+}
+
+impl Announcement {
+    pub fn new<'a>(
+        peer_id: PeerId,
+        addrs: impl IntoIterator<Item = &'a Multiaddr>,
+        capacity: Capacity,
+        bandwidth_headroom: Option<u64>,
+    ) -> Self {
+        let timestamp = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map_or(0, |since| since.as_secs());
+        Self {
+            peer_id: peer_id.to_string(),
+            addrs: addrs.into_iter().map(ToString::to_string).collect(),
+            capacity,
+            bandwidth_headroom,
+            timestamp,
+        }
+    }
+}
+
+/// A gossipsub node subscribed to `topic`, so it joins the mesh of the
+/// relays and clients following it.
+pub fn behaviour(key: &Keypair, topic: &str) -> gossipsub::Behaviour {
+    let config = gossipsub::ConfigBuilder::default()
+        .validation_mode(ValidationMode::Strict)
+        .build()
+        .expect("default gossipsub settings are valid");
+    let mut gossip = gossipsub::Behaviour::new(MessageAuthenticity::Signed(key.clone()), config)
+        .expect("signed messages suit strict validation");
+    if let Err(e) = gossip.subscribe(&IdentTopic::new(topic)) {
+        warn!("Could not subscribe to {topic}: {e}");
+    }
+    gossip
+}
+
+pub fn announce(gossip: &mut gossipsub::Behaviour, topic: &str, announcement: &Announcement) {
+    let message = serde_json::to_vec(announcement).expect("announcements serialize");
+    if let Err(e) = gossip.publish(IdentTopic::new(topic), message) {
+        debug!("Not announcing capacity on {topic}: {e}");
+    }
+}
+
+/// Throughput between announcements, over the same metered traffic that
+/// --max-bandwidth caps.
+pub struct Meter {
+    last: HashMap<PeerId, Traffic>,
+    at: Instant,
+}
+
+impl Meter {
+    pub fn new() -> Self {
+        Self {
+            last: HashMap::new(),
+            at: Instant::now(),
+        }
+    }
+
+    /// Bytes per second left under `limit` since the previous call. Peers
+    /// pruned in between are left out of the measurement.
+    pub fn headroom(&mut self, traffic: &PeerTraffic, limit: Option<Bandwidth>) -> Option<u64> {
+        let now: HashMap<_, _> = traffic.snapshot().into_iter().collect();
+        let (mut bytes_in, mut bytes_out) = (0, 0);
+        for (peer, totals) in &now {
+            let before = self.last.get(peer).copied().unwrap_or_default();
+            bytes_in += totals.bytes_in.saturating_sub(before.bytes_in);
+            bytes_out += totals.bytes_out.saturating_sub(before.bytes_out);
+        }
+        let elapsed = self.at.elapsed().as_secs_f64().max(1.0);
+        self.last = now;
+        self.at = Instant::now();
+        let rate = (bytes_in.max(bytes_out) as f64 / elapsed) as u64;
+        Some(limit?.bytes_per_sec().saturating_sub(rate))
+    }
+}
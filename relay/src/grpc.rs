@@ -0,0 +1,229 @@
+use std::{pin::Pin, time::SystemTime};
+
+use futures::{Stream, StreamExt};
+use libp2p::{Multiaddr, PeerId, relay};
+use sunset_relay_admin::v1::{
+    self, DrainRequest, DrainResponse, EventKind, GetStatusRequest, RelayEvent, RelayStatus,
+    WatchEventsRequest,
+    relay_admin_server::{RelayAdmin, RelayAdminServer},
+};
+use tokio::{
+    net::TcpListener,
+    sync::{broadcast, mpsc, oneshot},
+};
+use tokio_stream::wrappers::{BroadcastStream, TcpListenerStream};
+use tonic::{Request, Response, Status, transport::Server};
+use tracing::warn;
+
+use crate::{
+    admin::{self, Query, Token},
+    drain::Drain,
+    publicip::IpChange,
+};
+
+/// Relay events as streamed to `WatchEvents` subscribers.
+pub fn event(event: &relay::Event) -> Option<RelayEvent> {
+    let (kind, src, dst) = match event {
+        relay::Event::ReservationReqAccepted {
+            src_peer_id,
+            renewed,
+        } if *renewed => (EventKind::ReservationRenewed, src_peer_id, None),
+        relay::Event::ReservationReqAccepted { src_peer_id, .. } => {
+            (EventKind::ReservationAccepted, src_peer_id, None)
+        }
+        relay::Event::ReservationReqDenied { src_peer_id, .. } => {
+            (EventKind::ReservationDenied, src_peer_id, None)
+        }
+        relay::Event::ReservationTimedOut { src_peer_id } => {
+            (EventKind::ReservationTimedOut, src_peer_id, None)
+        }
+        relay::Event::CircuitReqAccepted {
+            src_peer_id,
+            dst_peer_id,
+        } => (EventKind::CircuitOpened, src_peer_id, Some(dst_peer_id)),
+        relay::Event::CircuitReqDenied {
+            src_peer_id,
+            dst_peer_id,
+            ..
+        } => (EventKind::CircuitDenied, src_peer_id, Some(dst_peer_id)),
+        relay::Event::CircuitClosed {
+            src_peer_id,
+            dst_peer_id,
+            ..
+        } => (EventKind::CircuitClosed, src_peer_id, Some(dst_peer_id)),
+        _ => return None,
+    };
+    Some(RelayEvent {
+        kind: kind.into(),
+        timestamp_ms: now_ms(),
+        src: src.to_string(),
+        dst: dst.map(ToString::to_string).unwrap_or_default(),
+        ..Default::default()
+    })
+}
+
+/// A connection opening or closing as streamed to `WatchEvents` subscribers.
+pub fn connection_event(connected: bool, peer: &PeerId, remote_addr: &Multiaddr) -> RelayEvent {
+    let kind = if connected {
+        EventKind::PeerConnected
+    } else {
+        EventKind::PeerDisconnected
+    };
+    RelayEvent {
+        kind: kind.into(),
+        timestamp_ms: now_ms(),
+        src: peer.to_string(),
+        remote_addr: remote_addr.to_string(),
+        ..Default::default()
+    }
+}
+
+/// A public IP change as streamed to `WatchEvents` subscribers.
+pub fn ip_event(change: &IpChange) -> RelayEvent {
+    RelayEvent {
+        kind: EventKind::PublicIpChanged.into(),
+        timestamp_ms: now_ms(),
+        old_ip: change.old.map(|ip| ip.to_string()).unwrap_or_default(),
+        new_ip: change.new.to_string(),
+        ..Default::default()
+    }
+}
+
+fn now_ms() -> u64 {
+    SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_millis() as u64
+}
+
+struct Service {
+    queries: mpsc::Sender<Query>,
+    events: broadcast::Sender<RelayEvent>,
+    drain: Drain,
+}
+
+#[tonic::async_trait]
+impl RelayAdmin for Service {
+    async fn get_status(
+        &self,
+        _request: Request<GetStatusRequest>,
+    ) -> Result<Response<RelayStatus>, Status> {
+        let (reply, status) = oneshot::channel();
+        self.queries.send(reply).await.map_err(|_| shutting_down())?;
+        let status = status.await.map_err(|_| shutting_down())?;
+        Ok(Response::new(status.into()))
+    }
+
+    type WatchEventsStream = Pin<Box<dyn Stream<Item = Result<RelayEvent, Status>> + Send>>;
+
+    async fn watch_events(
+        &self,
+        _request: Request<WatchEventsRequest>,
+    ) -> Result<Response<Self::WatchEventsStream>, Status> {
+        let events = BroadcastStream::new(self.events.subscribe()).filter_map(|event| async {
+            match event {
+                Ok(event) => Some(Ok(event)),
+                Err(e) => {
+                    warn!("Admin event stream fell behind: {e}");
+                    None
+                }
+            }
+        });
+        Ok(Response::new(Box::pin(events)))
+    }
+
+    async fn drain(
+        &self,
+        _request: Request<DrainRequest>,
+    ) -> Result<Response<DrainResponse>, Status> {
+        let started = self.drain.start();
+        Ok(Response::new(DrainResponse { started }))
+    }
+}
+
+fn shutting_down() -> Status {
+    Status::unavailable("relay is shutting down")
+}
+
+impl From<admin::Status> for RelayStatus {
+    fn from(status: admin::Status) -> Self {
+        RelayStatus {
+            peer_id: status.peer_id,
+            uptime_secs: status.uptime_secs,
+            draining: status.draining,
+            listen_addrs: status.listen_addrs,
+            external_addrs: status.external_addrs,
+            connected_peers: status.connected_peers,
+            reservations: status
+                .reservations
+                .into_iter()
+                .map(|r| v1::Reservation {
+                    peer_id: r.peer_id,
+                    count: r.count as u64,
+                })
+                .collect(),
+            circuits: status
+                .circuits
+                .into_iter()
+                .map(|c| v1::Circuit {
+                    src: c.src,
+                    dst: c.dst,
+                    age_secs: c.age_secs,
+                })
+                .collect(),
+            traffic: status
+                .traffic
+                .into_iter()
+                .map(|t| v1::PeerTraffic {
+                    peer_id: t.peer_id,
+                    bytes_in: t.bytes_in,
+                    bytes_out: t.bytes_out,
+                })
+                .collect(),
+            transports: status
+                .transports
+                .into_iter()
+                .map(|t| v1::TransportConnections {
+                    transport: t.transport,
+                    connections: t.connections as u64,
+                })
+                .collect(),
+        }
+    }
+}
+
+/// Serve the gRPC admin service on an already-bound listener, requiring the
+/// same bearer token as the HTTP admin API.
+pub async fn serve(
+    listener: TcpListener,
+    token: Token,
+    queries: mpsc::Sender<Query>,
+    events: broadcast::Sender<RelayEvent>,
+    drain: Drain,
+) {
+    let service = RelayAdminServer::with_interceptor(
+        Service {
+            queries,
+            events,
+            drain,
+        },
+        move |request: Request<()>| {
+            let authorized = request
+                .metadata()
+                .get("authorization")
+                .and_then(|value| value.to_str().ok())
+                .is_some_and(|value| token.authorizes(value));
+            if !authorized {
+                return Err(Status::unauthenticated("missing or invalid bearer token"));
+            }
+            Ok(request)
+        },
+    );
+    let result = Server::builder()
+        .add_service(service)
+        .serve_with_incoming(TcpListenerStream::new(listener))
+        .await;
+    if let Err(e) = result {
+        warn!("gRPC admin API stopped: {e}");
+    }
+}
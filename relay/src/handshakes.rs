@@ -0,0 +1,128 @@
+//! Caps inbound connections that are still handshaking at
+//! --max-pending-handshakes, so a burst of clients cannot spike CPU. A
+//! connection counts from the moment it is accepted until it is
+//! established or fails, which covers the TLS accept for WebSocket over
+//! TLS as well as the security and muxer negotiation on every transport.
+
+use std::{
+    collections::HashSet,
+    convert::Infallible,
+    fmt,
+    task::{Context, Poll},
+};
+
+use libp2p::{
+    Multiaddr, PeerId,
+    core::{Endpoint, transport::PortUse},
+    swarm::{
+        ConnectionDenied, ConnectionId, FromSwarm, NetworkBehaviour, THandler, THandlerInEvent,
+        THandlerOutEvent, ToSwarm, dummy,
+    },
+};
+use tracing::debug;
+
+use crate::metrics::HandshakeMetrics;
+
+#[derive(Debug)]
+struct TooManyHandshakes(u32);
+
+impl fmt::Display for TooManyHandshakes {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "already {} connections handshaking", self.0)
+    }
+}
+
+impl std::error::Error for TooManyHandshakes {}
+
+pub struct Behaviour {
+    max: u32,
+    pending: HashSet<ConnectionId>,
+    metrics: HandshakeMetrics,
+}
+
+impl Behaviour {
+    pub fn new(max: u32, metrics: HandshakeMetrics) -> Self {
+        Self {
+            max,
+            pending: HashSet::new(),
+            metrics,
+        }
+    }
+
+    /// Apply a changed --max-pending-handshakes. Handshakes already under
+    /// way over a lowered limit are left to finish.
+    pub fn set_max(&mut self, max: u32) {
+        self.max = max;
+    }
+
+    fn finished(&mut self, connection_id: ConnectionId) {
+        if self.pending.remove(&connection_id) {
+            self.metrics.set_pending(self.pending.len());
+        }
+    }
+}
+
+impl NetworkBehaviour for Behaviour {
+    type ConnectionHandler = dummy::ConnectionHandler;
+    type ToSwarm = Infallible;
+
+    fn handle_pending_inbound_connection(
+        &mut self,
+        connection_id: ConnectionId,
+        _local_addr: &Multiaddr,
+        remote_addr: &Multiaddr,
+    ) -> Result<(), ConnectionDenied> {
+        if self.pending.len() < self.max as usize {
+            self.pending.insert(connection_id);
+            self.metrics.set_pending(self.pending.len());
+            return Ok(());
+        }
+        debug!(%remote_addr, "Connection refused: too many handshakes in progress");
+        self.metrics.rejected();
+        Err(ConnectionDenied::new(TooManyHandshakes(self.max)))
+    }
+
+    fn handle_established_inbound_connection(
+        &mut self,
+        connection_id: ConnectionId,
+        _peer: PeerId,
+        _local_addr: &Multiaddr,
+        _remote_addr: &Multiaddr,
+    ) -> Result<THandler<Self>, ConnectionDenied> {
+        self.finished(connection_id);
+        Ok(dummy::ConnectionHandler)
+    }
+
+    fn handle_established_outbound_connection(
+        &mut self,
+        _connection_id: ConnectionId,
+        _peer: PeerId,
+        _addr: &Multiaddr,
+        _role_override: Endpoint,
+        _port_use: PortUse,
+    ) -> Result<THandler<Self>, ConnectionDenied> {
+        Ok(dummy::ConnectionHandler)
+    }
+
+    fn on_swarm_event(&mut self, event: FromSwarm) {
+        if let FromSwarm::ListenFailure(failure) = event {
+            self.finished(failure.connection_id);
+        }
+    }
+
+    fn on_connection_handler_event(
+        &mut self,
+        _peer: PeerId,
+        _connection_id: ConnectionId,
+        event: THandlerOutEvent<Self>,
+    ) {
+        match event {}
+    }
+
+    fn poll(
+        &mut self,
+        _cx: &mut Context<'_>,
+    ) -> Poll<ToSwarm<Self::ToSwarm, THandlerInEvent<Self>>> {
+        Poll::Pending
+    }
+}
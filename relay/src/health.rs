@@ -0,0 +1,92 @@
+use std::{
+    sync::{
+        Arc,
+        atomic::{AtomicBool, Ordering},
+    },
+    time::Duration,
+};
+
+use axum::{Router, extract::State, http::StatusCode, routing::get};
+use tokio::{
+    net::TcpListener,
+    sync::{mpsc, oneshot},
+    time,
+};
+use tracing::warn;
+
+/// How long the event loop may take to answer a liveness ping.
+const LIVENESS_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// Whether a load balancer should keep sending new clients to this relay.
+#[derive(Clone, Default)]
+pub struct Readiness(Arc<AtomicBool>);
+
+impl Readiness {
+    pub fn set(&self, ready: bool) {
+        self.0.store(ready, Ordering::SeqCst);
+    }
+
+    pub fn is_ready(&self) -> bool {
+        self.0.load(Ordering::SeqCst)
+    }
+}
+
+/// A ping for the event loop to answer.
+pub type Ping = oneshot::Sender<()>;
+
+/// Whether the event loop is still turning, checked by round-tripping a
+/// [`Ping`] through it.
+#[derive(Clone)]
+pub struct Liveness(mpsc::Sender<Ping>);
+
+impl Liveness {
+    pub fn new() -> (Self, mpsc::Receiver<Ping>) {
+        let (tx, rx) = mpsc::channel(16);
+        (Self(tx), rx)
+    }
+
+    pub async fn check(&self) -> bool {
+        let ping = async {
+            let (pong, answered) = oneshot::channel();
+            self.0.send(pong).await.ok()?;
+            answered.await.ok()
+        };
+        matches!(time::timeout(LIVENESS_TIMEOUT, ping).await, Ok(Some(())))
+    }
+}
+
+#[derive(Clone)]
+struct AppState {
+    readiness: Readiness,
+    liveness: Liveness,
+}
+
+/// Serve `/healthz` and `/readyz` on an already-bound listener.
+pub async fn serve(listener: TcpListener, readiness: Readiness, liveness: Liveness) {
+    let app = Router::new()
+        .route("/healthz", get(healthz))
+        .route("/readyz", get(readyz))
+        .with_state(AppState {
+            readiness,
+            liveness,
+        });
+    if let Err(e) = axum::serve(listener, app).await {
+        warn!("Health check server stopped: {e}");
+    }
+}
+
+async fn healthz(State(state): State<AppState>) -> StatusCode {
+    if state.liveness.check().await {
+        StatusCode::OK
+    } else {
+        StatusCode::SERVICE_UNAVAILABLE
+    }
+}
+
+async fn readyz(State(state): State<AppState>) -> StatusCode {
+    if state.readiness.is_ready() {
+        StatusCode::OK
+    } else {
+        StatusCode::SERVICE_UNAVAILABLE
+    }
+}
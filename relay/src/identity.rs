@@ -0,0 +1,215 @@
+use std::{
+    env,
+    error::Error,
+    fmt,
+    io::{self, IsTerminal},
+    ops::RangeInclusive,
+    path::{Path, PathBuf},
+};
+
+use base64::{Engine, engine::general_purpose::STANDARD as BASE64};
+use libp2p::identity::Keypair;
+use rand::rngs::OsRng;
+use rsa::{RsaPrivateKey, pkcs8::EncodePrivateKey};
+use tokio::{fs, io::AsyncReadExt};
+use tracing::{debug, info, warn};
+
+use crate::{config::KeyType, faults, keyfile, vault};
+
+/// RSA modulus sizes worth generating: smaller is weak, larger is slow.
+pub const RSA_BITS: RangeInclusive<usize> = 2048..=8192;
+
+/// Where the relay's key comes from.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum IdentitySource {
+    /// A key file, generated on first start if missing.
+    File(PathBuf),
+    /// An environment variable holding a key file's contents in base64.
+    Env(String),
+    /// A key file's contents piped to standard input.
+    Stdin,
+    /// A Vault KV v2 secret, as `MOUNT/PATH`, holding a key file's contents
+    /// in base64.
+    Vault(String),
+}
+
+impl fmt::Display for IdentitySource {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::File(path) => write!(f, "{}", path.display()),
+            Self::Env(var) => write!(f, "${var}"),
+            Self::Stdin => f.write_str("stdin"),
+            Self::Vault(secret) => write!(f, "vault:{secret}"),
+        }
+    }
+}
+
+/// Load an identity, or for a key file that does not exist yet, generate
+/// and save a new one of `key_type`. With a passphrase, newly generated
+/// keys are saved encrypted.
+pub async fn load_or_create_identity(
+    source: &IdentitySource,
+    key_type: KeyType,
+    key_bits: usize,
+    passphrase: Option<&str>,
+) -> Result<Keypair, Box<dyn Error + Send + Sync>> {
+    faults::check_identity()?;
+    let IdentitySource::File(path) = source else {
+        let keypair = load_identity(source, passphrase).await?;
+        info!("Loaded identity from {source}");
+        return Ok(keypair);
+    };
+    if let Ok(data) = fs::read(path).await {
+        if let Some(keypair) = decode_identity(&decrypt(source, data, passphrase)?) {
+            info!("Loaded identity from {}", path.display());
+            return Ok(keypair);
+        }
+        warn!(
+            "Could not decode identity file {}, generating new key",
+            path.display()
+        );
+    }
+    let keypair = generate_identity(path, key_type, key_bits, passphrase).await?;
+    info!(
+        "Generated new {key_type:?} identity, saved to {}",
+        path.display()
+    );
+    Ok(keypair)
+}
+
+/// Load an existing identity without ever creating one.
+pub async fn load_identity(
+    source: &IdentitySource,
+    passphrase: Option<&str>,
+) -> Result<Keypair, Box<dyn Error + Send + Sync>> {
+    let (keypair, _) = load_stored(source, passphrase).await?;
+    Ok(keypair)
+}
+
+/// Load an existing identity along with the key as stored, decrypted.
+pub async fn load_stored(
+    source: &IdentitySource,
+    passphrase: Option<&str>,
+) -> Result<(Keypair, Vec<u8>), Box<dyn Error + Send + Sync>> {
+    let data = decrypt(source, read(source).await?, passphrase)?;
+    let keypair = decode_identity(&data).ok_or("not a libp2p, raw Ed25519 or PKCS#8 RSA key")?;
+    Ok((keypair, data))
+}
+
+async fn read(source: &IdentitySource) -> Result<Vec<u8>, Box<dyn Error + Send + Sync>> {
+    let data = match source {
+        IdentitySource::File(path) => fs::read(path).await?,
+        IdentitySource::Env(var) => {
+            let encoded = env::var(var)?;
+            BASE64.decode(encoded.trim())?
+        }
+        IdentitySource::Stdin => {
+            let mut data = Vec::new();
+            tokio::io::stdin().read_to_end(&mut data).await?;
+            data
+        }
+        IdentitySource::Vault(secret) => BASE64.decode(vault::read_key(secret).await?.trim())?,
+    };
+    Ok(data)
+}
+
+/// Decrypt a key if it is encrypted. One that will not decrypt is an error,
+/// so it is never mistaken for an undecodable file and replaced.
+fn decrypt(
+    source: &IdentitySource,
+    data: Vec<u8>,
+    passphrase: Option<&str>,
+) -> Result<Vec<u8>, Box<dyn Error + Send + Sync>> {
+    if keyfile::is_encrypted(&data) {
+        let passphrase = match passphrase {
+            Some(passphrase) => passphrase.to_owned(),
+            None => prompt(source)?,
+        };
+        return keyfile::decrypt(&data, &passphrase);
+    }
+    if passphrase.is_some() {
+        warn!("Identity from {source} is not encrypted; the passphrase only applies to newly generated keys");
+    }
+    Ok(data)
+}
+
+/// Decode a key as stored: protobuf, a raw Ed25519 secret or PKCS#8 RSA.
+fn decode_identity(data: &[u8]) -> Option<Keypair> {
+    // Try to decode as a libp2p protobuf-encoded keypair first
+    if let Ok(keypair) = Keypair::from_protobuf_encoding(data) {
+        return Some(keypair);
+    }
+    // Try as raw Ed25519 secret key bytes (32 bytes)
+    if data.len() == 32 {
+        if let Ok(keypair) = Keypair::ed25519_from_bytes(data.to_vec()) {
+            debug!("Identity is a raw Ed25519 secret key");
+            return Some(keypair);
+        }
+    }
+    // Try as a PKCS#8 RSA key, which libp2p cannot encode as protobuf
+    if let Ok(keypair) = Keypair::rsa_from_pkcs8(&mut data.to_vec()) {
+        debug!("Identity is a PKCS#8 RSA key");
+        return Some(keypair);
+    }
+    None
+}
+
+/// Ask for the passphrase of an encrypted key on the terminal.
+fn prompt(source: &IdentitySource) -> Result<String, Box<dyn Error + Send + Sync>> {
+    if *source == IdentitySource::Stdin || !io::stdin().is_terminal() {
+        return Err("the key is encrypted; set --identity-passphrase or SUTRO_IDENTITY_PASSPHRASE".into());
+    }
+    Ok(rpassword::prompt_password(format!("Passphrase for {source}: "))?)
+}
+
+/// Generate an identity of `key_type` and save it to `path`, encrypted if
+/// a passphrase is given. `key_bits` only applies to RSA.
+pub async fn generate_identity(
+    path: &Path,
+    key_type: KeyType,
+    key_bits: usize,
+    passphrase: Option<&str>,
+) -> Result<Keypair, Box<dyn Error + Send + Sync>> {
+    let (keypair, encoded) = generate(key_type, key_bits)?;
+    save(path, encoded, passphrase).await?;
+    Ok(keypair)
+}
+
+/// Write an encoded key to `path`, encrypted if a passphrase is given.
+pub async fn save(
+    path: &Path,
+    mut encoded: Vec<u8>,
+    passphrase: Option<&str>,
+) -> Result<(), Box<dyn Error + Send + Sync>> {
+    if let Some(passphrase) = passphrase {
+        encoded = keyfile::encrypt(&encoded, passphrase)?;
+    }
+    fs::write(path, &encoded).await?;
+    Ok(())
+}
+
+/// A fresh keypair and its key file encoding: protobuf, except for RSA
+/// keys, which are stored as PKCS#8 DER.
+pub fn generate(
+    key_type: KeyType,
+    key_bits: usize,
+) -> Result<(Keypair, Vec<u8>), Box<dyn Error + Send + Sync>> {
+    let keypair = match key_type {
+        KeyType::Ed25519 => Keypair::generate_ed25519(),
+        KeyType::Ecdsa => Keypair::generate_ecdsa(),
+        KeyType::Secp256k1 => Keypair::generate_secp256k1(),
+        KeyType::Rsa => {
+            if !RSA_BITS.contains(&key_bits) {
+                return Err(format!("RSA keys must be 2048 to 8192 bits, not {key_bits}").into());
+            }
+            let der = RsaPrivateKey::new(&mut OsRng, key_bits)?
+                .to_pkcs8_der()?
+                .as_bytes()
+                .to_vec();
+            let keypair = Keypair::rsa_from_pkcs8(&mut der.clone())?;
+            return Ok((keypair, der));
+        }
+    };
+    let encoded = keypair.to_protobuf_encoding()?;
+    Ok((keypair, encoded))
+}
@@ -0,0 +1,66 @@
+//! What the TCP and WebSocket transports need to know about inbound
+//! connections: which sources send PROXY or `X-Forwarded-For` headers, how
+//! to tune accepted sockets and how many headers may be awaited at once.
+//! Clones share the settings, read as each connection arrives, so a reload
+//! applies to new connections.
+
+use std::sync::{Arc, RwLock};
+
+use libp2p::Multiaddr;
+
+use crate::{config::Config, gate::Cidr, geo, sockopts::SocketOptions};
+
+struct Settings {
+    proxy: Vec<Cidr>,
+    forwarded: Vec<Cidr>,
+    sockets: SocketOptions,
+    max_pending: usize,
+}
+
+impl Settings {
+    fn from_config(config: &Config) -> Self {
+        Self {
+            proxy: config.proxy_sources(),
+            forwarded: config.forwarding_proxies(),
+            sockets: SocketOptions::new(config),
+            max_pending: config.max_pending_handshakes as usize,
+        }
+    }
+}
+
+#[derive(Clone)]
+pub struct Ingress(Arc<RwLock<Settings>>);
+
+impl Ingress {
+    pub fn new(config: &Config) -> Self {
+        Self(Arc::new(RwLock::new(Settings::from_config(config))))
+    }
+
+    pub fn set(&self, config: &Config) {
+        *self.0.write().unwrap() = Settings::from_config(config);
+    }
+
+    pub fn sockets(&self) -> SocketOptions {
+        self.0.read().unwrap().sockets
+    }
+
+    /// Headers awaited past this many drop the connection.
+    pub fn max_pending(&self) -> usize {
+        self.0.read().unwrap().max_pending
+    }
+
+    /// Whether a connection from `addr` starts with a PROXY header.
+    pub fn expects_proxy_header(&self, addr: &Multiaddr) -> bool {
+        trusts(&self.0.read().unwrap().proxy, addr)
+    }
+
+    /// Whether `addr` is a proxy whose `X-Forwarded-For` is honoured.
+    pub fn trusts_forwarded(&self, addr: &Multiaddr) -> bool {
+        trusts(&self.0.read().unwrap().forwarded, addr)
+    }
+}
+
+/// An empty list trusts no one.
+fn trusts(trusted: &[Cidr], addr: &Multiaddr) -> bool {
+    geo::ip_of(addr).is_some_and(|ip| trusted.iter().any(|cidr| cidr.contains(ip)))
+}
@@ -0,0 +1,77 @@
+//! Keeps a second relay from starting with the same identity: both would
+//! announce one PeerID and clients would reach whichever answered first.
+//! While running, the relay holds an exclusive lock on `<identity>.lock`
+//! beside its --identity file, and writes its process ID to --pid-file.
+//! Identities from the environment, standard input or Vault have no file to
+//! lock beside, so are not guarded.
+
+use std::{
+    ffi::OsString,
+    fs::{self, File, OpenOptions, TryLockError},
+    path::{Path, PathBuf},
+    process,
+};
+
+use tracing::{debug, warn};
+
+use crate::{config::Config, identity::IdentitySource, startup::StartupError};
+
+/// Held for as long as the relay runs. Dropping it releases the lock and
+/// removes the PID file.
+pub struct Instance {
+    _lock: Option<File>,
+    pid_file: Option<PathBuf>,
+}
+
+impl Instance {
+    pub fn acquire(config: &Config) -> Result<Self, StartupError> {
+        let lock = match config.identity_source() {
+            IdentitySource::File(identity) => Some(lock(&identity)?),
+            _ => None,
+        };
+        if let Some(path) = &config.pid_file {
+            fs::write(path, format!("{}\n", process::id()))
+                .map_err(|e| StartupError::open("PID file", path, e))?;
+            debug!("Wrote PID file {}", path.display());
+        }
+        Ok(Self {
+            _lock: lock,
+            pid_file: config.pid_file.clone(),
+        })
+    }
+}
+
+impl Drop for Instance {
+    fn drop(&mut self) {
+        let Some(path) = &self.pid_file else {
+            return;
+        };
+        if let Err(e) = fs::remove_file(path) {
+            warn!("Could not remove PID file {}: {e}", path.display());
+        }
+    }
+}
+
+/// Take the lock beside `identity`, failing if another process holds it.
+/// The lock file itself is left behind, since removing it would let a
+/// third relay lock a fresh file while the second still holds the old one.
+fn lock(identity: &Path) -> Result<File, StartupError> {
+    let path = lock_path(identity);
+    let file = OpenOptions::new()
+        .create(true)
+        .write(true)
+        .truncate(false)
+        .open(&path)
+        .map_err(|e| StartupError::open("identity lock", &path, e))?;
+    match file.try_lock() {
+        Ok(()) => Ok(file),
+        Err(TryLockError::WouldBlock) => Err(StartupError::IdentityInUse(identity.to_path_buf())),
+        Err(TryLockError::Error(e)) => Err(StartupError::open("identity lock", &path, e)),
+    }
+}
+
+fn lock_path(identity: &Path) -> PathBuf {
+    let mut path = OsString::from(identity);
+    path.push(".lock");
+    PathBuf::from(path)
+}
@@ -0,0 +1,22 @@
+use std::{collections::HashSet, fs, net::Ipv6Addr};
+
+const IFA_F_TEMPORARY: u32 = 0x01;
+const IFA_F_DEPRECATED: u32 = 0x20;
+
+/// Addresses the kernel marks as temporary (RFC 8981 privacy extensions) or
+/// deprecated, which rotate away and break cached client addresses. Empty on
+/// platforms without `/proc/net/if_inet6`.
+pub fn unstable_addresses() -> HashSet<Ipv6Addr> {
+    let Ok(table) = fs::read_to_string("/proc/net/if_inet6") else {
+        return HashSet::new();
+    };
+    table.lines().filter_map(parse_unstable).collect()
+}
+
+/// Parse a line like `20010db8000000000000000000000001 02 40 00 01 eth0`.
+fn parse_unstable(line: &str) -> Option<Ipv6Addr> {
+    let mut fields = line.split_whitespace();
+    let addr = u128::from_str_radix(fields.next()?, 16).ok()?;
+    let flags = u32::from_str_radix(fields.nth(3)?, 16).ok()?;
+    (flags & (IFA_F_TEMPORARY | IFA_F_DEPRECATED) != 0).then(|| Ipv6Addr::from(addr))
+}
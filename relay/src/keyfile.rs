@@ -0,0 +1,88 @@
+//! Passphrase-encrypted key files. The encoded keypair is sealed with
+//! ChaCha20-Poly1305 under a key derived from the passphrase with Argon2id,
+//! and stored after a magic line with the salt and nonce.
+
+use std::error::Error;
+
+use argon2::Argon2;
+use chacha20poly1305::{ChaCha20Poly1305, Key, KeyInit, Nonce, aead::Aead};
+
+const MAGIC: &[u8] = b"sutro-encrypted-key-v1\n";
+const SALT_LEN: usize = 16;
+const NONCE_LEN: usize = 12;
+
+pub fn is_encrypted(data: &[u8]) -> bool {
+    data.starts_with(MAGIC)
+}
+
+pub fn encrypt(
+    plaintext: &[u8],
+    passphrase: &str,
+) -> Result<Vec<u8>, Box<dyn Error + Send + Sync>> {
+    let mut salt = [0; SALT_LEN];
+    let mut nonce = [0; NONCE_LEN];
+    getrandom::getrandom(&mut salt)?;
+    getrandom::getrandom(&mut nonce)?;
+    let sealed = cipher(passphrase, &salt)?
+        .encrypt(Nonce::from_slice(&nonce), plaintext)
+        .map_err(|_| "failed to encrypt key")?;
+    Ok([MAGIC, &salt, &nonce, &sealed].concat())
+}
+
+pub fn decrypt(data: &[u8], passphrase: &str) -> Result<Vec<u8>, Box<dyn Error + Send + Sync>> {
+    let data = data.strip_prefix(MAGIC).ok_or("not an encrypted key file")?;
+    if data.len() < SALT_LEN + NONCE_LEN {
+        return Err("encrypted key file is truncated".into());
+    }
+    let (salt, data) = data.split_at(SALT_LEN);
+    let (nonce, sealed) = data.split_at(NONCE_LEN);
+    cipher(passphrase, salt)?
+        .decrypt(Nonce::from_slice(nonce), sealed)
+        .map_err(|_| "wrong passphrase or corrupted key file".into())
+}
+
+fn cipher(passphrase: &str, salt: &[u8]) -> Result<ChaCha20Poly1305, Box<dyn Error + Send + Sync>> {
+    let mut key = [0; 32];
+    Argon2::default()
+        .hash_password_into(passphrase.as_bytes(), salt, &mut key)
+        .map_err(|e| e.to_string())?;
+    Ok(ChaCha20Poly1305::new(Key::from_slice(&key)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const KEY: &[u8] = b"an encoded keypair";
+
+    #[test]
+    fn decrypt_undoes_encrypt() {
+        let sealed = encrypt(KEY, "correct horse").unwrap();
+        assert!(is_encrypted(&sealed));
+        assert!(!is_encrypted(KEY));
+        assert_eq!(decrypt(&sealed, "correct horse").unwrap(), KEY);
+    }
+
+    #[test]
+    fn each_encryption_is_salted_afresh() {
+        let first = encrypt(KEY, "correct horse").unwrap();
+        let second = encrypt(KEY, "correct horse").unwrap();
+        assert_ne!(first, second);
+    }
+
+    #[test]
+    fn wrong_passphrase_is_an_error() {
+        let sealed = encrypt(KEY, "correct horse").unwrap();
+        let err = decrypt(&sealed, "battery staple").unwrap_err();
+        assert_eq!(err.to_string(), "wrong passphrase or corrupted key file");
+    }
+
+    #[test]
+    fn decrypt_rejects_plain_and_truncated_files() {
+        let err = decrypt(KEY, "correct horse").unwrap_err();
+        assert_eq!(err.to_string(), "not an encrypted key file");
+        let sealed = encrypt(KEY, "correct horse").unwrap();
+        let err = decrypt(&sealed[..MAGIC.len() + SALT_LEN], "correct horse").unwrap_err();
+        assert_eq!(err.to_string(), "encrypted key file is truncated");
+    }
+}
@@ -0,0 +1,209 @@
+//! Identity keys in formats other tools understand: PKCS#8 PEM, as written
+//! by `openssl genpkey`, and JSON Web Keys (RFC 7517, with RFC 8037 for
+//! Ed25519).
+
+use std::error::Error;
+
+use base64::{Engine, engine::general_purpose::URL_SAFE_NO_PAD as BASE64URL};
+use clap::ValueEnum;
+use ed25519_dalek::SigningKey;
+use libp2p::identity::{self, Keypair, ecdsa, secp256k1};
+use rsa::{
+    BigUint, RsaPrivateKey,
+    pkcs8::{DecodePrivateKey, EncodePrivateKey, LineEnding},
+    traits::{PrivateKeyParts, PublicKeyParts},
+};
+use serde::Deserialize;
+use serde_json::json;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, ValueEnum)]
+pub enum KeyFormat {
+    /// PKCS#8 `PRIVATE KEY` PEM
+    Pem,
+    /// JSON Web Key
+    Jwk,
+}
+
+/// Encode an identity as `format`. `stored` is the key as it was loaded,
+/// which RSA keys are exported from: libp2p offers no way to read their
+/// private half back out.
+pub fn export(
+    keypair: &Keypair,
+    stored: &[u8],
+    format: KeyFormat,
+) -> Result<String, Box<dyn Error + Send + Sync>> {
+    let key = Key::from_keypair(keypair, stored)?;
+    match format {
+        KeyFormat::Pem => key.to_pem(),
+        KeyFormat::Jwk => key.to_jwk(),
+    }
+}
+
+/// Read a PEM or JWK private key, telling them apart by the leading brace
+/// of a JWK. Returns the identity and its encoding for an identity file.
+pub fn import(text: &str) -> Result<(Keypair, Vec<u8>), Box<dyn Error + Send + Sync>> {
+    let key = if text.trim_start().starts_with('{') {
+        Key::from_jwk(text)?
+    } else {
+        Key::from_pem(text)?
+    };
+    key.into_keypair()
+}
+
+enum Key {
+    Ed25519(SigningKey),
+    Ecdsa(p256::SecretKey),
+    Secp256k1(k256::SecretKey),
+    Rsa(RsaPrivateKey),
+}
+
+#[derive(Deserialize)]
+struct Jwk {
+    kty: String,
+    crv: Option<String>,
+    d: Option<String>,
+    n: Option<String>,
+    e: Option<String>,
+    p: Option<String>,
+    q: Option<String>,
+}
+
+impl Key {
+    fn from_keypair(
+        keypair: &Keypair,
+        stored: &[u8],
+    ) -> Result<Self, Box<dyn Error + Send + Sync>> {
+        let keypair = keypair.clone();
+        let key = match keypair.key_type() {
+            identity::KeyType::Ed25519 => {
+                let secret = keypair.try_into_ed25519()?.secret();
+                Self::Ed25519(SigningKey::from_bytes(secret.as_ref().try_into()?))
+            }
+            identity::KeyType::Ecdsa => {
+                let secret = keypair.try_into_ecdsa()?.secret().to_bytes();
+                Self::Ecdsa(p256::SecretKey::from_slice(&secret)?)
+            }
+            identity::KeyType::Secp256k1 => {
+                let secret = keypair.try_into_secp256k1()?.secret().to_bytes();
+                Self::Secp256k1(k256::SecretKey::from_slice(&secret)?)
+            }
+            identity::KeyType::RSA => Self::Rsa(RsaPrivateKey::from_pkcs8_der(stored)?),
+        };
+        Ok(key)
+    }
+
+    /// The libp2p identity and how it is written to an identity file.
+    fn into_keypair(self) -> Result<(Keypair, Vec<u8>), Box<dyn Error + Send + Sync>> {
+        let keypair: Keypair = match self {
+            Self::Ed25519(key) => Keypair::ed25519_from_bytes(key.to_bytes())?,
+            Self::Ecdsa(key) => {
+                ecdsa::Keypair::from(ecdsa::SecretKey::try_from_bytes(key.to_bytes())?).into()
+            }
+            Self::Secp256k1(key) => {
+                secp256k1::Keypair::from(secp256k1::SecretKey::try_from_bytes(key.to_bytes())?)
+                    .into()
+            }
+            Self::Rsa(key) => {
+                let der = key.to_pkcs8_der()?.as_bytes().to_vec();
+                return Ok((Keypair::rsa_from_pkcs8(&mut der.clone())?, der));
+            }
+        };
+        let encoded = keypair.to_protobuf_encoding()?;
+        Ok((keypair, encoded))
+    }
+
+    fn from_pem(pem: &str) -> Result<Self, Box<dyn Error + Send + Sync>> {
+        if let Ok(key) = SigningKey::from_pkcs8_pem(pem) {
+            return Ok(Self::Ed25519(key));
+        }
+        if let Ok(key) = p256::SecretKey::from_pkcs8_pem(pem) {
+            return Ok(Self::Ecdsa(key));
+        }
+        if let Ok(key) = k256::SecretKey::from_pkcs8_pem(pem) {
+            return Ok(Self::Secp256k1(key));
+        }
+        let key = RsaPrivateKey::from_pkcs8_pem(pem)
+            .map_err(|_| "not a PKCS#8 Ed25519, ECDSA P-256, secp256k1 or RSA private key")?;
+        Ok(Self::Rsa(key))
+    }
+
+    fn to_pem(&self) -> Result<String, Box<dyn Error + Send + Sync>> {
+        let pem = match self {
+            Self::Ed25519(key) => key.to_pkcs8_pem(LineEnding::LF)?,
+            Self::Ecdsa(key) => key.to_pkcs8_pem(LineEnding::LF)?,
+            Self::Secp256k1(key) => key.to_pkcs8_pem(LineEnding::LF)?,
+            Self::Rsa(key) => key.to_pkcs8_pem(LineEnding::LF)?,
+        };
+        Ok(pem.to_string())
+    }
+
+    fn from_jwk(text: &str) -> Result<Self, Box<dyn Error + Send + Sync>> {
+        let jwk: Jwk = serde_json::from_str(text)?;
+        match (jwk.kty.as_str(), jwk.crv.as_deref()) {
+            ("OKP", Some("Ed25519")) => {
+                let secret = field(jwk.d)?;
+                Ok(Self::Ed25519(SigningKey::from_bytes(
+                    secret.as_slice().try_into()?,
+                )))
+            }
+            ("EC", Some("P-256")) => Ok(Self::Ecdsa(p256::SecretKey::from_jwk_str(text)?)),
+            ("EC", Some("secp256k1")) => Ok(Self::Secp256k1(k256::SecretKey::from_jwk_str(text)?)),
+            ("RSA", _) => {
+                let int = |value: Option<String>| {
+                    field(value).map(|bytes| BigUint::from_bytes_be(&bytes))
+                };
+                let primes = vec![int(jwk.p)?, int(jwk.q)?];
+                let key =
+                    RsaPrivateKey::from_components(int(jwk.n)?, int(jwk.e)?, int(jwk.d)?, primes)?;
+                Ok(Self::Rsa(key))
+            }
+            (kty, crv) => Err(format!(
+                "unsupported JWK with kty {kty} and crv {}",
+                crv.unwrap_or("none")
+            )
+            .into()),
+        }
+    }
+
+    fn to_jwk(&self) -> Result<String, Box<dyn Error + Send + Sync>> {
+        let jwk = match self {
+            Self::Ed25519(key) => json!({
+                "kty": "OKP",
+                "crv": "Ed25519",
+                "d": BASE64URL.encode(key.to_bytes()),
+                "x": BASE64URL.encode(key.verifying_key().to_bytes()),
+            })
+            .to_string(),
+            Self::Ecdsa(key) => key.to_jwk_string().to_string(),
+            Self::Secp256k1(key) => key.to_jwk_string().to_string(),
+            Self::Rsa(key) => rsa_jwk(key)?,
+        };
+        Ok(jwk)
+    }
+}
+
+fn rsa_jwk(key: &RsaPrivateKey) -> Result<String, Box<dyn Error + Send + Sync>> {
+    let [p, q] = key.primes() else {
+        return Err("multi-prime RSA keys cannot be exported as JWK".into());
+    };
+    let crt = "RSA key is missing its CRT parameters";
+    let int = |n: &BigUint| BASE64URL.encode(n.to_bytes_be());
+    let jwk = json!({
+        "kty": "RSA",
+        "n": int(key.n()),
+        "e": int(key.e()),
+        "d": int(key.d()),
+        "p": int(p),
+        "q": int(q),
+        "dp": int(key.dp().ok_or(crt)?),
+        "dq": int(key.dq().ok_or(crt)?),
+        "qi": int(&key.crt_coefficient().ok_or(crt)?),
+    });
+    Ok(jwk.to_string())
+}
+
+/// A base64url private key parameter of a JWK.
+fn field(value: Option<String>) -> Result<Vec<u8>, Box<dyn Error + Send + Sync>> {
+    let value = value.ok_or("JWK has no private key parameters")?;
+    Ok(BASE64URL.decode(value)?)
+}
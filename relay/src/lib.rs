@@ -0,0 +1,105 @@
+//! A libp2p circuit relay with room-based peer discovery, for running on its
+//! own through the `relay` binary or inside another application:
+//!
+//! ```no_run
+//! # async fn example() -> Result<(), sunset_relay::startup::StartupError> {
+//! use sunset_relay::Relay;
+//!
+//! let relay = Relay::builder()
+//!     .listen(["/ip4/0.0.0.0/udp/4001/quic-v1".parse().unwrap()])
+//!     .identity("relay.key")
+//!     .start()
+//!     .await?;
+//! relay.listening().await;
+//! println!("{} on {:?}", relay.peer_id(), relay.listen_addrs());
+//! relay.stop();
+//! relay.stopped().await;
+//! # Ok(())
+//! # }
+//! ```
+
+mod abuse;
+mod acl;
+mod acme;
+mod addrs;
+mod admin;
+mod alert;
+mod announce;
+mod audit;
+mod auth;
+mod authz;
+mod autonat;
+mod billing;
+mod builder;
+mod capacity;
+mod churn;
+mod cloudflare;
+mod cluster;
+pub mod buildinfo;
+pub mod config;
+mod connlimits;
+mod connmgr;
+mod consul;
+mod ddns;
+mod debug;
+mod dht;
+mod diagnostics;
+mod dialer;
+mod discovery;
+pub mod dnsaddr;
+mod drain;
+#[cfg(feature = "fault-injection")]
+pub mod faults;
+#[cfg(not(feature = "fault-injection"))]
+mod faults;
+mod forwarded;
+mod gate;
+mod geo;
+mod gossip;
+mod grpc;
+mod handshakes;
+mod health;
+mod ingress;
+pub mod identity;
+mod instance;
+mod ipv6;
+mod keyfile;
+pub mod keyformat;
+mod limits;
+pub mod listen;
+mod mdns;
+mod metrics;
+mod notify;
+mod proxy;
+mod psk;
+mod publicip;
+mod quota;
+mod reachability;
+mod rendezvous;
+mod reputation;
+mod rfc2136;
+mod route53;
+mod routing;
+mod security;
+mod server;
+mod sockopts;
+mod spans;
+pub mod startup;
+mod throttle;
+mod tiers;
+mod tls;
+mod traffic;
+mod udp;
+pub mod vanity;
+mod vault;
+
+pub use admin::{
+    BandwidthInfo, CertificateInfo, CircuitInfo, ReservationInfo, Status, TrafficInfo,
+    TransportInfo,
+};
+pub use builder::RelayBuilder;
+pub use diagnostics::{Diagnostics, LimitInfo, RuntimeInfo};
+pub use gate::{Cidr, Gater};
+pub use geo::CountryPolicy;
+pub use server::Relay;
+pub use throttle::Bandwidth;
@@ -0,0 +1,321 @@
+//! The reservation and circuit caps, enforced through the relay's rate
+//! limiter hooks rather than its own settings so that a reload can change
+//! them. The relay checks a request before it is accepted and the event loop
+//! keeps the counts, so requests racing each other can briefly overshoot.
+
+use std::{
+    collections::{HashMap, HashSet},
+    net::IpAddr,
+    num::NonZeroU32,
+    sync::{Arc, Mutex},
+    time::{Duration, Instant},
+};
+
+use libp2p::{Multiaddr, PeerId, relay};
+use tracing::debug;
+
+use crate::{config::Config, geo::ip_of};
+
+/// A RESERVE request limit and the window it refills over.
+type Rate = (NonZeroU32, Duration);
+
+#[derive(Debug, Default, Clone, Copy, PartialEq)]
+pub struct Limits {
+    pub max_reservations: usize,
+    pub max_reservations_per_peer: usize,
+    pub max_circuits: usize,
+    pub max_circuits_per_peer: usize,
+    pub max_circuits_per_ip: Option<usize>,
+    pub reservation_peer_rate: Option<Rate>,
+    pub reservation_ip_rate: Option<Rate>,
+}
+
+impl Limits {
+    pub fn from_config(config: &Config) -> Self {
+        Self {
+            max_reservations: config.max_reservations,
+            max_reservations_per_peer: config.max_reservations_per_peer,
+            max_circuits: config.max_circuits,
+            max_circuits_per_peer: config.max_circuits_per_peer,
+            max_circuits_per_ip: config.max_circuits_per_ip,
+            reservation_peer_rate: config.reservation_peer_rate(),
+            reservation_ip_rate: config.reservation_ip_rate(),
+        }
+    }
+}
+
+/// RESERVE requests allowed per window, refilled evenly across it.
+struct Bucket {
+    tokens: f64,
+    updated: Instant,
+}
+
+impl Bucket {
+    fn full((limit, _): Rate, now: Instant) -> Self {
+        Self {
+            tokens: f64::from(limit.get()),
+            updated: now,
+        }
+    }
+
+    /// Credit the time since the last call, returning the balance and how
+    /// many tokens the bucket holds when full.
+    fn refill(&mut self, (limit, window): Rate, now: Instant) -> (f64, f64) {
+        let burst = f64::from(limit.get());
+        let per_sec = burst / window.as_secs_f64().max(f64::MIN_POSITIVE);
+        let elapsed = now.duration_since(self.updated).as_secs_f64();
+        self.tokens = (self.tokens + elapsed * per_sec).min(burst);
+        self.updated = now;
+        (self.tokens, burst)
+    }
+
+    fn take(&mut self, rate: Rate, now: Instant) -> bool {
+        if self.refill(rate, now).0 < 1.0 {
+            return false;
+        }
+        self.tokens -= 1.0;
+        true
+    }
+
+    fn is_full(&mut self, rate: Rate, now: Instant) -> bool {
+        let (tokens, burst) = self.refill(rate, now);
+        tokens >= burst
+    }
+}
+
+#[derive(Default)]
+struct State {
+    limits: Limits,
+    held: HashMap<PeerId, usize>,
+    /// Addresses reservations were let through from, to tell renewals apart
+    reserved_from: HashMap<PeerId, HashSet<Multiaddr>>,
+    peer_rates: HashMap<PeerId, Bucket>,
+    ip_rates: HashMap<IpAddr, Bucket>,
+    peer_ips: HashMap<PeerId, IpAddr>,
+    circuits: HashMap<(PeerId, PeerId), Vec<Option<IpAddr>>>,
+    circuits_by_ip: HashMap<IpAddr, usize>,
+}
+
+impl State {
+    fn circuits(&self) -> usize {
+        self.circuits.values().map(Vec::len).sum()
+    }
+
+    fn circuits_of(&self, peer: &PeerId) -> usize {
+        self.circuits
+            .iter()
+            .filter(|((src, dst), _)| src == peer || dst == peer)
+            .map(|(_, ips)| ips.len())
+            .sum()
+    }
+
+    fn reserve(&mut self, peer: PeerId, addr: &Multiaddr, now: Instant) -> bool {
+        let limits = self.limits;
+        if let Some(rate) = limits.reservation_peer_rate {
+            let bucket = self
+                .peer_rates
+                .entry(peer)
+                .or_insert_with(|| Bucket::full(rate, now));
+            if !bucket.take(rate, now) {
+                debug!(%peer, "Reservation refused: too many requests from this peer");
+                return false;
+            }
+        }
+        if let Some(rate) = limits.reservation_ip_rate
+            && let Some(ip) = ip_of(addr)
+        {
+            let bucket = self
+                .ip_rates
+                .entry(ip)
+                .or_insert_with(|| Bucket::full(rate, now));
+            if !bucket.take(rate, now) {
+                debug!(%peer, %ip, "Reservation refused: too many requests from this IP");
+                return false;
+            }
+        }
+        let renewal = self
+            .reserved_from
+            .get(&peer)
+            .is_some_and(|addrs| addrs.contains(addr));
+        if renewal {
+            return true;
+        }
+        let held = self.held.get(&peer).copied().unwrap_or(0);
+        if held >= limits.max_reservations_per_peer {
+            debug!(%peer, held, "Reservation refused: holds the most allowed per peer");
+            return false;
+        }
+        let active: usize = self.held.values().sum();
+        if active >= limits.max_reservations {
+            debug!(%peer, active, "Reservation refused: no slots left");
+            return false;
+        }
+        self.reserved_from
+            .entry(peer)
+            .or_default()
+            .insert(addr.clone());
+        true
+    }
+
+    fn open_circuit(&self, src: PeerId, addr: &Multiaddr) -> bool {
+        let limits = self.limits;
+        let open = self.circuits();
+        if open >= limits.max_circuits {
+            debug!(peer = %src, open, "Circuit refused: no circuits left");
+            return false;
+        }
+        let of_peer = self.circuits_of(&src);
+        if of_peer >= limits.max_circuits_per_peer {
+            debug!(peer = %src, open = of_peer, "Circuit refused: too many for this peer");
+            return false;
+        }
+        let (Some(max), Some(ip)) = (limits.max_circuits_per_ip, ip_of(addr)) else {
+            return true;
+        };
+        let from_ip = self.circuits_by_ip.get(&ip).copied().unwrap_or(0);
+        if from_ip >= max {
+            debug!(peer = %src, %ip, open = from_ip, "Circuit refused: too many from this IP");
+            return false;
+        }
+        true
+    }
+}
+
+/// Shared by the reservation and circuit limiters plugged into the relay,
+/// with the event loop keeping the counts current.
+#[derive(Clone)]
+pub struct RelayLimits(Arc<Mutex<State>>);
+
+impl RelayLimits {
+    pub fn new(limits: Limits) -> Self {
+        Self(Arc::new(Mutex::new(State {
+            limits,
+            ..Default::default()
+        })))
+    }
+
+    /// Apply changed limits. Requests made so far under a changed rate are
+    /// forgotten.
+    pub fn set(&self, limits: Limits) {
+        let mut state = self.0.lock().unwrap();
+        let old = state.limits;
+        if old.reservation_peer_rate != limits.reservation_peer_rate {
+            state.peer_rates.clear();
+        }
+        if old.reservation_ip_rate != limits.reservation_ip_rate {
+            state.ip_rates.clear();
+        }
+        state.limits = limits;
+    }
+
+    pub fn reservations(&self) -> ReservationLimit {
+        ReservationLimit(self.clone())
+    }
+
+    pub fn circuits(&self) -> CircuitLimit {
+        CircuitLimit(self.clone())
+    }
+
+    /// Track who holds reservations. Rate buckets that have filled back up
+    /// are forgotten here too.
+    pub fn set_reservations<'a>(&self, holders: impl IntoIterator<Item = (&'a PeerId, usize)>) {
+        let mut state = self.0.lock().unwrap();
+        let held: HashMap<PeerId, usize> = holders
+            .into_iter()
+            .map(|(peer, count)| (*peer, count))
+            .collect();
+        state
+            .reserved_from
+            .retain(|peer, _| held.contains_key(peer));
+        state.held = held;
+        let (limits, now) = (state.limits, Instant::now());
+        if let Some(rate) = limits.reservation_peer_rate {
+            state
+                .peer_rates
+                .retain(|_, bucket| !bucket.is_full(rate, now));
+        }
+        if let Some(rate) = limits.reservation_ip_rate {
+            state
+                .ip_rates
+                .retain(|_, bucket| !bucket.is_full(rate, now));
+        }
+    }
+
+    pub fn connected(&self, peer: PeerId, addr: &Multiaddr) {
+        if let Some(ip) = ip_of(addr) {
+            self.0.lock().unwrap().peer_ips.insert(peer, ip);
+        }
+    }
+
+    pub fn disconnected(&self, peer: &PeerId) {
+        self.0.lock().unwrap().peer_ips.remove(peer);
+    }
+
+    /// Open circuits from the IP with the most.
+    pub fn busiest_ip(&self) -> usize {
+        let state = self.0.lock().unwrap();
+        state.circuits_by_ip.values().copied().max().unwrap_or(0)
+    }
+
+    pub fn relay_event(&self, event: &relay::Event) {
+        let mut state = self.0.lock().unwrap();
+        match event {
+            relay::Event::CircuitReqAccepted {
+                src_peer_id,
+                dst_peer_id,
+            } => {
+                let ip = state.peer_ips.get(src_peer_id).copied();
+                if let Some(ip) = ip {
+                    *state.circuits_by_ip.entry(ip).or_default() += 1;
+                }
+                state
+                    .circuits
+                    .entry((*src_peer_id, *dst_peer_id))
+                    .or_default()
+                    .push(ip);
+            }
+            relay::Event::CircuitClosed {
+                src_peer_id,
+                dst_peer_id,
+                ..
+            } => {
+                let key = (*src_peer_id, *dst_peer_id);
+                let Some(ips) = state.circuits.get_mut(&key) else {
+                    return;
+                };
+                let ip = ips.pop().flatten();
+                if ips.is_empty() {
+                    state.circuits.remove(&key);
+                }
+                let Some(ip) = ip else {
+                    return;
+                };
+                if let Some(count) = state.circuits_by_ip.get_mut(&ip) {
+                    *count -= 1;
+                    if *count == 0 {
+                        state.circuits_by_ip.remove(&ip);
+                    }
+                }
+            }
+            _ => {}
+        }
+    }
+}
+
+/// The reservation caps and RESERVE rates, as a reservation rate limiter.
+pub struct ReservationLimit(RelayLimits);
+
+impl relay::RateLimiter for ReservationLimit {
+    fn try_next(&mut self, peer: PeerId, addr: &Multiaddr, now: Instant) -> bool {
+        self.0.0.lock().unwrap().reserve(peer, addr, now)
+    }
+}
+
+/// The circuit caps, as a circuit source rate limiter.
+pub struct CircuitLimit(RelayLimits);
+
+impl relay::RateLimiter for CircuitLimit {
+    fn try_next(&mut self, peer: PeerId, addr: &Multiaddr, _now: Instant) -> bool {
+        self.0.0.lock().unwrap().open_circuit(peer, addr)
+    }
+}
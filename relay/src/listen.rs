@@ -0,0 +1,131 @@
+use std::net::{IpAddr, Ipv4Addr};
+#[cfg(unix)]
+use std::{fs, os::unix::fs::FileTypeExt, path::Path};
+
+use libp2p::{Multiaddr, core::multiaddr::Protocol};
+
+use crate::{config::Config, startup::StartupError};
+
+/// WebSocket over TCP for browsers and QUIC for native peers, on each
+/// --listen-ip, plus WebSocket over TLS on its own port when a
+/// certificate is configured, and plain TCP on localhost for Tor to forward
+/// an onion service to, and --unix-socket. WebSocket listeners carry
+/// --ws-path. --no-ws, --no-quic and --psk drop their transports, and
+/// --listen replaces all of them.
+pub fn plan(config: &Config) -> Vec<Multiaddr> {
+    if !config.listen.is_empty() {
+        return config.listen.clone();
+    }
+    let ips = &config.listen_ips;
+    let path = || Protocol::Ws(config.ws_path.clone().into());
+    let websocket = (!config.no_ws).then(|| {
+        ips.iter().map(|&ip| {
+            Multiaddr::from(ip)
+                .with(Protocol::Tcp(config.ws_port))
+                .with(path())
+        })
+    });
+    let quic = config.serves_quic().then(|| {
+        ips.iter().map(|&ip| {
+            Multiaddr::from(ip)
+                .with(Protocol::Udp(config.quic_port))
+                .with(Protocol::QuicV1)
+        })
+    });
+    let secure = config.cert_files().is_some().then(|| {
+        ips.iter().map(|&ip| {
+            Multiaddr::from(ip)
+                .with(Protocol::Tcp(config.wss_port))
+                .with(Protocol::Tls)
+                .with(path())
+        })
+    });
+    let onion = config
+        .onion_address
+        .as_ref()
+        .map(|_| Multiaddr::from(Ipv4Addr::LOCALHOST).with(Protocol::Tcp(config.onion_port)));
+    let unix = config.unix_socket.as_ref().map(|path| {
+        Multiaddr::empty().with(Protocol::Unix(path.to_string_lossy().into_owned().into()))
+    });
+    websocket
+        .into_iter()
+        .flatten()
+        .chain(quic.into_iter().flatten())
+        .chain(secure.into_iter().flatten())
+        .chain(onion)
+        .chain(unix)
+        .collect()
+}
+
+/// Remove a socket a previous run left at a /unix address, which would
+/// otherwise fail the bind. Anything but a socket is left for the bind to
+/// report.
+#[cfg(unix)]
+pub fn remove_stale_socket(addr: &Multiaddr) {
+    let Some(Protocol::Unix(path)) = addr.iter().next() else {
+        return;
+    };
+    let path = Path::new(path.as_ref());
+    if fs::symlink_metadata(path).is_ok_and(|meta| meta.file_type().is_socket()) {
+        let _ = fs::remove_file(path);
+    }
+}
+
+/// Reject listen addresses that would bind the same socket. Every libp2p
+/// transport opens its own listener, so plain TCP and WebSocket cannot share
+/// a TCP port the way they can behind a single multiplexed listener. IPv6
+/// listeners are v6-only, so an IPv4 and IPv6 listener never overlap.
+pub fn check_conflicts(addrs: &[Multiaddr]) -> Result<(), StartupError> {
+    let sockets: Vec<(&Multiaddr, Socket)> = addrs
+        .iter()
+        .filter_map(|addr| Some((addr, Socket::of(addr)?)))
+        .collect();
+    for (i, (first, a)) in sockets.iter().enumerate() {
+        if let Some((second, _)) = sockets[i + 1..].iter().find(|(_, b)| a.overlaps(b)) {
+            return Err(StartupError::ListenConflict {
+                first: (*first).clone(),
+                second: (*second).clone(),
+                socket: a.to_string(),
+            });
+        }
+    }
+    Ok(())
+}
+
+struct Socket {
+    ip: IpAddr,
+    udp: bool,
+    port: u16,
+}
+
+impl Socket {
+    fn of(addr: &Multiaddr) -> Option<Self> {
+        let mut protocols = addr.iter();
+        let ip = match protocols.next()? {
+            Protocol::Ip4(ip) => IpAddr::V4(ip),
+            Protocol::Ip6(ip) => IpAddr::V6(ip),
+            _ => return None,
+        };
+        let (udp, port) = match protocols.next()? {
+            Protocol::Tcp(port) => (false, port),
+            Protocol::Udp(port) => (true, port),
+            _ => return None,
+        };
+        Some(Self { ip, udp, port })
+    }
+
+    fn overlaps(&self, other: &Self) -> bool {
+        self.port != 0
+            && self.port == other.port
+            && self.udp == other.udp
+            && self.ip.is_ipv4() == other.ip.is_ipv4()
+            && (self.ip == other.ip || self.ip.is_unspecified() || other.ip.is_unspecified())
+    }
+}
+
+impl std::fmt::Display for Socket {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let proto = if self.udp { "UDP" } else { "TCP" };
+        write!(f, "{proto} port {} on {}", self.port, self.ip)
+    }
+}
@@ -0,0 +1,138 @@
+//! `--log-file`: log lines appended to a file that rotates itself, so a
+//! relay on a bare VM needs no logrotate. Once the file reaches
+//! --log-file-max-bytes, or has been written to for --log-file-max-age, it
+//! becomes `relay.log.1`, older files shift up to `relay.log.N`, and those
+//! past --log-file-keep are deleted. With --log-file-compress, rotated files
+//! are gzipped to `relay.log.N.gz` on a background thread.
+
+use std::{
+    fs::{self, File, OpenOptions},
+    io::{self, BufReader, BufWriter, Write},
+    path::{Path, PathBuf},
+    thread::{self, JoinHandle},
+    time::{Duration, SystemTime},
+};
+
+use flate2::{Compression, write::GzEncoder};
+use sunset_relay::config::Config;
+
+pub struct LogFile {
+    path: PathBuf,
+    file: File,
+    size: u64,
+    opened: SystemTime,
+    max_bytes: u64,
+    max_age: Option<Duration>,
+    keep: usize,
+    compress: bool,
+    compressing: Option<JoinHandle<()>>,
+}
+
+impl LogFile {
+    pub fn open(path: &Path, config: &Config) -> io::Result<Self> {
+        let file = append(path)?;
+        let meta = file.metadata()?;
+        Ok(Self {
+            path: path.to_path_buf(),
+            file,
+            size: meta.len(),
+            opened: meta.created().unwrap_or_else(|_| SystemTime::now()),
+            max_bytes: config.log_file_max_bytes,
+            max_age: config.log_file_max_age,
+            keep: config.log_file_keep,
+            compress: config.log_file_compress,
+            compressing: None,
+        })
+    }
+
+    fn due(&self, len: usize) -> bool {
+        if self.size == 0 {
+            return false;
+        }
+        let aged = self
+            .max_age
+            .is_some_and(|max| self.opened.elapsed().is_ok_and(|age| age >= max));
+        aged || self.size + len as u64 > self.max_bytes
+    }
+
+    fn rotate(&mut self) -> io::Result<()> {
+        if let Some(compressing) = self.compressing.take() {
+            let _ = compressing.join();
+        }
+        if self.keep == 0 {
+            fs::remove_file(&self.path)?;
+        } else {
+            for n in (1..self.keep).rev() {
+                for gz in [false, true] {
+                    let from = rotated(&self.path, n, gz);
+                    if from.exists() {
+                        fs::rename(&from, rotated(&self.path, n + 1, gz))?;
+                    }
+                }
+            }
+            let _ = fs::remove_file(rotated(&self.path, 1, true));
+            fs::rename(&self.path, rotated(&self.path, 1, false))?;
+            if self.compress {
+                let path = rotated(&self.path, 1, false);
+                self.compressing = Some(thread::spawn(move || gzip(&path)));
+            }
+        }
+        self.file = append(&self.path)?;
+        self.size = 0;
+        self.opened = SystemTime::now();
+        Ok(())
+    }
+}
+
+impl Write for LogFile {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        if self.due(buf.len())
+            && let Err(e) = self.rotate()
+        {
+            eprintln!("Could not rotate log file {}: {e}", self.path.display());
+        }
+        let written = self.file.write(buf)?;
+        self.size += written as u64;
+        Ok(written)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.file.flush()
+    }
+}
+
+fn append(path: &Path) -> io::Result<File> {
+    OpenOptions::new().create(true).append(true).open(path)
+}
+
+fn rotated(path: &Path, n: usize, gz: bool) -> PathBuf {
+    let mut name = path.as_os_str().to_owned();
+    name.push(format!(".{n}"));
+    if gz {
+        name.push(".gz");
+    }
+    PathBuf::from(name)
+}
+
+/// Replace `path` with a gzipped copy. Logging through this file would
+/// recurse, so failures go to stderr.
+fn gzip(path: &Path) {
+    let mut name = path.as_os_str().to_owned();
+    name.push(".gz");
+    let gz = PathBuf::from(name);
+    let compressed = File::open(path).and_then(|file| {
+        let mut encoder =
+            GzEncoder::new(BufWriter::new(File::create(&gz)?), Compression::default());
+        io::copy(&mut BufReader::new(file), &mut encoder)?;
+        encoder.finish()?.flush()
+    });
+    match compressed {
+        Ok(()) => {
+            let _ = fs::remove_file(path);
+        }
+        Err(e) => {
+            eprintln!("Could not compress log file {}: {e}", path.display());
+            let _ = fs::remove_file(&gz);
+        }
+    }
+}
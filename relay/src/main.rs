@@ -1,310 +1,281 @@
-use std::{
-    collections::HashMap,
-    net::{Ipv4Addr, Ipv6Addr},
-    path::PathBuf,
-    sync::Arc,
-    time::{Duration, Instant},
+mod commands;
+mod daemon;
+#[cfg(unix)]
+mod dump;
+mod logfile;
+mod output;
+mod reload;
+mod rotation;
+#[cfg(windows)]
+mod service;
+mod shutdown;
+#[cfg(unix)]
+mod sinks;
+mod systemd;
+mod telemetry;
+mod top;
+
+use std::{path::PathBuf, time::Duration};
+
+use clap::{Args, Parser, Subcommand};
+use tracing::{error, info, warn};
+
+use sunset_relay::{
+    Relay, buildinfo,
+    config::{Config, Output, Settings},
+    keyformat::KeyFormat,
+    startup::StartupError,
 };
 
-use clap::Parser;
-use futures::StreamExt;
-use libp2p::{
-    core::multiaddr::Protocol,
-    identify, identity,
-    multiaddr::Multiaddr,
-    noise,
-    relay,
-    request_response::{self, ProtocolSupport},
-    swarm::{NetworkBehaviour, SwarmEvent},
-    tcp, yamux, PeerId, StreamProtocol,
-};
-use serde::{Deserialize, Serialize};
-use tokio::{fs, signal, sync::Mutex};
-use tracing::{debug, info, warn};
-use tracing_subscriber::EnvFilter;
+use crate::telemetry::Telemetry;
 
 #[derive(Debug, Parser)]
-#[command(name = "sunset-relay", about = "Minimal libp2p circuit relay with room-based peer discovery")]
-struct Opt {
-    /// Port to listen on
-    #[arg(long, default_value = "4001")]
-    port: u16,
-
-    /// Path to persistent identity key
-    #[arg(long, default_value = "identity.key")]
-    identity: PathBuf,
-
-    /// Max circuit relay reservations
-    #[arg(long, default_value = "256")]
-    max_reservations: u32,
+#[command(
+    name = "sunset-relay",
+    about = "Minimal libp2p circuit relay with room-based peer discovery",
+    version = buildinfo::LONG_VERSION
+)]
+struct Cli {
+    #[command(subcommand)]
+    command: Command,
 }
 
-// -- Discovery protocol types --
-
-#[derive(Debug, Clone, Serialize, Deserialize)]
-struct DiscoveryRequest {
-    room: String,
-    peer_id: String,
-    addrs: Vec<String>,
+#[derive(Debug, Subcommand)]
+enum Command {
+    /// Run the relay
+    Serve(ConfigArgs),
+    /// Print the PeerID and listen addresses of the configured identity without starting
+    Id(ConfigArgs),
+    /// Generate a new identity file
+    Keygen(commands::KeygenArgs),
+    /// Move identity keys to and from PEM and JWK
+    #[command(subcommand)]
+    Key(KeyCommand),
+    /// Validate the configuration and print the effective settings
+    Check(ConfigArgs),
+    /// Print the _dnsaddr TXT records for the configured addresses, or publish them
+    Dnsaddr {
+        /// Domain clients bootstrap from as /dnsaddr/NAME [default: --dnsaddr, --external-dns or --domain]
+        name: Option<String>,
+
+        /// Replace the published records through --ddns-provider instead of printing them
+        #[arg(long)]
+        publish: bool,
+
+        #[command(flatten)]
+        args: ConfigArgs,
+    },
+    /// Watch a running relay's reservations, circuits and bandwidth through its admin API
+    Top {
+        /// Admin API to connect to [default: --admin-addr, over loopback if it listens on every address]
+        #[arg(long)]
+        url: Option<String>,
+
+        /// How often to refresh
+        #[arg(long, default_value = "1s", value_parser = humantime::parse_duration)]
+        interval: Duration,
+
+        #[command(flatten)]
+        args: ConfigArgs,
+    },
+    /// Install, remove or run the relay as a Windows service
+    #[cfg(windows)]
+    #[command(subcommand)]
+    Service(ServiceCommand),
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
-struct PeerInfo {
-    peer_id: String,
-    addrs: Vec<String>,
+#[derive(Debug, Subcommand)]
+enum KeyCommand {
+    /// Print the configured identity as PEM or JWK
+    Export {
+        #[arg(long, default_value = "pem")]
+        format: KeyFormat,
+
+        #[command(flatten)]
+        args: ConfigArgs,
+    },
+    /// Write an identity file from a PEM or JWK private key
+    Import(commands::KeyImportArgs),
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
-struct DiscoveryResponse {
-    peers: Vec<PeerInfo>,
+#[cfg(windows)]
+#[derive(Debug, Subcommand)]
+enum ServiceCommand {
+    /// Register the relay to start at boot with these settings, which should use absolute paths
+    Install(ConfigArgs),
+    /// Stop the service and remove it
+    Uninstall,
+    /// Run as the service; only the service manager starts the relay this way
+    Run(ConfigArgs),
 }
 
-// -- Room registry --
+#[derive(Clone, Debug, Args)]
+struct ConfigArgs {
+    /// TOML file with relay settings; flags and `SUTRO_*` variables override its values
+    #[arg(long, env = "SUTRO_CONFIG")]
+    config: Option<PathBuf>,
 
-struct PeerEntry {
-    addrs: Vec<String>,
-    last_seen: Instant,
+    #[command(flatten)]
+    settings: Settings,
 }
 
-type RoomRegistry = Arc<Mutex<HashMap<String, HashMap<String, PeerEntry>>>>;
-
-const PEER_TTL: Duration = Duration::from_secs(30);
-
-async fn handle_discovery(
-    registry: &RoomRegistry,
-    req: DiscoveryRequest,
-) -> DiscoveryResponse {
-    let mut rooms = registry.lock().await;
-
-    // Expire stale entries in this room
-    let now = Instant::now();
-    if let Some(room) = rooms.get_mut(&req.room) {
-        room.retain(|_, entry| now.duration_since(entry.last_seen) < PEER_TTL);
+fn main() {
+    let cli = Cli::parse();
+    if let Command::Serve(args) = &cli.command
+        && let Err(e) = daemon::detach(args)
+    {
+        let _ = Telemetry::init(None);
+        e.report();
+        std::process::exit(1);
+    }
+    let runtime = tokio::runtime::Runtime::new().expect("failed to start the Tokio runtime");
+    if let Err(e) = runtime.block_on(run(cli.command)) {
+        e.report();
+        std::process::exit(1);
     }
-
-    // Insert/update the requesting peer
-    let room = rooms.entry(req.room.clone()).or_default();
-    room.insert(
-        req.peer_id.clone(),
-        PeerEntry {
-            addrs: req.addrs,
-            last_seen: now,
-        },
-    );
-
-    // Collect all other peers in the room
-    let peers: Vec<PeerInfo> = room
-        .iter()
-        .filter(|(pid, _)| *pid != &req.peer_id)
-        .map(|(pid, entry)| PeerInfo {
-            peer_id: pid.clone(),
-            addrs: entry.addrs.clone(),
-        })
-        .collect();
-
-    DiscoveryResponse { peers }
 }
 
-/// Clean up a peer from all rooms when they disconnect.
-async fn remove_peer(registry: &RoomRegistry, peer_id: &PeerId) {
-    let peer_str = peer_id.to_string();
-    let mut rooms = registry.lock().await;
-    let mut empty_rooms = Vec::new();
-    for (room_name, peers) in rooms.iter_mut() {
-        peers.remove(&peer_str);
-        if peers.is_empty() {
-            empty_rooms.push(room_name.clone());
+async fn run(command: Command) -> Result<(), StartupError> {
+    match command {
+        Command::Serve(args) => start(args).await,
+        Command::Id(args) => match setup(args) {
+            Ok((config, _)) => commands::id(&config).await,
+            Err(e) => Err(e),
+        },
+        Command::Keygen(args) => match Telemetry::init(None) {
+            Ok(_) => commands::keygen(args).await,
+            Err(e) => Err(e),
+        },
+        Command::Key(KeyCommand::Export { format, args }) => match setup(args) {
+            Ok((config, _)) => commands::export_key(&config, format).await,
+            Err(e) => Err(e),
+        },
+        Command::Key(KeyCommand::Import(args)) => match Telemetry::init(None) {
+            Ok(_) => commands::import_key(args).await,
+            Err(e) => Err(e),
+        },
+        Command::Check(args) => setup(args).and_then(|(config, _)| commands::check(&config)),
+        Command::Dnsaddr {
+            name,
+            publish,
+            args,
+        } => match setup(args) {
+            Ok((config, _)) => commands::dnsaddr(&config, name, publish).await,
+            Err(e) => Err(e),
+        },
+        Command::Top {
+            url,
+            interval,
+            args,
+        } => match setup(args) {
+            Ok((config, _)) => top::run(&config, url, interval).await,
+            Err(e) => Err(e),
+        },
+        #[cfg(windows)]
+        Command::Service(ServiceCommand::Install(args)) => {
+            setup(args).and_then(|_| service::install())
+        }
+        #[cfg(windows)]
+        Command::Service(ServiceCommand::Uninstall) => {
+            Telemetry::init(None).and_then(|_| service::uninstall())
+        }
+        #[cfg(windows)]
+        Command::Service(ServiceCommand::Run(args)) => {
+            tokio::task::block_in_place(|| service::run(args))
         }
-    }
-    for room_name in empty_rooms {
-        rooms.remove(&room_name);
     }
 }
 
-// -- libp2p behaviour --
-
-#[derive(NetworkBehaviour)]
-struct Behaviour {
-    relay: relay::Behaviour,
-    identify: identify::Behaviour,
-    discovery: request_response::json::Behaviour<DiscoveryRequest, DiscoveryResponse>,
+/// Load the configuration and serve it until stopped.
+async fn start(args: ConfigArgs) -> Result<(), StartupError> {
+    let source = reload::Source::new(args.config.clone(), args.settings.clone());
+    let (config, telemetry) = setup(args)?;
+    let result = serve(config, source, &telemetry).await;
+    telemetry.shutdown();
+    result
 }
 
-#[tokio::main]
-async fn main() -> Result<(), Box<dyn std::error::Error>> {
-    let _ = tracing_subscriber::fmt()
-        .with_env_filter(
-            EnvFilter::try_from_default_env().unwrap_or_else(|_| EnvFilter::new("info")),
-        )
-        .try_init();
-
-    let opt = Opt::parse();
-
-    let local_key = load_or_create_identity(&opt.identity).await?;
-    let local_peer_id = local_key.public().to_peer_id();
-
-    info!("Local PeerID: {local_peer_id}");
-
-    // Configure relay with reservation limits
-    let relay_config = relay::Config {
-        max_reservations: opt.max_reservations as usize,
-        ..Default::default()
-    };
-
-    let mut swarm = libp2p::SwarmBuilder::with_existing_identity(local_key)
-        .with_tokio()
-        .with_tcp(
-            tcp::Config::default(),
-            noise::Config::new,
-            yamux::Config::default,
-        )?
-        .with_quic()
-        .with_dns()?
-        .with_websocket(noise::Config::new, yamux::Config::default)
-        .await?
-        .with_behaviour(|key| Behaviour {
-            relay: relay::Behaviour::new(key.public().to_peer_id(), relay_config),
-            identify: identify::Behaviour::new(identify::Config::new(
-                "/sunset-relay/0.1.0".to_string(),
-                key.public(),
-            )),
-            discovery: request_response::json::Behaviour::new(
-                [(
-                    StreamProtocol::new("/sunset/discovery/1.0.0"),
-                    ProtocolSupport::Full,
-                )],
-                request_response::Config::default(),
-            ),
-        })?
-        .build();
-
-    // Listen on all interfaces — WebSocket (for browsers) and QUIC (for native peers)
-    let port = opt.port;
-
-    // WebSocket over TCP (IPv4 + IPv6) — browsers connect here
-    swarm.listen_on(
-        Multiaddr::empty()
-            .with(Protocol::from(Ipv4Addr::UNSPECIFIED))
-            .with(Protocol::Tcp(port))
-            .with(Protocol::Ws("/".into())),
-    )?;
-    swarm.listen_on(
-        Multiaddr::empty()
-            .with(Protocol::from(Ipv6Addr::UNSPECIFIED))
-            .with(Protocol::Tcp(port))
-            .with(Protocol::Ws("/".into())),
-    )?;
-
-    // QUIC (IPv4 + IPv6)
-    swarm.listen_on(
-        Multiaddr::empty()
-            .with(Protocol::from(Ipv4Addr::UNSPECIFIED))
-            .with(Protocol::Udp(port))
-            .with(Protocol::QuicV1),
-    )?;
-    swarm.listen_on(
-        Multiaddr::empty()
-            .with(Protocol::from(Ipv6Addr::UNSPECIFIED))
-            .with(Protocol::Udp(port))
-            .with(Protocol::QuicV1),
-    )?;
-
-    info!("Relay listening on port {port}");
+/// Load the configuration and set up logging, which depends on it.
+fn setup(args: ConfigArgs) -> Result<(Config, Telemetry), StartupError> {
+    let config = Config::load(args.config.as_deref(), args.settings);
+    let telemetry = Telemetry::init(config.as_ref().ok());
+    match (config, telemetry) {
+        (Err(e), _) => Err(StartupError::Config(e)),
+        (Ok(_), Err(e)) => Err(e),
+        (Ok(config), Ok(telemetry)) => Ok((config, telemetry)),
+    }
+}
 
-    let registry: RoomRegistry = Arc::new(Mutex::new(HashMap::new()));
+/// Run the relay as a service: signals stop, drain, reload and dump it, and
+/// systemd hears about readiness and liveness. A previous identity being
+/// rotated out runs alongside and follows the same stops and reloads.
+async fn serve(
+    config: Config,
+    source: reload::Source,
+    telemetry: &Telemetry,
+) -> Result<(), StartupError> {
+    let retiring = config.retiring();
+    let (output, qr) = (config.output, config.qr);
+    #[cfg(unix)]
+    let (diagnostics_file, dump_file) =
+        tokio::sync::watch::channel(config.diagnostics_file.clone());
+    let relay = Relay::start(config).await?;
+    let previous = rotation::start(retiring).await?;
+    if let Some(interval) = systemd::watchdog_interval() {
+        info!(
+            "Pinging the systemd watchdog every {}",
+            humantime::format_duration(interval)
+        );
+        tokio::spawn(systemd::watchdog(relay.clone(), interval));
+    }
+    let listening = relay.clone();
+    tokio::spawn(async move {
+        listening.listening().await;
+        systemd::ready();
+    });
+    tokio::spawn(shutdown::drain_on_signal(relay.clone()));
+    #[cfg(unix)]
+    tokio::spawn(dump::dump_on_signal(relay.clone(), dump_file));
+    if output == Output::Json {
+        tokio::spawn(output::print_json(relay.clone()));
+    }
+    if qr {
+        tokio::spawn(output::print_qr(relay.clone()));
+    }
 
-    // Event loop
+    let mut hangups = reload::Hangups::new();
+    let stopped = relay.stopped();
+    tokio::pin!(stopped);
     loop {
         tokio::select! {
-            event = swarm.next() => {
-                match event.expect("swarm stream should be infinite") {
-                    SwarmEvent::NewListenAddr { address, .. } => {
-                        info!("Listening on {address}/p2p/{local_peer_id}");
-                    }
-                    SwarmEvent::Behaviour(BehaviourEvent::Identify(identify::Event::Received {
-                        info: identify::Info { observed_addr, .. },
-                        ..
-                    })) => {
-                        swarm.add_external_address(observed_addr);
-                    }
-                    SwarmEvent::Behaviour(BehaviourEvent::Relay(
-                        relay::Event::ReservationReqAccepted { src_peer_id, .. },
-                    )) => {
-                        info!("Relay reservation accepted for {src_peer_id}");
-                    }
-                    SwarmEvent::Behaviour(BehaviourEvent::Discovery(
-                        request_response::Event::Message {
-                            peer,
-                            message: request_response::Message::Request {
-                                request,
-                                channel,
-                                ..
-                            },
-                            ..
-                        },
-                    )) => {
-                        debug!(
-                            "Discovery request from {peer}: room={} addrs={}",
-                            request.room,
-                            request.addrs.len()
-                        );
-                        let response = handle_discovery(&registry, request).await;
-                        debug!("Responding with {} peers", response.peers.len());
-                        if swarm
-                            .behaviour_mut()
-                            .discovery
-                            .send_response(channel, response)
-                            .is_err()
-                        {
-                            warn!("Failed to send discovery response to {peer}");
-                        }
-                    }
-                    SwarmEvent::ConnectionEstablished { peer_id, endpoint, .. } => {
-                        info!("Connection established with {peer_id} via {}", endpoint.get_remote_address());
-                    }
-                    SwarmEvent::ConnectionClosed { peer_id, cause, .. } => {
-                        info!("Connection closed with {peer_id}: {cause:?}");
-                        remove_peer(&registry, &peer_id).await;
+            _ = &mut stopped => break,
+            _ = shutdown::signal() => {
+                relay.stop();
+                previous.iter().for_each(Relay::stop);
+            }
+            _ = hangups.recv() => match source.load() {
+                Ok(new) => {
+                    telemetry.set_log_level(new.log_level.as_deref());
+                    #[cfg(unix)]
+                    diagnostics_file.send_replace(new.diagnostics_file.clone());
+                    if let (Some(previous), Some((retiring, _))) = (&previous, new.retiring()) {
+                        previous.reload(retiring);
                     }
-                    _ => {}
+                    relay.reload(new);
                 }
-            }
-            _ = signal::ctrl_c() => {
-                info!("Shutting down...");
-                break;
-            }
+                Err(e) => warn!("Not reloading configuration: {e}"),
+            },
         }
     }
-
-    Ok(())
-}
-
-/// Load an Ed25519 identity from disk, or generate and save a new one.
-async fn load_or_create_identity(
-    path: &PathBuf,
-) -> Result<identity::Keypair, Box<dyn std::error::Error>> {
-    if let Ok(data) = fs::read(path).await {
-        // Try to decode as a libp2p protobuf-encoded keypair first
-        if let Ok(keypair) = identity::Keypair::from_protobuf_encoding(&data) {
-            info!("Loaded identity from {}", path.display());
-            return Ok(keypair);
-        }
-        // Try as raw Ed25519 secret key bytes (32 bytes)
-        if data.len() == 32 {
-            if let Ok(keypair) = identity::Keypair::ed25519_from_bytes(data) {
-                info!("Loaded raw Ed25519 identity from {}", path.display());
-                return Ok(keypair);
-            }
-        }
-        warn!(
-            "Could not decode identity file {}, generating new key",
-            path.display()
-        );
+    systemd::stopping();
+    if let Some(previous) = previous {
+        previous.stop();
+        previous.stopped().await;
     }
-
-    let keypair = identity::Keypair::generate_ed25519();
-    let encoded = keypair.to_protobuf_encoding()?;
-    fs::write(path, &encoded).await?;
-    info!("Generated new identity, saved to {}", path.display());
-    Ok(keypair)
+    if let Some(reason) = relay.failure() {
+        error!("Relay stopped itself: {reason}");
+        telemetry.shutdown();
+        std::process::exit(2);
+    }
+    Ok(())
 }
@@ -0,0 +1,36 @@
+//! mDNS on the local network, so the relay finds and is found by peers on
+//! the same LAN without any public infrastructure, as in labs, demos and
+//! offline deployments.
+
+use std::io;
+
+use libp2p::{
+    Multiaddr, PeerId,
+    mdns::{self, Event},
+};
+use tracing::debug;
+
+pub type Behaviour = mdns::tokio::Behaviour;
+
+pub fn behaviour(local_peer_id: PeerId) -> io::Result<Behaviour> {
+    mdns::tokio::Behaviour::new(mdns::Config::default(), local_peer_id)
+}
+
+/// The peers and addresses newly found on the network, logging the ones
+/// that went quiet.
+pub fn discovered(event: Event) -> Vec<(PeerId, Multiaddr)> {
+    match event {
+        Event::Discovered(found) => {
+            for (peer, addr) in &found {
+                debug!(%peer, %addr, "Found peer on the local network");
+            }
+            found
+        }
+        Event::Expired(gone) => {
+            for (peer, addr) in &gone {
+                debug!(%peer, %addr, "Peer left the local network");
+            }
+            Vec::new()
+        }
+    }
+}
@@ -0,0 +1,352 @@
+use std::sync::Arc;
+
+use axum::{
+    Router,
+    extract::State,
+    http::{StatusCode, header},
+    response::IntoResponse,
+    routing::get,
+};
+use libp2p::{
+    Multiaddr,
+    autonat::v1::NatStatus,
+    metrics::{Metrics as Libp2pMetrics, Recorder},
+    relay,
+};
+use prometheus_client::{
+    encoding::{EncodeLabelSet, text::encode},
+    metrics::{counter::Counter, family::Family, gauge::Gauge},
+    registry::Registry,
+};
+use tokio::net::TcpListener;
+use tracing::warn;
+
+use crate::{abuse::Offence, addrs::transport_name, geo::GeoIp, traffic::PeerTraffic};
+
+#[derive(Clone, Debug, Hash, PartialEq, Eq, EncodeLabelSet)]
+struct ConnectionLabels {
+    transport: String,
+    country: String,
+}
+
+#[derive(Clone, Debug, Hash, PartialEq, Eq, EncodeLabelSet)]
+struct DialBackLabels {
+    result: &'static str,
+}
+
+#[derive(Clone, Debug, Hash, PartialEq, Eq, EncodeLabelSet)]
+struct BanLabels {
+    offence: &'static str,
+}
+
+/// Health of the WebSocket TLS certificate, kept up to date by the file
+/// watcher and ACME renewal rather than the event loop.
+#[derive(Clone, Default)]
+pub struct CertMetrics {
+    expiry: Gauge,
+    renewal_failures: Counter,
+}
+
+impl CertMetrics {
+    /// Record a newly loaded certificate and when it expires, as a Unix time.
+    pub fn loaded(&self, not_after: Option<i64>) {
+        self.expiry.set(not_after.unwrap_or(0));
+    }
+
+    pub fn renewal_failed(&self) {
+        self.renewal_failures.inc();
+    }
+
+    /// When the loaded certificate expires, as a Unix time, if one is loaded.
+    pub fn expires(&self) -> Option<i64> {
+        Some(self.expiry.get()).filter(|&expiry| expiry != 0)
+    }
+
+    pub fn renewal_failures(&self) -> u64 {
+        self.renewal_failures.get()
+    }
+}
+
+/// Inbound connections still handshaking, kept by the handshake limiter.
+#[derive(Clone, Default)]
+pub struct HandshakeMetrics {
+    pending: Gauge,
+    rejected: Counter,
+}
+
+impl HandshakeMetrics {
+    pub fn set_pending(&self, pending: usize) {
+        self.pending.set(pending as i64);
+    }
+
+    pub fn rejected(&self) {
+        self.rejected.inc();
+    }
+}
+
+/// Relay metrics on top of the generic libp2p swarm and relay metrics.
+/// Bytes per transport and direction come from the swarm's bandwidth metrics.
+pub struct Metrics {
+    libp2p: Libp2pMetrics,
+    reservations: Gauge,
+    circuits_opened: Counter,
+    circuits_closed: Counter,
+    connections: Family<ConnectionLabels, Gauge>,
+    connections_denied: Counter,
+    bans: Family<BanLabels, Counter>,
+    banned: Gauge,
+    discrepancies: Counter,
+    dial_backs: Family<DialBackLabels, Counter>,
+    reachable: Gauge,
+    probes: Family<DialBackLabels, Counter>,
+    geoip: Arc<GeoIp>,
+}
+
+impl Metrics {
+    /// Connections are labelled by country while a GeoIP database is loaded.
+    pub fn new(
+        registry: &mut Registry,
+        geoip: Arc<GeoIp>,
+        traffic: PeerTraffic,
+        certs: CertMetrics,
+        handshakes: HandshakeMetrics,
+    ) -> Self {
+        let libp2p = Libp2pMetrics::new(registry);
+        let registry = registry.sub_registry_with_prefix("sutro");
+
+        let reservations = Gauge::default();
+        registry.register(
+            "reservations",
+            "Active circuit relay reservations",
+            reservations.clone(),
+        );
+        let circuits_opened = Counter::default();
+        registry.register(
+            "circuits_opened",
+            "Relayed circuits accepted",
+            circuits_opened.clone(),
+        );
+        let circuits_closed = Counter::default();
+        registry.register(
+            "circuits_closed",
+            "Relayed circuits closed",
+            circuits_closed.clone(),
+        );
+        let connections = Family::default();
+        registry.register(
+            "connections",
+            "Open connections by transport and country",
+            connections.clone(),
+        );
+        let connections_denied = Counter::default();
+        registry.register(
+            "connections_denied",
+            "Inbound connections rejected before the handshake finished",
+            connections_denied.clone(),
+        );
+        let bans = Family::default();
+        registry.register(
+            "peer_bans",
+            "Peers banned by --abuse-bans, by the offence that earned the ban",
+            bans.clone(),
+        );
+        let banned = Gauge::default();
+        registry.register("banned_peers", "Peers currently banned", banned.clone());
+        let discrepancies = Counter::default();
+        registry.register(
+            "reservation_discrepancies",
+            "Reservation accounting errors repaired by reconciliation",
+            discrepancies.clone(),
+        );
+        let dial_backs = Family::default();
+        registry.register(
+            "autonat_dial_backs",
+            "AutoNAT dial-backs made for peers, by whether the address was reachable",
+            dial_backs.clone(),
+        );
+        let reachable = Gauge::default();
+        reachable.set(-1);
+        registry.register(
+            "reachable",
+            "Whether AutoNAT servers can dial the relay back: 1 if so, 0 if not, -1 before they have said",
+            reachable.clone(),
+        );
+        let probes = Family::default();
+        registry.register(
+            "reachability_probes",
+            "Dial-backs the relay asked AutoNAT servers for, by result",
+            probes.clone(),
+        );
+        registry.register(
+            "tls_certificate_expiry_timestamp_seconds",
+            "When the WebSocket TLS certificate expires, as a Unix time (0 without one)",
+            certs.expiry,
+        );
+        registry.register(
+            "tls_certificate_renewal_failures",
+            "Failed attempts to renew the ACME certificate",
+            certs.renewal_failures,
+        );
+        registry.register(
+            "pending_handshakes",
+            "Inbound connections still handshaking",
+            handshakes.pending,
+        );
+        registry.register(
+            "handshakes_rejected",
+            "Inbound connections refused over --max-pending-handshakes",
+            handshakes.rejected,
+        );
+        registry.register_collector(Box::new(traffic));
+
+        Self {
+            libp2p,
+            reservations,
+            circuits_opened,
+            circuits_closed,
+            connections,
+            connections_denied,
+            bans,
+            banned,
+            discrepancies,
+            dial_backs,
+            reachable,
+            probes,
+            geoip,
+        }
+    }
+
+    /// Feed an event to the generic libp2p metrics.
+    pub fn record<E>(&self, event: &E)
+    where
+        Libp2pMetrics: Recorder<E>,
+    {
+        self.libp2p.record(event);
+    }
+
+    pub fn relay_event(&self, event: &relay::Event) {
+        self.libp2p.record(event);
+        match event {
+            relay::Event::CircuitReqAccepted { .. } => {
+                self.circuits_opened.inc();
+            }
+            relay::Event::CircuitClosed { .. } => {
+                self.circuits_closed.inc();
+            }
+            _ => {}
+        }
+    }
+
+    pub fn set_reservations(&self, active: usize) {
+        self.reservations.set(active as i64);
+    }
+
+    pub fn connected(&self, addr: &Multiaddr) {
+        self.connection(addr).inc();
+    }
+
+    pub fn disconnected(&self, addr: &Multiaddr) {
+        self.connection(addr).dec();
+    }
+
+    pub fn denied(&self) {
+        self.connections_denied.inc();
+    }
+
+    pub fn banned(&self, offence: Offence) {
+        let offence = offence.as_str();
+        self.bans.get_or_create(&BanLabels { offence }).inc();
+    }
+
+    pub fn set_banned(&self, peers: usize) {
+        self.banned.set(peers as i64);
+    }
+
+    pub fn repaired(&self, fixed: usize) {
+        self.discrepancies.inc_by(fixed as u64);
+    }
+
+    pub fn dial_back(&self, reachable: bool) {
+        let result = if reachable { "reachable" } else { "unreachable" };
+        self.dial_backs.get_or_create(&DialBackLabels { result }).inc();
+    }
+
+    pub fn set_reachable(&self, status: &NatStatus) {
+        self.reachable.set(match status {
+            NatStatus::Public(_) => 1,
+            NatStatus::Private => 0,
+            NatStatus::Unknown => -1,
+        });
+    }
+
+    pub fn probe(&self, result: &'static str) {
+        self.probes.get_or_create(&DialBackLabels { result }).inc();
+    }
+
+    fn connection(&self, addr: &Multiaddr) -> Gauge {
+        let country = self.geoip.country_of(addr);
+        self.connections
+            .get_or_create(&ConnectionLabels {
+                transport: transport_name(addr).to_string(),
+                country: country.unwrap_or_else(|| "unknown".to_string()),
+            })
+            .clone()
+    }
+}
+
+/// Bytes in and out over every transport, summed from the swarm's
+/// bandwidth metrics in `registry`.
+pub fn bandwidth(registry: &Registry) -> (u64, u64) {
+    let mut body = String::new();
+    if encode(&mut body, registry).is_err() {
+        return (0, 0);
+    }
+    let mut totals = (0, 0);
+    for line in body.lines() {
+        let Some((name, rest)) = line.split_once('{') else {
+            continue;
+        };
+        let Some((labels, value)) = rest.split_once("} ") else {
+            continue;
+        };
+        if !name.ends_with("bandwidth_bytes_total") {
+            continue;
+        }
+        let bytes: u64 = value
+            .split(' ')
+            .next()
+            .and_then(|value| value.parse().ok())
+            .unwrap_or(0);
+        if labels.contains("direction=\"Inbound\"") {
+            totals.0 += bytes;
+        } else {
+            totals.1 += bytes;
+        }
+    }
+    totals
+}
+
+/// Serve `/metrics` in the OpenMetrics text format on an already-bound listener.
+pub async fn serve(listener: TcpListener, registry: Arc<Registry>) {
+    let app = Router::new()
+        .route("/metrics", get(metrics))
+        .with_state(registry);
+    if let Err(e) = axum::serve(listener, app).await {
+        warn!("Metrics server stopped: {e}");
+    }
+}
+
+async fn metrics(State(registry): State<Arc<Registry>>) -> impl IntoResponse {
+    let mut body = String::new();
+    if encode(&mut body, &registry).is_err() {
+        return StatusCode::INTERNAL_SERVER_ERROR.into_response();
+    }
+    (
+        [(
+            header::CONTENT_TYPE,
+            "application/openmetrics-text; version=1.0.0; charset=utf-8",
+        )],
+        body,
+    )
+        .into_response()
+}
@@ -0,0 +1,106 @@
+//! Notifications of relay events, posted as JSON to --event-webhook so the
+//! relay can be wired into chat or paging without polling it. Like alerts,
+//! each payload has the `event` name and a `text` for Slack-compatible
+//! webhooks, alongside the peers or addresses the event is about.
+
+use std::sync::{Arc, RwLock};
+
+use libp2p::relay;
+use reqwest::Client;
+use serde_json::{Value, json};
+use tracing::{debug, warn};
+
+use crate::{
+    abuse,
+    config::{Config, NotifyEvent},
+};
+
+struct Target {
+    webhook: Option<String>,
+    events: Vec<NotifyEvent>,
+}
+
+impl Target {
+    fn from_config(config: &Config) -> Self {
+        Self {
+            webhook: config.event_webhook.clone().map(|url| url.0),
+            events: config.event_webhook_events.clone(),
+        }
+    }
+}
+
+/// Clones share the webhook and events, which a reload can change.
+#[derive(Clone)]
+pub struct Notifier {
+    client: Client,
+    target: Arc<RwLock<Target>>,
+}
+
+impl Notifier {
+    pub fn from_config(config: &Config) -> Self {
+        Self {
+            client: Client::new(),
+            target: Arc::new(RwLock::new(Target::from_config(config))),
+        }
+    }
+
+    pub fn set(&self, config: &Config) {
+        *self.target.write().unwrap() = Target::from_config(config);
+    }
+
+    fn webhook_for(&self, event: NotifyEvent) -> Option<String> {
+        let target = self.target.read().unwrap();
+        target.events.contains(&event).then(|| target.webhook.clone())?
+    }
+
+    /// Post a notification in the background, if `event` is one of
+    /// --event-webhook-events. `details` is a JSON object whose fields are
+    /// sent along. Delivery failures are only logged.
+    pub fn send(&self, event: NotifyEvent, text: String, details: Value) {
+        let Some(webhook) = self.webhook_for(event) else {
+            return;
+        };
+        debug!(?event, "{text}");
+        let mut body = details;
+        body["event"] = json!(event);
+        body["text"] = json!(text);
+        let request = self.client.post(webhook).json(&body);
+        tokio::spawn(async move {
+            let sent = request.send().await.and_then(|r| r.error_for_status());
+            if let Err(e) = sent {
+                warn!(?event, "Could not deliver event notification: {e}");
+            }
+        });
+    }
+
+    pub fn relay_event(&self, event: &relay::Event) {
+        match event {
+            relay::Event::ReservationReqAccepted {
+                src_peer_id,
+                renewed: false,
+            } => self.send(
+                NotifyEvent::ReservationCreated,
+                format!("Peer {src_peer_id} reserved a slot on the relay"),
+                json!({ "peer_id": src_peer_id.to_string() }),
+            ),
+            relay::Event::ReservationTimedOut { src_peer_id } => self.send(
+                NotifyEvent::ReservationExpired,
+                format!("The reservation of peer {src_peer_id} expired"),
+                json!({ "peer_id": src_peer_id.to_string() }),
+            ),
+            relay::Event::CircuitClosed {
+                src_peer_id,
+                dst_peer_id,
+                error: Some(error),
+            } if abuse::hit_data_limit(error) => self.send(
+                NotifyEvent::CircuitLimitExceeded,
+                format!("A circuit from {src_peer_id} to {dst_peer_id} hit the data limit"),
+                json!({
+                    "src_peer_id": src_peer_id.to_string(),
+                    "dst_peer_id": dst_peer_id.to_string(),
+                }),
+            ),
+            _ => {}
+        }
+    }
+}
@@ -0,0 +1,115 @@
+//! What the relay prints for scripts and people once it is listening. With
+//! `--output json`, its PeerID and addresses go to stdout as one JSON
+//! document per line, printed again whenever the addresses or the TLS
+//! certificate change. With `--qr`, its primary address goes to stderr as a
+//! QR code for pointing a phone at.
+
+use std::time::{Duration, SystemTime};
+
+use libp2p::{Multiaddr, multiaddr::Protocol};
+use qrcode::{QrCode, render::unicode::Dense1x2};
+use serde::Serialize;
+use sunset_relay::{Relay, Status};
+use tokio::time;
+use tracing::warn;
+
+/// External addresses and certificate reloads are not signalled, so they
+/// are checked for this often.
+const RECHECK_INTERVAL: Duration = Duration::from_secs(30);
+
+#[derive(PartialEq, Serialize)]
+struct Document {
+    peer_id: String,
+    listen_addrs: Vec<String>,
+    external_addrs: Vec<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    certificate_expires: Option<String>,
+}
+
+impl From<Status> for Document {
+    fn from(status: Status) -> Self {
+        let dialable = |addrs: Vec<String>| {
+            addrs
+                .into_iter()
+                .map(|addr| format!("{addr}/p2p/{}", status.peer_id))
+                .collect()
+        };
+        Self {
+            listen_addrs: dialable(status.listen_addrs),
+            external_addrs: dialable(status.external_addrs),
+            certificate_expires: status.certificate.map(|cert| {
+                let not_after =
+                    SystemTime::UNIX_EPOCH + Duration::from_secs(cert.not_after.max(0) as u64);
+                humantime::format_rfc3339_seconds(not_after).to_string()
+            }),
+            peer_id: status.peer_id,
+        }
+    }
+}
+
+/// Print the document once the relay is listening, and again on every
+/// change until it stops.
+pub async fn print_json(relay: Relay) {
+    relay.listening().await;
+    let mut listen_addrs = relay.watch_listen_addrs();
+    let mut recheck = time::interval(RECHECK_INTERVAL);
+    let mut printed = None;
+    loop {
+        let Some(status) = relay.status().await else {
+            return;
+        };
+        let document = Document::from(status);
+        if printed.as_ref() != Some(&document) {
+            match serde_json::to_string(&document) {
+                Ok(json) => println!("{json}"),
+                Err(e) => warn!("Could not print the relay's addresses: {e}"),
+            }
+            printed = Some(document);
+        }
+        tokio::select! {
+            changed = listen_addrs.changed() => {
+                if changed.is_err() {
+                    return;
+                }
+            }
+            _ = recheck.tick() => {}
+        }
+    }
+}
+
+/// Print the primary address as a QR code once the relay is listening: the
+/// first external address, else the first listen address off loopback.
+pub async fn print_qr(relay: Relay) {
+    relay.listening().await;
+    let Some(status) = relay.status().await else {
+        return;
+    };
+    let external = status
+        .external_addrs
+        .iter()
+        .filter_map(|addr| addr.parse::<Multiaddr>().ok());
+    let listening = relay
+        .listen_addrs()
+        .into_iter()
+        .filter(|addr| !is_loopback(addr));
+    let Some(addr) = external.chain(listening).next() else {
+        warn!("No address to print a QR code for");
+        return;
+    };
+    let addr = addr.with(Protocol::P2p(relay.peer_id()));
+    match QrCode::new(addr.to_string()) {
+        Ok(code) => eprintln!(
+            "{}\n{addr}",
+            code.render::<Dense1x2>().quiet_zone(true).build()
+        ),
+        Err(e) => warn!("Could not encode {addr} as a QR code: {e}"),
+    }
+}
+
+fn is_loopback(addr: &Multiaddr) -> bool {
+    addr.iter().any(|protocol| match protocol {
+        Protocol::Ip4(ip) => ip.is_loopback(),
+        Protocol::Ip6(ip) => ip.is_loopback(),
+        _ => false,
+    })
+}
@@ -0,0 +1,384 @@
+//! The PROXY protocol, v1 and v2, for relays behind a TCP load balancer such
+//! as HAProxy or an AWS NLB. The header is read before the connection is
+//! reported to the swarm, so gating, limits and metrics see the client's
+//! address as if it had connected directly.
+
+use std::{
+    io,
+    net::{IpAddr, SocketAddr},
+    pin::Pin,
+    task::{Context, Poll},
+    time::Duration,
+};
+
+use futures::{
+    StreamExt,
+    future::{self, BoxFuture},
+    stream::FuturesUnordered,
+};
+use libp2p::{
+    Multiaddr,
+    core::{
+        multiaddr::Protocol,
+        transport::{DialOpts, ListenerId, Transport, TransportError, TransportEvent},
+    },
+    tcp,
+};
+use tokio::{io::AsyncReadExt, net::TcpStream, time};
+use tracing::debug;
+
+use crate::{ingress::Ingress, sockopts::SocketOptions};
+
+/// How long a load balancer gets to send the header after connecting.
+const HEADER_TIMEOUT: Duration = Duration::from_secs(5);
+const V2_SIGNATURE: &[u8; 12] = b"\r\n\r\n\0\r\nQUIT\n";
+/// The longest v1 header, CRLF included.
+const V1_MAX: usize = 107;
+
+type Inner = tcp::tokio::Transport;
+type Upgrade = <Inner as Transport>::ListenerUpgrade;
+type Event = TransportEvent<Upgrade, io::Error>;
+
+/// TCP that takes the client address from a PROXY header on inbound
+/// connections from the sources `ingress` names, tuning each accepted
+/// socket. Connections whose header is missing or malformed are dropped, as
+/// are those arriving while too many headers are already awaited. Dialing is
+/// left alone.
+pub struct ProxyProtocol {
+    inner: Inner,
+    ingress: Ingress,
+    pending: FuturesUnordered<BoxFuture<'static, Option<Event>>>,
+}
+
+impl ProxyProtocol {
+    pub fn new(inner: Inner, ingress: Ingress) -> Self {
+        Self {
+            inner,
+            ingress,
+            pending: FuturesUnordered::new(),
+        }
+    }
+}
+
+impl Transport for ProxyProtocol {
+    type Output = <Inner as Transport>::Output;
+    type Error = io::Error;
+    type ListenerUpgrade = Upgrade;
+    type Dial = <Inner as Transport>::Dial;
+
+    fn listen_on(
+        &mut self,
+        id: ListenerId,
+        addr: Multiaddr,
+    ) -> Result<(), TransportError<Self::Error>> {
+        self.inner.listen_on(id, addr)
+    }
+
+    fn remove_listener(&mut self, id: ListenerId) -> bool {
+        self.inner.remove_listener(id)
+    }
+
+    fn dial(
+        &mut self,
+        addr: Multiaddr,
+        opts: DialOpts,
+    ) -> Result<Self::Dial, TransportError<Self::Error>> {
+        self.inner.dial(addr, opts)
+    }
+
+    fn poll(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<Event> {
+        let this = &mut *self;
+        loop {
+            if let Poll::Ready(Some(accepted)) = this.pending.poll_next_unpin(cx) {
+                match accepted {
+                    Some(event) => return Poll::Ready(event),
+                    None => continue,
+                }
+            }
+            let event = match Pin::new(&mut this.inner).poll(cx) {
+                Poll::Ready(event) => event,
+                Poll::Pending => return Poll::Pending,
+            };
+            match event {
+                TransportEvent::Incoming {
+                    listener_id,
+                    upgrade,
+                    local_addr,
+                    send_back_addr,
+                } if this.ingress.expects_proxy_header(&send_back_addr) => {
+                    if this.pending.len() >= this.ingress.max_pending() {
+                        debug!(%send_back_addr, "Dropped connection: too many headers awaited");
+                        continue;
+                    }
+                    this.pending.push(Box::pin(accept(
+                        listener_id,
+                        upgrade,
+                        local_addr,
+                        send_back_addr,
+                        this.ingress.sockets(),
+                    )));
+                }
+                TransportEvent::Incoming {
+                    listener_id,
+                    upgrade,
+                    local_addr,
+                    send_back_addr,
+                } => {
+                    let stream = upgrade.into_inner();
+                    if let Ok(stream) = &stream {
+                        this.ingress.sockets().apply(&stream.0);
+                    }
+                    return Poll::Ready(TransportEvent::Incoming {
+                        listener_id,
+                        upgrade: future::ready(stream),
+                        local_addr,
+                        send_back_addr,
+                    });
+                }
+                event => return Poll::Ready(event),
+            }
+        }
+    }
+}
+
+/// Report the connection once its header has been read, or drop it if the
+/// header is missing or malformed.
+async fn accept(
+    listener_id: ListenerId,
+    upgrade: Upgrade,
+    local_addr: Multiaddr,
+    send_back_addr: Multiaddr,
+    sockets: SocketOptions,
+) -> Option<Event> {
+    let mut stream = upgrade.await.ok()?;
+    sockets.apply(&stream.0);
+    let source = time::timeout(HEADER_TIMEOUT, read_header(&mut stream.0))
+        .await
+        .unwrap_or_else(|_| Err(invalid("no PROXY header in time")))
+        .inspect_err(|e| debug!(%send_back_addr, "Dropped connection: {e}"))
+        .ok()?;
+    let send_back_addr = match source {
+        Some(source) => Multiaddr::from(source.ip()).with(Protocol::Tcp(source.port())),
+        None => send_back_addr,
+    };
+    Some(TransportEvent::Incoming {
+        listener_id,
+        upgrade: future::ready(Ok(stream)),
+        local_addr,
+        send_back_addr,
+    })
+}
+
+/// Consume the header, returning the client address unless the balancer
+/// connected on its own behalf, as for a health check.
+async fn read_header(stream: &mut TcpStream) -> io::Result<Option<SocketAddr>> {
+    let mut start = [0; 6];
+    stream.read_exact(&mut start).await?;
+    if &start == b"PROXY " {
+        return read_v1(stream).await;
+    }
+    let mut rest = [0; 6];
+    stream.read_exact(&mut rest).await?;
+    if [start, rest].concat() != V2_SIGNATURE {
+        return Err(invalid("missing PROXY header"));
+    }
+    read_v2(stream).await
+}
+
+/// Read the rest of a v1 line a byte at a time, so nothing after it is
+/// taken from the stream.
+async fn read_v1(stream: &mut TcpStream) -> io::Result<Option<SocketAddr>> {
+    let mut line = b"PROXY ".to_vec();
+    while !line.ends_with(b"\r\n") {
+        if line.len() == V1_MAX {
+            return Err(invalid("PROXY v1 header is too long"));
+        }
+        line.push(stream.read_u8().await?);
+    }
+    parse_v1(&line)
+}
+
+fn parse_v1(line: &[u8]) -> io::Result<Option<SocketAddr>> {
+    let malformed = || invalid("malformed PROXY v1 header");
+    let line = std::str::from_utf8(line).map_err(|_| malformed())?;
+    let fields: Vec<&str> = line.trim_end().split(' ').collect();
+    match fields[..] {
+        ["PROXY", "UNKNOWN", ..] => Ok(None),
+        ["PROXY", "TCP4" | "TCP6", source, _, port, _] => {
+            let ip: IpAddr = source.parse().map_err(|_| malformed())?;
+            let port = port.parse().map_err(|_| malformed())?;
+            Ok(Some(SocketAddr::new(ip, port)))
+        }
+        _ => Err(malformed()),
+    }
+}
+
+async fn read_v2(stream: &mut TcpStream) -> io::Result<Option<SocketAddr>> {
+    let mut head = [0; 4];
+    stream.read_exact(&mut head).await?;
+    let [version, family, len @ ..] = head;
+    if version >> 4 != 2 {
+        return Err(invalid("unsupported PROXY protocol version"));
+    }
+    let mut body = vec![0; usize::from(u16::from_be_bytes(len))];
+    stream.read_exact(&mut body).await?;
+    let local = version & 0x0f == 0;
+    if local {
+        return Ok(None);
+    }
+    parse_v2(family >> 4, &body)
+}
+
+/// The source address of an AF_INET or AF_INET6 block. Other families, such
+/// as Unix sockets, carry no client IP.
+fn parse_v2(family: u8, body: &[u8]) -> io::Result<Option<SocketAddr>> {
+    let (ip, port) = match family {
+        1 => (IpAddr::from(bytes::<4>(body, 0)?), bytes(body, 8)?),
+        2 => (IpAddr::from(bytes::<16>(body, 0)?), bytes(body, 32)?),
+        _ => return Ok(None),
+    };
+    Ok(Some(SocketAddr::new(ip, u16::from_be_bytes(port))))
+}
+
+fn bytes<const N: usize>(body: &[u8], at: usize) -> io::Result<[u8; N]> {
+    body.get(at..at + N)
+        .and_then(|b| b.try_into().ok())
+        .ok_or_else(|| invalid("truncated PROXY v2 addresses"))
+}
+
+fn invalid(reason: &'static str) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, reason)
+}
+
+#[cfg(test)]
+mod tests {
+    use tokio::{io::AsyncWriteExt, net::TcpListener};
+
+    use super::*;
+
+    fn addr(s: &str) -> Option<SocketAddr> {
+        Some(s.parse().unwrap())
+    }
+
+    /// The address block that follows a v2 header for a TCP connection.
+    fn v2_body(source: SocketAddr, dest: SocketAddr) -> Vec<u8> {
+        let ip = |addr: SocketAddr| match addr.ip() {
+            IpAddr::V4(ip) => ip.octets().to_vec(),
+            IpAddr::V6(ip) => ip.octets().to_vec(),
+        };
+        [
+            ip(source),
+            ip(dest),
+            source.port().to_be_bytes().to_vec(),
+            dest.port().to_be_bytes().to_vec(),
+        ]
+        .concat()
+    }
+
+    #[test]
+    fn v1_names_the_client() {
+        let header = b"PROXY TCP4 198.51.100.7 203.0.113.1 51234 443\r\n";
+        assert_eq!(parse_v1(header).unwrap(), addr("198.51.100.7:51234"));
+        let header = b"PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n";
+        assert_eq!(parse_v1(header).unwrap(), addr("[2001:db8::7]:51234"));
+        assert_eq!(parse_v1(b"PROXY UNKNOWN\r\n").unwrap(), None);
+    }
+
+    #[test]
+    fn v1_rejects_malformed_headers() {
+        for header in [
+            &b"PROXY TCP4 198.51.100.7 203.0.113.1 51234\r\n"[..],
+            b"PROXY TCP4 relay.example.com 203.0.113.1 51234 443\r\n",
+            b"PROXY TCP4 198.51.100.7 203.0.113.1 port 443\r\n",
+            b"PROXY UDP4 198.51.100.7 203.0.113.1 51234 443\r\n",
+            b"PROXY \xff\r\n",
+        ] {
+            let err = parse_v1(header).unwrap_err();
+            assert_eq!(err.kind(), io::ErrorKind::InvalidData);
+        }
+    }
+
+    #[test]
+    fn v2_names_the_client() {
+        let v4 = v2_body(
+            "198.51.100.7:51234".parse().unwrap(),
+            "203.0.113.1:443".parse().unwrap(),
+        );
+        assert_eq!(parse_v2(1, &v4).unwrap(), addr("198.51.100.7:51234"));
+        let v6 = v2_body(
+            "[2001:db8::7]:51234".parse().unwrap(),
+            "[2001:db8::1]:443".parse().unwrap(),
+        );
+        assert_eq!(parse_v2(2, &v6).unwrap(), addr("[2001:db8::7]:51234"));
+        assert_eq!(parse_v2(3, &[0; 216]).unwrap(), None);
+    }
+
+    #[test]
+    fn v2_rejects_truncated_bodies() {
+        let v4 = v2_body(
+            "198.51.100.7:51234".parse().unwrap(),
+            "203.0.113.1:443".parse().unwrap(),
+        );
+        for len in [0, 4, 9] {
+            let err = parse_v2(1, &v4[..len]).unwrap_err();
+            assert_eq!(err.to_string(), "truncated PROXY v2 addresses");
+        }
+        let err = parse_v2(2, &v4).unwrap_err();
+        assert_eq!(err.to_string(), "truncated PROXY v2 addresses");
+    }
+
+    /// A v2 PROXY header for TCP over IPv4, announcing a `len` byte body.
+    fn v2_header(len: u16) -> Vec<u8> {
+        [&V2_SIGNATURE[..], &[0x21, 0x11], &len.to_be_bytes()].concat()
+    }
+
+    /// Connect a client that sends `sent` and then closes its side.
+    async fn received(sent: Vec<u8>) -> TcpStream {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let mut client = TcpStream::connect(listener.local_addr().unwrap())
+            .await
+            .unwrap();
+        let (server, _) = listener.accept().await.unwrap();
+        client.write_all(&sent).await.unwrap();
+        client.shutdown().await.unwrap();
+        server
+    }
+
+    #[tokio::test]
+    async fn read_header_leaves_what_follows() {
+        let mut stream =
+            received(b"PROXY TCP4 198.51.100.7 203.0.113.1 51234 443\r\nhello".to_vec()).await;
+        assert_eq!(
+            read_header(&mut stream).await.unwrap(),
+            addr("198.51.100.7:51234")
+        );
+        let mut rest = String::new();
+        stream.read_to_string(&mut rest).await.unwrap();
+        assert_eq!(rest, "hello");
+
+        let body = v2_body(
+            "198.51.100.7:51234".parse().unwrap(),
+            "203.0.113.1:443".parse().unwrap(),
+        );
+        let sent = [v2_header(12), body, b"hello".to_vec()].concat();
+        let mut stream = received(sent).await;
+        assert_eq!(
+            read_header(&mut stream).await.unwrap(),
+            addr("198.51.100.7:51234")
+        );
+        let mut rest = String::new();
+        stream.read_to_string(&mut rest).await.unwrap();
+        assert_eq!(rest, "hello");
+    }
+
+    #[tokio::test]
+    async fn read_header_fails_on_a_short_stream() {
+        let sent = [v2_header(12), vec![0; 4]].concat();
+        let err = read_header(&mut received(sent).await).await.unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::UnexpectedEof);
+
+        let mut stream = received(b"GET / HTTP/1.1\r\n".to_vec()).await;
+        let err = read_header(&mut stream).await.unwrap_err();
+        assert_eq!(err.to_string(), "missing PROXY header");
+    }
+}
@@ -0,0 +1,36 @@
+//! Private networks: under --psk every connection first proves it holds the
+//! network's pre-shared key, as in Kubo, so peers from the public network
+//! are cut off before they can negotiate anything.
+
+use std::path::Path;
+
+use futures::{AsyncRead, AsyncWrite, future::Either};
+use libp2p::pnet::{PnetConfig, PnetError, PnetOutput, PreSharedKey};
+use tokio::fs;
+
+use crate::startup::StartupError;
+
+pub async fn load(path: &Path) -> Result<PreSharedKey, StartupError> {
+    let key = fs::read_to_string(path)
+        .await
+        .map_err(|e| StartupError::swarm_key(path, e))?;
+    key.parse().map_err(|e| StartupError::swarm_key(path, e))
+}
+
+/// Run the pnet handshake on a new connection, or pass it through on the
+/// public network.
+pub async fn handshake<S>(
+    socket: S,
+    key: Option<PreSharedKey>,
+) -> Result<Either<PnetOutput<S>, S>, PnetError>
+where
+    S: AsyncRead + AsyncWrite + Send + Unpin + 'static,
+{
+    let Some(key) = key else {
+        return Ok(Either::Right(socket));
+    };
+    PnetConfig::new(key)
+        .handshake(socket)
+        .await
+        .map(Either::Left)
+}
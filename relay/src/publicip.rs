@@ -0,0 +1,98 @@
+//! The relay's public IPs as peers observe them. On hosts whose IP changes,
+//! such as residential lines or cloud instances without a static address,
+//! an IP is only believed once peers connecting from several networks
+//! report it, so one host cannot redirect the relay's announcements however
+//! many peer IDs it makes up.
+
+use std::{
+    collections::{HashMap, HashSet},
+    net::IpAddr,
+};
+
+use libp2p::{Multiaddr, swarm::ConnectionId};
+
+use crate::{announce, gate, geo};
+
+/// Distinct source networks that must observe a public IP before it becomes
+/// the current one.
+const CONFIRMATIONS: usize = 3;
+/// How much of a peer's address makes up the network it votes for.
+const VOTER_IPV4_PREFIX: u8 = 24;
+const VOTER_IPV6_PREFIX: u8 = 48;
+
+/// A public IP that was seen for the first time or replaced another.
+pub struct IpChange {
+    pub old: Option<IpAddr>,
+    pub new: IpAddr,
+}
+
+#[derive(Default)]
+pub struct PublicIps {
+    v4: Family,
+    v6: Family,
+    /// The network each open connection comes from
+    voters: HashMap<ConnectionId, IpAddr>,
+}
+
+#[derive(Default)]
+struct Family {
+    current: Option<IpAddr>,
+    votes: HashMap<IpAddr, HashSet<IpAddr>>,
+}
+
+impl PublicIps {
+    pub fn connected(&mut self, connection: ConnectionId, remote_addr: &Multiaddr) {
+        if let Some(ip) = geo::ip_of(remote_addr) {
+            let network = gate::subnet(ip, VOTER_IPV4_PREFIX, VOTER_IPV6_PREFIX);
+            self.voters.insert(connection, network);
+        }
+    }
+
+    pub fn disconnected(&mut self, connection: ConnectionId) {
+        self.voters.remove(&connection);
+    }
+
+    /// Record that the peer on `connection` reached the relay at `addr`,
+    /// returning the change if this makes a different public IP the current
+    /// one.
+    pub fn observed(&mut self, connection: ConnectionId, addr: &Multiaddr) -> Option<IpChange> {
+        let voter = *self.voters.get(&connection)?;
+        let ip = geo::ip_of(addr).filter(|ip| announce::is_public(*ip))?;
+        let family = if ip.is_ipv4() {
+            &mut self.v4
+        } else {
+            &mut self.v6
+        };
+        family.observed(voter, ip)
+    }
+
+    /// Whether `addr` is fit to announce: not on a public IP other than the
+    /// current one.
+    pub fn confirmed(&self, addr: &Multiaddr) -> bool {
+        let Some(ip) = geo::ip_of(addr).filter(|ip| announce::is_public(*ip)) else {
+            return true;
+        };
+        let family = if ip.is_ipv4() { &self.v4 } else { &self.v6 };
+        family.current == Some(ip)
+    }
+}
+
+impl Family {
+    fn observed(&mut self, voter: IpAddr, ip: IpAddr) -> Option<IpChange> {
+        self.votes.retain(|_, voters| {
+            voters.remove(&voter);
+            !voters.is_empty()
+        });
+        if self.current == Some(ip) {
+            return None;
+        }
+        let voters = self.votes.entry(ip).or_default();
+        voters.insert(voter);
+        if voters.len() < CONFIRMATIONS {
+            return None;
+        }
+        self.votes.clear();
+        let old = self.current.replace(ip);
+        Some(IpChange { old, new: ip })
+    }
+}
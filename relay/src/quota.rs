@@ -0,0 +1,579 @@
+//! Relaying offered per API key. With --api-keys, a client sends one of the
+//! file's keys over /sunset/auth/1.0.0 before reserving, and all peers that
+//! presented the same key share its quota: how many reservations they may
+//! hold at once, how many gigabytes they may exchange with the relay in a
+//! calendar month (UTC), and a bandwidth cap. A key whose month is used up
+//! has its peers disconnected and refused until the next month. Usage is
+//! counted and capped on every transport, as with --max-bandwidth, and
+//! checked against the quota every [`CHECK_INTERVAL`]. A key's `tier` places
+//! its peers in that reservation tier.
+
+use std::{
+    collections::{HashMap, HashSet},
+    io,
+    path::{Path, PathBuf},
+    sync::{Arc, Mutex},
+    time::{Duration, Instant, SystemTime},
+};
+
+use libp2p::{Multiaddr, PeerId, relay};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use tokio::fs;
+use tracing::{debug, info, warn};
+
+use crate::{
+    auth::AuthResponse,
+    startup::StartupError,
+    throttle::{Bandwidth, Throttle},
+    tiers::Tier,
+    traffic::PeerTraffic,
+};
+
+const BYTES_PER_GB: u64 = 1_000_000_000;
+
+/// How often usage is charged to keys, so peers of a key that runs out are
+/// cut off within seconds rather than at the next reconcile.
+pub const CHECK_INTERVAL: Duration = Duration::from_secs(5);
+
+/// What the per-key bandwidth cap is set on peers as.
+const KIND: &str = "api-key";
+
+#[derive(Deserialize)]
+struct KeyFile {
+    #[serde(default)]
+    keys: Vec<Entry>,
+}
+
+/// One `[[keys]]` table of the --api-keys file.
+#[derive(Deserialize)]
+struct Entry {
+    name: String,
+    key: String,
+    tier: Option<Tier>,
+    #[serde(flatten)]
+    quota: Quota,
+}
+
+/// What the peers of one key may use between them. Anything unset is
+/// unlimited.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize)]
+pub struct Quota {
+    pub reservations: Option<usize>,
+    pub gb_per_month: Option<u64>,
+    pub max_bandwidth: Option<Bandwidth>,
+}
+
+/// A key's usage, as kept in --api-key-usage.
+#[derive(Clone, Default, Serialize, Deserialize)]
+struct Usage {
+    /// The month counted, as `YYYY-MM`
+    month: String,
+    bytes: u64,
+}
+
+struct Account {
+    quota: Quota,
+    tier: Tier,
+    throttle: Throttle,
+    usage: Usage,
+    /// Connected peers that presented the key
+    peers: HashSet<PeerId>,
+    reservations: usize,
+}
+
+impl Account {
+    fn new(quota: Quota, usage: Usage) -> Self {
+        Self {
+            quota,
+            tier: Tier::Default,
+            throttle: Throttle::new(quota.max_bandwidth),
+            usage,
+            peers: HashSet::new(),
+            reservations: 0,
+        }
+    }
+
+    /// Start counting afresh once the month turns.
+    fn roll(&mut self, month: &str) {
+        if self.usage.month != month {
+            self.usage = Usage {
+                month: month.to_string(),
+                bytes: 0,
+            };
+        }
+    }
+
+    fn exhausted(&self, month: &str) -> bool {
+        let Some(gb) = self.quota.gb_per_month else {
+            return false;
+        };
+        self.usage.month == month && self.usage.bytes >= gb.saturating_mul(BYTES_PER_GB)
+    }
+}
+
+/// A key's quota and what its peers are using, for the admin API.
+pub struct KeyUsage {
+    pub name: String,
+    pub quota: Quota,
+    pub month: String,
+    pub bytes: u64,
+    pub reservations: usize,
+    pub peers: usize,
+}
+
+#[derive(Default)]
+struct Shared {
+    path: PathBuf,
+    usage_path: Option<PathBuf>,
+    /// By key name, which usage is kept under so keys can be replaced
+    accounts: HashMap<String, Account>,
+    /// Key digests to names. Looking keys up by digest keeps the lookup's
+    /// timing independent of the keys themselves.
+    names: HashMap<[u8; 32], String>,
+    bound: HashMap<PeerId, String>,
+    held: HashSet<PeerId>,
+    /// Traffic totals last credited, to credit only what is new
+    credited: HashMap<PeerId, u64>,
+    changed: bool,
+}
+
+/// Plugged into the relay as a reservation rate limiter. Clones share the
+/// accounts, which the event loop keeps up to date.
+#[derive(Clone)]
+pub struct Quotas {
+    traffic: PeerTraffic,
+    shared: Arc<Mutex<Shared>>,
+}
+
+impl Quotas {
+    /// Load the keys in `path` and the usage kept in `usage_path`, which
+    /// starts afresh if it does not exist yet.
+    pub async fn open(
+        path: &Path,
+        usage_path: Option<&Path>,
+        traffic: PeerTraffic,
+    ) -> Result<Self, StartupError> {
+        let usage = match usage_path {
+            Some(usage_path) => read_usage(usage_path)
+                .await
+                .map_err(|e| StartupError::open("API key usage file", usage_path, e))?,
+            None => HashMap::new(),
+        };
+        let accounts = usage
+            .into_iter()
+            .map(|(name, usage)| (name, Account::new(Quota::default(), usage)))
+            .collect();
+        let quotas = Self {
+            traffic,
+            shared: Arc::new(Mutex::new(Shared {
+                path: path.to_path_buf(),
+                usage_path: usage_path.map(Path::to_path_buf),
+                accounts,
+                ..Default::default()
+            })),
+        };
+        quotas.load().await?;
+        Ok(quotas)
+    }
+
+    /// Re-read the keys file. Usage carries over by key name, also for keys
+    /// removed and added back, and peers of keys no longer listed lose their
+    /// access. On error the current keys are kept.
+    pub async fn load(&self) -> Result<(), StartupError> {
+        let path = self.shared.lock().unwrap().path.clone();
+        let entries = read_keys(&path).await?;
+        let mut shared = self.shared.lock().unwrap();
+        let mut accounts = HashMap::new();
+        let mut names = HashMap::new();
+        for entry in entries {
+            let mut account = shared
+                .accounts
+                .remove(&entry.name)
+                .unwrap_or_else(|| Account::new(entry.quota, Usage::default()));
+            if account.quota != entry.quota {
+                account.throttle.set_limit(entry.quota.max_bandwidth);
+                account.quota = entry.quota;
+            }
+            account.tier = entry.tier.unwrap_or(Tier::Default);
+            names.insert(digest(&entry.key), entry.name.clone());
+            accounts.insert(entry.name, account);
+        }
+        info!("Loaded {} API keys", accounts.len());
+        let revoked: Vec<PeerId> = shared
+            .bound
+            .iter()
+            .filter(|(_, name)| !accounts.contains_key(*name))
+            .map(|(peer, _)| *peer)
+            .collect();
+        for peer in revoked {
+            shared.bound.remove(&peer);
+            self.traffic.throttle_peer(peer, KIND, None);
+        }
+        for (name, account) in shared.accounts.drain() {
+            if account.usage.bytes > 0 {
+                accounts.insert(name, Account::new(Quota::default(), account.usage));
+            }
+        }
+        shared.accounts = accounts;
+        shared.names = names;
+        Ok(())
+    }
+
+    /// Read the keys from `path` on the next [`Quotas::load`], and keep usage
+    /// in `usage_path` from now on, starting with what is counted so far.
+    pub fn set_paths(&self, path: &Path, usage_path: Option<&Path>) {
+        let mut shared = self.shared.lock().unwrap();
+        shared.path = path.to_path_buf();
+        if shared.usage_path.as_deref() != usage_path {
+            shared.usage_path = usage_path.map(Path::to_path_buf);
+            shared.changed = true;
+        }
+    }
+
+    /// Bind `peer` to the account of `key`, if it is one of ours and its
+    /// month is not used up.
+    pub fn authorize(&self, peer: PeerId, key: &str) -> AuthResponse {
+        let mut shared = self.shared.lock().unwrap();
+        let Some(name) = shared.names.get(&digest(key)).cloned() else {
+            debug!(%peer, "API key refused: not a known key");
+            return AuthResponse::refused("unknown API key");
+        };
+        let month = this_month();
+        let Some(account) = shared.accounts.get_mut(&name) else {
+            return AuthResponse::refused("unknown API key");
+        };
+        account.roll(&month);
+        if account.exhausted(&month) {
+            debug!(%peer, key = %name, "API key refused: monthly quota used up");
+            return AuthResponse::refused("the key's monthly quota is used up");
+        }
+        account.peers.insert(peer);
+        let throttle = account.throttle.clone();
+        if let Some(previous) = shared.bound.insert(peer, name.clone())
+            && previous != name
+            && let Some(account) = shared.accounts.get_mut(&previous)
+        {
+            account.peers.remove(&peer);
+        }
+        debug!(%peer, key = %name, "API key accepted");
+        self.traffic.throttle_peer(peer, KIND, Some(throttle));
+        AuthResponse::accepted(None)
+    }
+
+    /// The name of the key `peer` presented, if it presented one.
+    pub fn key_name(&self, peer: &PeerId) -> Option<String> {
+        self.shared.lock().unwrap().bound.get(peer).cloned()
+    }
+
+    /// The tier of the key `peer` presented, if it presented one.
+    pub fn tier(&self, peer: &PeerId) -> Option<Tier> {
+        let shared = self.shared.lock().unwrap();
+        let name = shared.bound.get(peer)?;
+        shared.accounts.get(name).map(|account| account.tier)
+    }
+
+    /// Release `peer` from its key once its last connection has closed.
+    pub fn disconnected(&self, peer: &PeerId) {
+        let mut shared = self.shared.lock().unwrap();
+        let Some(name) = shared.bound.remove(peer) else {
+            return;
+        };
+        if let Some(account) = shared.accounts.get_mut(&name) {
+            account.peers.remove(peer);
+        }
+        self.traffic.throttle_peer(*peer, KIND, None);
+    }
+
+    /// Count the reservations each key's peers hold, and who holds any,
+    /// whose renewals are always let through.
+    pub fn set_reservations<'a>(&self, holders: impl IntoIterator<Item = (&'a PeerId, usize)>) {
+        let mut shared = self.shared.lock().unwrap();
+        let shared = &mut *shared;
+        shared.held.clear();
+        for account in shared.accounts.values_mut() {
+            account.reservations = 0;
+        }
+        for (peer, count) in holders {
+            shared.held.insert(*peer);
+            let account = shared
+                .bound
+                .get(peer)
+                .and_then(|name| shared.accounts.get_mut(name));
+            if let Some(account) = account {
+                account.reservations += count;
+            }
+        }
+    }
+
+    /// Charge the bytes each bound peer exchanged since the last call to its
+    /// key, returning the peers of keys whose month is used up, for the
+    /// event loop to disconnect. A total below the last one means the peer
+    /// was pruned and came back with fresh counters.
+    pub fn credit(&self) -> Vec<PeerId> {
+        let snapshot = self.traffic.snapshot();
+        let month = this_month();
+        let mut shared = self.shared.lock().unwrap();
+        let shared = &mut *shared;
+        let mut credited = HashMap::new();
+        for (peer, traffic) in snapshot {
+            let total = traffic.bytes_in + traffic.bytes_out;
+            let last = shared
+                .credited
+                .get(&peer)
+                .copied()
+                .filter(|last| *last <= total);
+            credited.insert(peer, total);
+            let new = total - last.unwrap_or(0);
+            let account = shared
+                .bound
+                .get(&peer)
+                .and_then(|name| shared.accounts.get_mut(name));
+            let Some(account) = account else {
+                continue;
+            };
+            account.roll(&month);
+            if new > 0 {
+                account.usage.bytes += new;
+                shared.changed = true;
+            }
+        }
+        shared.credited = credited;
+        let mut exhausted = Vec::new();
+        for (name, account) in &shared.accounts {
+            if account.peers.is_empty() || !account.exhausted(&month) {
+                continue;
+            }
+            warn!(key = %name, "API key has used up its monthly quota, disconnecting its peers");
+            exhausted.extend(account.peers.iter().copied());
+        }
+        exhausted
+    }
+
+    /// Every key's quota and usage, by name.
+    pub fn usage(&self) -> Vec<KeyUsage> {
+        let month = this_month();
+        let shared = self.shared.lock().unwrap();
+        let mut usage: Vec<KeyUsage> = shared
+            .names
+            .values()
+            .filter_map(|name| {
+                let account = shared.accounts.get(name)?;
+                let current = account.usage.month == month;
+                Some(KeyUsage {
+                    name: name.clone(),
+                    quota: account.quota,
+                    month: month.clone(),
+                    bytes: if current { account.usage.bytes } else { 0 },
+                    reservations: account.reservations,
+                    peers: account.peers.len(),
+                })
+            })
+            .collect();
+        usage.sort_by(|a, b| a.name.cmp(&b.name));
+        usage
+    }
+
+    /// Write the usage out in the background, if it changed.
+    pub fn save(&self) {
+        let Some((path, json)) = self.serialize() else {
+            return;
+        };
+        tokio::spawn(async move { store(&path, &json).await });
+    }
+
+    /// Write the usage out before the relay stops.
+    pub async fn close(&self) {
+        if let Some((path, json)) = self.serialize() {
+            store(&path, &json).await;
+        }
+    }
+
+    /// The usage file's new contents, if usage changed since the last write.
+    fn serialize(&self) -> Option<(PathBuf, Vec<u8>)> {
+        let mut shared = self.shared.lock().unwrap();
+        let path = shared.usage_path.clone()?;
+        if !shared.changed {
+            return None;
+        }
+        shared.changed = false;
+        let file: HashMap<&String, &Usage> = shared
+            .accounts
+            .iter()
+            .map(|(name, account)| (name, &account.usage))
+            .collect();
+        let json = serde_json::to_vec(&file).expect("usage serializes");
+        Some((path, json))
+    }
+}
+
+impl relay::RateLimiter for Quotas {
+    fn try_next(&mut self, peer: PeerId, _addr: &Multiaddr, _now: Instant) -> bool {
+        let shared = self.shared.lock().unwrap();
+        let Some(name) = shared.bound.get(&peer) else {
+            debug!(%peer, "Reservation refused: no API key presented");
+            return false;
+        };
+        if shared.held.contains(&peer) {
+            return true;
+        }
+        let Some(account) = shared.accounts.get(name) else {
+            return false;
+        };
+        if account.exhausted(&this_month()) {
+            debug!(%peer, key = %name, "Reservation refused: the key's monthly quota is used up");
+            return false;
+        }
+        if account
+            .quota
+            .reservations
+            .is_some_and(|max| account.reservations >= max)
+        {
+            debug!(%peer, key = %name, "Reservation refused: the key holds all the reservations it may");
+            return false;
+        }
+        true
+    }
+}
+
+async fn read_keys(path: &Path) -> Result<Vec<Entry>, StartupError> {
+    let text = fs::read_to_string(path)
+        .await
+        .map_err(|e| StartupError::api_keys(path, e))?;
+    let file: KeyFile = toml::from_str(&text).map_err(|e| StartupError::api_keys(path, e))?;
+    let mut names = HashSet::new();
+    let mut keys = HashSet::new();
+    for entry in &file.keys {
+        if entry.key.is_empty() {
+            return Err(StartupError::api_keys(
+                path,
+                format!("key {:?} is empty", entry.name),
+            ));
+        }
+        if !names.insert(&entry.name) {
+            return Err(StartupError::api_keys(
+                path,
+                format!("name {:?} is used twice", entry.name),
+            ));
+        }
+        if !keys.insert(&entry.key) {
+            return Err(StartupError::api_keys(
+                path,
+                format!("key {:?} repeats another", entry.name),
+            ));
+        }
+    }
+    Ok(file.keys)
+}
+
+async fn read_usage(path: &Path) -> io::Result<HashMap<String, Usage>> {
+    match fs::read(path).await {
+        Ok(bytes) => Ok(serde_json::from_slice(&bytes)?),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(HashMap::new()),
+        Err(e) => Err(e),
+    }
+}
+
+async fn store(path: &Path, json: &[u8]) {
+    if let Err(e) = write(path, json).await {
+        warn!("Failed to save API key usage to {}: {e}", path.display());
+    }
+}
+
+/// Replace `path` in one step, so a crash never leaves half a file.
+async fn write(path: &Path, contents: &[u8]) -> io::Result<()> {
+    let partial = path.with_extension("tmp");
+    fs::write(&partial, contents).await?;
+    fs::rename(&partial, path).await
+}
+
+fn digest(key: &str) -> [u8; 32] {
+    Sha256::digest(key.as_bytes()).into()
+}
+
+/// The current month in UTC, as `YYYY-MM`.
+fn this_month() -> String {
+    let now = humantime::format_rfc3339_seconds(SystemTime::now()).to_string();
+    now[..7].to_string()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const KEYS: &str = r#"
+[[keys]]
+name = "alice"
+key = "alice-secret-key"
+gb_per_month = 1
+"#;
+
+    async fn quotas(dir: &Path) -> (Quotas, PeerTraffic) {
+        let path = dir.join("keys.toml");
+        fs::write(&path, KEYS).await.unwrap();
+        let traffic = PeerTraffic::new(false);
+        let quotas = Quotas::open(&path, None, traffic.clone()).await.unwrap();
+        (quotas, traffic)
+    }
+
+    /// A peer bound to alice's key, whose usage so far is `usage`.
+    fn bound(quotas: &Quotas, usage: Usage) -> PeerId {
+        let peer = PeerId::random();
+        assert!(quotas.authorize(peer, "alice-secret-key").accepted);
+        let mut shared = quotas.shared.lock().unwrap();
+        shared.accounts.get_mut("alice").unwrap().usage = usage;
+        peer
+    }
+
+    fn usage(quotas: &Quotas) -> (String, u64) {
+        let shared = quotas.shared.lock().unwrap();
+        let usage = &shared.accounts["alice"].usage;
+        (usage.month.clone(), usage.bytes)
+    }
+
+    #[tokio::test]
+    async fn credit_starts_a_new_month_afresh() {
+        let dir = tempfile::tempdir().unwrap();
+        let (quotas, traffic) = quotas(dir.path()).await;
+        let last_month = Usage {
+            month: "2000-01".to_string(),
+            bytes: 5 * BYTES_PER_GB,
+        };
+        let peer = bound(&quotas, last_month);
+        traffic.add(peer, 10, 20);
+        assert_eq!(quotas.credit(), Vec::new());
+        assert_eq!(usage(&quotas), (this_month(), 30));
+    }
+
+    #[tokio::test]
+    async fn credit_reports_peers_of_a_used_up_key() {
+        let dir = tempfile::tempdir().unwrap();
+        let (quotas, traffic) = quotas(dir.path()).await;
+        let almost = Usage {
+            month: this_month(),
+            bytes: BYTES_PER_GB - 10,
+        };
+        let peer = bound(&quotas, almost);
+        traffic.add(peer, 5, 0);
+        assert_eq!(quotas.credit(), Vec::new());
+        traffic.add(peer, 0, 5);
+        assert_eq!(quotas.credit(), vec![peer]);
+        let refused = quotas.authorize(PeerId::random(), "alice-secret-key");
+        assert!(!refused.accepted);
+    }
+
+    #[tokio::test]
+    async fn credit_counts_reset_counters_from_zero() {
+        let dir = tempfile::tempdir().unwrap();
+        let (quotas, traffic) = quotas(dir.path()).await;
+        let peer = bound(&quotas, Usage::default());
+        traffic.add(peer, 100, 0);
+        assert_eq!(quotas.credit(), Vec::new());
+        assert_eq!(usage(&quotas).1, 100);
+
+        traffic.prune();
+        traffic.add(peer, 30, 0);
+        quotas.credit();
+        assert_eq!(usage(&quotas).1, 130);
+    }
+}
@@ -0,0 +1,108 @@
+//! Checking that the relay can still be dialed from outside by having
+//! AutoNAT servers dial it back periodically, so a relay that silently lost
+//! its public addresses is noticed instead of serving nobody.
+
+use std::time::Duration;
+
+use libp2p::{
+    Multiaddr, PeerId,
+    autonat::v1::{self as autonat, NatStatus, OutboundProbeError, OutboundProbeEvent},
+    core::multiaddr::Protocol,
+};
+use tracing::{info, warn};
+
+use crate::config::Config;
+
+/// Longest wait before asking again while the verdict is not yet confident.
+const RETRY: Duration = Duration::from_secs(90);
+
+/// An AutoNAT v1 client asking --reachability-servers and connected peers
+/// for a dial-back every --reachability-interval. Like every v1 client it
+/// also answers other peers' probes, within the library's throttling.
+pub fn behaviour(local_peer_id: PeerId, config: &Config) -> autonat::Behaviour {
+    let mut behaviour = autonat::Behaviour::new(
+        local_peer_id,
+        autonat::Config {
+            refresh_interval: config.reachability_interval,
+            retry_interval: config.reachability_interval.min(RETRY),
+            ..Default::default()
+        },
+    );
+    set_servers(&mut behaviour, &[], &config.reachability_servers);
+    behaviour
+}
+
+/// Ask `servers` for dial-backs from now on instead of `previous`.
+pub fn set_servers(
+    behaviour: &mut autonat::Behaviour,
+    previous: &[Multiaddr],
+    servers: &[Multiaddr],
+) {
+    for addr in previous.iter().filter(|addr| !servers.contains(addr)) {
+        if let Some(Protocol::P2p(peer)) = addr.iter().last() {
+            behaviour.remove_server(&peer);
+        }
+    }
+    for addr in servers {
+        if let Some(Protocol::P2p(peer)) = addr.iter().last() {
+            behaviour.add_server(peer, Some(addr.clone()));
+        }
+    }
+}
+
+/// How a probe of ours went, for metrics: `None` while it is in flight.
+pub fn probe_result(event: &OutboundProbeEvent) -> Option<&'static str> {
+    match event {
+        OutboundProbeEvent::Request { .. } => None,
+        OutboundProbeEvent::Response { .. } => Some("reachable"),
+        OutboundProbeEvent::Error {
+            error: OutboundProbeError::Response(_),
+            ..
+        } => Some("unreachable"),
+        OutboundProbeEvent::Error { .. } => Some("failed"),
+    }
+}
+
+/// Whether the relay has been found unreachable, and whether that has
+/// lasted long enough to have been reported. Only a verdict of private
+/// counts: without servers to ask, reachability is unknown, not failed.
+#[derive(Default)]
+pub struct Monitor {
+    unreachable: bool,
+    reported: bool,
+}
+
+impl Monitor {
+    /// Follow a new verdict. Returns true when the relay has just been
+    /// found unreachable, so the caller starts --unreachable-after.
+    pub fn status_changed(&mut self, status: &NatStatus) -> bool {
+        match status {
+            NatStatus::Private if self.unreachable => false,
+            NatStatus::Private => {
+                warn!("AutoNAT servers could not dial the relay back");
+                self.unreachable = true;
+                true
+            }
+            NatStatus::Public(addr) => {
+                if self.unreachable {
+                    info!(%addr, "AutoNAT servers can dial the relay again");
+                }
+                *self = Self::default();
+                false
+            }
+            NatStatus::Unknown => {
+                *self = Self::default();
+                false
+            }
+        }
+    }
+
+    /// Whether the relay is unreachable and that has not been reported yet.
+    pub fn pending(&self) -> bool {
+        self.unreachable && !self.reported
+    }
+
+    pub fn reported(&mut self) {
+        self.reported = true;
+    }
+}
@@ -0,0 +1,54 @@
+//! Reloading the configuration on SIGHUP.
+
+use std::path::PathBuf;
+
+use sunset_relay::config::{Config, ConfigError, Settings};
+
+/// Where the running configuration came from. Flags and environment
+/// variables are kept as given at startup, so a reload only picks up
+/// changes to the config file.
+pub struct Source {
+    file: Option<PathBuf>,
+    flags: Settings,
+}
+
+impl Source {
+    pub fn new(file: Option<PathBuf>, flags: Settings) -> Self {
+        Self { file, flags }
+    }
+
+    pub fn load(&self) -> Result<Config, ConfigError> {
+        Config::load(self.file.as_deref(), self.flags.clone())
+    }
+}
+
+/// Requests to reload, delivered as SIGHUP. Never fires on other platforms.
+pub struct Hangups {
+    #[cfg(unix)]
+    signal: tokio::signal::unix::Signal,
+}
+
+impl Hangups {
+    #[cfg(unix)]
+    pub fn new() -> Self {
+        use tokio::signal::unix::{SignalKind, signal};
+        Self {
+            signal: signal(SignalKind::hangup()).expect("failed to install SIGHUP handler"),
+        }
+    }
+
+    #[cfg(not(unix))]
+    pub fn new() -> Self {
+        Self {}
+    }
+
+    #[cfg(unix)]
+    pub async fn recv(&mut self) {
+        self.signal.recv().await;
+    }
+
+    #[cfg(not(unix))]
+    pub async fn recv(&mut self) {
+        std::future::pending::<()>().await
+    }
+}
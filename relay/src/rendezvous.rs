@@ -0,0 +1,50 @@
+//! A rendezvous point, so peers of small apps using the relay can register
+//! under a namespace and discover each other there without running a
+//! separate server.
+
+use libp2p::rendezvous::server::{self, Event};
+use tracing::debug;
+
+use crate::config::Config;
+
+pub type Behaviour = server::Behaviour;
+
+pub fn behaviour(config: &Config) -> Behaviour {
+    let ttl = config.rendezvous_max_ttl.as_secs();
+    server::Behaviour::new(server::Config::default().with_max_ttl(ttl))
+}
+
+pub fn log_event(event: &Event) {
+    match event {
+        Event::PeerRegistered { peer, registration } => debug!(
+            %peer,
+            namespace = %registration.namespace,
+            ttl = registration.ttl,
+            "Rendezvous registration"
+        ),
+        Event::PeerNotRegistered {
+            peer,
+            namespace,
+            error,
+        } => debug!(%peer, %namespace, ?error, "Rejected rendezvous registration"),
+        Event::PeerUnregistered { peer, namespace } => {
+            debug!(%peer, %namespace, "Rendezvous unregistration")
+        }
+        Event::RegistrationExpired(registration) => debug!(
+            peer = %registration.record.peer_id(),
+            namespace = %registration.namespace,
+            "Rendezvous registration expired"
+        ),
+        Event::DiscoverServed {
+            enquirer,
+            registrations,
+        } => debug!(
+            peer = %enquirer,
+            registrations = registrations.len(),
+            "Rendezvous discovery"
+        ),
+        Event::DiscoverNotServed { enquirer, error } => {
+            debug!(peer = %enquirer, ?error, "Rejected rendezvous discovery")
+        }
+    }
+}
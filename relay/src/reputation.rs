@@ -0,0 +1,296 @@
+//! A score per PeerID built from how a peer has used the relay, kept in
+//! --reputation-file across restarts. Once no more than
+//! --reputation-reserved reservation slots are free, only peers with a
+//! positive score may take them, so a relay near capacity keeps room for
+//! the peers that have used it well.
+
+use std::{
+    collections::{HashMap, HashSet},
+    io,
+    path::{Path, PathBuf},
+    sync::{Arc, Mutex},
+    time::{Duration, Instant, SystemTime, UNIX_EPOCH},
+};
+
+use libp2p::{Multiaddr, PeerId, relay};
+use serde::{Deserialize, Serialize};
+use tokio::fs;
+use tracing::{debug, info, warn};
+
+use crate::traffic::PeerTraffic;
+
+/// Bytes relayed that earn a point.
+const BYTES_PER_POINT: u64 = 10 * 1024 * 1024;
+const POINTS_PER_FAILURE: i64 = 3;
+const POINTS_PER_VIOLATION: i64 = 20;
+
+/// Peers not seen for this long are dropped from the file.
+const FORGET_AFTER: Duration = Duration::from_secs(30 * 24 * 60 * 60);
+
+/// A peer's history. PeerIDs are kept as strings in the file, as libp2p's
+/// are not serializable.
+#[derive(Clone, Default, Serialize, Deserialize)]
+struct Record {
+    /// Bytes exchanged over the peer's connections
+    bytes: u64,
+    /// Circuits relayed to their end without an error
+    circuits: u64,
+    /// Circuit requests denied or that could not reach their destination
+    failures: u64,
+    /// Bans earned under --abuse-bans
+    violations: u64,
+    /// Unix time the record last changed
+    updated: u64,
+}
+
+impl Record {
+    /// One point per circuit and per 10 MiB relayed, minus three per failed
+    /// circuit and twenty per ban.
+    fn score(&self) -> i64 {
+        let earned = self.circuits.saturating_add(self.bytes / BYTES_PER_POINT);
+        let lost = (self.failures as i64).saturating_mul(POINTS_PER_FAILURE)
+            + (self.violations as i64).saturating_mul(POINTS_PER_VIOLATION);
+        (earned as i64).saturating_sub(lost)
+    }
+}
+
+#[derive(Default)]
+struct Shared {
+    /// Where scores are kept. Without one nothing is scored and every
+    /// reservation is let through.
+    path: Option<PathBuf>,
+    peers: HashMap<PeerId, Record>,
+    /// Traffic totals last credited, to credit only what is new
+    credited: HashMap<PeerId, u64>,
+    held: HashSet<PeerId>,
+    active: usize,
+    changed: bool,
+    max_reservations: usize,
+    reserved: usize,
+}
+
+/// Plugged into the relay as a reservation rate limiter. Clones share the
+/// scores, which the event loop keeps up to date.
+#[derive(Clone)]
+pub struct Reputation {
+    shared: Arc<Mutex<Shared>>,
+}
+
+impl Reputation {
+    pub fn disabled() -> Self {
+        Self {
+            shared: Arc::default(),
+        }
+    }
+
+    /// Load the scores kept in `path`, starting afresh if it does not exist
+    /// yet.
+    pub async fn open(path: &Path, max_reservations: usize, reserved: usize) -> io::Result<Self> {
+        let peers = read(path).await?;
+        Ok(Self {
+            shared: Arc::new(Mutex::new(Shared {
+                path: Some(path.to_path_buf()),
+                peers,
+                max_reservations,
+                reserved,
+                ..Default::default()
+            })),
+        })
+    }
+
+    /// Keep scores in `path` from now on, or stop scoring without one. The
+    /// scores so far are written to the previous file and those in the new
+    /// one take over. On error the current file stays in use.
+    pub async fn set_path(&self, path: Option<&Path>) -> io::Result<()> {
+        if self.shared.lock().unwrap().path.as_deref() == path {
+            return Ok(());
+        }
+        let peers = match path {
+            Some(path) => read(path).await?,
+            None => HashMap::new(),
+        };
+        self.close().await;
+        let mut shared = self.shared.lock().unwrap();
+        shared.path = path.map(Path::to_path_buf);
+        shared.peers = peers;
+        Ok(())
+    }
+
+    fn update(&self, peer: PeerId, change: impl FnOnce(&mut Record)) {
+        let mut shared = self.shared.lock().unwrap();
+        if shared.path.is_none() {
+            return;
+        }
+        let record = shared.peers.entry(peer).or_default();
+        change(record);
+        record.updated = unix_now();
+        shared.changed = true;
+    }
+
+    pub fn relay_event(&self, event: &relay::Event) {
+        match event {
+            relay::Event::CircuitClosed {
+                src_peer_id,
+                dst_peer_id,
+                error: None,
+            } => {
+                self.update(*src_peer_id, |record| record.circuits += 1);
+                self.update(*dst_peer_id, |record| record.circuits += 1);
+            }
+            relay::Event::CircuitReqDenied { src_peer_id, .. }
+            | relay::Event::CircuitReqOutboundConnectFailed { src_peer_id, .. } => {
+                self.update(*src_peer_id, |record| record.failures += 1);
+            }
+            _ => {}
+        }
+    }
+
+    /// Count a ban against `peer`.
+    pub fn violated(&self, peer: PeerId) {
+        self.update(peer, |record| record.violations += 1);
+    }
+
+    /// Credit the bytes exchanged with each peer since the last call. A
+    /// total below the last one means the peer was pruned and came back
+    /// with fresh counters.
+    pub fn credit(&self, traffic: &PeerTraffic) {
+        let snapshot = traffic.snapshot();
+        let now = unix_now();
+        let mut shared = self.shared.lock().unwrap();
+        if shared.path.is_none() {
+            return;
+        }
+        let mut credited = HashMap::new();
+        for (peer, traffic) in snapshot {
+            let total = traffic.bytes_in + traffic.bytes_out;
+            let last = shared
+                .credited
+                .get(&peer)
+                .copied()
+                .filter(|last| *last <= total);
+            let new = total - last.unwrap_or(0);
+            credited.insert(peer, total);
+            if new == 0 {
+                continue;
+            }
+            let record = shared.peers.entry(peer).or_default();
+            record.bytes += new;
+            record.updated = now;
+            shared.changed = true;
+        }
+        shared.credited = credited;
+    }
+
+    /// Apply a changed --max-reservations or --reputation-reserved.
+    pub fn set_capacity(&self, max_reservations: usize, reserved: usize) {
+        let mut shared = self.shared.lock().unwrap();
+        shared.max_reservations = max_reservations;
+        shared.reserved = reserved;
+    }
+
+    /// Track who holds reservations, whose renewals are always let through.
+    pub fn set_reservations<'a>(&self, holders: impl IntoIterator<Item = (&'a PeerId, usize)>) {
+        let mut shared = self.shared.lock().unwrap();
+        shared.held.clear();
+        shared.active = 0;
+        for (peer, count) in holders {
+            shared.held.insert(*peer);
+            shared.active += count;
+        }
+    }
+
+    /// Write the scores out in the background, if they changed.
+    pub fn save(&self) {
+        let Some((path, json)) = self.serialize() else {
+            return;
+        };
+        tokio::spawn(async move { store(&path, &json).await });
+    }
+
+    /// Write the scores out before the relay stops.
+    pub async fn close(&self) {
+        if let Some((path, json)) = self.serialize() {
+            store(&path, &json).await;
+        }
+    }
+
+    /// The file's new contents, if the scores changed since the last write.
+    fn serialize(&self) -> Option<(PathBuf, Vec<u8>)> {
+        let mut shared = self.shared.lock().unwrap();
+        let path = shared.path.clone()?;
+        if !shared.changed {
+            return None;
+        }
+        shared.changed = false;
+        let oldest = unix_now().saturating_sub(FORGET_AFTER.as_secs());
+        shared.peers.retain(|_, record| record.updated >= oldest);
+        let file: HashMap<String, &Record> = shared
+            .peers
+            .iter()
+            .map(|(peer, record)| (peer.to_string(), record))
+            .collect();
+        let json = serde_json::to_vec(&file).expect("records serialize");
+        Some((path, json))
+    }
+}
+
+impl relay::RateLimiter for Reputation {
+    fn try_next(&mut self, peer: PeerId, _addr: &Multiaddr, _now: Instant) -> bool {
+        let shared = self.shared.lock().unwrap();
+        if shared.path.is_none() {
+            return true;
+        }
+        let free = shared.max_reservations.saturating_sub(shared.active);
+        if free > shared.reserved || shared.held.contains(&peer) {
+            return true;
+        }
+        let score = shared.peers.get(&peer).map_or(0, Record::score);
+        if score > 0 {
+            return true;
+        }
+        debug!(%peer, score, free, "Reservation refused: remaining slots are held for reputable peers");
+        false
+    }
+}
+
+/// The scores kept in `path`, none if it does not exist yet.
+async fn read(path: &Path) -> io::Result<HashMap<PeerId, Record>> {
+    let peers = match fs::read(path).await {
+        Ok(bytes) => parse(&bytes)?,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => HashMap::new(),
+        Err(e) => return Err(e),
+    };
+    info!("Loaded reputation scores for {} peers", peers.len());
+    Ok(peers)
+}
+
+fn parse(bytes: &[u8]) -> io::Result<HashMap<PeerId, Record>> {
+    let file: HashMap<String, Record> = serde_json::from_slice(bytes)?;
+    let peers = file
+        .into_iter()
+        .filter_map(|(peer, record)| Some((peer.parse().ok()?, record)))
+        .collect();
+    Ok(peers)
+}
+
+async fn store(path: &Path, json: &[u8]) {
+    if let Err(e) = write(path, json).await {
+        warn!(
+            "Failed to save reputation scores to {}: {e}",
+            path.display()
+        );
+    }
+}
+
+/// Replace `path` in one step, so a crash never leaves half a file.
+async fn write(path: &Path, contents: &[u8]) -> io::Result<()> {
+    let partial = path.with_extension("tmp");
+    fs::write(&partial, contents).await?;
+    fs::rename(&partial, path).await
+}
+
+fn unix_now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_or(0, |since| since.as_secs())
+}
@@ -0,0 +1,236 @@
+//! Dynamic DNS and dnsaddr records on an authoritative server that accepts RFC 2136
+//! updates, such as BIND, Knot or PowerDNS, optionally signed with an
+//! HMAC-SHA256 TSIG key as `nsupdate -y` does.
+
+use std::{
+    error::Error,
+    net::{IpAddr, SocketAddr},
+    time::{Duration, SystemTime},
+};
+
+use base64::{Engine, engine::general_purpose::STANDARD as BASE64};
+use hmac::{Hmac, Mac};
+use sha2::Sha256;
+use tokio::{
+    net::{UdpSocket, lookup_host},
+    time,
+};
+
+const TIMEOUT: Duration = Duration::from_secs(5);
+/// How far apart the clocks of the relay and the server may be.
+const FUDGE: u16 = 300;
+const OPCODE_UPDATE: u16 = 5 << 11;
+const TYPE_A: u16 = 1;
+const TYPE_SOA: u16 = 6;
+const TYPE_TXT: u16 = 16;
+const TYPE_AAAA: u16 = 28;
+const TYPE_TSIG: u16 = 250;
+const CLASS_IN: u16 = 1;
+const CLASS_ANY: u16 = 255;
+
+/// A TSIG key given as `NAME:BASE64SECRET`.
+pub struct TsigKey {
+    name: String,
+    secret: Vec<u8>,
+}
+
+impl TsigKey {
+    pub fn parse(key: &str) -> Option<Self> {
+        let (name, secret) = key.split_once(':')?;
+        if name.is_empty() {
+            return None;
+        }
+        Some(Self {
+            name: name.to_ascii_lowercase(),
+            secret: BASE64.decode(secret.trim()).ok()?,
+        })
+    }
+
+    /// Append the TSIG record that signs `message`, which has the ID `id`.
+    fn sign(&self, message: &mut Vec<u8>, id: u16) {
+        let now = SystemTime::UNIX_EPOCH
+            .elapsed()
+            .unwrap_or_default()
+            .as_secs();
+        let signed_at = &now.to_be_bytes()[2..];
+        let key_name = wire(&self.name);
+        let algorithm = wire("hmac-sha256");
+
+        let mut mac =
+            Hmac::<Sha256>::new_from_slice(&self.secret).expect("HMAC takes keys of any length");
+        mac.update(message);
+        mac.update(&key_name);
+        mac.update(&CLASS_ANY.to_be_bytes());
+        mac.update(&0u32.to_be_bytes());
+        mac.update(&algorithm);
+        mac.update(signed_at);
+        mac.update(&FUDGE.to_be_bytes());
+        // No error and no other data.
+        mac.update(&[0; 4]);
+        let mac = mac.finalize().into_bytes();
+
+        let mut rdata = algorithm;
+        rdata.extend_from_slice(signed_at);
+        rdata.extend_from_slice(&FUDGE.to_be_bytes());
+        rdata.extend_from_slice(&(mac.len() as u16).to_be_bytes());
+        rdata.extend_from_slice(&mac);
+        rdata.extend_from_slice(&id.to_be_bytes());
+        rdata.extend_from_slice(&[0; 4]);
+        record(message, &self.name, TYPE_TSIG, CLASS_ANY, 0, &rdata);
+        message[10..12].copy_from_slice(&1u16.to_be_bytes());
+    }
+}
+
+pub struct Rfc2136 {
+    server: String,
+    zone: String,
+    key: Option<TsigKey>,
+}
+
+impl Rfc2136 {
+    /// Updates for `zone` sent to `server`, a host with an optional port.
+    pub fn new(server: String, zone: String, key: Option<TsigKey>) -> Self {
+        Self { server, zone, key }
+    }
+
+    /// Replace the A or AAAA records of `name` with `ip`.
+    pub async fn replace(
+        &self,
+        name: &str,
+        ip: IpAddr,
+    ) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let (kind, rdata) = match ip {
+            IpAddr::V4(ip) => (TYPE_A, ip.octets().to_vec()),
+            IpAddr::V6(ip) => (TYPE_AAAA, ip.octets().to_vec()),
+        };
+        self.update(name, kind, 60, &[rdata]).await
+    }
+
+    /// Replace the TXT records of `name` with `values`.
+    pub async fn replace_txt(
+        &self,
+        name: &str,
+        values: &[String],
+    ) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let rdata: Vec<Vec<u8>> = values.iter().map(|v| txt(v)).collect();
+        self.update(name, TYPE_TXT, 300, &rdata).await
+    }
+
+    async fn update(
+        &self,
+        name: &str,
+        kind: u16,
+        ttl: u32,
+        rdata: &[Vec<u8>],
+    ) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let id = rand::random();
+        let message = self.message(id, name, kind, ttl, rdata);
+        let server = lookup_host(with_port(&self.server))
+            .await?
+            .next()
+            .ok_or_else(|| format!("{} has no address", self.server))?;
+        let local: SocketAddr = if server.is_ipv4() {
+            ([0; 4], 0).into()
+        } else {
+            ([0; 16], 0).into()
+        };
+        let socket = UdpSocket::bind(local).await?;
+        socket.connect(server).await?;
+        socket.send(&message).await?;
+        let mut response = [0; 512];
+        let len = time::timeout(TIMEOUT, socket.recv(&mut response))
+            .await
+            .map_err(|_| format!("{} did not answer the update", self.server))??;
+        if len < 4 || response[..2] != id.to_be_bytes() {
+            return Err(format!("{} sent an unexpected answer", self.server).into());
+        }
+        match response[3] & 0x0f {
+            0 => Ok(()),
+            rcode => {
+                Err(format!("{} refused the update: {}", self.server, rcode_name(rcode)).into())
+            }
+        }
+    }
+
+    /// An UPDATE that deletes the name's records of type `kind` and adds
+    /// one for each of `rdata`, in one transaction.
+    fn message(&self, id: u16, name: &str, kind: u16, ttl: u32, rdata: &[Vec<u8>]) -> Vec<u8> {
+        let mut message = Vec::new();
+        message.extend_from_slice(&id.to_be_bytes());
+        message.extend_from_slice(&OPCODE_UPDATE.to_be_bytes());
+        // One zone, no prerequisites, the updates, no additional records.
+        let updates = 1 + rdata.len() as u16;
+        for count in [1, 0, updates, 0] {
+            message.extend_from_slice(&count.to_be_bytes());
+        }
+        message.extend_from_slice(&wire(&self.zone));
+        message.extend_from_slice(&TYPE_SOA.to_be_bytes());
+        message.extend_from_slice(&CLASS_IN.to_be_bytes());
+        record(&mut message, name, kind, CLASS_ANY, 0, &[]);
+        for rdata in rdata {
+            record(&mut message, name, kind, CLASS_IN, ttl, rdata);
+        }
+        if let Some(key) = &self.key {
+            key.sign(&mut message, id);
+        }
+        message
+    }
+}
+
+fn record(message: &mut Vec<u8>, owner: &str, kind: u16, class: u16, ttl: u32, rdata: &[u8]) {
+    message.extend_from_slice(&wire(owner));
+    message.extend_from_slice(&kind.to_be_bytes());
+    message.extend_from_slice(&class.to_be_bytes());
+    message.extend_from_slice(&ttl.to_be_bytes());
+    message.extend_from_slice(&(rdata.len() as u16).to_be_bytes());
+    message.extend_from_slice(rdata);
+}
+
+/// A domain name in wire format, without compression.
+fn wire(name: &str) -> Vec<u8> {
+    let mut wire = Vec::new();
+    for label in name.trim_end_matches('.').split('.') {
+        wire.push(label.len() as u8);
+        wire.extend_from_slice(label.as_bytes());
+    }
+    wire.push(0);
+    wire
+}
+
+/// TXT data for `value`, split into character strings of at most 255
+/// bytes.
+fn txt(value: &str) -> Vec<u8> {
+    let mut rdata = Vec::new();
+    for chunk in value.as_bytes().chunks(255) {
+        rdata.push(chunk.len() as u8);
+        rdata.extend_from_slice(chunk);
+    }
+    rdata
+}
+
+fn with_port(server: &str) -> String {
+    if server.parse::<SocketAddr>().is_ok() {
+        return server.to_owned();
+    }
+    if let Ok(ip) = server.parse::<IpAddr>() {
+        return SocketAddr::new(ip, 53).to_string();
+    }
+    if server.contains(':') {
+        return server.to_owned();
+    }
+    format!("{server}:53")
+}
+
+fn rcode_name(rcode: u8) -> String {
+    let name = match rcode {
+        1 => "FORMERR",
+        2 => "SERVFAIL",
+        4 => "NOTIMP",
+        5 => "REFUSED",
+        8 => "NXRRSET",
+        9 => "NOTAUTH, check the TSIG key",
+        10 => "NOTZONE",
+        _ => return format!("RCODE {rcode}"),
+    };
+    name.to_owned()
+}
@@ -0,0 +1,31 @@
+//! Serving the previous identity next to the current one, so clients that
+//! still dial the old PeerID keep working until it is retired.
+
+use std::time::{Duration, SystemTime};
+
+use sunset_relay::{Relay, config::Config, startup::StartupError};
+use tokio::time;
+use tracing::info;
+
+/// Start the previous identity's relay unless its retirement time has
+/// already passed, and drain it once that time comes.
+pub async fn start(retiring: Option<(Config, SystemTime)>) -> Result<Option<Relay>, StartupError> {
+    let Some((config, until)) = retiring else {
+        return Ok(None);
+    };
+    let until_text = humantime::format_rfc3339_seconds(until);
+    let Ok(remaining) = until.duration_since(SystemTime::now()) else {
+        info!("Previous identity was due to retire at {until_text}; not serving it");
+        return Ok(None);
+    };
+    let relay = Relay::start(config).await?;
+    info!(peer = %relay.peer_id(), "Serving previous identity until {until_text}");
+    tokio::spawn(retire(relay.clone(), remaining));
+    Ok(Some(relay))
+}
+
+async fn retire(relay: Relay, after: Duration) {
+    time::sleep(after).await;
+    info!(peer = %relay.peer_id(), "Retiring previous identity");
+    relay.drain();
+}
@@ -0,0 +1,146 @@
+//! Dynamic DNS and dnsaddr records in an AWS Route 53 hosted zone, with credentials
+//! taken from the environment as the AWS CLI does. Requests are signed with
+//! Signature Version 4 directly rather than pulling in the AWS SDK.
+
+use std::{env, error::Error, time::SystemTime};
+
+use hmac::{Hmac, Mac};
+use reqwest::Client;
+use sha2::{Digest, Sha256, digest::Output};
+
+const HOST: &str = "route53.amazonaws.com";
+/// Route 53 is a global service signed for this region.
+const REGION: &str = "us-east-1";
+
+pub struct Route53 {
+    client: Client,
+    zone: String,
+    access_key: Option<String>,
+    secret_key: Option<String>,
+    session_token: Option<String>,
+}
+
+impl Route53 {
+    /// The hosted zone `zone`, with `AWS_ACCESS_KEY_ID`,
+    /// `AWS_SECRET_ACCESS_KEY` and, for temporary credentials,
+    /// `AWS_SESSION_TOKEN`.
+    pub fn from_env(zone: &str) -> Self {
+        Self {
+            client: Client::new(),
+            zone: zone.trim_start_matches("/hostedzone/").to_owned(),
+            access_key: env::var("AWS_ACCESS_KEY_ID").ok(),
+            secret_key: env::var("AWS_SECRET_ACCESS_KEY").ok(),
+            session_token: env::var("AWS_SESSION_TOKEN").ok(),
+        }
+    }
+
+    /// Point the `kind` record for `name` at `value`, replacing whatever it
+    /// held.
+    pub async fn upsert(
+        &self,
+        name: &str,
+        kind: &str,
+        value: &str,
+    ) -> Result<(), Box<dyn Error + Send + Sync>> {
+        self.replace(name, kind, 60, &[value.to_owned()]).await
+    }
+
+    /// Make `values` the TXT records of `name`.
+    pub async fn replace_txt(
+        &self,
+        name: &str,
+        values: &[String],
+    ) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let quoted: Vec<String> = values.iter().map(|v| format!("\"{v}\"")).collect();
+        self.replace(name, "TXT", 300, &quoted).await
+    }
+
+    async fn replace(
+        &self,
+        name: &str,
+        kind: &str,
+        ttl: u32,
+        values: &[String],
+    ) -> Result<(), Box<dyn Error + Send + Sync>> {
+        let (Some(access_key), Some(secret_key)) = (&self.access_key, &self.secret_key) else {
+            return Err("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set".into());
+        };
+        let records: String = values
+            .iter()
+            .map(|v| format!("<ResourceRecord><Value>{v}</Value></ResourceRecord>"))
+            .collect();
+        let body = format!(
+            r#"<?xml version="1.0" encoding="UTF-8"?>
+<ChangeResourceRecordSetsRequest xmlns="https://route53.amazonaws.com/doc/2013-04-01/">
+<ChangeBatch><Changes><Change><Action>UPSERT</Action><ResourceRecordSet>
+<Name>{name}</Name><Type>{kind}</Type><TTL>{ttl}</TTL>
+<ResourceRecords>{records}</ResourceRecords>
+</ResourceRecordSet></Change></Changes></ChangeBatch>
+</ChangeResourceRecordSetsRequest>"#
+        );
+        let path = format!("/2013-04-01/hostedzone/{}/rrset", self.zone);
+        let mut request = self.client.post(format!("https://{HOST}{path}"));
+        for (name, value) in self.sign(access_key, secret_key, &path, &body, SystemTime::now()) {
+            request = request.header(name, value);
+        }
+        let response = request.body(body).send().await?;
+        if !response.status().is_success() {
+            let status = response.status();
+            let text = response.text().await.unwrap_or_default();
+            return Err(format!("Route 53 returned {status}: {text}").into());
+        }
+        Ok(())
+    }
+
+    /// The headers that authenticate a POST of `body` to `path` at `now`.
+    fn sign(
+        &self,
+        access_key: &str,
+        secret_key: &str,
+        path: &str,
+        body: &str,
+        now: SystemTime,
+    ) -> Vec<(&'static str, String)> {
+        let time = humantime::format_rfc3339_seconds(now).to_string();
+        let time: String = time.chars().filter(|c| !matches!(c, '-' | ':')).collect();
+        let date = &time[..8];
+        let mut headers = vec![("host", HOST.to_owned()), ("x-amz-date", time.clone())];
+        if let Some(token) = &self.session_token {
+            headers.push(("x-amz-security-token", token.clone()));
+        }
+        let signed: Vec<&str> = headers.iter().map(|(name, _)| *name).collect();
+        let signed = signed.join(";");
+        let canonical_headers: String = headers
+            .iter()
+            .map(|(name, value)| format!("{name}:{value}\n"))
+            .collect();
+        let canonical = format!(
+            "POST\n{path}\n\n{canonical_headers}\n{signed}\n{:x}",
+            Sha256::digest(body)
+        );
+        let scope = format!("{date}/{REGION}/route53/aws4_request");
+        let to_sign = format!(
+            "AWS4-HMAC-SHA256\n{time}\n{scope}\n{:x}",
+            Sha256::digest(&canonical)
+        );
+        let key = [date, REGION, "route53", "aws4_request"]
+            .iter()
+            .fold(format!("AWS4{secret_key}").into_bytes(), |key, part| {
+                hmac(&key, part.as_bytes()).to_vec()
+            });
+        let signature = format!("{:x}", hmac(&key, to_sign.as_bytes()));
+        let authorization = format!(
+            "AWS4-HMAC-SHA256 Credential={access_key}/{scope}, SignedHeaders={signed}, Signature={signature}"
+        );
+        // reqwest sets the host header itself.
+        headers.remove(0);
+        headers.push(("authorization", authorization));
+        headers
+    }
+}
+
+fn hmac(key: &[u8], data: &[u8]) -> Output<Sha256> {
+    let mut mac = Hmac::<Sha256>::new_from_slice(key).expect("HMAC takes keys of any length");
+    mac.update(data);
+    mac.finalize().into_bytes()
+}
@@ -0,0 +1,199 @@
+//! The delegated routing HTTP API (IPIP-337, `/routing/v1`), answered from
+//! the relay's DHT, so browser clients can find peers and providers through
+//! a host they already trust instead of joining the DHT themselves.
+
+use std::collections::HashMap;
+
+use axum::{
+    Json, Router,
+    extract::{Path, State},
+    http::{HeaderValue, StatusCode, header},
+    middleware,
+    response::Response,
+    routing::get,
+};
+use cid::Cid;
+use libp2p::{
+    Multiaddr, PeerId,
+    kad::{self, GetClosestPeersOk, GetProvidersOk, QueryId, QueryResult, RecordKey},
+};
+use serde::Serialize;
+use tokio::{
+    net::TcpListener,
+    sync::{mpsc, oneshot},
+};
+use tracing::{debug, warn};
+
+use crate::dht;
+
+/// Lookups in flight at once; more are answered with 503.
+const MAX_PENDING: usize = 64;
+
+pub enum Lookup {
+    Peer(PeerId),
+    Providers(RecordKey),
+}
+
+/// A peer found by a lookup. Providers come without addresses, which
+/// clients then resolve through `/routing/v1/peers`.
+pub struct Found {
+    pub id: PeerId,
+    pub addrs: Vec<Multiaddr>,
+}
+
+/// A lookup for the event loop to run on the DHT.
+pub type Query = (Lookup, oneshot::Sender<Vec<Found>>);
+
+/// Lookups started on the DHT and waiting for their queries to finish.
+#[derive(Default)]
+pub struct Lookups {
+    pending: HashMap<QueryId, (Lookup, oneshot::Sender<Vec<Found>>, Vec<Found>)>,
+}
+
+impl Lookups {
+    /// Start `lookup`, dropping `reply` when too many are in flight so the
+    /// handler answers 503.
+    pub fn start(&mut self, dht: &mut dht::Behaviour, (lookup, reply): Query) {
+        if self.pending.len() >= MAX_PENDING {
+            return;
+        }
+        let id = match &lookup {
+            Lookup::Peer(peer) => dht.get_closest_peers(*peer),
+            Lookup::Providers(key) => dht.get_providers(key.clone()),
+        };
+        self.pending.insert(id, (lookup, reply, Vec::new()));
+    }
+
+    /// Collect what a query step found, answering once the query is done.
+    pub fn on_event(&mut self, event: &kad::Event) {
+        let kad::Event::OutboundQueryProgressed {
+            id, result, step, ..
+        } = event
+        else {
+            return;
+        };
+        let Some((lookup, _, found)) = self.pending.get_mut(id) else {
+            return;
+        };
+        match (lookup, result) {
+            (
+                Lookup::Peer(target),
+                QueryResult::GetClosestPeers(Ok(GetClosestPeersOk { peers, .. })),
+            ) => {
+                let matching = peers.iter().filter(|peer| peer.peer_id == *target);
+                found.extend(matching.map(|peer| Found {
+                    id: peer.peer_id,
+                    addrs: peer.addrs.clone(),
+                }));
+            }
+            (
+                Lookup::Providers(_),
+                QueryResult::GetProviders(Ok(GetProvidersOk::FoundProviders { providers, .. })),
+            ) => {
+                found.extend(providers.iter().map(|id| Found {
+                    id: *id,
+                    addrs: Vec::new(),
+                }));
+            }
+            (_, result) => debug!(?result, "Delegated routing query step"),
+        }
+        if !step.last {
+            return;
+        }
+        if let Some((_, reply, found)) = self.pending.remove(id) {
+            let _ = reply.send(found);
+        }
+    }
+}
+
+/// One record in the `peer` schema.
+#[derive(Serialize)]
+#[serde(rename_all = "PascalCase")]
+struct PeerRecord {
+    schema: &'static str,
+    #[serde(rename = "ID")]
+    id: String,
+    addrs: Vec<String>,
+}
+
+impl From<Found> for PeerRecord {
+    fn from(found: Found) -> Self {
+        Self {
+            schema: "peer",
+            id: found.id.to_string(),
+            addrs: found.addrs.iter().map(ToString::to_string).collect(),
+        }
+    }
+}
+
+#[derive(Serialize)]
+#[serde(rename_all = "PascalCase")]
+struct Peers {
+    peers: Vec<PeerRecord>,
+}
+
+#[derive(Serialize)]
+#[serde(rename_all = "PascalCase")]
+struct Providers {
+    providers: Vec<PeerRecord>,
+}
+
+/// Serve `/routing/v1` on an already-bound listener, open to any origin.
+pub async fn serve(listener: TcpListener, queries: mpsc::Sender<Query>) {
+    let app = Router::new()
+        .route("/routing/v1/peers/{id}", get(peers))
+        .route("/routing/v1/providers/{cid}", get(providers))
+        .layer(middleware::map_response(allow_any_origin))
+        .with_state(queries);
+    if let Err(e) = axum::serve(listener, app).await {
+        warn!("Delegated routing API stopped: {e}");
+    }
+}
+
+async fn allow_any_origin(mut response: Response) -> Response {
+    response.headers_mut().insert(
+        header::ACCESS_CONTROL_ALLOW_ORIGIN,
+        HeaderValue::from_static("*"),
+    );
+    response
+}
+
+/// Accepts a PeerID as text or as a `libp2p-key` CID.
+async fn peers(
+    State(queries): State<mpsc::Sender<Query>>,
+    Path(id): Path<String>,
+) -> Result<Json<Peers>, StatusCode> {
+    let peer = id.parse().ok().or_else(|| {
+        let cid = Cid::try_from(id.as_str()).ok()?;
+        PeerId::from_bytes(&cid.hash().to_bytes()).ok()
+    });
+    let peer = peer.ok_or(StatusCode::BAD_REQUEST)?;
+    let found = lookup(&queries, Lookup::Peer(peer)).await?;
+    let peers = found.into_iter().map(PeerRecord::from).collect();
+    Ok(Json(Peers { peers }))
+}
+
+async fn providers(
+    State(queries): State<mpsc::Sender<Query>>,
+    Path(cid): Path<String>,
+) -> Result<Json<Providers>, StatusCode> {
+    let cid = Cid::try_from(cid.as_str()).map_err(|_| StatusCode::BAD_REQUEST)?;
+    let key = RecordKey::new(&cid.hash().to_bytes());
+    let found = lookup(&queries, Lookup::Providers(key)).await?;
+    let providers = found.into_iter().map(PeerRecord::from).collect();
+    Ok(Json(Providers { providers }))
+}
+
+/// Run a lookup on the event loop; nothing found is a 404.
+async fn lookup(queries: &mpsc::Sender<Query>, lookup: Lookup) -> Result<Vec<Found>, StatusCode> {
+    let (reply, found) = oneshot::channel();
+    queries
+        .send((lookup, reply))
+        .await
+        .map_err(|_| StatusCode::SERVICE_UNAVAILABLE)?;
+    let found = found.await.map_err(|_| StatusCode::SERVICE_UNAVAILABLE)?;
+    if found.is_empty() {
+        return Err(StatusCode::NOT_FOUND);
+    }
+    Ok(found)
+}
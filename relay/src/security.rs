@@ -0,0 +1,148 @@
+//! The security handshakes offered on TCP, WebSocket and Unix socket
+//! connections, in --security order, so a deployment can prefer TLS 1.3 or
+//! drop Noise for compliance. QUIC always secures itself with TLS 1.3.
+
+use std::{error::Error, fmt};
+
+use futures::{
+    AsyncRead, AsyncWrite, FutureExt, TryFutureExt,
+    future::{BoxFuture, Either},
+};
+use libp2p::{
+    PeerId,
+    core::upgrade::{InboundConnectionUpgrade, OutboundConnectionUpgrade, UpgradeInfo},
+    identity::Keypair,
+    noise, tls,
+};
+
+use crate::config::SecurityProtocol;
+
+#[derive(Clone)]
+enum Handshake {
+    Noise(noise::Config),
+    Tls(tls::Config),
+}
+
+impl Handshake {
+    fn protocol(&self) -> &'static str {
+        let info = match self {
+            Self::Noise(noise) => noise.protocol_info().into_iter().next(),
+            Self::Tls(tls) => tls.protocol_info().into_iter().next(),
+        };
+        info.expect("security upgrades name their protocol")
+    }
+}
+
+/// Offers each configured handshake and runs whichever the peer picks.
+#[derive(Clone)]
+pub struct Security {
+    offered: Vec<Handshake>,
+}
+
+impl Security {
+    pub fn new(
+        key: &Keypair,
+        protocols: &[SecurityProtocol],
+    ) -> Result<Self, Box<dyn Error + Send + Sync>> {
+        let offered = protocols
+            .iter()
+            .map(|protocol| -> Result<_, Box<dyn Error + Send + Sync>> {
+                Ok(match protocol {
+                    SecurityProtocol::Noise => Handshake::Noise(noise::Config::new(key)?),
+                    SecurityProtocol::Tls => Handshake::Tls(tls::Config::new(key)?),
+                })
+            })
+            .collect::<Result<_, _>>()?;
+        Ok(Self { offered })
+    }
+
+    fn take(self, info: &str) -> Handshake {
+        self.offered
+            .into_iter()
+            .find(|handshake| handshake.protocol() == info)
+            .expect("multistream-select only picks offered protocols")
+    }
+}
+
+impl UpgradeInfo for Security {
+    type Info = &'static str;
+    type InfoIter = Vec<&'static str>;
+
+    fn protocol_info(&self) -> Self::InfoIter {
+        self.offered.iter().map(Handshake::protocol).collect()
+    }
+}
+
+type Stream<T> = Either<noise::Output<T>, tls::TlsStream<T>>;
+
+impl<T> InboundConnectionUpgrade<T> for Security
+where
+    T: AsyncRead + AsyncWrite + Send + Unpin + 'static,
+{
+    type Output = (PeerId, Stream<T>);
+    type Error = HandshakeError;
+    type Future = BoxFuture<'static, Result<Self::Output, Self::Error>>;
+
+    fn upgrade_inbound(self, socket: T, info: Self::Info) -> Self::Future {
+        match self.take(info) {
+            Handshake::Noise(noise) => noise
+                .upgrade_inbound(socket, info)
+                .map_ok(|(peer, stream)| (peer, Either::Left(stream)))
+                .map_err(HandshakeError::Noise)
+                .boxed(),
+            Handshake::Tls(tls) => tls
+                .upgrade_inbound(socket, info)
+                .map_ok(|(peer, stream)| (peer, Either::Right(stream)))
+                .map_err(HandshakeError::Tls)
+                .boxed(),
+        }
+    }
+}
+
+impl<T> OutboundConnectionUpgrade<T> for Security
+where
+    T: AsyncRead + AsyncWrite + Send + Unpin + 'static,
+{
+    type Output = (PeerId, Stream<T>);
+    type Error = HandshakeError;
+    type Future = BoxFuture<'static, Result<Self::Output, Self::Error>>;
+
+    fn upgrade_outbound(self, socket: T, info: Self::Info) -> Self::Future {
+        match self.take(info) {
+            Handshake::Noise(noise) => noise
+                .upgrade_outbound(socket, info)
+                .map_ok(|(peer, stream)| (peer, Either::Left(stream)))
+                .map_err(HandshakeError::Noise)
+                .boxed(),
+            Handshake::Tls(tls) => tls
+                .upgrade_outbound(socket, info)
+                .map_ok(|(peer, stream)| (peer, Either::Right(stream)))
+                .map_err(HandshakeError::Tls)
+                .boxed(),
+        }
+    }
+}
+
+#[derive(Debug)]
+pub enum HandshakeError {
+    Noise(noise::Error),
+    Tls(tls::UpgradeError),
+}
+
+impl fmt::Display for HandshakeError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::Noise(e) => write!(f, "noise handshake failed: {e}"),
+            Self::Tls(e) => write!(f, "TLS handshake failed: {e}"),
+        }
+    }
+}
+
+impl Error for HandshakeError {
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
+        match self {
+            Self::Noise(e) => Some(e),
+            Self::Tls(e) => Some(e),
+        }
+    }
+}
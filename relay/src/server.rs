@@ -0,0 +1,1718 @@
+//! An embeddable relay: [`Relay::start`] binds everything the configuration
+//! asks for and runs the swarm on a background task, handing back a handle
+//! to query and control it.
+
+use std::{
+    collections::{HashMap, HashSet},
+    error::Error,
+    io,
+    sync::Arc,
+    time::{Duration, Instant},
+};
+
+use futures::StreamExt;
+use libp2p::{
+    Multiaddr, PeerId, StreamProtocol, Swarm, Transport,
+    core::{
+        ConnectedPoint,
+        muxing::StreamMuxerBox,
+        transport::{Boxed, ListenerId, OptionalTransport},
+        upgrade,
+    },
+    gossipsub, identify, identity, memory_connection_limits,
+    pnet::PreSharedKey,
+    quic, relay,
+    request_response::{self, ProtocolSupport},
+    swarm::{ListenError, NetworkBehaviour, SwarmEvent, behaviour::toggle::Toggle},
+    tcp,
+    websocket::tls,
+    yamux,
+};
+#[cfg(unix)]
+use libp2p::uds;
+use prometheus_client::registry::Registry;
+use serde_json::json;
+use tokio::{
+    net::TcpListener,
+    sync::{Mutex, broadcast, mpsc, oneshot, watch},
+    time,
+};
+#[cfg(unix)]
+use tokio_util::compat::TokioAsyncReadCompatExt;
+use tracing::{debug, info, warn};
+
+use crate::{
+    abuse::{self, Bans, Offence},
+    acl::Acl,
+    acme::{self, Acme},
+    alert::Alerts,
+    addrs,
+    admin::{self, Circuits, Query, Status, Transports},
+    announce::Announcer,
+    audit::AuditLog,
+    auth::{AuthRequest, AuthResponse, Tokens},
+    authz::Webhook,
+    autonat,
+    billing::Billing,
+    builder::RelayBuilder,
+    buildinfo,
+    capacity::{Capacity, CapacityRequest, Reservations},
+    churn,
+    cluster::Cluster,
+    cloudflare::Cloudflare,
+    config::{AcmeStorage, Config, NotifyEvent},
+    connlimits,
+    connmgr::ConnManager,
+    consul::Consul,
+    ddns::{self, Ddns},
+    dnsaddr::{self, Publisher},
+    debug,
+    dht,
+    diagnostics::{self, Diagnostics},
+    dialer::Dialer,
+    discovery::{DiscoveryRequest, DiscoveryResponse, RoomRegistry, handle_discovery, remove_peer},
+    drain::Drain,
+    faults::{self, Faulty},
+    gate::{self, Gater},
+    geo::{GeoIp, ReservationPolicy},
+    gossip,
+    grpc,
+    handshakes,
+    health::{self, Liveness},
+    identity::load_or_create_identity,
+    ingress::Ingress,
+    instance::Instance,
+    limits::{Limits, RelayLimits},
+    listen,
+    mdns,
+    metrics::{self, CertMetrics, HandshakeMetrics, Metrics},
+    notify::Notifier,
+    proxy::ProxyProtocol,
+    psk,
+    publicip::{IpChange, PublicIps},
+    quota::{self, Quotas},
+    reachability,
+    rendezvous,
+    reputation::Reputation,
+    routing,
+    security::Security,
+    spans::RelaySpans,
+    startup::{self, StartupError},
+    throttle::Throttle,
+    tiers::Tiers,
+    tls::Wss,
+    traffic::{Dump, MeteredMuxer, PeerTraffic},
+    udp,
+};
+
+type Started = oneshot::Sender<Result<Relay, StartupError>>;
+
+/// Handle to a relay running in the background. Clones control the same
+/// relay, and dropping every handle stops it as if by [`Relay::stop`].
+#[derive(Clone)]
+pub struct Relay {
+    peer_id: PeerId,
+    listen_addrs: watch::Receiver<Vec<Multiaddr>>,
+    listening: watch::Receiver<bool>,
+    stopped: watch::Receiver<bool>,
+    failure: watch::Receiver<Option<String>>,
+    stop: Arc<watch::Sender<bool>>,
+    reloads: mpsc::UnboundedSender<Config>,
+    queries: mpsc::Sender<Query>,
+    diagnostics: mpsc::Sender<diagnostics::Query>,
+    liveness: Liveness,
+    drain: Drain,
+}
+
+impl Relay {
+    /// Configure a relay from the defaults, setting only its listen
+    /// addresses, identity or gater, or any other settings, as needed.
+    pub fn builder() -> RelayBuilder {
+        RelayBuilder::default()
+    }
+
+    /// Start a relay, returning once its identity is loaded and its
+    /// listeners and HTTP endpoints are bound. Must be called from within a
+    /// Tokio runtime.
+    pub async fn start(config: Config) -> Result<Self, StartupError> {
+        Self::spawn(config, None).await
+    }
+
+    /// Start a relay as [`Relay::start`] does, that also admits connections
+    /// only as `gater` allows.
+    pub async fn start_with_gater(config: Config, gater: impl Gater) -> Result<Self, StartupError> {
+        Self::spawn(config, Some(Arc::new(gater))).await
+    }
+
+    pub(crate) async fn spawn(
+        config: Config,
+        gater: Option<Arc<dyn Gater>>,
+    ) -> Result<Self, StartupError> {
+        let (started_tx, started) = oneshot::channel();
+        tokio::spawn(async move {
+            let mut started_tx = Some(started_tx);
+            let result = run(config, gater, &mut started_tx).await;
+            if let (Err(e), Some(started_tx)) = (result, started_tx) {
+                let _ = started_tx.send(Err(e));
+            }
+        });
+        started.await.expect("relay task panicked while starting")
+    }
+
+    pub fn peer_id(&self) -> PeerId {
+        self.peer_id
+    }
+
+    /// Addresses the relay is currently listening on.
+    pub fn listen_addrs(&self) -> Vec<Multiaddr> {
+        self.listen_addrs.borrow().clone()
+    }
+
+    /// The addresses the relay is listening on, updated as they change.
+    pub fn watch_listen_addrs(&self) -> watch::Receiver<Vec<Multiaddr>> {
+        self.listen_addrs.clone()
+    }
+
+    /// Resolve once every listener has reported an address.
+    pub async fn listening(&self) {
+        let _ = self.listening.clone().wait_for(|listening| *listening).await;
+    }
+
+    /// A snapshot of the relay's peers, reservations and circuits, or `None`
+    /// once it has stopped.
+    pub async fn status(&self) -> Option<Status> {
+        let (reply, status) = oneshot::channel();
+        self.queries.send(reply).await.ok()?;
+        status.await.ok()
+    }
+
+    /// Everything in [`Relay::status`] plus limit usage, bans and runtime
+    /// load, for debugging, or `None` once the relay has stopped.
+    pub async fn diagnostics(&self) -> Option<Diagnostics> {
+        let (reply, diagnostics) = oneshot::channel();
+        self.diagnostics.send(reply).await.ok()?;
+        diagnostics.await.ok()
+    }
+
+    /// Whether the event loop is still making progress.
+    pub async fn is_alive(&self) -> bool {
+        self.liveness.check().await
+    }
+
+    /// Apply the settings that can change while running. Any others that
+    /// differ are logged as needing a restart.
+    pub fn reload(&self, config: Config) {
+        let _ = self.reloads.send(config);
+    }
+
+    /// Refuse new reservations and circuits and stop once the open circuits
+    /// have closed or `drain_timeout` passes. Returns false if the relay was
+    /// already draining.
+    pub fn drain(&self) -> bool {
+        self.drain.start()
+    }
+
+    /// Fail readiness for `pre_stop_delay` so load balancers stop routing
+    /// new clients here, drain for up to `shutdown_grace` so open circuits
+    /// can finish, then shut down. Returns immediately; see
+    /// [`Relay::stopped`].
+    pub fn stop(&self) {
+        self.stop.send_replace(true);
+    }
+
+    /// Resolve once the relay has shut down, however it came to stop.
+    pub async fn stopped(&self) {
+        let _ = self.stopped.clone().wait_for(|stopped| *stopped).await;
+    }
+
+    /// Why the relay stopped itself as unhealthy, if it did, such as under
+    /// --exit-when-unreachable.
+    pub fn failure(&self) -> Option<String> {
+        self.failure.borrow().clone()
+    }
+}
+
+#[derive(NetworkBehaviour)]
+struct Behaviour {
+    gate: gate::Behaviour,
+    churn: churn::Behaviour,
+    bans: abuse::Behaviour,
+    handshakes: handshakes::Behaviour,
+    limits: connlimits::Behaviour,
+    memory: Toggle<memory_connection_limits::Behaviour>,
+    relay: relay::Behaviour,
+    identify: identify::Behaviour,
+    autonat: Toggle<autonat::Behaviour>,
+    reachability: Toggle<libp2p::autonat::v1::Behaviour>,
+    dht: Toggle<dht::Behaviour>,
+    rendezvous: Toggle<rendezvous::Behaviour>,
+    mdns: Toggle<mdns::Behaviour>,
+    gossip: Toggle<gossipsub::Behaviour>,
+    discovery: request_response::json::Behaviour<DiscoveryRequest, DiscoveryResponse>,
+    capacity: request_response::json::Behaviour<CapacityRequest, Capacity>,
+    auth: Toggle<request_response::json::Behaviour<AuthRequest, AuthResponse>>,
+}
+
+/// Set up and run the relay, handing a [`Relay`] to `started_tx` once it is up.
+/// Errors are only returned before that point.
+async fn run(
+    mut config: Config,
+    gater: Option<Arc<dyn Gater>>,
+    started_tx: &mut Option<Started>,
+) -> Result<(), StartupError> {
+    let started = Instant::now();
+    info!("Effective configuration: {config:?}");
+    let _instance = Instance::acquire(&config)?;
+    let passphrase = config.identity_passphrase.as_ref().map(|p| p.0.as_str());
+    let source = config.identity_source();
+    let local_key =
+        load_or_create_identity(&source, config.key_type, config.key_bits, passphrase)
+            .await
+            .map_err(|e| StartupError::identity(&source, e))?;
+    let local_peer_id = local_key.public().to_peer_id();
+
+    info!("Local PeerID: {local_peer_id}");
+
+    let plan = listen::plan(&config);
+    listen::check_conflicts(&plan)?;
+
+    let geoip = GeoIp::open(config.geoip_db.as_deref())?;
+
+    // The relay's own caps and default RESERVE rate limits are lifted in
+    // favour of the configured ones, which a reload can change. Circuit
+    // duration and bytes are copied into each connection's handler, so they
+    // stay as set at startup.
+    let relay_limits = RelayLimits::new(Limits::from_config(&config));
+    let mut relay_config = relay::Config {
+        max_reservations: usize::MAX,
+        max_reservations_per_peer: usize::MAX,
+        max_circuits: usize::MAX,
+        max_circuits_per_peer: usize::MAX,
+        max_circuit_duration: config.circuit_duration_limit(),
+        max_circuit_bytes: config.circuit_bytes_limit(),
+        reservation_rate_limiters: vec![Box::new(relay_limits.reservations())],
+        ..Default::default()
+    };
+    relay_config
+        .circuit_src_rate_limiters
+        .push(Box::new(relay_limits.circuits()));
+    let drain = Drain::new();
+    relay_config
+        .reservation_rate_limiters
+        .push(Box::new(drain.clone()));
+    relay_config
+        .circuit_src_rate_limiters
+        .push(Box::new(drain.clone()));
+    let bans = Bans::new(abuse::Policy::from_config(&config));
+    relay_config
+        .reservation_rate_limiters
+        .push(Box::new(bans.clone()));
+    relay_config
+        .circuit_src_rate_limiters
+        .push(Box::new(bans.clone()));
+    let reputation = match &config.reputation_file {
+        Some(path) => Reputation::open(path, config.max_reservations, config.reserved_slots())
+            .await
+            .map_err(|e| StartupError::open("reputation file", path, e))?,
+        None => Reputation::disabled(),
+    };
+    relay_config
+        .reservation_rate_limiters
+        .push(Box::new(reputation.clone()));
+    let tokens = config.reservation_token_secret.as_ref().map(|secret| {
+        let tokens = Tokens::new(&secret.0);
+        relay_config
+            .reservation_rate_limiters
+            .push(Box::new(tokens.clone()));
+        tokens
+    });
+    // The webhook, access lists and country policy are installed even when
+    // unset or empty so that a reload can fill them in.
+    let webhook = Webhook::from_config(&config);
+    relay_config
+        .reservation_rate_limiters
+        .push(Box::new(webhook.clone()));
+    let acl = Acl::default();
+    acl.load(
+        config.reservation_allowlist.as_deref(),
+        config.reservation_denylist.as_deref(),
+    )
+    .await?;
+    relay_config
+        .reservation_rate_limiters
+        .push(Box::new(acl.clone()));
+    let cluster = config.cluster.as_deref().map(|prefix| {
+        let cluster = Cluster::spawn(
+            prefix,
+            local_peer_id,
+            config.max_reservations_per_peer,
+            config.cluster_sync_interval,
+        );
+        relay_config
+            .reservation_rate_limiters
+            .push(Box::new(cluster.clone()));
+        cluster
+    });
+    let reservation_policy =
+        ReservationPolicy::new(geoip.clone(), config.reservation_countries.clone());
+    relay_config
+        .reservation_rate_limiters
+        .push(Box::new(reservation_policy.clone()));
+
+    let max_streams = config.max_streams_per_connection;
+    let muxer = move || {
+        let mut yamux = yamux::Config::default();
+        yamux.set_max_num_streams(max_streams);
+        yamux
+    };
+
+    let cert_metrics = CertMetrics::default();
+    let handshake_metrics = HandshakeMetrics::default();
+    let alerts = Alerts::new(config.alert_webhook.clone().map(|url| url.0));
+    let notifier = Notifier::from_config(&config);
+    let certs = start_tls(&config, &cert_metrics, &alerts, &notifier).await?;
+    let ingress = Ingress::new(&config);
+
+    let throttle = Throttle::new(config.max_bandwidth);
+    let traffic = PeerTraffic::new(config.traffic_dump.is_some()).with_throttle(throttle.clone());
+    let quotas = match &config.api_keys {
+        Some(path) => {
+            let quotas =
+                Quotas::open(path, config.api_key_usage.as_deref(), traffic.clone()).await?;
+            relay_config
+                .reservation_rate_limiters
+                .push(Box::new(quotas.clone()));
+            Some(quotas)
+        }
+        None => None,
+    };
+    let tiers = Tiers::new(&config, tokens.clone(), quotas.clone(), traffic.clone());
+    tiers.load(&config).await?;
+    relay_config
+        .reservation_rate_limiters
+        .push(Box::new(tiers.clone()));
+    let lan = config
+        .mdns
+        .then(|| mdns::behaviour(local_peer_id))
+        .transpose()
+        .map_err(|e| StartupError::transport("mdns", e))?;
+    let swarm_key = match &config.psk {
+        Some(path) => Some(psk::load(path).await?),
+        None => None,
+    };
+    if let Some(key) = &swarm_key {
+        info!("Serving only the private network with key fingerprint {}", key.fingerprint());
+    }
+    let mut metrics_registry = Registry::default();
+    let mut swarm = libp2p::SwarmBuilder::with_existing_identity(local_key)
+        .with_tokio()
+        .with_other_transport(|key| -> Result<_, Box<dyn Error + Send + Sync>> {
+            let tcp = tcp::tokio::Transport::new(ingress.sockets().tcp_config());
+            Ok(ProxyProtocol::new(tcp, ingress.clone())
+                .and_then(move |socket, _| psk::handshake(socket, swarm_key))
+                .upgrade(upgrade::Version::V1Lazy)
+                .authenticate(Security::new(key, &config.security)?)
+                .multiplex(muxer())
+                .map(streams(&traffic)))
+        })
+        .map_err(|e| StartupError::transport("tcp", e))?
+        .with_other_transport(|key| {
+            if !config.serves_quic() {
+                return OptionalTransport::none();
+            }
+            udp::check_receive_buffer(config.quic_receive_buffer);
+            let quic =
+                quic::tokio::Transport::new(quic_config(key, &config)).map(streams(&traffic));
+            OptionalTransport::some(quic)
+        })
+        .map_err(|e| StartupError::transport("quic", e))?
+        .with_other_transport(|key| -> Result<_, Box<dyn Error + Send + Sync>> {
+            if !config.serves_websocket() {
+                return Ok(OptionalTransport::none());
+            }
+            let wss = Wss::new(certs, ingress.clone())?
+                .and_then(move |socket, _| psk::handshake(socket, swarm_key))
+                .upgrade(upgrade::Version::V1Lazy)
+                .authenticate(Security::new(key, &config.security)?)
+                .multiplex(muxer())
+                .map(streams(&traffic));
+            Ok(OptionalTransport::some(wss))
+        })
+        .map_err(|e| StartupError::transport("websocket", e))?
+        .with_other_transport(|key| unix_transport(key, &config, swarm_key, muxer(), &traffic))
+        .map_err(|e| StartupError::transport("unix", e))?
+        .with_dns()
+        .map_err(|e| StartupError::transport("dns", e))?
+        .with_bandwidth_metrics(&mut metrics_registry)
+        .with_behaviour(|key| Behaviour {
+            gate: build_gate(&config, &geoip, gater.as_ref()),
+            churn: churn::Behaviour::new(churn::Limit::from_config(&config)),
+            bans: abuse::Behaviour::new(bans.clone()),
+            handshakes: handshakes::Behaviour::new(
+                config.max_pending_handshakes,
+                handshake_metrics.clone(),
+            ),
+            limits: connlimits::Behaviour::new(connlimits::Limits::from_config(&config)),
+            memory: memory_limit(&config),
+            relay: relay::Behaviour::new(key.public().to_peer_id(), relay_config),
+            identify: identify::Behaviour::new(
+                identify::Config::new("/sunset-relay/0.1.0".to_string(), key.public())
+                    .with_agent_version(buildinfo::AGENT_VERSION.to_string())
+                    .with_hide_listen_addrs(true),
+            ),
+            autonat: config
+                .autonat
+                .then(|| autonat::Behaviour::new(autonat_limits(&config)))
+                .into(),
+            reachability: config
+                .check_reachability
+                .then(|| reachability::behaviour(key.public().to_peer_id(), &config))
+                .into(),
+            dht: dht::behaviour(key.public().to_peer_id(), &config).into(),
+            rendezvous: config.rendezvous.then(|| rendezvous::behaviour(&config)).into(),
+            mdns: lan.into(),
+            gossip: config
+                .capacity_topic
+                .as_deref()
+                .map(|topic| gossip::behaviour(key, topic))
+                .into(),
+            discovery: request_response::json::Behaviour::new(
+                [(
+                    StreamProtocol::new("/sunset/discovery/1.0.0"),
+                    ProtocolSupport::Full,
+                )],
+                request_response::Config::default(),
+            ),
+            capacity: request_response::json::Behaviour::new(
+                [(
+                    StreamProtocol::new("/sunset/capacity/1.0.0"),
+                    ProtocolSupport::Inbound,
+                )],
+                request_response::Config::default(),
+            ),
+            auth: (tokens.is_some() || quotas.is_some())
+                .then(|| {
+                    request_response::json::Behaviour::new(
+                        [(
+                            StreamProtocol::new("/sunset/auth/1.0.0"),
+                            ProtocolSupport::Inbound,
+                        )],
+                        request_response::Config::default(),
+                    )
+                })
+                .into(),
+        })
+        .map_err(|e| StartupError::transport("behaviour", e))?
+        .build();
+    let metrics = Metrics::new(
+        &mut metrics_registry,
+        geoip.clone(),
+        traffic.clone(),
+        cert_metrics.clone(),
+        handshake_metrics,
+    );
+    let metrics_registry = Arc::new(metrics_registry);
+
+    // Ready once every listener has reported an address.
+    let mut pending_listeners = HashSet::new();
+    let mut listeners = HashMap::new();
+    for addr in plan {
+        #[cfg(unix)]
+        listen::remove_stale_socket(&addr);
+        let id = startup::listen_on(&mut swarm, addr.clone())?;
+        pending_listeners.insert(id);
+        listeners.insert(addr, id);
+    }
+
+    info!("Relay listening on {} addresses", pending_listeners.len());
+
+    let readiness = health::Readiness::default();
+    let (liveness, mut pings) = Liveness::new();
+    if let Some(addr) = config.health_addr {
+        let listener = TcpListener::bind(addr)
+            .await
+            .map_err(|e| StartupError::bind(addr, e))?;
+        info!("Serving health checks on http://{addr}");
+        tokio::spawn(health::serve(listener, readiness.clone(), liveness.clone()));
+    }
+    if let Some(addr) = config.metrics_addr {
+        let listener = TcpListener::bind(addr)
+            .await
+            .map_err(|e| StartupError::bind(addr, e))?;
+        info!("Serving metrics on http://{addr}/metrics");
+        tokio::spawn(metrics::serve(listener, metrics_registry.clone()));
+    }
+    if let Some(addr) = config.debug_addr {
+        let listener = TcpListener::bind(addr)
+            .await
+            .map_err(|e| StartupError::bind(addr, e))?;
+        info!("Serving debug endpoints on http://{addr}/debug/vars");
+        tokio::spawn(debug::serve(listener, started));
+    }
+    let (routing_tx, mut routing_queries) = mpsc::channel(16);
+    let mut lookups = routing::Lookups::default();
+    if let Some(addr) = config.routing_addr {
+        let listener = TcpListener::bind(addr)
+            .await
+            .map_err(|e| StartupError::bind(addr, e))?;
+        info!("Serving delegated routing on http://{addr}/routing/v1");
+        tokio::spawn(routing::serve(listener, routing_tx));
+    }
+    let (admin_tx, mut admin_queries) = mpsc::channel(16);
+    let (diagnostics_tx, mut diagnostics_queries) = mpsc::channel(4);
+    let (admin_events, _) = broadcast::channel(256);
+    let admin_token = config
+        .admin_token
+        .as_ref()
+        .map(|token| admin::Token::new(&token.0));
+    if let Some(token) = &admin_token {
+        let addr = config.admin_addr;
+        let listener = TcpListener::bind(addr)
+            .await
+            .map_err(|e| StartupError::bind(addr, e))?;
+        info!("Serving admin API on http://{addr}");
+        tokio::spawn(admin::serve(
+            listener,
+            token.clone(),
+            admin_tx.clone(),
+            drain.clone(),
+            bans.clone(),
+            quotas.clone(),
+            admin_events.clone(),
+        ));
+
+        let addr = config.admin_grpc_addr;
+        let listener = TcpListener::bind(addr)
+            .await
+            .map_err(|e| StartupError::bind(addr, e))?;
+        info!("Serving gRPC admin API on {addr}");
+        tokio::spawn(grpc::serve(
+            listener,
+            token.clone(),
+            admin_tx.clone(),
+            admin_events.clone(),
+            drain.clone(),
+        ));
+    }
+    let mut dumping = start_dump(&config, &traffic);
+
+    let registry: RoomRegistry = Arc::new(Mutex::new(HashMap::new()));
+    let mut reservations = Reservations::new(config.max_reservations);
+    let mut audit = open_audit(&config).await.map_err(|e| {
+        let path = config.audit_log.clone().unwrap_or_default();
+        StartupError::open("audit log", &path, e)
+    })?;
+    let mut billing = Billing::from_config(&config, quotas.clone());
+    let mut spans = RelaySpans::default();
+    let mut circuits = Circuits::default();
+    let mut transports = Transports::default();
+    let mut announcer = Announcer::default();
+    announcer.set(&mut swarm, &config);
+    if let Some(addr) = config.onion_multiaddr() {
+        info!("Serving the onion service {addr} on 127.0.0.1:{}", config.onion_port);
+    }
+    let mut public_ips = PublicIps::default();
+    let mut ddns = start_ddns(&config, &alerts);
+    let mut publisher = start_dnsaddr(&config, &alerts);
+    let mut dialer = Dialer::new(&config.bootstrap, &config.peering);
+    let redial = time::sleep(Duration::ZERO);
+    tokio::pin!(redial);
+    let mut conns = ConnManager::new(config.conn_watermarks(), config.conn_grace);
+    let mut reconcile = time::interval(config.reconcile_interval);
+    reconcile.set_missed_tick_behavior(time::MissedTickBehavior::Skip);
+    let mut capacity_announcements = time::interval(config.capacity_interval);
+    capacity_announcements.set_missed_tick_behavior(time::MissedTickBehavior::Skip);
+    let mut meter = gossip::Meter::new();
+    let mut quota_checks = time::interval(quota::CHECK_INTERVAL);
+    quota_checks.set_missed_tick_behavior(time::MissedTickBehavior::Skip);
+    let mut cluster_sync = time::interval(config.cluster_sync_interval);
+    cluster_sync.set_missed_tick_behavior(time::MissedTickBehavior::Skip);
+    let mut usage_exports = time::interval(config.usage_export_interval);
+    usage_exports.set_missed_tick_behavior(time::MissedTickBehavior::Skip);
+    let drain_started = drain.started();
+    tokio::pin!(drain_started);
+    let drain_deadline = time::sleep(Duration::ZERO);
+    tokio::pin!(drain_deadline);
+    let mut draining = false;
+    let mut unreachable = reachability::Monitor::default();
+    let unreachable_deadline = time::sleep(Duration::ZERO);
+    tokio::pin!(unreachable_deadline);
+
+    let (reloads_tx, mut reloads) = mpsc::unbounded_channel();
+    let stop = Arc::new(watch::Sender::new(false));
+    let mut stop_requests = stop.subscribe();
+    let stop_requested = async {
+        let _ = stop_requests.wait_for(|stop| *stop).await;
+    };
+    tokio::pin!(stop_requested);
+    let stop_deadline = time::sleep(Duration::ZERO);
+    tokio::pin!(stop_deadline);
+    let mut stopping = false;
+    let mut graceful = false;
+    let (listen_addrs_tx, listen_addrs) = watch::channel(Vec::new());
+    let (listening_tx, listening) = watch::channel(false);
+    let (stopped_tx, stopped) = watch::channel(false);
+    let (failure_tx, failure) = watch::channel(None);
+    let relay = Relay {
+        peer_id: local_peer_id,
+        listen_addrs,
+        listening,
+        stopped,
+        failure,
+        stop,
+        reloads: reloads_tx,
+        queries: admin_tx,
+        diagnostics: diagnostics_tx,
+        liveness,
+        drain: drain.clone(),
+    };
+    if let Some(started_tx) = started_tx.take() {
+        let _ = started_tx.send(Ok(relay));
+    }
+
+    loop {
+        tokio::select! {
+            event = swarm.next() => {
+                let event = event.expect("swarm stream should be infinite");
+                metrics.record(&event);
+                match event {
+                    SwarmEvent::NewListenAddr { listener_id, address } => {
+                        info!(addr = %address, "Listening on {address}/p2p/{local_peer_id}");
+                        listen_addrs_tx.send_modify(|addrs| addrs.push(address.clone()));
+                        announcer.add_listen(&mut swarm, address);
+                        if pending_listeners.remove(&listener_id) && pending_listeners.is_empty() {
+                            listening_tx.send_replace(true);
+                            readiness.set(!draining && !stopping);
+                        }
+                    }
+                    SwarmEvent::ExpiredListenAddr { address, .. } => {
+                        listen_addrs_tx.send_modify(|addrs| addrs.retain(|addr| *addr != address));
+                        announcer.remove_listen(&mut swarm, &address);
+                    }
+                    SwarmEvent::ExternalAddrConfirmed { .. } | SwarmEvent::ExternalAddrExpired { .. } => {
+                        if let Some(publisher) = &publisher {
+                            let records = dnsaddr::records(local_peer_id, swarm.external_addresses());
+                            publisher.update(records);
+                        }
+                    }
+                    SwarmEvent::Behaviour(BehaviourEvent::Identify(identify::Event::Received {
+                        connection_id,
+                        peer_id,
+                        info,
+                        ..
+                    })) => {
+                        if let Some(dht) = swarm.behaviour_mut().dht.as_mut() {
+                            dht::learn(dht, peer_id, &info);
+                        }
+                        let observed_addr = info.observed_addr;
+                        if let Some(change) = public_ips.observed(connection_id, &observed_addr) {
+                            log_ip_change(&change);
+                            if let Some(old) = change.old {
+                                announcer.withdraw_ip(&mut swarm, old);
+                                notifier.send(
+                                    NotifyEvent::AddressChanged,
+                                    format!(
+                                        "The relay's public IP changed from {old} to {}",
+                                        change.new
+                                    ),
+                                    json!({ "old": old, "new": change.new }),
+                                );
+                            }
+                            let _ = admin_events.send(grpc::ip_event(&change));
+                            if let Some(ddns) = &mut ddns {
+                                ddns.update(change.new);
+                            }
+                        }
+                        if public_ips.confirmed(&observed_addr) {
+                            announcer.add(&mut swarm, observed_addr);
+                        }
+                    }
+                    SwarmEvent::Behaviour(BehaviourEvent::Autonat(event)) => {
+                        debug!(
+                            peer = %event.client,
+                            addr = %event.tested_addr,
+                            reachable = event.result.is_ok(),
+                            "Dialed back for AutoNAT"
+                        );
+                        metrics.dial_back(event.result.is_ok());
+                    }
+                    SwarmEvent::Behaviour(BehaviourEvent::Reachability(
+                        libp2p::autonat::v1::Event::OutboundProbe(event),
+                    )) => {
+                        if let Some(result) = reachability::probe_result(&event) {
+                            debug!(result, "AutoNAT probe finished");
+                            metrics.probe(result);
+                        }
+                    }
+                    SwarmEvent::Behaviour(BehaviourEvent::Reachability(
+                        libp2p::autonat::v1::Event::StatusChanged { new, .. },
+                    )) => {
+                        metrics.set_reachable(&new);
+                        if let libp2p::autonat::v1::NatStatus::Public(addr) = &new
+                            && let Some(ddns) = &mut ddns
+                        {
+                            ddns.reachable(addr);
+                        }
+                        if unreachable.status_changed(&new) {
+                            unreachable_deadline
+                                .as_mut()
+                                .reset(time::Instant::now() + config.unreachable_after);
+                        }
+                    }
+                    SwarmEvent::Behaviour(BehaviourEvent::Dht(event)) => {
+                        if let Some(dht) = swarm.behaviour_mut().dht.as_mut() {
+                            dht::on_event(dht, &event);
+                        }
+                        lookups.on_event(&event);
+                    }
+                    SwarmEvent::Behaviour(BehaviourEvent::Rendezvous(event)) => {
+                        rendezvous::log_event(&event);
+                    }
+                    SwarmEvent::Behaviour(BehaviourEvent::Mdns(event)) => {
+                        for (peer, addr) in mdns::discovered(event) {
+                            if let Some(dht) = swarm.behaviour_mut().dht.as_mut() {
+                                dht.add_address(&peer, addr.clone());
+                            }
+                            swarm.add_peer_address(peer, addr);
+                        }
+                    }
+                    SwarmEvent::Behaviour(BehaviourEvent::Relay(event)) => {
+                        log_relay_event(&event);
+                        reservations.relay_event(&event);
+                        audit.relay_event(&event);
+                        metrics.relay_event(&event);
+                        spans.relay_event(&event);
+                        circuits.relay_event(&event);
+                        reputation.relay_event(&event);
+                        notifier.relay_event(&event);
+                        faults::relay_event(&event);
+                        if let Some(billing) = &mut billing {
+                            billing.relay_event(&event);
+                        }
+                        if let Some((peer, offence)) = abuse::offence(&event) {
+                            strike(
+                                &mut swarm,
+                                &bans,
+                                &reputation,
+                                &metrics,
+                                &notifier,
+                                peer,
+                                offence,
+                            );
+                        }
+                        relay_limits.relay_event(&event);
+                        if let Some(event) = grpc::event(&event) {
+                            let _ = admin_events.send(event);
+                        }
+                        publish_reservations(
+                            &reservations,
+                            &metrics,
+                            &reputation,
+                            &relay_limits,
+                            quotas.as_ref(),
+                            &webhook,
+                            &tiers,
+                        );
+                        if draining && circuits.is_empty() {
+                            info!("Drained all circuits, shutting down");
+                            break;
+                        }
+                    }
+                    SwarmEvent::Behaviour(BehaviourEvent::Capacity(
+                        request_response::Event::Message {
+                            peer,
+                            message: request_response::Message::Request { channel, .. },
+                            ..
+                        },
+                    )) => {
+                        let capacity = reservations.capacity(config.capacity_granularity, draining);
+                        if swarm
+                            .behaviour_mut()
+                            .capacity
+                            .send_response(channel, capacity)
+                            .is_err()
+                        {
+                            warn!(peer = %peer, "Failed to send capacity response");
+                        }
+                    }
+                    SwarmEvent::Behaviour(BehaviourEvent::Auth(
+                        request_response::Event::Message {
+                            peer,
+                            message: request_response::Message::Request {
+                                request,
+                                channel,
+                                ..
+                            },
+                            ..
+                        },
+                    )) => {
+                        let response =
+                            authenticate(peer, &request, quotas.as_ref(), tokens.as_ref());
+                        tiers.classify(peer);
+                        let sent = swarm
+                            .behaviour_mut()
+                            .auth
+                            .as_mut()
+                            .is_some_and(|auth| auth.send_response(channel, response).is_ok());
+                        if !sent {
+                            warn!(peer = %peer, "Failed to send auth response");
+                        }
+                    }
+                    SwarmEvent::Behaviour(BehaviourEvent::Discovery(
+                        request_response::Event::Message {
+                            peer,
+                            message: request_response::Message::Request {
+                                request,
+                                channel,
+                                ..
+                            },
+                            ..
+                        },
+                    )) => {
+                        debug!(
+                            peer = %peer,
+                            room = %request.room,
+                            addrs = request.addrs.len(),
+                            "Discovery request"
+                        );
+                        let response = handle_discovery(&registry, request).await;
+                        debug!(peer = %peer, peers = response.peers.len(), "Discovery response");
+                        if swarm
+                            .behaviour_mut()
+                            .discovery
+                            .send_response(channel, response)
+                            .is_err()
+                        {
+                            warn!(peer = %peer, "Failed to send discovery response");
+                        }
+                    }
+                    SwarmEvent::ConnectionEstablished { peer_id, connection_id, endpoint, .. } => {
+                        let remote_addr = endpoint.get_remote_address();
+                        info!(
+                            peer = %peer_id,
+                            remote_addr = %remote_addr,
+                            transport = addrs::transport_name(remote_addr),
+                            "Connection established"
+                        );
+                        audit.connected(peer_id, remote_addr);
+                        let event = grpc::connection_event(true, &peer_id, remote_addr);
+                        let _ = admin_events.send(event);
+                        tiers.classify(peer_id);
+                        dialer.connected(&peer_id);
+                        metrics.connected(remote_addr);
+                        transports.connected(remote_addr);
+                        if endpoint.is_listener() {
+                            strike(
+                                &mut swarm,
+                                &bans,
+                                &reputation,
+                                &metrics,
+                                &notifier,
+                                peer_id,
+                                Offence::Reconnects,
+                            );
+                            webhook.check(peer_id, remote_addr);
+                        }
+                        relay_limits.connected(peer_id, remote_addr);
+                        conns.connected(connection_id, peer_id);
+                        public_ips.connected(connection_id, remote_addr);
+                        let idle = conns.trim(|peer| {
+                            reservations.holds(peer)
+                                || circuits.involves(peer)
+                                || dialer.is_peering(peer)
+                        });
+                        if !idle.is_empty() {
+                            debug!("Above --conns-high, closing {} idle connections", idle.len());
+                        }
+                        for id in idle {
+                            swarm.close_connection(id);
+                        }
+                    }
+                    SwarmEvent::ConnectionClosed {
+                        peer_id,
+                        connection_id,
+                        endpoint,
+                        cause,
+                        num_established,
+                        ..
+                    } => {
+                        let remote_addr = endpoint.get_remote_address();
+                        info!(
+                            peer = %peer_id,
+                            remote_addr = %remote_addr,
+                            transport = addrs::transport_name(remote_addr),
+                            cause = ?cause,
+                            "Connection closed"
+                        );
+                        remove_peer(&registry, &peer_id).await;
+                        metrics.disconnected(remote_addr);
+                        transports.disconnected(remote_addr);
+                        conns.disconnected(connection_id);
+                        public_ips.disconnected(connection_id);
+                        let event = grpc::connection_event(false, &peer_id, remote_addr);
+                        let _ = admin_events.send(event);
+                        if num_established == 0 {
+                            reservations.disconnected(&peer_id);
+                            audit.disconnected(&peer_id, &traffic);
+                            spans.disconnected(&peer_id);
+                            relay_limits.disconnected(&peer_id);
+                            if let Some(quotas) = &quotas {
+                                quotas.disconnected(&peer_id);
+                            }
+                            publish_reservations(
+                                &reservations,
+                                &metrics,
+                                &reputation,
+                                &relay_limits,
+                                quotas.as_ref(),
+                                &webhook,
+                                &tiers,
+                            );
+                            if dialer.disconnected(&peer_id) {
+                                info!(peer = %peer_id, "Lost the connection to a peering relay, redialing");
+                            }
+                            if let Some(next) = dialer.next() {
+                                redial.as_mut().reset(next.into());
+                            }
+                        }
+                    }
+                    SwarmEvent::OutgoingConnectionError { peer_id: Some(peer), error, .. } => {
+                        if let Some(wait) = dialer.failed(&peer) {
+                            warn!(
+                                %peer,
+                                "Could not reach configured peer, retrying in {}: {error}",
+                                humantime::format_duration(wait)
+                            );
+                            if let Some(next) = dialer.next() {
+                                redial.as_mut().reset(next.into());
+                            }
+                        }
+                    }
+                    SwarmEvent::IncomingConnectionError {
+                        send_back_addr,
+                        error: ListenError::Denied { cause },
+                        ..
+                    } => {
+                        debug!(remote_addr = %send_back_addr, %cause, "Rejected incoming connection");
+                        metrics.denied();
+                    }
+                    _ => {}
+                }
+            }
+            _ = &mut redial, if dialer.next().is_some() => {
+                for (peer, addr) in dialer.due(Instant::now()) {
+                    debug!(%peer, %addr, "Dialing configured peer");
+                    if let Err(e) = swarm.dial(addr) {
+                        warn!(%peer, "Could not dial configured peer: {e}");
+                        dialer.failed(&peer);
+                    }
+                }
+                if let Some(next) = dialer.next() {
+                    redial.as_mut().reset(next.into());
+                }
+            }
+            _ = capacity_announcements.tick(), if config.capacity_topic.is_some() => {
+                let announcement = gossip::Announcement::new(
+                    local_peer_id,
+                    swarm.external_addresses(),
+                    reservations.capacity(config.capacity_granularity, draining),
+                    meter.headroom(&traffic, config.max_bandwidth),
+                );
+                if let (Some(gossip), Some(topic)) =
+                    (swarm.behaviour_mut().gossip.as_mut(), &config.capacity_topic)
+                {
+                    gossip::announce(gossip, topic, &announcement);
+                }
+            }
+            _ = cluster_sync.tick(), if cluster.is_some() => {
+                if let Some(cluster) = &cluster {
+                    let banned = bans.active().into_iter().map(|ban| ban.peer);
+                    cluster.publish(reservations.holders(), acl.denied(), banned);
+                }
+            }
+            _ = usage_exports.tick(), if billing.is_some() => {
+                if let Some(billing) = &mut billing {
+                    billing.export(&traffic);
+                }
+            }
+            _ = quota_checks.tick(), if quotas.is_some() => {
+                if let Some(quotas) = &quotas {
+                    for peer in quotas.credit() {
+                        let _ = swarm.disconnect_peer_id(peer);
+                    }
+                }
+            }
+            _ = reconcile.tick() => {
+                reputation.credit(&traffic);
+                reputation.save();
+                if let Some(billing) = &mut billing {
+                    billing.credit(&traffic);
+                }
+                if let Some(quotas) = &quotas {
+                    for peer in quotas.credit() {
+                        let _ = swarm.disconnect_peer_id(peer);
+                    }
+                    quotas.save();
+                }
+                traffic.prune();
+                bans.prune();
+                if let Some(tokens) = &tokens {
+                    tokens.prune();
+                }
+                webhook.prune();
+                metrics.set_banned(bans.active().len());
+                let fixed = reservations.reconcile(|peer| swarm.is_connected(peer));
+                metrics.repaired(fixed);
+                publish_reservations(
+                    &reservations,
+                    &metrics,
+                    &reputation,
+                    &relay_limits,
+                    quotas.as_ref(),
+                    &webhook,
+                    &tiers,
+                );
+                if fixed > 0 {
+                    warn!(
+                        "Repaired {fixed} reservation accounting discrepancies ({} total)",
+                        reservations.discrepancies()
+                    );
+                }
+            }
+            Some(new) = reloads.recv() => {
+                let reconcile_interval = config.reconcile_interval;
+                let capacity_interval = config.capacity_interval;
+                let cluster_sync_interval = config.cluster_sync_interval;
+                let usage_export_interval = config.usage_export_interval;
+                let peers = (config.bootstrap.clone(), config.peering.clone());
+                let dns = dns_settings(&config);
+                let ws_path = config.ws_path.clone();
+                let audit_log = audit_settings(&config);
+                let reachability_servers = config.reachability_servers.clone();
+                let dump = dump_settings(&config);
+                let export = export_settings(&config);
+                for setting in config.reload(new) {
+                    warn!(setting, "Setting changed but only takes effect after a restart");
+                }
+                if let Err(e) = acl
+                    .load(
+                        config.reservation_allowlist.as_deref(),
+                        config.reservation_denylist.as_deref(),
+                    )
+                    .await
+                {
+                    warn!("Keeping the previous reservation access lists: {e}");
+                }
+                if let (Some(quotas), Some(path)) = (&quotas, &config.api_keys) {
+                    quotas.set_paths(path, config.api_key_usage.as_deref());
+                    if let Err(e) = quotas.load().await {
+                        warn!("Keeping the previous API keys: {e}");
+                    }
+                }
+                if let Err(e) = tiers.load(&config).await {
+                    warn!("Keeping the previous trusted peers: {e}");
+                }
+                if let Err(e) = geoip.reload(config.geoip_db.as_deref()) {
+                    warn!("Keeping the previous GeoIP database: {e}");
+                }
+                reservation_policy.set(config.reservation_countries.clone());
+                relay_limits.set(Limits::from_config(&config));
+                reservations.set_max(config.max_reservations);
+                reputation.set_capacity(config.max_reservations, config.reserved_slots());
+                if let Err(e) = reputation.set_path(config.reputation_file.as_deref()).await {
+                    warn!("Keeping the previous reputation file: {e}");
+                }
+                if let Some(cluster) = &cluster {
+                    cluster.set_max_per_peer(config.max_reservations_per_peer);
+                }
+                swarm.behaviour_mut().gate = build_gate(&config, &geoip, gater.as_ref());
+                swarm.behaviour_mut().churn.set_limit(churn::Limit::from_config(&config));
+                swarm.behaviour_mut().handshakes.set_max(config.max_pending_handshakes);
+                swarm.behaviour_mut().limits.set_limits(connlimits::Limits::from_config(&config));
+                swarm.behaviour_mut().memory = memory_limit(&config);
+                ingress.set(&config);
+                alerts.set_webhook(config.alert_webhook.clone().map(|url| url.0));
+                webhook.set(&config);
+                notifier.set(&config);
+                if let (Some(token), Some(new)) = (&admin_token, &config.admin_token) {
+                    token.set(&new.0);
+                }
+                if let (Some(tokens), Some(secret)) = (&tokens, &config.reservation_token_secret) {
+                    tokens.set_secret(&secret.0);
+                }
+                if (config.bootstrap.clone(), config.peering.clone()) != peers {
+                    dialer.set(&config.bootstrap, &config.peering);
+                    if let Some(next) = dialer.next() {
+                        redial.as_mut().reset(next.into());
+                    }
+                }
+                bans.set_policy(abuse::Policy::from_config(&config));
+                conns.set_limits(config.conn_watermarks(), config.conn_grace);
+                throttle.set_limit(config.max_bandwidth);
+                if let Some(autonat) = swarm.behaviour_mut().autonat.as_mut() {
+                    autonat.set_limits(autonat_limits(&config));
+                }
+                if let Some(reachability) = swarm.behaviour_mut().reachability.as_mut() {
+                    let servers = &config.reachability_servers;
+                    reachability::set_servers(reachability, &reachability_servers, servers);
+                }
+                if config.ws_path != ws_path {
+                    relisten(&mut swarm, &mut listeners, listen::plan(&config));
+                }
+                announcer.set(&mut swarm, &config);
+                if audit_settings(&config) != audit_log
+                    && let Err(e) = audit.reopen(open_audit(&config)).await
+                {
+                    warn!("Audit log closed: {e}");
+                }
+                if dump_settings(&config) != dump {
+                    traffic.set_dumping(config.traffic_dump.is_some());
+                    dumping = start_dump(&config, &traffic);
+                }
+                if export_settings(&config) != export {
+                    billing = match billing.take() {
+                        Some(billing) => billing.reconfigure(&config, &traffic),
+                        None => Billing::from_config(&config, quotas.clone()),
+                    };
+                }
+                if dns_settings(&config) != dns {
+                    let known = ddns.take();
+                    ddns = start_ddns(&config, &alerts);
+                    if let (Some(known), Some(ddns)) = (known, &mut ddns) {
+                        known.hand_over(ddns);
+                    }
+                    publisher = start_dnsaddr(&config, &alerts);
+                    if let Some(publisher) = &publisher {
+                        let records = dnsaddr::records(local_peer_id, swarm.external_addresses());
+                        publisher.update(records);
+                    }
+                }
+                if config.capacity_interval != capacity_interval {
+                    capacity_announcements = time::interval(config.capacity_interval);
+                    capacity_announcements.set_missed_tick_behavior(time::MissedTickBehavior::Skip);
+                }
+                if config.reconcile_interval != reconcile_interval {
+                    reconcile = time::interval(config.reconcile_interval);
+                    reconcile.set_missed_tick_behavior(time::MissedTickBehavior::Skip);
+                }
+                if config.cluster_sync_interval != cluster_sync_interval {
+                    cluster_sync = time::interval(config.cluster_sync_interval);
+                    cluster_sync.set_missed_tick_behavior(time::MissedTickBehavior::Skip);
+                }
+                if config.usage_export_interval != usage_export_interval {
+                    usage_exports = time::interval(config.usage_export_interval);
+                    usage_exports.set_missed_tick_behavior(time::MissedTickBehavior::Skip);
+                }
+                info!("Reloaded configuration");
+            }
+            Some(pong) = pings.recv() => {
+                let _ = pong.send(());
+            }
+            Some(query) = routing_queries.recv() => {
+                if let Some(dht) = swarm.behaviour_mut().dht.as_mut() {
+                    lookups.start(dht, query);
+                }
+            }
+            Some(reply) = admin_queries.recv() => {
+                let _ = reply.send(admin::status(
+                    &swarm,
+                    started,
+                    &reservations,
+                    &circuits,
+                    &transports,
+                    &traffic,
+                    &cert_metrics,
+                    &metrics_registry,
+                    draining,
+                ));
+            }
+            Some(reply) = diagnostics_queries.recv() => {
+                let status = admin::status(
+                    &swarm,
+                    started,
+                    &reservations,
+                    &circuits,
+                    &transports,
+                    &traffic,
+                    &cert_metrics,
+                    &metrics_registry,
+                    draining,
+                );
+                let _ = reply.send(diagnostics::snapshot(
+                    status,
+                    &swarm,
+                    &config,
+                    &bans,
+                    &relay_limits,
+                ));
+            }
+            _ = &mut drain_started, if !draining => {
+                draining = true;
+                readiness.set(false);
+                capacity_announcements.reset_immediately();
+                if circuits.is_empty() {
+                    info!("Draining with no open circuits, shutting down");
+                    break;
+                }
+                let timeout = if graceful {
+                    config.shutdown_grace
+                } else {
+                    config.drain_timeout
+                };
+                info!(
+                    circuits = circuits.len(),
+                    "Draining: refusing new reservations and circuits for up to {}",
+                    humantime::format_duration(timeout)
+                );
+                drain_deadline.as_mut().reset(time::Instant::now() + timeout);
+            }
+            _ = &mut drain_deadline, if draining => {
+                let timeout = if graceful { "Shutdown grace" } else { "Drain timeout" };
+                warn!(
+                    circuits = circuits.len(),
+                    "{timeout} passed with circuits still open, shutting down"
+                );
+                break;
+            }
+            _ = &mut stop_requested, if !stopping => {
+                stopping = true;
+                readiness.set(false);
+                if !config.pre_stop_delay.is_zero() {
+                    info!(
+                        "Shutdown requested, failing readiness for {} before stopping",
+                        humantime::format_duration(config.pre_stop_delay)
+                    );
+                }
+                stop_deadline
+                    .as_mut()
+                    .reset(time::Instant::now() + config.pre_stop_delay);
+            }
+            _ = &mut unreachable_deadline, if unreachable.pending() => {
+                unreachable.reported();
+                let reason = format!(
+                    "AutoNAT servers have not been able to dial the relay for {}",
+                    humantime::format_duration(config.unreachable_after)
+                );
+                alerts.send("relay_unreachable", reason.clone());
+                if config.exit_when_unreachable {
+                    warn!("{reason}, shutting down");
+                    failure_tx.send_replace(Some(reason));
+                    break;
+                }
+            }
+            _ = &mut stop_deadline, if stopping && !graceful => {
+                if config.shutdown_grace.is_zero() {
+                    info!("Shutting down...");
+                    break;
+                }
+                graceful = true;
+                if !drain.start() {
+                    let deadline = time::Instant::now() + config.shutdown_grace;
+                    if deadline < drain_deadline.deadline() {
+                        drain_deadline.as_mut().reset(deadline);
+                    }
+                }
+            }
+        }
+    }
+
+    if let Some(billing) = &mut billing {
+        billing.close(&traffic).await;
+    }
+    drop(dumping);
+    if let Some(path) = &config.traffic_dump {
+        let dump = Dump::new(path.clone(), config.traffic_dump_format);
+        if let Err(e) = dump.write(&traffic).await {
+            warn!("Failed to write traffic dump to {}: {e}", path.display());
+        }
+    }
+    audit.close().await;
+    reputation.close().await;
+    if let Some(quotas) = &quotas {
+        quotas.close().await;
+    }
+    stopped_tx.send_replace(true);
+    Ok(())
+}
+
+/// Get or load the WebSocket TLS certificate, if one is configured, and
+/// keep it renewed and reloaded in the background.
+async fn start_tls(
+    config: &Config,
+    metrics: &CertMetrics,
+    alerts: &Alerts,
+    notifier: &Notifier,
+) -> Result<Option<watch::Receiver<tls::Config>>, StartupError> {
+    if let Some(domain) = &config.domain {
+        start_acme(domain, config, metrics, alerts).await?;
+    }
+    let Some(files) = config.cert_files() else {
+        return Ok(None);
+    };
+    let (loaded, expires) = files
+        .load()
+        .await
+        .map_err(|e| StartupError::certificate(&files.cert, e))?;
+    metrics.loaded(expires);
+    let (certs_tx, certs) = watch::channel(loaded);
+    tokio::spawn(files.watch(
+        certs_tx,
+        expires,
+        metrics.clone(),
+        alerts.clone(),
+        notifier.clone(),
+    ));
+    Ok(Some(certs))
+}
+
+/// Obtain the --domain certificate unless a cached one is still good, and
+/// keep it renewed in the background. The relay only fails to start when
+/// there is no unexpired certificate to start with.
+async fn start_acme(
+    domain: &str,
+    config: &Config,
+    metrics: &CertMetrics,
+    alerts: &Alerts,
+) -> Result<(), StartupError> {
+    let token = config.cloudflare_api_token.clone().map(|t| t.0).unwrap_or_default();
+    let acme = Acme::new(
+        domain.to_string(),
+        config.acme_directory.clone(),
+        config.acme_email.clone(),
+        Cloudflare::new(token),
+        config.acme_cache.clone(),
+        (config.acme_storage == AcmeStorage::Consul)
+            .then(|| Consul::from_env(&config.acme_consul_prefix)),
+    );
+    if let Err(e) = acme.ensure().await {
+        if !acme.cached().await {
+            let cert = acme::cert_files(&config.acme_cache, &config.acme_directory, domain).cert;
+            return Err(StartupError::certificate(&cert, e));
+        }
+        metrics.renewal_failed();
+        let text = format!("Could not renew the certificate for {domain}: {e}");
+        warn!("{text}; starting with the cached one");
+        alerts.send("certificate_renewal_failed", text);
+    }
+    tokio::spawn(acme.renew(metrics.clone(), alerts.clone()));
+    Ok(())
+}
+
+/// Keep --external-dns pointed at the public IPs peers agree on, if a
+/// provider is configured.
+fn start_ddns(config: &Config, alerts: &Alerts) -> Option<Ddns> {
+    let name = config.external_dns.clone()?;
+    let provider = ddns::Provider::from_config(config)?;
+    info!(%name, "Keeping DNS pointed at the relay's public IPs");
+    Some(Ddns::spawn(
+        provider,
+        name,
+        alerts.clone(),
+        config.check_reachability,
+    ))
+}
+
+async fn open_audit(config: &Config) -> io::Result<AuditLog> {
+    let Some(path) = &config.audit_log else {
+        return Ok(AuditLog::disabled());
+    };
+    AuditLog::open(
+        path,
+        config.audit_log_max_bytes,
+        config.audit_log_keep,
+        config.audit_log_retention,
+    )
+    .await
+}
+
+fn audit_settings(config: &Config) -> impl PartialEq {
+    (
+        config.audit_log.clone(),
+        config.audit_log_max_bytes,
+        config.audit_log_keep,
+        config.audit_log_retention,
+    )
+}
+
+/// Dump per-peer traffic every --traffic-dump-interval if --traffic-dump is
+/// set, until the returned handle is dropped.
+fn start_dump(config: &Config, traffic: &PeerTraffic) -> Option<oneshot::Sender<()>> {
+    let path = config.traffic_dump.clone()?;
+    info!("Dumping per-peer traffic to {}", path.display());
+    let (stop, stopped) = oneshot::channel();
+    let dump = Dump::new(path, config.traffic_dump_format);
+    tokio::spawn(dump.run(traffic.clone(), config.traffic_dump_interval, stopped));
+    Some(stop)
+}
+
+fn dump_settings(config: &Config) -> impl PartialEq {
+    (
+        config.traffic_dump.clone(),
+        config.traffic_dump_interval,
+        config.traffic_dump_format,
+    )
+}
+
+fn export_settings(config: &Config) -> impl PartialEq {
+    (
+        config.usage_export.clone(),
+        config.usage_export_webhook.clone(),
+        config.usage_export_format,
+    )
+}
+
+/// Move the listeners over to `plan`. New addresses are listened on before
+/// the old ones close, so a port both use stays bound throughout.
+fn relisten<B: NetworkBehaviour>(
+    swarm: &mut Swarm<B>,
+    listeners: &mut HashMap<Multiaddr, ListenerId>,
+    plan: Vec<Multiaddr>,
+) {
+    for addr in plan.iter().filter(|addr| !listeners.contains_key(addr)) {
+        match startup::listen_on(swarm, addr.clone()) {
+            Ok(id) => {
+                listeners.insert(addr.clone(), id);
+            }
+            Err(e) => warn!(%addr, "Could not listen on a reloaded address: {e}"),
+        }
+    }
+    let stale: Vec<Multiaddr> = listeners
+        .keys()
+        .filter(|addr| !plan.contains(addr))
+        .cloned()
+        .collect();
+    for addr in stale {
+        if let Some(id) = listeners.remove(&addr) {
+            swarm.remove_listener(id);
+        }
+    }
+}
+
+/// What the DNS updaters are started with, to tell when a reload must
+/// restart them.
+fn dns_settings(config: &Config) -> impl PartialEq {
+    (
+        config.external_dns.clone(),
+        config.dnsaddr.clone(),
+        config.ddns_provider,
+        config.cloudflare_api_token.clone(),
+        config.route53_zone_id.clone(),
+        config.ddns_server.clone(),
+        config.ddns_zone.clone(),
+        config.ddns_tsig_key.clone(),
+    )
+}
+
+/// Publish the announced addresses under --dnsaddr as they change, if set.
+fn start_dnsaddr(config: &Config, alerts: &Alerts) -> Option<Publisher> {
+    let name = config.dnsaddr.clone()?;
+    let provider = ddns::Provider::from_config(config)?;
+    info!(%name, "Publishing the announced addresses as dnsaddr records");
+    Some(Publisher::spawn(provider, name, alerts.clone()))
+}
+
+/// Connection gate for the configured IP ranges and connection country
+/// policy, ahead of an embedder's gater.
+fn build_gate(
+    config: &Config,
+    geoip: &Arc<GeoIp>,
+    gater: Option<&Arc<dyn Gater>>,
+) -> gate::Behaviour {
+    let mut gate = gate::Behaviour::new(config.allow_cidrs.clone(), config.deny_cidrs.clone());
+    if let Some(gater) = gater {
+        gate = gate.with_gater(gater.clone());
+    }
+    if config.connection_countries.is_empty() {
+        return gate;
+    }
+    gate.with_countries(geoip.clone(), config.connection_countries.clone())
+}
+
+/// Meter the streams of every connection, whatever the transport, and
+/// disturb them when faults are injected.
+fn streams<M>(
+    traffic: &PeerTraffic,
+) -> impl FnOnce((PeerId, M), ConnectedPoint) -> (PeerId, Faulty<MeteredMuxer<M>>) + Clone {
+    let traffic = traffic.clone();
+    move |(peer, muxer), _| (peer, faults::muxer(peer, traffic.muxer(peer, muxer)))
+}
+
+type UnixTransport = OptionalTransport<Boxed<(PeerId, StreamMuxerBox)>>;
+
+/// Unix domain sockets, for --unix-socket and /unix listen addresses.
+#[cfg(unix)]
+fn unix_transport(
+    key: &identity::Keypair,
+    config: &Config,
+    swarm_key: Option<PreSharedKey>,
+    muxer: yamux::Config,
+    traffic: &PeerTraffic,
+) -> Result<UnixTransport, Box<dyn Error + Send + Sync>> {
+    let unix = uds::TokioUdsConfig::new()
+        .map(|socket, _| socket.compat())
+        .and_then(move |socket, _| psk::handshake(socket, swarm_key))
+        .upgrade(upgrade::Version::V1Lazy)
+        .authenticate(Security::new(key, &config.security)?)
+        .multiplex(muxer)
+        .map(streams(traffic))
+        .map(|(peer, muxer), _| (peer, StreamMuxerBox::new(muxer)))
+        .boxed();
+    Ok(OptionalTransport::some(unix))
+}
+
+/// No Unix sockets off Unix, where validation refuses --unix-socket.
+#[cfg(not(unix))]
+fn unix_transport(
+    _key: &identity::Keypair,
+    _config: &Config,
+    _swarm_key: Option<PreSharedKey>,
+    _muxer: yamux::Config,
+    _traffic: &PeerTraffic,
+) -> Result<UnixTransport, Box<dyn Error + Send + Sync>> {
+    Ok(OptionalTransport::none())
+}
+
+fn memory_limit(config: &Config) -> Toggle<memory_connection_limits::Behaviour> {
+    config
+        .max_memory_bytes
+        .map(memory_connection_limits::Behaviour::with_max_bytes)
+        .into()
+}
+
+fn autonat_limits(config: &Config) -> autonat::Limits {
+    autonat::Limits {
+        per_peer: config.autonat_peer_limit,
+        global: config.autonat_global_limit,
+        period: config.autonat_limit_period,
+    }
+}
+
+fn quic_config(key: &identity::Keypair, config: &Config) -> quic::Config {
+    let mut quic = quic::Config::new(key);
+    quic.max_idle_timeout = config.quic_idle_timeout.as_millis().try_into().unwrap_or(u32::MAX);
+    quic.keep_alive_interval = config.quic_keep_alive;
+    quic.max_concurrent_stream_limit = config.quic_max_streams.try_into().unwrap_or(u32::MAX);
+    quic
+}
+
+/// Count `offence` against `peer`, disconnecting it if that earns a ban.
+fn strike(
+    swarm: &mut Swarm<Behaviour>,
+    bans: &Bans,
+    reputation: &Reputation,
+    metrics: &Metrics,
+    notifier: &Notifier,
+    peer: PeerId,
+    offence: Offence,
+) {
+    let Some(duration) = bans.strike(peer, offence) else {
+        return;
+    };
+    warn!(
+        %peer,
+        offence = offence.as_str(),
+        "Banning peer for {}",
+        humantime::format_duration(duration)
+    );
+    metrics.banned(offence);
+    reputation.violated(peer);
+    notifier.send(
+        NotifyEvent::PeerBanned,
+        format!(
+            "Banned peer {peer} for {} for {}",
+            humantime::format_duration(duration),
+            offence.as_str()
+        ),
+        json!({
+            "peer_id": peer.to_string(),
+            "offence": offence.as_str(),
+            "duration_secs": duration.as_secs(),
+        }),
+    );
+    let _ = swarm.disconnect_peer_id(peer);
+}
+
+/// Hand the reservations now held to everything that counts or limits
+/// them.
+fn publish_reservations(
+    reservations: &Reservations,
+    metrics: &Metrics,
+    reputation: &Reputation,
+    relay_limits: &RelayLimits,
+    quotas: Option<&Quotas>,
+    webhook: &Webhook,
+    tiers: &Tiers,
+) {
+    metrics.set_reservations(reservations.active());
+    reputation.set_reservations(reservations.holders());
+    relay_limits.set_reservations(reservations.holders());
+    if let Some(quotas) = quotas {
+        quotas.set_reservations(reservations.holders());
+    }
+    webhook.set_reservations(reservations.holders());
+    tiers.set_reservations(reservations.holders());
+}
+
+/// Check `request` against --api-keys and --reservation-token-secret,
+/// accepting it only once it satisfies each that is set.
+fn authenticate(
+    peer: PeerId,
+    request: &AuthRequest,
+    quotas: Option<&Quotas>,
+    tokens: Option<&Tokens>,
+) -> AuthResponse {
+    if let Some(quotas) = quotas {
+        let Some(key) = &request.api_key else {
+            return AuthResponse::refused("no API key presented");
+        };
+        let response = quotas.authorize(peer, key);
+        if !response.accepted || tokens.is_none() {
+            return response;
+        }
+    }
+    match tokens {
+        Some(tokens) => tokens.authorize(peer, request),
+        None => AuthResponse::refused("the relay takes no credentials"),
+    }
+}
+
+/// Log reservation and circuit lifecycle events with the peers involved.
+fn log_relay_event(event: &relay::Event) {
+    match event {
+        relay::Event::ReservationReqAccepted {
+            src_peer_id,
+            renewed: false,
+        } => info!(peer = %src_peer_id, "Relay reservation accepted"),
+        relay::Event::ReservationReqAccepted { src_peer_id, .. } => {
+            debug!(peer = %src_peer_id, "Relay reservation renewed")
+        }
+        relay::Event::ReservationReqDenied { src_peer_id, .. } => {
+            warn!(peer = %src_peer_id, "Relay reservation denied")
+        }
+        relay::Event::ReservationTimedOut { src_peer_id } => {
+            debug!(peer = %src_peer_id, "Relay reservation timed out")
+        }
+        relay::Event::CircuitReqAccepted {
+            src_peer_id,
+            dst_peer_id,
+        } => info!(src = %src_peer_id, dst = %dst_peer_id, "Circuit opened"),
+        relay::Event::CircuitReqDenied {
+            src_peer_id,
+            dst_peer_id,
+            ..
+        } => warn!(src = %src_peer_id, dst = %dst_peer_id, "Circuit denied"),
+        relay::Event::CircuitClosed {
+            src_peer_id,
+            dst_peer_id,
+            error,
+        } => info!(src = %src_peer_id, dst = %dst_peer_id, error = ?error, "Circuit closed"),
+        _ => {}
+    }
+}
+
+fn log_ip_change(change: &IpChange) {
+    match change.old {
+        Some(old) => warn!(%old, new = %change.new, "Public IP changed, re-announcing addresses"),
+        None => info!(ip = %change.new, "Peers see the relay at public IP {}", change.new),
+    }
+}
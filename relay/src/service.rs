@@ -0,0 +1,142 @@
+//! Running unattended as a Windows service. `service install` registers the
+//! relay with the service manager to start at boot as `service run` with
+//! the same configuration flags, and the manager's stop and shutdown
+//! controls stop it the way SIGTERM does on Unix. The service starts in
+//! the system directory, so paths in its configuration should be absolute.
+
+use std::{env, ffi::OsString, sync::OnceLock, time::Duration};
+
+use sunset_relay::startup::StartupError;
+use windows_service::{
+    define_windows_service,
+    service::{
+        ServiceAccess, ServiceControl, ServiceControlAccept, ServiceErrorControl, ServiceExitCode,
+        ServiceInfo, ServiceStartType, ServiceState, ServiceStatus, ServiceType,
+    },
+    service_control_handler::{self, ServiceControlHandlerResult, ServiceStatusHandle},
+    service_dispatcher,
+    service_manager::{ServiceManager, ServiceManagerAccess},
+};
+
+use crate::{ConfigArgs, shutdown};
+
+const SERVICE_NAME: &str = "sunset-relay";
+const DISPLAY_NAME: &str = "Sunset relay";
+const DESCRIPTION: &str = "libp2p circuit relay with room-based peer discovery";
+
+/// Handed from [`run`] to the service's main function, which the service
+/// manager calls without arguments of ours.
+static ARGS: OnceLock<ConfigArgs> = OnceLock::new();
+
+define_windows_service!(ffi_service_main, service_main);
+
+/// Register the service to run this executable with the configuration
+/// flags `service install` was given.
+pub fn install() -> Result<(), StartupError> {
+    let error = |e| StartupError::service("install the Windows service", e);
+    let manager = ServiceManager::local_computer(
+        None::<&str>,
+        ServiceManagerAccess::CONNECT | ServiceManagerAccess::CREATE_SERVICE,
+    )
+    .map_err(error)?;
+    let executable_path =
+        env::current_exe().map_err(|e| StartupError::service("install the Windows service", e))?;
+    let mut launch_arguments = vec![OsString::from("service"), OsString::from("run")];
+    launch_arguments.extend(env::args_os().skip_while(|arg| arg != "install").skip(1));
+    let info = ServiceInfo {
+        name: SERVICE_NAME.into(),
+        display_name: DISPLAY_NAME.into(),
+        service_type: ServiceType::OWN_PROCESS,
+        start_type: ServiceStartType::AutoStart,
+        error_control: ServiceErrorControl::Normal,
+        executable_path,
+        launch_arguments,
+        dependencies: Vec::new(),
+        account_name: None,
+        account_password: None,
+    };
+    let service = manager
+        .create_service(&info, ServiceAccess::CHANGE_CONFIG)
+        .map_err(error)?;
+    service.set_description(DESCRIPTION).map_err(error)?;
+    println!("Installed the {SERVICE_NAME} service; start it with `sc start {SERVICE_NAME}`");
+    Ok(())
+}
+
+/// Stop the service if it is running and remove it.
+pub fn uninstall() -> Result<(), StartupError> {
+    let error = |e| StartupError::service("uninstall the Windows service", e);
+    let manager = ServiceManager::local_computer(None::<&str>, ServiceManagerAccess::CONNECT)
+        .map_err(error)?;
+    let access = ServiceAccess::QUERY_STATUS | ServiceAccess::STOP | ServiceAccess::DELETE;
+    let service = manager.open_service(SERVICE_NAME, access).map_err(error)?;
+    service.delete().map_err(error)?;
+    if service.query_status().map_err(error)?.current_state != ServiceState::Stopped {
+        service.stop().map_err(error)?;
+    }
+    println!("Removed the {SERVICE_NAME} service");
+    Ok(())
+}
+
+/// Hand the process to the service manager, which calls back into
+/// [`service_main`] and returns once the service has stopped.
+pub fn run(args: ConfigArgs) -> Result<(), StartupError> {
+    let _ = ARGS.set(args);
+    service_dispatcher::start(SERVICE_NAME, ffi_service_main)
+        .map_err(|e| StartupError::service("start as a Windows service", e))
+}
+
+fn service_main(_arguments: Vec<OsString>) {
+    let Some(args) = ARGS.get() else {
+        return;
+    };
+    let status = match register() {
+        Ok(status) => status,
+        Err(e) => {
+            e.report();
+            return;
+        }
+    };
+    set_state(status, ServiceState::Running, ServiceExitCode::Win32(0));
+    let runtime = tokio::runtime::Runtime::new().expect("failed to start the Tokio runtime");
+    let exit_code = match runtime.block_on(crate::start(args.clone())) {
+        Ok(()) => ServiceExitCode::Win32(0),
+        Err(e) => {
+            e.report();
+            ServiceExitCode::ServiceSpecific(1)
+        }
+    };
+    set_state(status, ServiceState::Stopped, exit_code);
+}
+
+/// Listen for the service manager's controls, stopping the relay on stop
+/// and on system shutdown.
+fn register() -> Result<ServiceStatusHandle, StartupError> {
+    let handler = |control| match control {
+        ServiceControl::Stop | ServiceControl::Shutdown => {
+            shutdown::request();
+            ServiceControlHandlerResult::NoError
+        }
+        ServiceControl::Interrogate => ServiceControlHandlerResult::NoError,
+        _ => ServiceControlHandlerResult::NotImplemented,
+    };
+    service_control_handler::register(SERVICE_NAME, handler)
+        .map_err(|e| StartupError::service("register with the service manager", e))
+}
+
+fn set_state(status: ServiceStatusHandle, state: ServiceState, exit_code: ServiceExitCode) {
+    let controls_accepted = if state == ServiceState::Running {
+        ServiceControlAccept::STOP | ServiceControlAccept::SHUTDOWN
+    } else {
+        ServiceControlAccept::empty()
+    };
+    let _ = status.set_service_status(ServiceStatus {
+        service_type: ServiceType::OWN_PROCESS,
+        current_state: state,
+        controls_accepted,
+        exit_code,
+        checkpoint: 0,
+        wait_hint: Duration::ZERO,
+        process_id: None,
+    });
+}
@@ -0,0 +1,48 @@
+use sunset_relay::Relay;
+use tokio::{signal, sync::Notify};
+
+static REQUESTED: Notify = Notify::const_new();
+
+/// Stop the relay as if signalled, for the Windows service manager, which
+/// does not send signals.
+#[cfg(windows)]
+pub fn request() {
+    REQUESTED.notify_one();
+}
+
+/// Resolve once the process is asked to stop via SIGINT, SIGTERM or
+/// [`request`].
+pub async fn signal() {
+    tokio::select! {
+        _ = signal::ctrl_c() => {}
+        _ = terminate() => {}
+        _ = REQUESTED.notified() => {}
+    }
+}
+
+#[cfg(unix)]
+async fn terminate() {
+    signal::unix::signal(signal::unix::SignalKind::terminate())
+        .expect("failed to install SIGTERM handler")
+        .recv()
+        .await;
+}
+
+#[cfg(not(unix))]
+async fn terminate() {
+    std::future::pending::<()>().await
+}
+
+/// Drain the relay whenever the process receives SIGUSR2. SIGUSR1 dumps
+/// the relay's state instead.
+#[cfg(unix)]
+pub async fn drain_on_signal(relay: Relay) {
+    let mut usr2 = signal::unix::signal(signal::unix::SignalKind::user_defined2())
+        .expect("failed to install SIGUSR2 handler");
+    while usr2.recv().await.is_some() {
+        relay.drain();
+    }
+}
+
+#[cfg(not(unix))]
+pub async fn drain_on_signal(_relay: Relay) {}
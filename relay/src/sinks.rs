@@ -0,0 +1,124 @@
+//! `--log-target syslog` and `journald`: log lines handed to the local
+//! syslog daemon or the systemd journal, so they join standard Linux log
+//! pipelines. Both map tracing levels to the same priorities: ERROR to err,
+//! WARN to warning, INFO to info, and DEBUG and TRACE to debug.
+
+use std::{
+    io::{self, Write},
+    os::unix::net::UnixDatagram,
+    process,
+    sync::Arc,
+};
+
+use tracing::{Level, Metadata};
+use tracing_journald::{Priority, PriorityMappings};
+use tracing_subscriber::fmt::MakeWriter;
+
+const IDENTIFIER: &str = "sunset-relay";
+
+pub const JOURNALD_SOCKET: &str = "/run/systemd/journal/socket";
+
+/// Where syslog daemons listen: Linux, then macOS.
+pub const SYSLOG_SOCKETS: [&str; 2] = ["/dev/log", "/var/run/syslog"];
+
+/// RFC 5424 facility for system daemons.
+const FACILITY_DAEMON: u8 = 3;
+
+pub fn journald() -> io::Result<tracing_journald::Layer> {
+    Ok(tracing_journald::layer()?
+        .with_syslog_identifier(IDENTIFIER.to_string())
+        .with_priority_mappings(PriorityMappings {
+            error: Priority::Error,
+            warn: Priority::Warning,
+            info: Priority::Informational,
+            debug: Priority::Debug,
+            trace: Priority::Debug,
+        }))
+}
+
+/// Log lines sent to the syslog daemon as one datagram each, in the
+/// `<PRI>TAG: MESSAGE` form the local socket accepts. The daemon adds the
+/// timestamp and hostname.
+#[derive(Clone)]
+pub struct Syslog {
+    socket: Arc<UnixDatagram>,
+    tag: String,
+}
+
+impl Syslog {
+    pub fn connect() -> io::Result<Self> {
+        let socket = UnixDatagram::unbound()?;
+        let mut error = None;
+        for path in SYSLOG_SOCKETS {
+            match socket.connect(path) {
+                Ok(()) => {
+                    return Ok(Self {
+                        socket: Arc::new(socket),
+                        tag: format!("{IDENTIFIER}[{}]", process::id()),
+                    });
+                }
+                Err(e) => error = Some(e),
+            }
+        }
+        Err(error.unwrap_or_else(|| io::ErrorKind::NotFound.into()))
+    }
+
+    fn message(&self, level: Level) -> Message<'_> {
+        Message {
+            syslog: self,
+            priority: FACILITY_DAEMON * 8 + severity(level),
+            line: Vec::new(),
+        }
+    }
+}
+
+impl<'a> MakeWriter<'a> for Syslog {
+    type Writer = Message<'a>;
+
+    fn make_writer(&'a self) -> Self::Writer {
+        self.message(Level::INFO)
+    }
+
+    fn make_writer_for(&'a self, meta: &Metadata<'_>) -> Self::Writer {
+        self.message(*meta.level())
+    }
+}
+
+/// One log line, sent when dropped.
+pub struct Message<'a> {
+    syslog: &'a Syslog,
+    priority: u8,
+    line: Vec<u8>,
+}
+
+impl Write for Message<'_> {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        self.line.extend_from_slice(buf);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+impl Drop for Message<'_> {
+    fn drop(&mut self) {
+        let line = self.line.trim_ascii_end();
+        if line.is_empty() {
+            return;
+        }
+        let mut datagram = format!("<{}>{}: ", self.priority, self.syslog.tag).into_bytes();
+        datagram.extend_from_slice(line);
+        let _ = self.syslog.socket.send(&datagram);
+    }
+}
+
+fn severity(level: Level) -> u8 {
+    match level {
+        Level::ERROR => 3,
+        Level::WARN => 4,
+        Level::INFO => 6,
+        _ => 7,
+    }
+}
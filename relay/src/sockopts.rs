@@ -0,0 +1,65 @@
+//! Socket options for the relay's TCP and WebSocket connections. Keepalive
+//! probes let a relay carrying many long-lived idle circuits notice a peer
+//! that vanished without closing its connection. There is no switch for
+//! SO_REUSEPORT: libp2p always sets it on listeners, as dialing out from the
+//! listen port needs it.
+
+use std::time::Duration;
+
+use libp2p::tcp;
+use socket2::{SockRef, TcpKeepalive};
+use tokio::net::TcpStream;
+use tracing::debug;
+
+use crate::config::Config;
+
+#[derive(Debug, Clone, Copy)]
+pub struct SocketOptions {
+    nodelay: bool,
+    keepalive: Option<Duration>,
+}
+
+impl SocketOptions {
+    pub fn new(config: &Config) -> Self {
+        Self {
+            nodelay: config.tcp_nodelay,
+            keepalive: config.tcp_keepalive,
+        }
+    }
+
+    /// The settings for sockets libp2p opens itself, for dials.
+    pub fn tcp_config(&self) -> tcp::Config {
+        tcp::Config::default().nodelay(self.nodelay)
+    }
+
+    /// Tune a connected socket. Failures only cost the tuning, so they are
+    /// logged and the connection kept.
+    pub fn apply(&self, stream: &TcpStream) {
+        if let Err(e) = stream.set_nodelay(self.nodelay) {
+            debug!("Could not set TCP_NODELAY: {e}");
+        }
+        let Some(idle) = self.keepalive else {
+            return;
+        };
+        let keepalive = TcpKeepalive::new().with_time(idle).with_interval(idle);
+        // Drop the peer after three unanswered probes where the count can be
+        // set; elsewhere the system count applies.
+        #[cfg(any(
+            target_os = "android",
+            target_os = "dragonfly",
+            target_os = "freebsd",
+            target_os = "fuchsia",
+            target_os = "illumos",
+            target_os = "ios",
+            target_os = "linux",
+            target_os = "macos",
+            target_os = "netbsd",
+            target_os = "tvos",
+            target_os = "watchos",
+        ))]
+        let keepalive = keepalive.with_retries(3);
+        if let Err(e) = SockRef::from(stream).set_tcp_keepalive(&keepalive) {
+            debug!("Could not enable TCP keepalive: {e}");
+        }
+    }
+}
@@ -0,0 +1,81 @@
+use std::collections::HashMap;
+
+use libp2p::{PeerId, relay};
+use tracing::{Span, debug, info_span};
+
+/// Long-lived spans covering each reservation and circuit from acceptance
+/// until it ends, so their lifetimes show up in traces.
+#[derive(Default)]
+pub struct RelaySpans {
+    reservations: HashMap<PeerId, Span>,
+    circuits: HashMap<(PeerId, PeerId), Vec<Span>>,
+}
+
+impl RelaySpans {
+    pub fn relay_event(&mut self, event: &relay::Event) {
+        match event {
+            relay::Event::ReservationReqAccepted {
+                src_peer_id,
+                renewed,
+            } => {
+                let span = self
+                    .reservations
+                    .entry(*src_peer_id)
+                    .or_insert_with(|| info_span!("reservation", peer = %src_peer_id));
+                span.in_scope(|| debug!(renewed, "Reservation accepted"));
+            }
+            relay::Event::ReservationReqDenied { src_peer_id, .. } => {
+                info_span!("reservation", peer = %src_peer_id)
+                    .in_scope(|| debug!("Reservation denied"));
+            }
+            relay::Event::ReservationTimedOut { src_peer_id } => {
+                if let Some(span) = self.reservations.remove(src_peer_id) {
+                    span.in_scope(|| debug!("Reservation timed out"));
+                }
+            }
+            relay::Event::CircuitReqAccepted {
+                src_peer_id,
+                dst_peer_id,
+            } => {
+                let span = info_span!("circuit", src = %src_peer_id, dst = %dst_peer_id);
+                span.in_scope(|| debug!("Circuit accepted"));
+                self.circuits
+                    .entry((*src_peer_id, *dst_peer_id))
+                    .or_default()
+                    .push(span);
+            }
+            relay::Event::CircuitReqDenied {
+                src_peer_id,
+                dst_peer_id,
+                ..
+            } => {
+                info_span!("circuit", src = %src_peer_id, dst = %dst_peer_id)
+                    .in_scope(|| debug!("Circuit denied"));
+            }
+            relay::Event::CircuitClosed {
+                src_peer_id,
+                dst_peer_id,
+                error,
+            } => {
+                let key = (*src_peer_id, *dst_peer_id);
+                let Some(spans) = self.circuits.get_mut(&key) else {
+                    return;
+                };
+                if let Some(span) = spans.pop() {
+                    span.in_scope(|| debug!(error = ?error, "Circuit closed"));
+                }
+                if spans.is_empty() {
+                    self.circuits.remove(&key);
+                }
+            }
+            _ => {}
+        }
+    }
+
+    /// End the reservation span of a peer whose last connection closed.
+    pub fn disconnected(&mut self, peer: &PeerId) {
+        if let Some(span) = self.reservations.remove(peer) {
+            span.in_scope(|| debug!("Reservation holder disconnected"));
+        }
+    }
+}
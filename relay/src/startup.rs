@@ -0,0 +1,381 @@
+use std::{
+    error::Error,
+    fmt, io,
+    path::{Path, PathBuf},
+};
+
+use libp2p::{
+    Multiaddr, Swarm, TransportError,
+    core::transport::ListenerId,
+    swarm::NetworkBehaviour,
+};
+use tracing::error;
+
+use crate::{config::ConfigError, faults};
+
+/// Why the relay could not start, and what it was doing at the time.
+#[derive(Debug)]
+pub enum StartupError {
+    Config(ConfigError),
+    PortInUse(String),
+    PermissionDenied(String),
+    InvalidMultiaddr(Multiaddr),
+    ListenConflict {
+        first: Multiaddr,
+        second: Multiaddr,
+        socket: String,
+    },
+    Listen {
+        addr: String,
+        source: io::Error,
+    },
+    Transport {
+        transport: &'static str,
+        source: Box<dyn Error + Send + Sync>,
+    },
+    Identity {
+        from: String,
+        source: Box<dyn Error + Send + Sync>,
+    },
+    Open {
+        what: &'static str,
+        path: PathBuf,
+        source: io::Error,
+    },
+    Telemetry {
+        endpoint: String,
+        source: Box<dyn Error + Send + Sync>,
+    },
+    PeerList {
+        path: PathBuf,
+        source: Box<dyn Error + Send + Sync>,
+    },
+    ApiKeys {
+        path: PathBuf,
+        source: Box<dyn Error + Send + Sync>,
+    },
+    Database {
+        path: PathBuf,
+        source: Box<dyn Error + Send + Sync>,
+    },
+    Certificate {
+        path: PathBuf,
+        source: Box<dyn Error + Send + Sync>,
+    },
+    Dns {
+        name: String,
+        source: Box<dyn Error + Send + Sync>,
+    },
+    SwarmKey {
+        path: PathBuf,
+        source: Box<dyn Error + Send + Sync>,
+    },
+    Admin {
+        url: String,
+        source: Box<dyn Error + Send + Sync>,
+    },
+    IdentityInUse(PathBuf),
+    Service {
+        action: &'static str,
+        source: Box<dyn Error + Send + Sync>,
+    },
+}
+
+impl StartupError {
+    pub fn bind(addr: impl fmt::Display, source: io::Error) -> Self {
+        let addr = addr.to_string();
+        match os_error_kind(&source) {
+            Some(io::ErrorKind::AddrInUse) => Self::PortInUse(addr),
+            Some(io::ErrorKind::PermissionDenied) => Self::PermissionDenied(addr),
+            _ => Self::Listen { addr, source },
+        }
+    }
+
+    pub fn transport(
+        transport: &'static str,
+        source: impl Into<Box<dyn Error + Send + Sync>>,
+    ) -> Self {
+        Self::Transport {
+            transport,
+            source: source.into(),
+        }
+    }
+
+    pub fn identity(
+        from: impl fmt::Display,
+        source: impl Into<Box<dyn Error + Send + Sync>>,
+    ) -> Self {
+        Self::Identity {
+            from: from.to_string(),
+            source: source.into(),
+        }
+    }
+
+    pub fn peer_list(path: &Path, source: impl Into<Box<dyn Error + Send + Sync>>) -> Self {
+        Self::PeerList {
+            path: path.to_path_buf(),
+            source: source.into(),
+        }
+    }
+
+    pub fn api_keys(path: &Path, source: impl Into<Box<dyn Error + Send + Sync>>) -> Self {
+        Self::ApiKeys {
+            path: path.to_path_buf(),
+            source: source.into(),
+        }
+    }
+
+    pub fn database(path: &Path, source: impl Into<Box<dyn Error + Send + Sync>>) -> Self {
+        Self::Database {
+            path: path.to_path_buf(),
+            source: source.into(),
+        }
+    }
+
+    pub fn certificate(path: &Path, source: impl Into<Box<dyn Error + Send + Sync>>) -> Self {
+        Self::Certificate {
+            path: path.to_path_buf(),
+            source: source.into(),
+        }
+    }
+
+    pub fn dns(name: impl fmt::Display, source: impl Into<Box<dyn Error + Send + Sync>>) -> Self {
+        Self::Dns {
+            name: name.to_string(),
+            source: source.into(),
+        }
+    }
+
+    pub fn swarm_key(path: &Path, source: impl Into<Box<dyn Error + Send + Sync>>) -> Self {
+        Self::SwarmKey {
+            path: path.to_path_buf(),
+            source: source.into(),
+        }
+    }
+
+    pub fn admin(url: impl fmt::Display, source: impl Into<Box<dyn Error + Send + Sync>>) -> Self {
+        Self::Admin {
+            url: url.to_string(),
+            source: source.into(),
+        }
+    }
+
+    pub fn service(action: &'static str, source: impl Into<Box<dyn Error + Send + Sync>>) -> Self {
+        Self::Service {
+            action,
+            source: source.into(),
+        }
+    }
+
+    pub fn open(what: &'static str, path: &Path, source: io::Error) -> Self {
+        Self::Open {
+            what,
+            path: path.to_path_buf(),
+            source,
+        }
+    }
+
+    fn reason(&self) -> &'static str {
+        match self {
+            Self::Config(_) => "invalid_config",
+            Self::PortInUse(_) => "port_in_use",
+            Self::PermissionDenied(_) => "permission_denied",
+            Self::InvalidMultiaddr(_) => "invalid_multiaddr",
+            Self::ListenConflict { .. } => "listen_conflict",
+            Self::Listen { .. } => "listen_failed",
+            Self::Transport { .. } => "transport_init",
+            Self::Identity { .. } => "identity",
+            Self::Open { .. } => "open_failed",
+            Self::Telemetry { .. } => "telemetry",
+            Self::PeerList { .. } => "peer_list",
+            Self::ApiKeys { .. } => "api_keys",
+            Self::Database { .. } => "geoip_database",
+            Self::Certificate { .. } => "tls_certificate",
+            Self::Dns { .. } => "dns_update",
+            Self::SwarmKey { .. } => "swarm_key",
+            Self::Admin { .. } => "admin_api",
+            Self::IdentityInUse(_) => "identity_in_use",
+            Self::Service { .. } => "service",
+        }
+    }
+
+    fn hint(&self) -> &'static str {
+        match self {
+            Self::Config(_) => "fix the reported setting in the --config file or its flag",
+            Self::PortInUse(_) => {
+                "another process is bound to this port; stop it or pick a different --port"
+            }
+            Self::PermissionDenied(_) => {
+                "ports below 1024 need CAP_NET_BIND_SERVICE or root; pick a higher --port"
+            }
+            Self::InvalidMultiaddr(_) => {
+                "no configured transport accepts this address; check its protocols and order"
+            }
+            Self::ListenConflict { .. } => {
+                "each transport binds its own socket; give them different ports or disable one"
+            }
+            Self::Listen { .. } => {
+                "check that the address is assigned to this host and is not firewalled"
+            }
+            Self::Transport { .. } => {
+                "the transport could not be initialised; re-run with RUST_LOG=debug for details"
+            }
+            Self::Identity { .. } => {
+                "make sure --identity points at a readable, writable file, or --identity-env or --identity-stdin supplies a libp2p key"
+            }
+            Self::Open { .. } => "check that the parent directory exists and is writable",
+            Self::Telemetry { .. } => {
+                "--otel-endpoint must be an OTLP/gRPC URL such as http://localhost:4317"
+            }
+            Self::PeerList { .. } => "list one PeerID per line; anything after # is a comment",
+            Self::ApiKeys { .. } => {
+                "--api-keys takes TOML [[keys]] tables, each with a unique name and key"
+            }
+            Self::Database { .. } => {
+                "point --geoip-db at a GeoLite2-Country or GeoIP2-Country .mmdb file"
+            }
+            Self::Certificate { .. } => {
+                "--tls-cert takes a PEM certificate chain and --tls-key its PEM private key"
+            }
+            Self::Dns { .. } => {
+                "check that the --ddns-provider credentials may edit records in the zone"
+            }
+            Self::SwarmKey { .. } => {
+                "--psk takes a swarm.key: /key/swarm/psk/1.0.0/, /base16/ and 64 hex digits, one per line"
+            }
+            Self::Admin { .. } => {
+                "check that the relay is running with --admin-token set to the same token"
+            }
+            Self::IdentityInUse(_) => {
+                "relays sharing an identity steal each other's clients; stop the other one or give this one its own --identity"
+            }
+            Self::Service { .. } => {
+                "installing or removing the service needs Administrator rights, and `service run` only works when the service manager starts it"
+            }
+        }
+    }
+
+    /// Log the failure with its category and a remediation hint.
+    pub fn report(&self) {
+        error!(
+            reason = self.reason(),
+            hint = self.hint(),
+            "Failed to start relay: {self}"
+        );
+    }
+}
+
+impl fmt::Display for StartupError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::Config(e) => write!(f, "{e}"),
+            Self::PortInUse(addr) => write!(f, "{addr} is already in use"),
+            Self::PermissionDenied(addr) => write!(f, "permission denied binding {addr}"),
+            Self::InvalidMultiaddr(addr) => write!(f, "unsupported listen address {addr}"),
+            Self::ListenConflict {
+                first,
+                second,
+                socket,
+            } => write!(f, "{first} and {second} would both bind {socket}"),
+            Self::Listen { addr, source } => write!(f, "could not listen on {addr}: {source}"),
+            Self::Transport { transport, source } => {
+                write!(f, "could not initialise {transport} transport: {source}")
+            }
+            Self::Identity { from, source } => {
+                write!(f, "could not load identity from {from}: {source}")
+            }
+            Self::Open { what, path, source } => {
+                write!(f, "could not open {what} {}: {source}", path.display())
+            }
+            Self::Telemetry { endpoint, source } => {
+                write!(f, "could not export traces to {endpoint}: {source}")
+            }
+            Self::PeerList { path, source } => {
+                write!(f, "could not load peer list {}: {source}", path.display())
+            }
+            Self::ApiKeys { path, source } => {
+                write!(f, "could not load API keys {}: {source}", path.display())
+            }
+            Self::Database { path, source } => {
+                write!(f, "could not open GeoIP database {}: {source}", path.display())
+            }
+            Self::Certificate { path, source } => {
+                write!(f, "could not load TLS certificate {}: {source}", path.display())
+            }
+            Self::Dns { name, source } => write!(f, "could not update {name}: {source}"),
+            Self::SwarmKey { path, source } => {
+                write!(f, "could not load swarm key {}: {source}", path.display())
+            }
+            Self::Admin { url, source } => {
+                write!(f, "could not reach the admin API at {url}: {source}")
+            }
+            Self::IdentityInUse(path) => {
+                write!(f, "another relay is already running with identity {}", path.display())
+            }
+            Self::Service { action, source } => write!(f, "could not {action}: {source}"),
+        }
+    }
+}
+
+impl Error for StartupError {
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
+        match self {
+            Self::Config(e) => Some(e),
+            Self::Listen { source, .. } | Self::Open { source, .. } => Some(source),
+            Self::Transport { source, .. }
+            | Self::Identity { source, .. }
+            | Self::Telemetry { source, .. }
+            | Self::PeerList { source, .. }
+            | Self::ApiKeys { source, .. }
+            | Self::Database { source, .. }
+            | Self::Certificate { source, .. }
+            | Self::Dns { source, .. }
+            | Self::SwarmKey { source, .. }
+            | Self::Admin { source, .. }
+            | Self::Service { source, .. } => Some(source.as_ref()),
+            _ => None,
+        }
+    }
+}
+
+/// Start listening on `addr`, classifying bind failures.
+pub fn listen_on<B: NetworkBehaviour>(
+    swarm: &mut Swarm<B>,
+    addr: Multiaddr,
+) -> Result<ListenerId, StartupError> {
+    if let Err(source) = faults::check_listen(&addr) {
+        return Err(StartupError::bind(addr, source));
+    }
+    match swarm.listen_on(addr.clone()) {
+        Ok(id) => Ok(id),
+        Err(TransportError::MultiaddrNotSupported(addr)) => {
+            Err(StartupError::InvalidMultiaddr(addr))
+        }
+        Err(TransportError::Other(source)) => Err(StartupError::bind(addr, source)),
+    }
+}
+
+/// Find the OS-level cause of an error that may have been boxed by the
+/// transport stack. Some wrappers only forward `Display`, so the message is
+/// checked as a last resort.
+fn os_error_kind(err: &io::Error) -> Option<io::ErrorKind> {
+    let mut current: Option<&(dyn Error + 'static)> = Some(err);
+    while let Some(e) = current {
+        if let Some(io) = e.downcast_ref::<io::Error>() {
+            if io.kind() != io::ErrorKind::Other {
+                return Some(io.kind());
+            }
+            current = io.get_ref().map(|inner| inner as &(dyn Error + 'static));
+            continue;
+        }
+        current = e.source();
+    }
+    let message = err.to_string();
+    if message.contains("Address already in use") {
+        return Some(io::ErrorKind::AddrInUse);
+    }
+    if message.contains("Permission denied") {
+        return Some(io::ErrorKind::PermissionDenied);
+    }
+    None
+}
@@ -0,0 +1,68 @@
+//! Readiness and watchdog notifications for systemd `Type=notify` units.
+//! Everything here does nothing unless systemd started the relay.
+
+use std::time::Duration;
+
+use sunset_relay::Relay;
+use tokio::time;
+use tracing::{debug, warn};
+
+#[cfg(unix)]
+fn notify(state: sd_notify::NotifyState) {
+    if let Err(e) = sd_notify::notify(false, &[state]) {
+        debug!("Failed to notify systemd: {e}");
+    }
+}
+
+/// Tell systemd the relay is up and listening.
+#[cfg(unix)]
+pub fn ready() {
+    notify(sd_notify::NotifyState::Ready);
+}
+
+/// Tell systemd the relay is shutting down.
+#[cfg(unix)]
+pub fn stopping() {
+    notify(sd_notify::NotifyState::Stopping);
+}
+
+/// How often to ping the watchdog, at half the unit's `WatchdogSec`, if
+/// it has one.
+#[cfg(unix)]
+pub fn watchdog_interval() -> Option<Duration> {
+    let mut usec = 0;
+    sd_notify::watchdog_enabled(false, &mut usec).then(|| Duration::from_micros(usec) / 2)
+}
+
+#[cfg(unix)]
+fn ping() {
+    notify(sd_notify::NotifyState::Watchdog);
+}
+
+#[cfg(not(unix))]
+pub fn ready() {}
+
+#[cfg(not(unix))]
+pub fn stopping() {}
+
+#[cfg(not(unix))]
+pub fn watchdog_interval() -> Option<Duration> {
+    None
+}
+
+#[cfg(not(unix))]
+fn ping() {}
+
+/// Ping the watchdog for as long as the event loop answers liveness checks,
+/// so systemd restarts a relay whose swarm has stopped making progress.
+pub async fn watchdog(relay: Relay, interval: Duration) {
+    let mut ticks = time::interval(interval);
+    loop {
+        ticks.tick().await;
+        if relay.is_alive().await {
+            ping();
+        } else {
+            warn!("Event loop missed a liveness check, withholding the systemd watchdog ping");
+        }
+    }
+}
@@ -0,0 +1,189 @@
+use std::sync::Mutex;
+
+use opentelemetry::{KeyValue, trace::TracerProvider as _};
+use opentelemetry_otlp::{SpanExporter, WithExportConfig};
+use opentelemetry_sdk::{Resource, trace::SdkTracerProvider};
+use tracing::warn;
+use tracing_subscriber::{
+    EnvFilter, Layer, Registry,
+    fmt::{MakeWriter, writer::BoxMakeWriter},
+    layer::{Layered, SubscriberExt},
+    reload,
+    util::SubscriberInitExt,
+};
+
+use sunset_relay::{
+    config::{Config, LogFormat, LogTarget, Output},
+    startup::StartupError,
+};
+
+use crate::logfile::LogFile;
+
+const SERVICE_NAME: &str = "sunset-relay";
+
+/// The layer log lines leave the process through.
+type Sink = Box<dyn Layer<Layered<reload::Layer<EnvFilter, Registry>, Registry>> + Send + Sync>;
+
+/// Handle to the trace exporter, flushed on [`Telemetry::shutdown`], and to
+/// the log filter, which can be swapped while running.
+pub struct Telemetry {
+    provider: Option<SdkTracerProvider>,
+    filter: reload::Handle<EnvFilter, Registry>,
+}
+
+impl Telemetry {
+    /// Install the global subscriber: log lines to --log-file or
+    /// --log-target, in the configured format, plus OTLP span export when
+    /// `config` names a collector. Logging is set up even if the exporter or
+    /// log sink fails, so the returned error can still be reported.
+    pub fn init(config: Option<&Config>) -> Result<Self, StartupError> {
+        let mut provider = None;
+        let mut error = None;
+        if let Some((endpoint, config)) = config.and_then(|c| Some((c.otel_endpoint.as_ref()?, c)))
+        {
+            match build_provider(endpoint, config) {
+                Ok(p) => provider = Some(p),
+                Err(source) => {
+                    error = Some(StartupError::Telemetry {
+                        endpoint: endpoint.clone(),
+                        source,
+                    })
+                }
+            }
+        }
+
+        let otel = provider
+            .as_ref()
+            .map(|p| tracing_opentelemetry::layer().with_tracer(p.tracer(SERVICE_NAME)));
+        let level = config.and_then(|c| c.log_level.as_deref());
+        let (filter, handle) = reload::Layer::new(filter(level));
+        let _ = tracing_subscriber::registry()
+            .with(filter)
+            .with(sink(config, &mut error))
+            .with(otel)
+            .try_init();
+
+        match error {
+            Some(e) => Err(e),
+            None => Ok(Self {
+                provider,
+                filter: handle,
+            }),
+        }
+    }
+
+    /// Switch to a new log level or filter directive.
+    pub fn set_log_level(&self, level: Option<&str>) {
+        if let Err(e) = self.filter.reload(filter(level)) {
+            warn!("Failed to change log level: {e}");
+        }
+    }
+
+    /// Export any spans still buffered.
+    pub fn shutdown(self) {
+        if let Some(provider) = self.provider {
+            if let Err(e) = provider.shutdown() {
+                warn!("Failed to flush trace spans: {e}");
+            }
+        }
+    }
+}
+
+/// --log-file, else --log-target. A sink that cannot be opened falls back
+/// to stdout, and says why in `error`.
+fn sink(config: Option<&Config>, error: &mut Option<StartupError>) -> Sink {
+    let format = config.map(|c| c.log_format).unwrap_or_default();
+    if let Some((path, config)) = config.and_then(|c| Some((c.log_file.as_ref()?, c))) {
+        match LogFile::open(path, config) {
+            Ok(file) => return fmt(format, true, false, Mutex::new(file)),
+            Err(e) => {
+                error.get_or_insert(StartupError::open("log file", path, e));
+            }
+        }
+    }
+    let target = config.map(|c| c.log_target).unwrap_or_default();
+    if target != LogTarget::Stdout {
+        match system_sink(target, format) {
+            Ok(sink) => return sink,
+            Err(e) => {
+                error.get_or_insert(e);
+            }
+        }
+    }
+    if config.is_some_and(|c| c.output == Output::Json) {
+        fmt(format, true, true, std::io::stderr)
+    } else {
+        fmt(format, true, true, std::io::stdout)
+    }
+}
+
+#[cfg(unix)]
+fn system_sink(target: LogTarget, format: LogFormat) -> Result<Sink, StartupError> {
+    use std::path::Path;
+
+    use crate::sinks;
+
+    if target == LogTarget::Journald {
+        let socket = Path::new(sinks::JOURNALD_SOCKET);
+        return sinks::journald()
+            .map(Layer::boxed)
+            .map_err(|e| StartupError::open("journald socket", socket, e));
+    }
+    let socket = Path::new(sinks::SYSLOG_SOCKETS[0]);
+    sinks::Syslog::connect()
+        .map(|syslog| fmt(format, false, false, syslog))
+        .map_err(|e| StartupError::open("syslog socket", socket, e))
+}
+
+#[cfg(not(unix))]
+fn system_sink(_target: LogTarget, _format: LogFormat) -> Result<Sink, StartupError> {
+    unreachable!("configuration validation keeps --log-target to stdout off Unix")
+}
+
+/// Log lines in `format` written to `writer`, with timestamps unless the
+/// sink adds its own, and colour only on stdout and stderr.
+fn fmt<W>(format: LogFormat, timestamps: bool, ansi: bool, writer: W) -> Sink
+where
+    W: for<'a> MakeWriter<'a> + Send + Sync + 'static,
+{
+    let fmt = tracing_subscriber::fmt::layer()
+        .with_ansi(ansi)
+        .with_writer(BoxMakeWriter::new(writer));
+    match (format, timestamps) {
+        (LogFormat::Text, true) => fmt.boxed(),
+        (LogFormat::Text, false) => fmt.without_time().boxed(),
+        (LogFormat::Json, true) => fmt.json().boxed(),
+        (LogFormat::Json, false) => fmt.json().without_time().boxed(),
+    }
+}
+
+/// The given filter, else `RUST_LOG`, else `info`.
+fn filter(level: Option<&str>) -> EnvFilter {
+    match level {
+        Some(level) => EnvFilter::new(level),
+        None => EnvFilter::try_from_default_env().unwrap_or_else(|_| EnvFilter::new("info")),
+    }
+}
+
+fn build_provider(
+    endpoint: &str,
+    config: &Config,
+) -> Result<SdkTracerProvider, Box<dyn std::error::Error + Send + Sync>> {
+    let exporter = SpanExporter::builder()
+        .with_tonic()
+        .with_endpoint(endpoint)
+        .build()?;
+    let resource = Resource::builder()
+        .with_service_name(SERVICE_NAME)
+        .with_attributes(
+            config
+                .otel_resource_attributes
+                .iter()
+                .map(|(key, value)| KeyValue::new(key.clone(), value.clone())),
+        )
+        .build();
+    Ok(SdkTracerProvider::builder()
+        .with_batch_exporter(exporter)
+        .with_resource(resource)
+        .build())
+}
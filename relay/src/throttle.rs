@@ -0,0 +1,237 @@
+use std::{
+    fmt,
+    pin::Pin,
+    str::FromStr,
+    sync::{Arc, Mutex},
+    task::{Context, Poll, ready},
+    time::{Duration, Instant},
+};
+
+use serde::Deserialize;
+use tokio::time::{self, Sleep};
+
+/// A throughput such as `50Mbps`, in bits per second with SI prefixes.
+#[derive(Clone, Copy, PartialEq, Eq, Deserialize)]
+#[serde(try_from = "String")]
+pub struct Bandwidth {
+    bits_per_sec: u64,
+}
+
+impl Bandwidth {
+    pub fn bytes_per_sec(&self) -> u64 {
+        self.bits_per_sec / 8
+    }
+}
+
+impl FromStr for Bandwidth {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let s = s.trim();
+        let split = s
+            .find(|c: char| !c.is_ascii_digit() && c != '.')
+            .unwrap_or(s.len());
+        let (number, unit) = s.split_at(split);
+        let number: f64 = number
+            .parse()
+            .map_err(|_| format!("{s:?} does not start with a number"))?;
+        let scale = match unit.trim() {
+            "bps" => 1.0,
+            "kbps" | "Kbps" => 1e3,
+            "Mbps" => 1e6,
+            "Gbps" => 1e9,
+            _ => return Err(format!("{s:?} needs a unit of bps, kbps, Mbps or Gbps")),
+        };
+        let bits_per_sec = (number * scale) as u64;
+        if bits_per_sec < 8 {
+            return Err(format!("{s:?} is below one byte per second"));
+        }
+        Ok(Self { bits_per_sec })
+    }
+}
+
+impl TryFrom<String> for Bandwidth {
+    type Error = String;
+
+    fn try_from(s: String) -> Result<Self, Self::Error> {
+        s.parse()
+    }
+}
+
+impl fmt::Display for Bandwidth {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let bits = self.bits_per_sec;
+        match bits {
+            _ if bits % 1_000_000_000 == 0 => write!(f, "{}Gbps", bits / 1_000_000_000),
+            _ if bits % 1_000_000 == 0 => write!(f, "{}Mbps", bits / 1_000_000),
+            _ if bits % 1_000 == 0 => write!(f, "{}kbps", bits / 1_000),
+            _ => write!(f, "{bits}bps"),
+        }
+    }
+}
+
+impl fmt::Debug for Bandwidth {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        fmt::Display::fmt(self, f)
+    }
+}
+
+/// Token bucket that lets a short burst through and then paces to `rate`.
+/// Bytes are debited after they have moved, so the balance can go negative
+/// by one buffer and the next caller waits it out. A rate of zero is
+/// unlimited.
+struct Bucket {
+    rate: f64,
+    burst: f64,
+    tokens: f64,
+    updated: Instant,
+}
+
+impl Bucket {
+    fn new(limit: Option<Bandwidth>) -> Self {
+        let rate = limit.map_or(0.0, |limit| limit.bytes_per_sec() as f64);
+        let burst = (rate / 10.0).max(16.0 * 1024.0);
+        Self {
+            rate,
+            burst,
+            tokens: burst,
+            updated: Instant::now(),
+        }
+    }
+
+    /// How long to wait before more bytes may move, if at all.
+    fn wait(&mut self) -> Option<Duration> {
+        if self.rate == 0.0 {
+            return None;
+        }
+        let now = Instant::now();
+        let elapsed = now.duration_since(self.updated).as_secs_f64();
+        self.tokens = (self.tokens + elapsed * self.rate).min(self.burst);
+        self.updated = now;
+        if self.tokens > 0.0 {
+            return None;
+        }
+        Some(Duration::from_secs_f64(-self.tokens / self.rate).max(Duration::from_millis(1)))
+    }
+
+    fn debit(&mut self, bytes: usize) {
+        if self.rate != 0.0 {
+            self.tokens -= bytes as f64;
+        }
+    }
+}
+
+/// One aggregate cap for everything the relay receives and another, equal
+/// one for everything it sends. Connections over the cap are slowed down
+/// through backpressure rather than closed. Without a limit nothing is
+/// held back, and one can be set later.
+#[derive(Clone)]
+pub struct Throttle {
+    inbound: Arc<Mutex<Bucket>>,
+    outbound: Arc<Mutex<Bucket>>,
+}
+
+impl Throttle {
+    pub fn new(limit: Option<Bandwidth>) -> Self {
+        Self {
+            inbound: Arc::new(Mutex::new(Bucket::new(limit))),
+            outbound: Arc::new(Mutex::new(Bucket::new(limit))),
+        }
+    }
+
+    pub fn set_limit(&self, limit: Option<Bandwidth>) {
+        *self.inbound.lock().unwrap() = Bucket::new(limit);
+        *self.outbound.lock().unwrap() = Bucket::new(limit);
+    }
+
+    pub fn inbound(&self) -> Pacer {
+        Pacer::new(self.inbound.clone())
+    }
+
+    pub fn outbound(&self) -> Pacer {
+        Pacer::new(self.outbound.clone())
+    }
+}
+
+/// A single stream's view of one direction of a [`Throttle`].
+pub struct Pacer {
+    bucket: Arc<Mutex<Bucket>>,
+    sleep: Option<Pin<Box<Sleep>>>,
+}
+
+impl Pacer {
+    fn new(bucket: Arc<Mutex<Bucket>>) -> Self {
+        Self {
+            bucket,
+            sleep: None,
+        }
+    }
+
+    /// Ready once the shared budget allows more bytes to move.
+    pub fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<()> {
+        loop {
+            if let Some(sleep) = &mut self.sleep {
+                ready!(sleep.as_mut().poll(cx));
+                self.sleep = None;
+            }
+            match self.bucket.lock().unwrap().wait() {
+                None => return Poll::Ready(()),
+                Some(delay) => self.sleep = Some(Box::pin(time::sleep(delay))),
+            }
+        }
+    }
+
+    pub fn consumed(&self, bytes: usize) {
+        self.bucket.lock().unwrap().debit(bytes);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn bandwidth(s: &str) -> Bandwidth {
+        s.parse().unwrap()
+    }
+
+    #[test]
+    fn bandwidth_display_round_trips() {
+        for (given, shown) in [
+            ("50Mbps", "50Mbps"),
+            ("1Gbps", "1Gbps"),
+            ("1000Mbps", "1Gbps"),
+            ("1.5Mbps", "1500kbps"),
+            ("64Kbps", "64kbps"),
+            (" 12bps ", "12bps"),
+        ] {
+            let parsed = bandwidth(given);
+            assert_eq!(parsed.to_string(), shown);
+            assert_eq!(bandwidth(shown), parsed);
+        }
+        assert_eq!(bandwidth("8Mbps").bytes_per_sec(), 1_000_000);
+    }
+
+    #[test]
+    fn bandwidth_needs_a_number_and_a_unit() {
+        for bad in ["fast", "Mbps", "10", "10MBps", "7bps"] {
+            assert!(bad.parse::<Bandwidth>().is_err(), "{bad}");
+        }
+    }
+
+    #[test]
+    fn unlimited_bucket_never_waits() {
+        let mut bucket = Bucket::new(None);
+        bucket.debit(usize::MAX);
+        assert_eq!(bucket.wait(), None);
+    }
+
+    #[test]
+    fn bucket_waits_out_an_overdraft() {
+        let mut bucket = Bucket::new(Some(bandwidth("8Mbps")));
+        assert_eq!(bucket.wait(), None);
+        bucket.debit(100_000 + 500_000);
+        let wait = bucket.wait().unwrap();
+        assert!(wait > Duration::from_millis(400), "{wait:?}");
+        assert!(wait <= Duration::from_millis(500), "{wait:?}");
+    }
+}
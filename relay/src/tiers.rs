@@ -0,0 +1,170 @@
+//! Reservation priority classes. Peers in --trusted-peers are trusted, as
+//! are those whose token or API key names the trusted tier; other peers
+//! that presented a token or key are in the default tier, and the rest are
+//! anonymous. Slots held for a tier under --max-reservations stay free for
+//! it until its peers take them, and the lower tiers can each be held to a
+//! shared bandwidth cap so the rest of --max-bandwidth is left to the tiers
+//! above them.
+
+use std::{
+    collections::HashSet,
+    sync::{Arc, RwLock},
+    time::Instant,
+};
+
+use libp2p::{Multiaddr, PeerId, relay};
+use serde::Deserialize;
+use tracing::{debug, info};
+
+use crate::{
+    acl::read_peers, auth::Tokens, config::Config, quota::Quotas, startup::StartupError,
+    throttle::Throttle, traffic::PeerTraffic,
+};
+
+/// What the tier bandwidth caps are set on peers as.
+const KIND: &str = "tier";
+
+/// Reservation priority, lowest first.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Tier {
+    /// Peers without a token or API key
+    Anonymous,
+    /// Peers with a token or API key that names no tier
+    Default,
+    Trusted,
+}
+
+#[derive(Default)]
+struct Shared {
+    max_reservations: usize,
+    trusted: HashSet<PeerId>,
+    reserved_trusted: usize,
+    reserved_default: usize,
+    /// Reservations held, in all and by trusted and default peers
+    active: usize,
+    held_trusted: usize,
+    held_default: usize,
+    held: HashSet<PeerId>,
+}
+
+/// Plugged into the relay as a reservation rate limiter. Clones share the
+/// tier settings and who holds what, which the event loop keeps current.
+#[derive(Clone)]
+pub struct Tiers {
+    tokens: Option<Tokens>,
+    quotas: Option<Quotas>,
+    traffic: PeerTraffic,
+    default_cap: Throttle,
+    anonymous_cap: Throttle,
+    shared: Arc<RwLock<Shared>>,
+}
+
+impl Tiers {
+    pub fn new(
+        config: &Config,
+        tokens: Option<Tokens>,
+        quotas: Option<Quotas>,
+        traffic: PeerTraffic,
+    ) -> Self {
+        Self {
+            tokens,
+            quotas,
+            traffic,
+            default_cap: Throttle::new(config.tier_bandwidth_default),
+            anonymous_cap: Throttle::new(config.tier_bandwidth_anonymous),
+            shared: Arc::default(),
+        }
+    }
+
+    /// Apply the tier settings and re-read --trusted-peers. On error the
+    /// current trusted peers are kept.
+    pub async fn load(&self, config: &Config) -> Result<(), StartupError> {
+        self.default_cap.set_limit(config.tier_bandwidth_default);
+        self.anonymous_cap
+            .set_limit(config.tier_bandwidth_anonymous);
+        {
+            let mut shared = self.shared.write().unwrap();
+            shared.max_reservations = config.max_reservations;
+            shared.reserved_trusted = config.tier_reserved_trusted;
+            shared.reserved_default = config.tier_reserved_default;
+        }
+        let trusted = match &config.trusted_peers {
+            Some(path) => {
+                let peers = read_peers(path).await?;
+                info!("Trusting {} peers for reservations", peers.len());
+                peers
+            }
+            None => HashSet::new(),
+        };
+        self.shared.write().unwrap().trusted = trusted;
+        Ok(())
+    }
+
+    /// The tier `peer` is in right now, the highest any source grants it.
+    pub fn tier(&self, peer: &PeerId) -> Tier {
+        if self.shared.read().unwrap().trusted.contains(peer) {
+            return Tier::Trusted;
+        }
+        let by_key = self.quotas.as_ref().and_then(|quotas| quotas.tier(peer));
+        let by_token = self.tokens.as_ref().and_then(|tokens| tokens.tier(peer));
+        by_key.max(by_token).unwrap_or(Tier::Anonymous)
+    }
+
+    /// Hold `peer` to its tier's bandwidth cap, as it connects and again
+    /// whenever it presents credentials.
+    pub fn classify(&self, peer: PeerId) {
+        let cap = match self.tier(&peer) {
+            Tier::Trusted => None,
+            Tier::Default => Some(self.default_cap.clone()),
+            Tier::Anonymous => Some(self.anonymous_cap.clone()),
+        };
+        self.traffic.throttle_peer(peer, KIND, cap);
+    }
+
+    /// Count the reservations held in each tier, and who holds any, whose
+    /// renewals are always let through.
+    pub fn set_reservations<'a>(&self, holders: impl IntoIterator<Item = (&'a PeerId, usize)>) {
+        let holders: Vec<(PeerId, usize, Tier)> = holders
+            .into_iter()
+            .map(|(peer, count)| (*peer, count, self.tier(peer)))
+            .collect();
+        let mut shared = self.shared.write().unwrap();
+        shared.held.clear();
+        shared.active = 0;
+        shared.held_trusted = 0;
+        shared.held_default = 0;
+        for (peer, count, tier) in holders {
+            shared.held.insert(peer);
+            shared.active += count;
+            match tier {
+                Tier::Trusted => shared.held_trusted += count,
+                Tier::Default => shared.held_default += count,
+                Tier::Anonymous => {}
+            }
+        }
+    }
+}
+
+impl relay::RateLimiter for Tiers {
+    fn try_next(&mut self, peer: PeerId, _addr: &Multiaddr, _now: Instant) -> bool {
+        let tier = self.tier(&peer);
+        let shared = self.shared.read().unwrap();
+        if shared.held.contains(&peer) {
+            return true;
+        }
+        let for_trusted = shared.reserved_trusted.saturating_sub(shared.held_trusted);
+        let for_default = shared.reserved_default.saturating_sub(shared.held_default);
+        let held_back = match tier {
+            Tier::Trusted => 0,
+            Tier::Default => for_trusted,
+            Tier::Anonymous => for_trusted + for_default,
+        };
+        let free = shared.max_reservations.saturating_sub(shared.active);
+        if free > held_back {
+            return true;
+        }
+        debug!(%peer, ?tier, free, "Reservation refused: remaining slots are held for higher tiers");
+        false
+    }
+}
@@ -0,0 +1,195 @@
+//! WebSocket over TLS with a certificate from PEM files, for operators who
+//! already have one, such as a wildcard certificate. The files are polled
+//! and a renewed certificate is used for new connections without a restart,
+//! while one close to expiry raises an alert.
+
+use std::{
+    error::Error,
+    io,
+    path::{Path, PathBuf},
+    pin::Pin,
+    task::{Context, Poll},
+    time::{Duration, SystemTime},
+};
+
+use libp2p::{
+    Multiaddr,
+    core::transport::{DialOpts, ListenerId, Transport, TransportError, TransportEvent},
+    dns, tcp,
+    websocket::{self, tls},
+};
+use serde_json::json;
+use tokio::{fs, sync::watch, time};
+use tracing::{info, warn};
+
+use crate::{
+    alert::Alerts, config::NotifyEvent, faults, forwarded::Forwarded, ingress::Ingress,
+    metrics::CertMetrics, notify::Notifier, proxy::ProxyProtocol,
+};
+
+const POLL_INTERVAL: Duration = Duration::from_secs(30);
+/// Alert once the certificate has less than this left, which ACME renewal
+/// would have prevented at 30 days.
+const ALERT_BEFORE: Duration = Duration::from_secs(14 * 24 * 60 * 60);
+
+type Inner = websocket::Config<dns::tokio::Transport<Forwarded<ProxyProtocol>>>;
+
+/// The certificate chain and private key files to serve WebSocket over TLS with.
+#[derive(Clone)]
+pub struct CertFiles {
+    pub cert: PathBuf,
+    pub key: PathBuf,
+}
+
+impl CertFiles {
+    /// Read and parse both files, returning the TLS config and when the
+    /// certificate expires.
+    pub async fn load(&self) -> Result<(tls::Config, Option<i64>), Box<dyn Error + Send + Sync>> {
+        faults::check_cert()?;
+        let cert = fs::read(&self.cert).await?;
+        let key = fs::read(&self.key).await?;
+        let certs = rustls_pemfile::certs(&mut cert.as_slice())
+            .map(|cert| cert.map(|cert| tls::Certificate::new(cert.to_vec())))
+            .collect::<Result<Vec<_>, _>>()?;
+        if certs.is_empty() {
+            return Err(format!("no certificates in {}", self.cert.display()).into());
+        }
+        let key = rustls_pemfile::private_key(&mut key.as_slice())?
+            .ok_or_else(|| format!("no private key in {}", self.key.display()))?;
+        let config = tls::Config::new(tls::PrivateKey::new(key.secret_der().to_vec()), certs)?;
+        Ok((config, not_after(&cert)))
+    }
+
+    /// Reload the certificate into `certs` whenever either file changes,
+    /// starting from one that expires at `expires`. A certificate that fails
+    /// to load is reported and the last good one stays in use.
+    pub async fn watch(
+        self,
+        certs: watch::Sender<tls::Config>,
+        mut expires: Option<i64>,
+        metrics: CertMetrics,
+        alerts: Alerts,
+        notifier: Notifier,
+    ) {
+        let mut seen = self.modified().await;
+        let mut alerted = None;
+        let mut ticks = time::interval(POLL_INTERVAL);
+        ticks.tick().await;
+        while !certs.is_closed() {
+            ticks.tick().await;
+            let modified = self.modified().await;
+            if modified != seen {
+                seen = modified;
+                match self.load().await {
+                    Ok((config, not_after)) => {
+                        certs.send_replace(config);
+                        expires = not_after;
+                        metrics.loaded(not_after);
+                        info!("Reloaded TLS certificate from {}", self.cert.display());
+                        notifier.send(
+                            NotifyEvent::CertificateRenewed,
+                            format!(
+                                "Loaded a renewed TLS certificate from {}",
+                                self.cert.display()
+                            ),
+                            json!({ "cert": self.cert, "not_after": not_after }),
+                        );
+                    }
+                    Err(e) => warn!("Keeping the current TLS certificate: {e}"),
+                }
+            }
+            if alerted != expires && expires.is_some_and(expiring) {
+                alerted = expires;
+                let text = format!(
+                    "TLS certificate {} expires in under {}",
+                    self.cert.display(),
+                    humantime::format_duration(ALERT_BEFORE)
+                );
+                alerts.send("certificate_expiring", text);
+            }
+        }
+    }
+
+    async fn modified(&self) -> (Option<SystemTime>, Option<SystemTime>) {
+        (modified(&self.cert).await, modified(&self.key).await)
+    }
+}
+
+/// When the first certificate in a PEM chain expires, as a Unix time.
+pub fn not_after(pem: &[u8]) -> Option<i64> {
+    let (_, pem) = x509_parser::pem::parse_x509_pem(pem).ok()?;
+    Some(pem.parse_x509().ok()?.validity().not_after.timestamp())
+}
+
+fn expiring(not_after: i64) -> bool {
+    let now = SystemTime::UNIX_EPOCH.elapsed().unwrap_or_default();
+    not_after < (now + ALERT_BEFORE).as_secs() as i64
+}
+
+async fn modified(path: &Path) -> Option<SystemTime> {
+    fs::metadata(path).await.ok()?.modified().ok()
+}
+
+/// WebSocket transport, over TLS too when given certificates. It takes a
+/// new certificate from the watch before handling the next connection. The
+/// client address is taken from PROXY headers and then `X-Forwarded-For`
+/// from the trusted proxies given for each, if any.
+pub struct Wss {
+    inner: Inner,
+    certs: Option<watch::Receiver<tls::Config>>,
+}
+
+impl Wss {
+    pub fn new(certs: Option<watch::Receiver<tls::Config>>, ingress: Ingress) -> io::Result<Self> {
+        let tcp = tcp::tokio::Transport::new(ingress.sockets().tcp_config());
+        let tcp = ProxyProtocol::new(tcp, ingress.clone());
+        let tcp = dns::tokio::Transport::system(Forwarded::new(tcp, ingress))?;
+        let mut inner = websocket::Config::new(tcp);
+        if let Some(certs) = &certs {
+            inner.set_tls_config(certs.borrow().clone());
+        }
+        Ok(Self { inner, certs })
+    }
+}
+
+impl Transport for Wss {
+    type Output = <Inner as Transport>::Output;
+    type Error = <Inner as Transport>::Error;
+    type ListenerUpgrade = <Inner as Transport>::ListenerUpgrade;
+    type Dial = <Inner as Transport>::Dial;
+
+    fn listen_on(
+        &mut self,
+        id: ListenerId,
+        addr: Multiaddr,
+    ) -> Result<(), TransportError<Self::Error>> {
+        self.inner.listen_on(id, addr)
+    }
+
+    fn remove_listener(&mut self, id: ListenerId) -> bool {
+        self.inner.remove_listener(id)
+    }
+
+    fn dial(
+        &mut self,
+        addr: Multiaddr,
+        opts: DialOpts,
+    ) -> Result<Self::Dial, TransportError<Self::Error>> {
+        self.inner.dial(addr, opts)
+    }
+
+    fn poll(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<TransportEvent<Self::ListenerUpgrade, Self::Error>> {
+        let this = &mut *self;
+        if let Some(certs) = this
+            .certs
+            .as_mut()
+            .filter(|certs| certs.has_changed().unwrap_or(false))
+        {
+            this.inner.set_tls_config(certs.borrow_and_update().clone());
+        }
+        Pin::new(&mut this.inner).poll(cx)
+    }
+}
@@ -0,0 +1,292 @@
+//! `top`: a live view of a running relay through its admin API, refreshed
+//! every --interval. Bandwidth is worked out from how much each peer's
+//! traffic totals grew between refreshes.
+
+use std::{
+    collections::HashMap,
+    error::Error,
+    net::{IpAddr, Ipv4Addr, SocketAddr},
+    time::{Duration, Instant},
+};
+
+use ratatui::{
+    DefaultTerminal, Frame,
+    crossterm::event::{self, Event, KeyCode, KeyEventKind},
+    layout::{Constraint, Layout},
+    style::{Modifier, Style},
+    text::Line,
+    widgets::{Block, Paragraph, Row, Table},
+};
+use reqwest::Client;
+use sunset_relay::{
+    Status,
+    config::{Config, ConfigError},
+    startup::StartupError,
+};
+use tokio::task;
+
+struct Admin {
+    client: Client,
+    url: String,
+    token: String,
+}
+
+impl Admin {
+    async fn status(&self) -> Result<Status, reqwest::Error> {
+        self.client
+            .get(format!("{}/status", self.url))
+            .bearer_auth(&self.token)
+            .send()
+            .await?
+            .error_for_status()?
+            .json()
+            .await
+    }
+}
+
+/// Bytes per second in and out of each peer over the last refresh.
+#[derive(Default)]
+struct Rates {
+    last: HashMap<String, (u64, u64)>,
+    at: Option<Instant>,
+    rates: HashMap<String, (f64, f64)>,
+}
+
+impl Rates {
+    fn update(&mut self, status: &Status) {
+        let now = Instant::now();
+        let elapsed = self.at.map(|at| now.duration_since(at).as_secs_f64());
+        let mut last = HashMap::new();
+        self.rates.clear();
+        for traffic in &status.traffic {
+            let totals = (traffic.bytes_in, traffic.bytes_out);
+            last.insert(traffic.peer_id.clone(), totals);
+            let (Some(elapsed), Some(before)) = (elapsed, self.last.get(&traffic.peer_id)) else {
+                continue;
+            };
+            let rate = |now: u64, before: u64| now.saturating_sub(before) as f64 / elapsed;
+            self.rates.insert(
+                traffic.peer_id.clone(),
+                (rate(totals.0, before.0), rate(totals.1, before.1)),
+            );
+        }
+        self.last = last;
+        self.at = Some(now);
+    }
+
+    fn of(&self, peer: &str) -> (f64, f64) {
+        self.rates.get(peer).copied().unwrap_or_default()
+    }
+}
+
+/// Show the relay behind `url`, or the one --admin-addr points at, until
+/// the user presses `q`.
+pub async fn run(
+    config: &Config,
+    url: Option<String>,
+    interval: Duration,
+) -> Result<(), StartupError> {
+    let token = config
+        .admin_token
+        .as_ref()
+        .ok_or(StartupError::Config(ConfigError::Invalid {
+            setting: "admin-token",
+            reason: "is needed to reach the admin API",
+        }))?;
+    let admin = Admin {
+        client: Client::new(),
+        url: url.unwrap_or_else(|| local_url(config.admin_addr)),
+        token: token.0.clone(),
+    };
+    let status = admin
+        .status()
+        .await
+        .map_err(|e| StartupError::admin(&admin.url, e))?;
+    let mut terminal = ratatui::init();
+    let result = watch(&mut terminal, &admin, status, interval).await;
+    ratatui::restore();
+    result.map_err(|e| StartupError::admin(&admin.url, e))
+}
+
+/// The admin API on this host, reached over loopback if it listens on
+/// every address.
+fn local_url(addr: SocketAddr) -> String {
+    let ip = match addr.ip() {
+        ip if ip.is_unspecified() => IpAddr::V4(Ipv4Addr::LOCALHOST),
+        ip => ip,
+    };
+    format!("http://{}", SocketAddr::new(ip, addr.port()))
+}
+
+async fn watch(
+    terminal: &mut DefaultTerminal,
+    admin: &Admin,
+    mut status: Status,
+    interval: Duration,
+) -> Result<(), Box<dyn Error + Send + Sync>> {
+    let mut rates = Rates::default();
+    let mut error = None;
+    loop {
+        rates.update(&status);
+        terminal.draw(|frame| draw(frame, &status, &rates, error.as_deref()))?;
+        if quit_within(interval)? {
+            return Ok(());
+        }
+        match admin.status().await {
+            Ok(fresh) => {
+                status = fresh;
+                error = None;
+            }
+            Err(e) => error = Some(e.to_string()),
+        }
+    }
+}
+
+/// Wait out `interval`, returning early with true if `q` or Esc is pressed.
+fn quit_within(interval: Duration) -> std::io::Result<bool> {
+    let deadline = Instant::now() + interval;
+    task::block_in_place(|| {
+        while let Some(left) = deadline.checked_duration_since(Instant::now()) {
+            if !event::poll(left)? {
+                break;
+            }
+            if let Event::Key(key) = event::read()?
+                && key.kind == KeyEventKind::Press
+                && matches!(key.code, KeyCode::Char('q') | KeyCode::Esc)
+            {
+                return Ok(true);
+            }
+        }
+        Ok(false)
+    })
+}
+
+fn draw(frame: &mut Frame, status: &Status, rates: &Rates, error: Option<&str>) {
+    let [header, peers, circuits, footer] = Layout::vertical([
+        Constraint::Length(5),
+        Constraint::Percentage(60),
+        Constraint::Min(5),
+        Constraint::Length(1),
+    ])
+    .areas(frame.area());
+    frame.render_widget(summary(status, rates), header);
+    frame.render_widget(peer_table(status, rates), peers);
+    frame.render_widget(circuit_table(status), circuits);
+    let hint = match error {
+        Some(e) => format!("q to quit | refresh failed: {e}"),
+        None => "q to quit".to_string(),
+    };
+    frame.render_widget(Paragraph::new(hint), footer);
+}
+
+fn summary(status: &Status, rates: &Rates) -> Paragraph<'static> {
+    let uptime = humantime::format_duration(Duration::from_secs(status.uptime_secs));
+    let state = if status.draining {
+        "draining"
+    } else {
+        "running"
+    };
+    let (rate_in, rate_out) = rates
+        .rates
+        .values()
+        .fold((0.0, 0.0), |(a, b), (i, o)| (a + i, b + o));
+    let held: usize = status.reservations.iter().map(|r| r.count).sum();
+    let mut transports: Vec<String> = status
+        .transports
+        .iter()
+        .map(|t| format!("{} {}", t.transport, t.connections))
+        .collect();
+    transports.sort();
+    Paragraph::new(vec![
+        Line::from(format!("{}  {state}, up {uptime}", status.peer_id)),
+        Line::from(format!(
+            "{} peers  {held} reservations  {} circuits  in {}/s  out {}/s",
+            status.connected_peers.len(),
+            status.circuits.len(),
+            bytes(rate_in),
+            bytes(rate_out),
+        )),
+        Line::from(format!("connections: {}", transports.join("  "))),
+    ])
+    .block(Block::bordered().title(" sunset-relay "))
+}
+
+fn peer_table(status: &Status, rates: &Rates) -> Table<'static> {
+    let reservations: HashMap<&str, usize> = status
+        .reservations
+        .iter()
+        .map(|r| (r.peer_id.as_str(), r.count))
+        .collect();
+    let mut peers: Vec<_> = status
+        .traffic
+        .iter()
+        .map(|t| (t, rates.of(&t.peer_id)))
+        .collect();
+    peers.sort_by(|(_, a), (_, b)| (b.0 + b.1).total_cmp(&(a.0 + a.1)));
+    let rows = peers.into_iter().map(|(t, (rate_in, rate_out))| {
+        Row::new(vec![
+            t.peer_id.clone(),
+            format!("{}/s", bytes(rate_in)),
+            format!("{}/s", bytes(rate_out)),
+            bytes(t.bytes_in as f64),
+            bytes(t.bytes_out as f64),
+            reservations
+                .get(t.peer_id.as_str())
+                .map_or_else(String::new, ToString::to_string),
+        ])
+    });
+    Table::new(
+        rows,
+        [
+            Constraint::Min(52),
+            Constraint::Length(11),
+            Constraint::Length(11),
+            Constraint::Length(10),
+            Constraint::Length(10),
+            Constraint::Length(12),
+        ],
+    )
+    .header(
+        Row::new(["PEER", "IN", "OUT", "TOTAL IN", "TOTAL OUT", "RESERVATIONS"])
+            .style(Style::new().add_modifier(Modifier::BOLD)),
+    )
+    .block(Block::bordered().title(" peers by bandwidth "))
+}
+
+fn circuit_table(status: &Status) -> Table<'static> {
+    let rows = status.circuits.iter().map(|c| {
+        Row::new(vec![
+            c.src.clone(),
+            c.dst.clone(),
+            humantime::format_duration(Duration::from_secs(c.age_secs)).to_string(),
+        ])
+    });
+    Table::new(
+        rows,
+        [
+            Constraint::Min(52),
+            Constraint::Min(52),
+            Constraint::Length(16),
+        ],
+    )
+    .header(
+        Row::new(["SOURCE", "DESTINATION", "AGE"]).style(Style::new().add_modifier(Modifier::BOLD)),
+    )
+    .block(Block::bordered().title(" circuits, oldest first "))
+}
+
+/// `n` bytes in decimal units, such as `1.5 MB`.
+fn bytes(n: f64) -> String {
+    const UNITS: [&str; 5] = ["B", "kB", "MB", "GB", "TB"];
+    let mut n = n;
+    let mut unit = 0;
+    while n >= 1000.0 && unit < UNITS.len() - 1 {
+        n /= 1000.0;
+        unit += 1;
+    }
+    if unit == 0 {
+        format!("{n:.0} {}", UNITS[unit])
+    } else {
+        format!("{n:.1} {}", UNITS[unit])
+    }
+}
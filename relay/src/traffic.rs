@@ -0,0 +1,429 @@
+use std::{
+    collections::HashMap,
+    fmt, io,
+    path::PathBuf,
+    pin::Pin,
+    sync::{
+        Arc, Mutex,
+        atomic::{AtomicBool, AtomicU64, Ordering},
+    },
+    task::{Context, Poll, ready},
+    time::{Duration, SystemTime},
+};
+
+use futures::{AsyncRead, AsyncWrite};
+use libp2p::{
+    PeerId,
+    core::muxing::{StreamMuxer, StreamMuxerEvent},
+};
+use prometheus_client::{
+    collector::Collector,
+    encoding::{DescriptorEncoder, EncodeMetric},
+    metrics::{MetricType, counter::ConstCounter},
+};
+use serde::Serialize;
+use tokio::{fs::OpenOptions, io::AsyncWriteExt, sync::oneshot, time};
+use tracing::warn;
+
+use crate::{
+    config::DumpFormat,
+    throttle::{Pacer, Throttle},
+};
+
+/// Bytes received from and sent to a peer.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct Traffic {
+    pub bytes_in: u64,
+    pub bytes_out: u64,
+}
+
+#[derive(Default)]
+struct Counters {
+    bytes_in: AtomicU64,
+    bytes_out: AtomicU64,
+    /// Caps of the peer's own on top of the shared one, by what set them
+    throttles: Mutex<HashMap<&'static str, Throttle>>,
+    /// Bumped whenever `throttles` changes, for streams to notice cheaply
+    throttle_changes: AtomicU64,
+}
+
+impl Counters {
+    fn load(&self) -> Traffic {
+        Traffic {
+            bytes_in: self.bytes_in.load(Ordering::Relaxed),
+            bytes_out: self.bytes_out.load(Ordering::Relaxed),
+        }
+    }
+}
+
+struct Peer {
+    counters: Arc<Counters>,
+    dumped: Traffic,
+}
+
+/// Bytes exchanged with each peer, counted on the streams of every
+/// connection whatever the transport. This covers relayed circuit data
+/// along with the peer's own protocol traffic, but not the framing of the
+/// security and muxer protocols underneath.
+#[derive(Clone)]
+pub struct PeerTraffic {
+    peers: Arc<Mutex<HashMap<PeerId, Peer>>>,
+    dumping: Arc<AtomicBool>,
+    throttle: Option<Throttle>,
+}
+
+impl PeerTraffic {
+    /// With `dumping`, peers are remembered after disconnecting until their
+    /// last bytes have been dumped.
+    pub fn new(dumping: bool) -> Self {
+        Self {
+            peers: Arc::default(),
+            dumping: Arc::new(AtomicBool::new(dumping)),
+            throttle: None,
+        }
+    }
+
+    pub fn set_dumping(&self, dumping: bool) {
+        self.dumping.store(dumping, Ordering::Relaxed);
+    }
+
+    /// Hold metered streams to a shared bandwidth cap.
+    pub fn with_throttle(mut self, throttle: Throttle) -> Self {
+        self.throttle = Some(throttle);
+        self
+    }
+
+    /// Wrap the muxer of a connection to `peer` so its streams are metered.
+    pub fn muxer<M>(&self, peer: PeerId, muxer: M) -> MeteredMuxer<M> {
+        MeteredMuxer {
+            inner: muxer,
+            counters: self.counters(peer),
+            throttle: self.throttle.clone(),
+        }
+    }
+
+    /// Hold `peer`'s metered streams to `throttle` as well as the shared cap,
+    /// from their next read or write on. Each `kind` of cap replaces only
+    /// what was set before under the same kind.
+    pub fn throttle_peer(&self, peer: PeerId, kind: &'static str, throttle: Option<Throttle>) {
+        let counters = self.counters(peer);
+        let mut throttles = counters.throttles.lock().unwrap();
+        match throttle {
+            Some(throttle) => throttles.insert(kind, throttle),
+            None => throttles.remove(kind),
+        };
+        counters.throttle_changes.fetch_add(1, Ordering::Release);
+    }
+
+    fn counters(&self, peer: PeerId) -> Arc<Counters> {
+        let mut peers = self.peers.lock().unwrap();
+        let peer = peers.entry(peer).or_insert_with(|| Peer {
+            counters: Arc::default(),
+            dumped: Traffic::default(),
+        });
+        peer.counters.clone()
+    }
+
+    /// Count bytes exchanged with `peer` as its metered streams would.
+    #[cfg(test)]
+    pub fn add(&self, peer: PeerId, bytes_in: u64, bytes_out: u64) {
+        let counters = self.counters(peer);
+        counters.bytes_in.fetch_add(bytes_in, Ordering::Relaxed);
+        counters.bytes_out.fetch_add(bytes_out, Ordering::Relaxed);
+    }
+
+    /// Totals for `peer`, if it is connected or has not been pruned yet.
+    pub fn get(&self, peer: &PeerId) -> Option<Traffic> {
+        let peers = self.peers.lock().unwrap();
+        peers.get(peer).map(|entry| entry.counters.load())
+    }
+
+    /// Totals for every peer that is connected or has not been pruned yet.
+    pub fn snapshot(&self) -> Vec<(PeerId, Traffic)> {
+        let peers = self.peers.lock().unwrap();
+        peers
+            .iter()
+            .map(|(peer, entry)| (*peer, entry.counters.load()))
+            .collect()
+    }
+
+    /// Bytes since the previous call, for peers that exchanged any.
+    fn take_unreported(&self) -> Vec<(PeerId, Traffic)> {
+        let mut peers = self.peers.lock().unwrap();
+        let mut unreported = Vec::new();
+        for (peer, entry) in peers.iter_mut() {
+            let now = entry.counters.load();
+            if now != entry.dumped {
+                unreported.push((
+                    *peer,
+                    Traffic {
+                        bytes_in: now.bytes_in - entry.dumped.bytes_in,
+                        bytes_out: now.bytes_out - entry.dumped.bytes_out,
+                    },
+                ));
+                entry.dumped = now;
+            }
+        }
+        unreported
+    }
+
+    /// Forget peers with no open connections, keeping any whose latest bytes
+    /// still have to be dumped.
+    pub fn prune(&self) {
+        let mut peers = self.peers.lock().unwrap();
+        peers.retain(|_, entry| {
+            Arc::strong_count(&entry.counters) > 1
+                || (self.dumping.load(Ordering::Relaxed) && entry.counters.load() != entry.dumped)
+        });
+    }
+}
+
+impl fmt::Debug for PeerTraffic {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("PeerTraffic").finish_non_exhaustive()
+    }
+}
+
+/// Exposes per-peer totals as `sutro_peer_bytes_total{peer,direction}`,
+/// read at scrape time so disconnected peers drop out once pruned.
+impl Collector for PeerTraffic {
+    fn encode(&self, mut encoder: DescriptorEncoder) -> Result<(), fmt::Error> {
+        let mut metric = encoder.encode_descriptor(
+            "peer_bytes",
+            "Bytes exchanged with each peer",
+            None,
+            MetricType::Counter,
+        )?;
+        for (peer, traffic) in self.snapshot() {
+            let peer = peer.to_string();
+            for (direction, bytes) in [("in", traffic.bytes_in), ("out", traffic.bytes_out)] {
+                let labels = [("peer", peer.as_str()), ("direction", direction)];
+                ConstCounter::new(bytes).encode(metric.encode_family(&labels)?)?;
+            }
+        }
+        Ok(())
+    }
+}
+
+/// A connection's muxer whose streams count the bytes they carry.
+pub struct MeteredMuxer<M> {
+    inner: M,
+    counters: Arc<Counters>,
+    throttle: Option<Throttle>,
+}
+
+impl<M> MeteredMuxer<M> {
+    fn stream<S>(&self, stream: S) -> MeteredStream<S> {
+        MeteredStream::new(stream, self.counters.clone(), self.throttle.as_ref())
+    }
+}
+
+impl<M: StreamMuxer + Unpin> StreamMuxer for MeteredMuxer<M>
+where
+    M::Substream: Unpin,
+{
+    type Substream = MeteredStream<M::Substream>;
+    type Error = M::Error;
+
+    fn poll_inbound(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Result<Self::Substream, Self::Error>> {
+        let stream = ready!(Pin::new(&mut self.inner).poll_inbound(cx))?;
+        Poll::Ready(Ok(self.stream(stream)))
+    }
+
+    fn poll_outbound(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Result<Self::Substream, Self::Error>> {
+        let stream = ready!(Pin::new(&mut self.inner).poll_outbound(cx))?;
+        Poll::Ready(Ok(self.stream(stream)))
+    }
+
+    fn poll_close(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        Pin::new(&mut self.inner).poll_close(cx)
+    }
+
+    fn poll(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Result<StreamMuxerEvent, Self::Error>> {
+        Pin::new(&mut self.inner).poll(cx)
+    }
+}
+
+/// A stream that adds what it reads and writes to its peer's counters,
+/// pausing first whenever the shared bandwidth cap or the peer's own is
+/// used up.
+pub struct MeteredStream<S> {
+    inner: S,
+    counters: Arc<Counters>,
+    pace_in: Option<Pacer>,
+    pace_out: Option<Pacer>,
+    peer_in: Vec<Pacer>,
+    peer_out: Vec<Pacer>,
+    throttle_changes: u64,
+}
+
+impl<S> MeteredStream<S> {
+    fn new(inner: S, counters: Arc<Counters>, throttle: Option<&Throttle>) -> Self {
+        Self {
+            inner,
+            counters,
+            pace_in: throttle.map(Throttle::inbound),
+            pace_out: throttle.map(Throttle::outbound),
+            peer_in: Vec::new(),
+            peer_out: Vec::new(),
+            throttle_changes: 0,
+        }
+    }
+
+    /// Pick up caps set on the peer since the last read or write.
+    fn refresh_throttle(&mut self) {
+        let changes = self.counters.throttle_changes.load(Ordering::Acquire);
+        if changes == self.throttle_changes {
+            return;
+        }
+        self.throttle_changes = changes;
+        let throttles = self.counters.throttles.lock().unwrap();
+        self.peer_in = throttles.values().map(Throttle::inbound).collect();
+        self.peer_out = throttles.values().map(Throttle::outbound).collect();
+    }
+}
+
+impl<S: AsyncRead + Unpin> AsyncRead for MeteredStream<S> {
+    fn poll_read(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut [u8],
+    ) -> Poll<io::Result<usize>> {
+        let this = &mut *self;
+        this.refresh_throttle();
+        for pacer in this.pace_in.iter_mut().chain(&mut this.peer_in) {
+            ready!(pacer.poll_ready(cx));
+        }
+        let read = ready!(Pin::new(&mut this.inner).poll_read(cx, buf))?;
+        this.counters
+            .bytes_in
+            .fetch_add(read as u64, Ordering::Relaxed);
+        for pacer in this.pace_in.iter().chain(&this.peer_in) {
+            pacer.consumed(read);
+        }
+        Poll::Ready(Ok(read))
+    }
+}
+
+impl<S: AsyncWrite + Unpin> AsyncWrite for MeteredStream<S> {
+    fn poll_write(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        let this = &mut *self;
+        this.refresh_throttle();
+        for pacer in this.pace_out.iter_mut().chain(&mut this.peer_out) {
+            ready!(pacer.poll_ready(cx));
+        }
+        let written = ready!(Pin::new(&mut this.inner).poll_write(cx, buf))?;
+        this.counters
+            .bytes_out
+            .fetch_add(written as u64, Ordering::Relaxed);
+        for pacer in this.pace_out.iter().chain(&this.peer_out) {
+            pacer.consumed(written);
+        }
+        Poll::Ready(Ok(written))
+    }
+
+    fn poll_flush(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.inner).poll_flush(cx)
+    }
+
+    fn poll_close(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.inner).poll_close(cx)
+    }
+}
+
+#[derive(Serialize)]
+struct Row<'a> {
+    timestamp: &'a str,
+    peer_id: String,
+    bytes_in: u64,
+    bytes_out: u64,
+}
+
+/// Appends the bytes exchanged with each peer since the previous dump, so
+/// summing a peer's rows gives its total.
+pub struct Dump {
+    path: PathBuf,
+    format: DumpFormat,
+}
+
+impl Dump {
+    pub fn new(path: PathBuf, format: DumpFormat) -> Self {
+        Self { path, format }
+    }
+
+    pub async fn write(&self, traffic: &PeerTraffic) -> io::Result<()> {
+        let rows = traffic.take_unreported();
+        traffic.prune();
+        if rows.is_empty() {
+            return Ok(());
+        }
+        let mut file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&self.path)
+            .await?;
+        let timestamp = humantime::format_rfc3339_millis(SystemTime::now()).to_string();
+        let mut out = String::new();
+        if matches!(self.format, DumpFormat::Csv) && file.metadata().await?.len() == 0 {
+            out.push_str("timestamp,peer_id,bytes_in,bytes_out\n");
+        }
+        for (peer, traffic) in rows {
+            let row = Row {
+                timestamp: &timestamp,
+                peer_id: peer.to_string(),
+                bytes_in: traffic.bytes_in,
+                bytes_out: traffic.bytes_out,
+            };
+            match self.format {
+                DumpFormat::Json => {
+                    out.push_str(&serde_json::to_string(&row)?);
+                    out.push('\n');
+                }
+                DumpFormat::Csv => out.push_str(&format!(
+                    "{},{},{},{}\n",
+                    row.timestamp, row.peer_id, row.bytes_in, row.bytes_out
+                )),
+            }
+        }
+        file.write_all(out.as_bytes()).await?;
+        file.flush().await
+    }
+
+    /// Write a dump every `interval` until `stop` is dropped. A dump being
+    /// written then is finished first.
+    pub async fn run(
+        self,
+        traffic: PeerTraffic,
+        interval: Duration,
+        mut stop: oneshot::Receiver<()>,
+    ) {
+        let mut ticks = time::interval(interval);
+        ticks.set_missed_tick_behavior(time::MissedTickBehavior::Delay);
+        ticks.tick().await;
+        loop {
+            tokio::select! {
+                _ = ticks.tick() => {}
+                _ = &mut stop => return,
+            }
+            if let Err(e) = self.write(&traffic).await {
+                warn!(
+                    "Failed to write traffic dump to {}: {e}",
+                    self.path.display()
+                );
+            }
+        }
+    }
+}
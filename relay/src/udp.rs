@@ -0,0 +1,28 @@
+//! The kernel's cap on UDP receive buffers, which QUIC outgrows at relay
+//! scale: once a buffer fills, packets are dropped and every connection on
+//! the socket slows down.
+
+use std::fs;
+
+use tracing::warn;
+
+/// Warn when net.core.rmem_max caps receive buffers below `wanted` bytes.
+/// Platforms without `/proc` are not checked.
+pub fn check_receive_buffer(wanted: u64) {
+    let Some(max) = rmem_max() else {
+        return;
+    };
+    if max >= wanted {
+        return;
+    }
+    warn!(
+        max,
+        wanted,
+        "UDP receive buffers are capped at {max} bytes, below the {wanted} QUIC needs under load; raise it with sysctl -w net.core.rmem_max={wanted}"
+    );
+}
+
+fn rmem_max() -> Option<u64> {
+    let max = fs::read_to_string("/proc/sys/net/core/rmem_max").ok()?;
+    max.trim().parse().ok()
+}
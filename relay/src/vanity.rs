@@ -0,0 +1,79 @@
+//! Brute-forcing identities whose PeerID starts with a chosen prefix.
+
+use std::{
+    error::Error,
+    sync::atomic::{AtomicBool, AtomicU64, Ordering},
+    thread,
+    time::Instant,
+};
+
+use libp2p::identity::Keypair;
+use tracing::info;
+
+use crate::{config::KeyType, identity};
+
+const BASE58: &str = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz";
+
+/// What every PeerID of a key type starts with: small public keys are
+/// inlined into the PeerID, larger ones are hashed with SHA2-256.
+fn fixed_prefix(key_type: KeyType) -> &'static str {
+    match key_type {
+        KeyType::Ed25519 => "12D3KooW",
+        KeyType::Secp256k1 => "16Uiu2HA",
+        KeyType::Ecdsa | KeyType::Rsa => "Qm",
+    }
+}
+
+/// Reject prefixes no PeerID of `key_type` can start with.
+pub fn check_prefix(key_type: KeyType, prefix: &str) -> Result<(), Box<dyn Error + Send + Sync>> {
+    if let Some(c) = prefix.chars().find(|c| !BASE58.contains(*c)) {
+        return Err(format!("{c:?} is not a base58 character").into());
+    }
+    let fixed = fixed_prefix(key_type);
+    if !prefix.starts_with(fixed) && !fixed.starts_with(prefix) {
+        return Err(format!("{key_type:?} PeerIDs always start with {fixed}").into());
+    }
+    Ok(())
+}
+
+/// Generate keys on `workers` threads until one's PeerID starts with
+/// `prefix`, returning it with its key file encoding. Each character past
+/// the fixed part multiplies the expected work by 58.
+pub fn search(
+    key_type: KeyType,
+    key_bits: usize,
+    prefix: &str,
+    workers: usize,
+) -> Result<(Keypair, Vec<u8>), String> {
+    let started = Instant::now();
+    let done = AtomicBool::new(false);
+    let tried = AtomicU64::new(0);
+    let worker = || -> Result<Option<(Keypair, Vec<u8>)>, String> {
+        while !done.load(Ordering::Relaxed) {
+            let generated = identity::generate(key_type, key_bits).map_err(|e| e.to_string());
+            let (keypair, encoded) = generated.inspect_err(|_| done.store(true, Ordering::Relaxed))?;
+            tried.fetch_add(1, Ordering::Relaxed);
+            if keypair.public().to_peer_id().to_base58().starts_with(prefix) {
+                done.store(true, Ordering::Relaxed);
+                return Ok(Some((keypair, encoded)));
+            }
+        }
+        Ok(None)
+    };
+    let found = thread::scope(|scope| {
+        let handles: Vec<_> = (0..workers).map(|_| scope.spawn(worker)).collect();
+        handles
+            .into_iter()
+            .filter_map(|handle| handle.join().expect("vanity worker panicked").transpose())
+            .collect::<Vec<_>>()
+    });
+    info!(
+        "Tried {} keys in {:.1?}",
+        tried.load(Ordering::Relaxed),
+        started.elapsed()
+    );
+    found
+        .into_iter()
+        .next()
+        .unwrap_or_else(|| Err("no worker threads".into()))
+}
@@ -0,0 +1,38 @@
+//! Reading the identity key from a HashiCorp Vault KV v2 secret, with the
+//! server and credentials taken from the environment as the `vault` CLI
+//! does.
+
+use std::{env, error::Error};
+
+use serde::Deserialize;
+
+#[derive(Deserialize)]
+struct Response {
+    data: Secret,
+}
+
+#[derive(Deserialize)]
+struct Secret {
+    data: Fields,
+}
+
+#[derive(Deserialize)]
+struct Fields {
+    key: String,
+}
+
+/// The `key` field of the latest version of `secret`, given as `MOUNT/PATH`.
+pub async fn read_key(secret: &str) -> Result<String, Box<dyn Error + Send + Sync>> {
+    let addr = env::var("VAULT_ADDR").map_err(|_| "VAULT_ADDR is not set")?;
+    let token = env::var("VAULT_TOKEN").map_err(|_| "VAULT_TOKEN is not set")?;
+    let (mount, path) = secret.split_once('/').ok_or("expected MOUNT/PATH")?;
+    let url = format!("{}/v1/{mount}/data/{path}", addr.trim_end_matches('/'));
+    let mut request = reqwest::Client::new()
+        .get(url)
+        .header("X-Vault-Token", token);
+    if let Ok(namespace) = env::var("VAULT_NAMESPACE") {
+        request = request.header("X-Vault-Namespace", namespace);
+    }
+    let response: Response = request.send().await?.error_for_status()?.json().await?;
+    Ok(response.data.data.key)
+}
@@ -0,0 +1,167 @@
+//! Startup and drain behaviour under the failures injected by the
+//! `fault-injection` feature. Faults are process-wide, so the tests take
+//! turns.
+
+use std::{
+    path::Path,
+    time::{Duration, Instant},
+};
+
+use futures::StreamExt;
+use libp2p::{
+    Multiaddr, PeerId, Swarm, SwarmBuilder,
+    multiaddr::Protocol,
+    noise, relay,
+    swarm::{NetworkBehaviour, SwarmEvent},
+    yamux,
+};
+use sunset_relay::{
+    Relay,
+    config::{Config, Settings},
+    faults::{self, Fault},
+    startup::StartupError,
+};
+use tokio::{sync::Mutex, time};
+
+static TURN: Mutex<()> = Mutex::const_new(());
+
+const DRAIN_TIMEOUT: Duration = Duration::from_secs(2);
+
+fn settings(dir: &Path) -> Settings {
+    Settings {
+        identity: Some(dir.join("identity.key")),
+        listen: Some(vec!["/ip4/127.0.0.1/udp/0/quic-v1".parse().unwrap()]),
+        drain_timeout: Some(DRAIN_TIMEOUT),
+        ..Settings::default()
+    }
+}
+
+async fn start(settings: Settings, fault: Fault) -> Result<Relay, StartupError> {
+    faults::inject(fault);
+    let started = Relay::start(Config::load(None, settings).unwrap()).await;
+    faults::clear();
+    started
+}
+
+#[tokio::test]
+async fn listen_fault_is_a_port_in_use() {
+    let _turn = TURN.lock().await;
+    let dir = tempfile::tempdir().unwrap();
+    let err = start(settings(dir.path()), Fault::Listen("quic".into()))
+        .await
+        .err()
+        .expect("relay started despite the listen fault");
+    assert!(
+        matches!(&err, StartupError::PortInUse(addr) if addr.contains("quic-v1")),
+        "{err:?}"
+    );
+}
+
+#[tokio::test]
+async fn identity_fault_fails_loading_the_identity() {
+    let _turn = TURN.lock().await;
+    let dir = tempfile::tempdir().unwrap();
+    let err = start(settings(dir.path()), Fault::Identity)
+        .await
+        .err()
+        .expect("relay started despite the identity fault");
+    let StartupError::Identity { source, .. } = &err else {
+        panic!("{err:?}");
+    };
+    assert!(source.to_string().contains("injected"), "{source}");
+}
+
+#[tokio::test]
+async fn cert_fault_fails_loading_the_certificate() {
+    let _turn = TURN.lock().await;
+    let dir = tempfile::tempdir().unwrap();
+    let settings = Settings {
+        tls_cert: Some(dir.path().join("cert.pem")),
+        tls_key: Some(dir.path().join("key.pem")),
+        ..settings(dir.path())
+    };
+    let err = start(settings, Fault::Cert)
+        .await
+        .err()
+        .expect("relay started despite the certificate fault");
+    let StartupError::Certificate { source, .. } = &err else {
+        panic!("{err:?}");
+    };
+    assert!(source.to_string().contains("injected"), "{source}");
+}
+
+#[derive(NetworkBehaviour)]
+struct Client {
+    relay: relay::client::Behaviour,
+}
+
+fn client() -> Swarm<Client> {
+    SwarmBuilder::with_new_identity()
+        .with_tokio()
+        .with_quic()
+        .with_relay_client(noise::Config::new, yamux::Config::default)
+        .unwrap()
+        .with_behaviour(|_, relay| Client { relay })
+        .unwrap()
+        .with_swarm_config(|c| c.with_idle_connection_timeout(Duration::from_secs(60)))
+        .build()
+}
+
+/// Reserve a slot on the relay at `circuit` and keep the swarm running.
+async fn reserve(circuit: Multiaddr) -> PeerId {
+    let mut swarm = client();
+    let peer = *swarm.local_peer_id();
+    swarm.listen_on(circuit).unwrap();
+    loop {
+        if let SwarmEvent::Behaviour(ClientEvent::Relay(
+            relay::client::Event::ReservationReqAccepted { .. },
+        )) = swarm.select_next_some().await
+        {
+            break;
+        }
+    }
+    tokio::spawn(async move { while swarm.next().await.is_some() {} });
+    peer
+}
+
+#[tokio::test]
+async fn stuck_circuit_holds_a_drain_until_its_timeout() {
+    let _turn = TURN.lock().await;
+    let dir = tempfile::tempdir().unwrap();
+    let relay = Relay::start(Config::load(None, settings(dir.path())).unwrap())
+        .await
+        .unwrap();
+    relay.listening().await;
+    let circuit = relay.listen_addrs()[0]
+        .clone()
+        .with(Protocol::P2p(relay.peer_id()))
+        .with(Protocol::P2pCircuit);
+
+    let listener = time::timeout(Duration::from_secs(10), reserve(circuit.clone()))
+        .await
+        .expect("no reservation accepted");
+    faults::inject(Fault::StuckCircuit);
+    let mut dialer = client();
+    dialer.dial(circuit.with(Protocol::P2p(listener))).unwrap();
+    tokio::spawn(async move { while dialer.next().await.is_some() {} });
+
+    time::timeout(Duration::from_secs(10), async {
+        while relay
+            .status()
+            .await
+            .is_none_or(|status| status.circuits.is_empty())
+        {
+            time::sleep(Duration::from_millis(50)).await;
+        }
+    })
+    .await
+    .expect("no circuit opened");
+
+    let draining = Instant::now();
+    assert!(relay.drain());
+    time::timeout(DRAIN_TIMEOUT * 3, relay.stopped())
+        .await
+        .expect("drain did not stop the relay");
+    faults::clear();
+    assert!(draining.elapsed() >= DRAIN_TIMEOUT);
+}
@@ -66,7 +66,7 @@ function startRelay(relayBin) {
     const identityPath = join(tmpDir, "identity.key");
     // Use port 0 — the relay will pick an available port
     // We parse the actual port from its log output
-    const proc = spawn(relayBin, ["--port", "0", "--identity", identityPath], {
+    const proc = spawn(relayBin, ["serve", "--port", "0", "--identity", identityPath], {
       stdio: ["ignore", "pipe", "pipe"],
       env: { ...process.env, RUST_LOG: "info" },
     });